@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+var (
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is the authenticated user
+type Identity struct {
+	User  string
+	Roles []string
+}
+
+// Authenticator checks the request credentials
+type Authenticator interface {
+	// Authenticate returns nil identity without error, if the request has no credentials suitable for the authenticator
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Chain tries authenticators in order, first found identity is used
+type Chain struct {
+	authenticators []Authenticator
+	userRoles      map[string][]string
+	challenge      string // WWW-Authenticate header value
+}
+
+// New returns the authenticators chain for config or nil, if authentication is not configured
+func New(cfg *config.Auth) (*Chain, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	c := &Chain{
+		userRoles: cfg.UserRoles,
+		challenge: `Bearer realm="graphite-clickhouse"`,
+	}
+
+	if len(cfg.Tokens) > 0 {
+		c.authenticators = append(c.authenticators, NewTokens(cfg.Tokens))
+	}
+
+	if cfg.JWKSFile != "" {
+		a, err := NewJWTFile(cfg.JWKSFile, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		c.authenticators = append(c.authenticators, a)
+	}
+
+	if cfg.HtpasswdFile != "" {
+		a, err := NewHtpasswdFile(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.authenticators = append(c.authenticators, a)
+		c.challenge = `Basic realm="graphite-clickhouse"`
+	}
+
+	return c, nil
+}
+
+// Authenticate returns the identity with the roles, merged from config
+func (c *Chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c.authenticators {
+		id, err := a.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if id != nil {
+			id.Roles = mergeRoles(id.Roles, c.userRoles[id.User])
+			return id, nil
+		}
+	}
+
+	return nil, ErrUnauthorized
+}
+
+// Challenge returns the WWW-Authenticate header value for unauthorized responses
+func (c *Chain) Challenge() string {
+	return c.challenge
+}
+
+// mergeRoles returns sorted roles without duplicates
+func mergeRoles(roles, extra []string) []string {
+	if len(roles) == 0 && len(extra) == 0 {
+		return nil
+	}
+
+	merged := make([]string, 0, len(roles)+len(extra))
+	merged = append(merged, roles...)
+	merged = append(merged, extra...)
+	sort.Strings(merged)
+
+	n := 0
+
+	for i := range merged {
+		if merged[i] == "" || (n > 0 && merged[n-1] == merged[i]) {
+			continue
+		}
+
+		merged[n] = merged[i]
+		n++
+	}
+
+	return merged[:n]
+}
+
+// Request returns the request with the identity in the context. X-Forwarded-User header is replaced with the authenticated user,
+// so user limits and tenants are resolved for it
+func Request(r *http.Request, id *Identity) *http.Request {
+	r.Header.Set("X-Forwarded-User", id.User)
+
+	ctx := scope.WithUser(r.Context(), id.User)
+	ctx = scope.WithRoles(ctx, id.Roles)
+
+	return r.WithContext(ctx)
+}
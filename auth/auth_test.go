@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+func newRequest(header string) *http.Request {
+	r, _ := http.NewRequest(http.MethodGet, "/render/?target=a.b", nil)
+	if header != "" {
+		r.Header.Set("Authorization", header)
+	}
+
+	return r
+}
+
+func basic(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestTokens(t *testing.T) {
+	a := NewTokens([]config.AuthToken{{Token: "secret", User: "grafana", Roles: []string{"ops"}}})
+
+	id, err := a.Authenticate(newRequest("Bearer secret"))
+	require.NoError(t, err)
+	assert.Equal(t, &Identity{User: "grafana", Roles: []string{"ops"}}, id)
+
+	id, err = a.Authenticate(newRequest("Bearer other"))
+	assert.NoError(t, err)
+	assert.Nil(t, id)
+
+	id, err = a.Authenticate(newRequest(""))
+	assert.NoError(t, err)
+	assert.Nil(t, id)
+}
+
+func TestHtpasswd(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("alice_pw"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	sum := sha1.Sum([]byte("bob_pw"))
+	body := "# users\nalice:" + string(bcryptHash) + "\nbob:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n"
+
+	a, err := NewHtpasswd(strings.NewReader(body))
+	require.NoError(t, err)
+
+	tests := []struct {
+		header  string
+		want    *Identity
+		wantErr bool
+	}{
+		{header: basic("alice", "alice_pw"), want: &Identity{User: "alice"}},
+		{header: basic("bob", "bob_pw"), want: &Identity{User: "bob"}},
+		{header: basic("alice", "bob_pw"), wantErr: true},
+		{header: basic("carol", "carol_pw"), wantErr: true},
+		{header: "Bearer token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			id, err := a.Authenticate(newRequest(tt.header))
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidCredentials)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, tt.want, id)
+		})
+	}
+
+	_, err = NewHtpasswd(strings.NewReader("carol:$apr1$xxx\n"))
+	assert.Error(t, err)
+
+	// unknown users are checked with the hash of the usual cost
+	cost, err := bcrypt.Cost([]byte(dummyHash))
+	require.NoError(t, err)
+	assert.Equal(t, bcrypt.DefaultCost, cost)
+}
+
+func rsaJWKS(t *testing.T, kid string, key *rsa.PrivateKey) []byte {
+	set := jwks{Keys: []jwk{{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+
+	b, err := json.Marshal(set)
+	require.NoError(t, err)
+
+	return b
+}
+
+func TestJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	cfg := config.New().Auth
+	cfg.JWTIssuer = "issuer"
+
+	a, err := NewJWT(rsaJWKS(t, "key1", key), &cfg)
+	require.NoError(t, err)
+
+	sign := func(key *rsa.PrivateKey, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "key1"
+
+		s, err := token.SignedString(key)
+		require.NoError(t, err)
+
+		return "Bearer " + s
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+
+	id, err := a.Authenticate(newRequest(sign(key, jwt.MapClaims{"sub": "alice", "iss": "issuer", "exp": exp, "roles": []string{"team_a", "ops"}})))
+	require.NoError(t, err)
+	assert.Equal(t, &Identity{User: "alice", Roles: []string{"team_a", "ops"}}, id)
+
+	id, err = a.Authenticate(newRequest(sign(key, jwt.MapClaims{"sub": "alice", "iss": "issuer", "exp": exp, "roles": "team_a ops"})))
+	require.NoError(t, err)
+	assert.Equal(t, &Identity{User: "alice", Roles: []string{"team_a", "ops"}}, id)
+
+	for name, header := range map[string]string{
+		"wrong key":    sign(otherKey, jwt.MapClaims{"sub": "alice", "iss": "issuer", "exp": exp}),
+		"wrong issuer": sign(key, jwt.MapClaims{"sub": "alice", "iss": "other", "exp": exp}),
+		"expired":      sign(key, jwt.MapClaims{"sub": "alice", "iss": "issuer", "exp": time.Now().Add(-time.Hour).Unix()}),
+		"no exp":       sign(key, jwt.MapClaims{"sub": "alice", "iss": "issuer"}),
+		"no user":      sign(key, jwt.MapClaims{"iss": "issuer", "exp": exp}),
+		"not jwt":      "Bearer static",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := a.Authenticate(newRequest(header))
+			assert.ErrorIs(t, err, ErrInvalidCredentials)
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	cfg := config.New().Auth
+	cfg.Tokens = []config.AuthToken{{Token: "secret", User: "grafana", Roles: []string{"ops"}}}
+	cfg.UserRoles = map[string][]string{"grafana": {"team_a", "ops"}}
+
+	c, err := New(&cfg)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	_, err = c.Authenticate(newRequest(""))
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	_, err = c.Authenticate(newRequest("Bearer other"))
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	r := newRequest("Bearer secret")
+	r.Header.Set("X-Forwarded-User", "admin")
+
+	id, err := c.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, &Identity{User: "grafana", Roles: []string{"ops", "team_a"}}, id)
+
+	r = Request(r, id)
+	assert.Equal(t, "grafana", r.Header.Get("X-Forwarded-User"))
+	assert.Equal(t, "grafana", scope.User(r.Context()))
+	assert.Equal(t, []string{"ops", "team_a"}, scope.Roles(r.Context()))
+
+	c, err = New(&config.Auth{})
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared with the password of unknown users, so the response time doesn't reveal the existing ones
+const dummyHash = "$2a$10$5VuNxp3shQw1fMJ.9JTJD.ZX4dsWA4je5x5A3dlns1L9.6C.Lm5ZC"
+
+// Htpasswd authenticates basic auth credentials with htpasswd file (bcrypt and SHA1 hashes)
+type Htpasswd struct {
+	users map[string]string
+}
+
+func NewHtpasswdFile(filename string) (*Htpasswd, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return NewHtpasswd(f)
+}
+
+func NewHtpasswd(r io.Reader) (*Htpasswd, error) {
+	h := &Htpasswd{users: make(map[string]string)}
+
+	s := bufio.NewScanner(r)
+	n := 0
+
+	for s.Scan() {
+		n++
+
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" || hash == "" {
+			return nil, fmt.Errorf("htpasswd: invalid line %d", n)
+		}
+
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("htpasswd: unsupported hash for user %q, only bcrypt and SHA1 are supported", user)
+		}
+
+		h.users[user] = hash
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *Htpasswd) Authenticate(r *http.Request) (*Identity, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	hash, ok := h.users[user]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+
+		expected := []byte(hash[len("{SHA}"):])
+		got := []byte(base64.StdEncoding.EncodeToString(sum[:]))
+
+		if subtle.ConstantTimeCompare(expected, got) != 1 {
+			return nil, ErrInvalidCredentials
+		}
+	} else if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{User: user}, nil
+}
@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/lomik/graphite-clickhouse/config"
+)
+
+// Tokens authenticates static bearer tokens
+type Tokens struct {
+	tokens []config.AuthToken
+}
+
+func NewTokens(tokens []config.AuthToken) *Tokens {
+	return &Tokens{tokens: tokens}
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+
+	return ""
+}
+
+func (t *Tokens) Authenticate(r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, nil
+	}
+
+	for i := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.tokens[i].Token)) == 1 {
+			return &Identity{
+				User:  t.tokens[i].User,
+				Roles: append([]string(nil), t.tokens[i].Roles...),
+			}, nil
+		}
+	}
+
+	// possible JWT, checked by the next authenticator
+	return nil, nil
+}
@@ -102,13 +102,28 @@ func (h *Handler) requestExpr(r *http.Request, tcq *finder.TagCountQuerier, from
 	wr := where.New()
 	pw := where.New()
 
-	if len(expr) == 0 {
+	tenant := finder.Tenant(r.Context(), h.config)
+
+	if len(expr) == 0 && tenant == nil {
 		return wr, pw, usedTags, nil
 	}
 
-	terms, err := finder.ParseTaggedConditions(expr, h.config, true)
-	if err != nil {
-		return wr, pw, usedTags, err
+	var (
+		terms []finder.TaggedTerm
+		err   error
+	)
+
+	if len(expr) > 0 {
+		terms, err = finder.ParseTaggedConditions(expr, h.config, true)
+		if err != nil {
+			return wr, pw, usedTags, err
+		}
+	}
+
+	if tenant != nil {
+		// tenant tag is hidden from autocomplete like the other used tags
+		terms = append(terms, finder.TenantTaggedTerm(tenant, h.config))
+		usedTags[h.config.Tenancy.Tag] = true
 	}
 
 	if tcq != nil {
@@ -308,7 +323,7 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 
 	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache"))
 	if useCache {
-		key, _ = taggedKey("tags;", h.config.Common.FindCacheConfig.FindTimeoutSec, fromDate, untilDate, "", exprs, tagPrefix, limit)
+		key, _ = taggedKey("tags"+scope.CacheKey(r.Context())+";", h.config.Common.FindCacheConfig.FindTimeoutSec, fromDate, untilDate, "", exprs, tagPrefix, limit)
 
 		body, err = h.config.Common.FindCache.Get(key)
 		if err == nil {
@@ -443,12 +458,18 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 	tags := make([]string, 0, uint64(len(rows))+1) // +1 - reserve for "name" tag
 
 	hasName := false
+	// the cached body is shared by users, so ACL is applied after the cache
+	acl := finder.RequestACL(r.Context(), h.config)
 
 	for i := 0; i < len(rows); i++ {
 		if rows[i] == "" {
 			continue
 		}
 
+		if acl != nil && !acl.AllowedTag(rows[i]) {
+			continue
+		}
+
 		if rows[i] == "__name__" {
 			rows[i] = "name"
 		}
@@ -464,7 +485,7 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if !hasName && !usedTags["name"] && (tagPrefix == "" || strings.HasPrefix("name", tagPrefix)) {
+	if !hasName && !usedTags["name"] && (tagPrefix == "" || strings.HasPrefix("name", tagPrefix)) && (acl == nil || acl.AllowedTag("__name__")) {
 		tags = append(tags, "name")
 	}
 
@@ -594,7 +615,7 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache"))
 	if useCache {
 		// logger = logger.With(zap.String("use_cache", "true"))
-		key, _ = taggedValuesKey("values;", h.config.Common.FindCacheConfig.FindTimeoutSec, fromDate, untilDate, tag, exprs, valuePrefix, limit)
+		key, _ = taggedValuesKey("values"+scope.CacheKey(r.Context())+";", h.config.Common.FindCacheConfig.FindTimeoutSec, fromDate, untilDate, tag, exprs, valuePrefix, limit)
 
 		body, err = h.config.Common.FindCache.Get(key)
 		if err == nil {
@@ -727,6 +748,19 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 			rows = rows[:len(rows)-1]
 		}
 
+		// the cached body is shared by users, so ACL is applied after the cache
+		if acl := finder.RequestACL(r.Context(), h.config); acl != nil {
+			allowed := rows[:0]
+
+			for _, value := range rows {
+				if acl.AllowedTagValue(tag, value) {
+					allowed = append(allowed, value)
+				}
+			}
+
+			rows = allowed
+		}
+
 		metricsCount = int64(len(rows))
 	}
 
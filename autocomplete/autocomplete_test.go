@@ -12,6 +12,7 @@ import (
 	"github.com/lomik/graphite-clickhouse/helper/date"
 	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
 	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -898,3 +899,63 @@ func TestHandler_ServeValuesWithMixedOperators(t *testing.T) {
 	testResponce(t, 0, h, &test, "")
 	assert.Equal(t, uint64(2), srv.Queries()) // Cost query only for equality terms
 }
+
+func TestHandler_ACL(t *testing.T) {
+	timeNow = func() time.Time {
+		return time.Unix(1669714247, 0)
+	}
+
+	metrics.DisableMetrics()
+
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.TaggedTable = "graphite_tagged"
+	cfg.Auth.Roles = map[string]*config.Role{
+		"team_a": {TagValues: []string{"team=a", "host=*"}},
+	}
+
+	now := timeNow()
+	fromDate, untilDate := dateString(cfg.ClickHouse.TaggedAutocompleDays, now)
+
+	srv.AddResponce(
+		"SELECT splitByChar('=', Tag1)[1] AS value FROM graphite_tagged  WHERE "+
+			"Date >= '"+fromDate+"' AND Date <= '"+untilDate+"' GROUP BY value ORDER BY value LIMIT 10000",
+		&chtest.TestResponse{
+			Body: []byte("__name__\nhost\nproject\nteam\n"),
+		})
+	srv.AddResponce(
+		"SELECT substr(Tag1, 6) AS value FROM graphite_tagged  WHERE (Tag1 LIKE 'team=%') AND "+
+			"(Date >= '"+fromDate+"' AND Date <= '"+untilDate+"') GROUP BY value ORDER BY value LIMIT 10000",
+		&chtest.TestResponse{
+			Body: []byte("a\nb\n"),
+		})
+
+	request := func(url string) *http.Request {
+		r := NewRequest("GET", srv.URL+url, nil)
+		ctx := scope.WithRoles(scope.WithUser(r.Context(), "alice"), []string{"team_a"})
+
+		return r.WithContext(ctx)
+	}
+
+	testResponce(t, 0, NewTags(cfg), &testStruct{
+		request:  request("/tags/autoComplete/tags"),
+		wantCode: http.StatusOK,
+		want:     `["host","team"]`,
+	}, "")
+
+	testResponce(t, 1, NewValues(cfg), &testStruct{
+		request:  request("/tags/autoComplete/values?tag=team"),
+		wantCode: http.StatusOK,
+		want:     `["a"]`,
+	}, "")
+
+	// users without ACL see all
+	testResponce(t, 2, NewValues(cfg), &testStruct{
+		request:  NewRequest("GET", srv.URL+"/tags/autoComplete/values?tag=team", nil),
+		wantCode: http.StatusOK,
+		want:     `["a","b"]`,
+	}, "")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNotAccess = errors.New("not an access log record")
+
+// Entry is the request from the access log
+type Entry struct {
+	Time      time.Time
+	Method    string
+	URL       string
+	Status    int
+	QueueFail bool
+}
+
+// Endpoint returns the path of URL, e.g. /render/
+func (e *Entry) Endpoint() string {
+	u, err := url.Parse(e.URL)
+	if err != nil || u.Path == "" {
+		return e.URL
+	}
+
+	return u.Path
+}
+
+// record is the subset of fields written by logs.AccessLog
+type record struct {
+	Timestamp json.RawMessage `json:"timestamp"`
+	Logger    string          `json:"logger"`
+	Message   string          `json:"message"`
+	Method    string          `json:"method"`
+	URL       string          `json:"url"`
+	Status    int             `json:"status"`
+	WaitFail  bool            `json:"wait_fail"`
+}
+
+// parseTime parses the time encoded by zapwriter: iso8601 string or epoch in seconds, millis or nanos
+func parseTime(raw string) (time.Time, error) {
+	raw = strings.Trim(raw, `"`)
+
+	if t, err := time.Parse("2006-01-02T15:04:05.000Z0700", raw); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return t, nil
+	}
+
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	switch {
+	case f < 1e11:
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	case f < 1e14:
+		return time.UnixMilli(int64(f)), nil
+	default:
+		return time.Unix(0, int64(f)), nil
+	}
+}
+
+// parseLine parses the access log line in json or mixed encoding:
+// [2024-01-26T09:57:33.548+0100] INFO [http] access {"time": 0.01, "method": "GET", "url": "/render/?...", "status": 200}
+func parseLine(line string) (*Entry, error) {
+	var (
+		rec record
+		ts  string
+	)
+
+	line = strings.TrimSpace(line)
+
+	if strings.HasPrefix(line, "{") {
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return nil, err
+		}
+
+		ts = string(rec.Timestamp)
+	} else {
+		if !strings.HasPrefix(line, "[") {
+			return nil, errNotAccess
+		}
+
+		end := strings.IndexByte(line, ']')
+		brace := strings.IndexByte(line, '{')
+
+		if end < 0 || brace < end {
+			return nil, errNotAccess
+		}
+
+		ts = line[1:end]
+
+		// INFO [http] access
+		header := strings.Fields(line[end+1 : brace])
+		if len(header) == 0 {
+			return nil, errNotAccess
+		}
+
+		rec.Message = header[len(header)-1]
+
+		if err := json.Unmarshal([]byte(line[brace:]), &rec); err != nil {
+			return nil, err
+		}
+	}
+
+	if rec.Message != "access" || rec.URL == "" {
+		return nil, errNotAccess
+	}
+
+	t, err := parseTime(ts)
+	if err != nil {
+		return nil, err
+	}
+
+	method := rec.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	return &Entry{
+		Time:      t,
+		Method:    method,
+		URL:       rec.URL,
+		Status:    rec.Status,
+		QueueFail: rec.WaitFail,
+	}, nil
+}
+
+// ReadAccessLog reads the access log records, other lines are skipped
+func ReadAccessLog(r io.Reader) ([]*Entry, error) {
+	var entries []*Entry
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		e, err := parseLine(scanner.Text())
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
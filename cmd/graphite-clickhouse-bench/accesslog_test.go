@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    *Entry
+		wantErr bool
+	}{
+		{
+			name: "json",
+			line: `{"level":"INFO","timestamp":"2024-01-26T09:57:33.548+0100","logger":"http","message":"access","time":0.01,"wait_slot":0,"wait_fail":false,"method":"GET","url":"/render/?target=a.b&from=-1h","peer":"127.0.0.1:1234","status":200}`,
+			want: &Entry{
+				Time:   time.Date(2024, 1, 26, 8, 57, 33, 548000000, time.UTC),
+				Method: "GET",
+				URL:    "/render/?target=a.b&from=-1h",
+				Status: 200,
+			},
+		},
+		{
+			name: "json epoch millis",
+			line: `{"level":"INFO","timestamp":1706259453548,"logger":"http","message":"access","method":"POST","url":"/render/","status":503,"wait_fail":true}`,
+			want: &Entry{
+				Time:      time.UnixMilli(1706259453548),
+				Method:    "POST",
+				URL:       "/render/",
+				Status:    503,
+				QueueFail: true,
+			},
+		},
+		{
+			name: "mixed epoch",
+			line: `[1706259453.5] INFO [http] access {"time":0.01,"url":"/metrics/find/?query=a.*","status":200}`,
+			want: &Entry{
+				Time:   time.Unix(1706259453, 500000000),
+				Method: "GET",
+				URL:    "/metrics/find/?query=a.*",
+				Status: 200,
+			},
+		},
+		{
+			name:    "not access",
+			line:    `[2024-01-26T09:57:33.548+0100] INFO [render] finder {"metrics":1}`,
+			wantErr: true,
+		},
+		{
+			name:    "garbage",
+			line:    `panic: runtime error`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLine(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.True(t, tt.want.Time.Equal(got.Time), "time %s, want %s", got.Time, tt.want.Time)
+			got.Time = tt.want.Time
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestReadAccessLog(t *testing.T) {
+	log := `[2024-01-26T09:57:33.548+0100] INFO [render] finder {"metrics":1}
+[2024-01-26T09:57:33.548+0100] INFO [http] access {"url":"/render/?target=a","status":200}
+not a log line
+[2024-01-26T09:57:34.548+0100] INFO [http] access {"url":"/metrics/find/?query=a","status":404}
+`
+	entries, err := ReadAccessLog(strings.NewReader(log))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "/render/", entries[0].Endpoint())
+	assert.Equal(t, "/metrics/find/", entries[1].Endpoint())
+	assert.Equal(t, time.Second, entries[1].Time.Sub(entries[0].Time))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lomik/graphite-clickhouse/helper/client"
+	"github.com/lomik/graphite-clickhouse/limiter"
+)
+
+// Bench replays the access log entries against the instance
+type Bench struct {
+	Client  *http.Client
+	Address string
+	// Speed is the multiplier of the intervals between requests, 2 is twice faster than in the log. Requests are sent
+	// without delays, if it's 0.
+	Speed       float64
+	Concurrency int
+}
+
+// isQueueFail returns true for the errors of graphite-clickhouse limiters
+func isQueueFail(err error) bool {
+	var httpErr *client.HttpError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode() != http.StatusServiceUnavailable {
+		return false
+	}
+
+	msg := strings.TrimSpace(httpErr.Message())
+
+	return msg == limiter.ErrTimeout.Error() || msg == limiter.ErrOverflow.Error()
+}
+
+func (b *Bench) do(e *Entry) *Result {
+	start := time.Now()
+	status, _, err := client.Raw(b.Client, b.Address, e.Method, e.URL)
+
+	return &Result{
+		Endpoint:  e.Endpoint(),
+		Status:    status,
+		Duration:  time.Since(start),
+		QueueFail: isQueueFail(err),
+	}
+}
+
+// Run replays entries in the order of time and waits for all responses. POST requests are skipped, the access log
+// doesn't contain bodies.
+func (b *Bench) Run(entries []*Entry, stats *Stats) {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+
+	concurrency := b.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	stats.Start(start)
+
+	for _, e := range entries {
+		if e.Method != http.MethodGet {
+			stats.Skip()
+			continue
+		}
+
+		if b.Speed > 0 {
+			offset := time.Duration(float64(e.Time.Sub(entries[0].Time)) / b.Speed)
+			if d := time.Until(start.Add(offset)); d > 0 {
+				time.Sleep(d)
+			}
+		}
+
+		sem <- struct{}{}
+
+		wg.Add(1)
+
+		go func(e *Entry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			stats.Add(b.do(e))
+		}(e)
+	}
+
+	wg.Wait()
+	stats.Stop(time.Now())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/graphite-clickhouse/limiter"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	assert.Equal(t, time.Duration(5), percentile(sorted, 0.5))
+	assert.Equal(t, time.Duration(9), percentile(sorted, 0.9))
+	assert.Equal(t, time.Duration(10), percentile(sorted, 0.99))
+	assert.Equal(t, time.Duration(1), percentile(sorted[:1], 0.5))
+	assert.Equal(t, time.Duration(0), percentile(nil, 0.5))
+}
+
+func TestBench_Run(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/render/":
+			w.Write([]byte("[]"))
+		case "/metrics/find/":
+			http.Error(w, limiter.ErrTimeout.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	entries := []*Entry{
+		{Time: start.Add(200 * time.Millisecond), Method: "GET", URL: "/metrics/find/?query=a.*"},
+		{Time: start, Method: "GET", URL: "/render/?target=a"},
+		{Time: start.Add(100 * time.Millisecond), Method: "POST", URL: "/render/"},
+		{Time: start.Add(100 * time.Millisecond), Method: "GET", URL: "/tags/autoComplete/tags"},
+		{Time: start.Add(200 * time.Millisecond), Method: "GET", URL: "/render/?target=b"},
+	}
+
+	b := &Bench{
+		Client:      &http.Client{Timeout: time.Second},
+		Address:     srv.URL,
+		Speed:       2,
+		Concurrency: 2,
+	}
+
+	stats := NewStats()
+	b.Run(entries, stats)
+
+	assert.GreaterOrEqual(t, stats.end.Sub(stats.start), 100*time.Millisecond, "requests must be delayed by speed")
+	assert.Equal(t, 1, stats.skipped)
+	assert.Len(t, stats.endpoints["/render/"].durations, 2)
+	assert.Equal(t, 1, stats.endpoints["/metrics/find/"].queueFails)
+	assert.Len(t, stats.statuses["200"].durations, 2)
+	assert.Len(t, stats.statuses["500"].durations, 1)
+	assert.Equal(t, 0, stats.statuses["500"].queueFails)
+	assert.Equal(t, 1, stats.statuses["503"].queueFails)
+
+	var sb strings.Builder
+	stats.Report(&sb)
+
+	report := sb.String()
+	assert.True(t, strings.HasPrefix(report, "requests: 4, skipped: 1, "), report)
+	assert.Contains(t, report, "1 (100.00%)")
+}
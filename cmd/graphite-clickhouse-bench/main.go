@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+func readEntries(files []string) ([]*Entry, error) {
+	if len(files) == 0 {
+		return ReadAccessLog(os.Stdin)
+	}
+
+	var entries []*Entry
+
+	for _, filename := range files {
+		var r io.Reader = os.Stdin
+
+		if filename != "-" {
+			f, err := os.Open(filename)
+			if err != nil {
+				return nil, err
+			}
+
+			defer f.Close()
+
+			r = f
+		}
+
+		e, err := ReadAccessLog(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+
+		entries = append(entries, e...)
+	}
+
+	return entries, nil
+}
+
+func main() {
+	address := flag.String("address", "http://127.0.0.1:9090", "Address of graphite-clickhouse server")
+	speed := flag.Float64("speed", 1, "Speed multiplier of the intervals between requests in the log, 0 to send requests without delays")
+	concurrency := flag.Int("concurrency", 10, "Maximum number of concurrent requests")
+	limit := flag.Int("limit", 0, "Replay only first N requests of the log")
+	timeout := flag.Duration("timeout", time.Minute, "request timeout")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s [flags] [ACCESS_LOG ...]:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Replays access log of graphite-clickhouse (json or mixed encoding, stdin by default) and reports latencies\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *speed < 0 {
+		fmt.Fprintf(os.Stderr, "invalid speed: %g\n", *speed)
+		os.Exit(1)
+	}
+
+	entries, err := readEntries(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	if len(entries) == 0 {
+		fmt.Fprintln(os.Stderr, "no access log records found")
+		os.Exit(1)
+	}
+
+	if *limit > 0 && *limit < len(entries) {
+		entries = entries[:*limit]
+	}
+
+	b := &Bench{
+		Client:      &http.Client{Timeout: *timeout},
+		Address:     *address,
+		Speed:       *speed,
+		Concurrency: *concurrency,
+	}
+
+	stats := NewStats()
+	b.Run(entries, stats)
+	stats.Report(os.Stdout)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Result is the replayed request
+type Result struct {
+	Endpoint  string
+	Status    int // 0 for transport errors
+	Duration  time.Duration
+	QueueFail bool
+}
+
+type group struct {
+	durations  []time.Duration
+	queueFails int
+}
+
+// Stats collects latencies per endpoint and per status
+type Stats struct {
+	mu         sync.Mutex
+	endpoints  map[string]*group
+	statuses   map[string]*group
+	skipped    int
+	start, end time.Time
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		endpoints: make(map[string]*group),
+		statuses:  make(map[string]*group),
+	}
+}
+
+func add(groups map[string]*group, key string, r *Result) {
+	g, ok := groups[key]
+	if !ok {
+		g = &group{}
+		groups[key] = g
+	}
+
+	g.durations = append(g.durations, r.Duration)
+
+	if r.QueueFail {
+		g.queueFails++
+	}
+}
+
+// Add appends the result to the stats
+func (s *Stats) Add(r *Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := "error"
+	if r.Status != 0 {
+		status = strconv.Itoa(r.Status)
+	}
+
+	add(s.endpoints, r.Endpoint, r)
+	add(s.statuses, status, r)
+}
+
+// Skip counts the request, which could not be replayed
+func (s *Stats) Skip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.skipped++
+}
+
+// Start sets the interval of the benchmark
+func (s *Stats) Start(t time.Time) {
+	s.start = t
+}
+
+// Stop sets the interval of the benchmark
+func (s *Stats) Stop(t time.Time) {
+	s.end = t
+}
+
+// percentile returns the nearest-rank percentile of the sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+
+	return sorted[i]
+}
+
+func writeGroups(w io.Writer, name string, groups map[string]*group) {
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "%s\tcount\tp50\tp90\tp99\tmax\tqueue fails\t\n", name)
+
+	for _, k := range keys {
+		g := groups[k]
+		sort.Slice(g.durations, func(i, j int) bool { return g.durations[i] < g.durations[j] })
+
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%d (%.2f%%)\t\n",
+			k, len(g.durations),
+			percentile(g.durations, 0.5).Round(time.Millisecond),
+			percentile(g.durations, 0.9).Round(time.Millisecond),
+			percentile(g.durations, 0.99).Round(time.Millisecond),
+			g.durations[len(g.durations)-1].Round(time.Millisecond),
+			g.queueFails, 100*float64(g.queueFails)/float64(len(g.durations)),
+		)
+	}
+
+	tw.Flush()
+}
+
+// Report writes the tables of latency percentiles per endpoint and per status
+func (s *Stats) Report(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := 0
+	for _, g := range s.endpoints {
+		total += len(g.durations)
+	}
+
+	duration := s.end.Sub(s.start)
+
+	var rps float64
+	if duration > 0 {
+		rps = float64(total) / duration.Seconds()
+	}
+
+	fmt.Fprintf(w, "requests: %d, skipped: %d, duration: %s, rps: %.2f\n\n", total, s.skipped, duration.Round(time.Millisecond), rps)
+	writeGroups(w, "endpoint", s.endpoints)
+	fmt.Fprintln(w)
+	writeGroups(w, "status", s.statuses)
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/pelletier/go-toml"
+
+	"github.com/lomik/graphite-clickhouse/helper/client"
+	"github.com/lomik/graphite-clickhouse/helper/datetime"
+)
+
+var ErrTimestampInvalid = errors.New("invalid timestamp")
+
+const defaultValueTolerance = 0.0000000001
+
+// CheckConfig is the file with requests and expected results
+type CheckConfig struct {
+	// Precision truncates from, until and expected timestamps, like in e2e tests
+	Precision time.Duration `toml:"precision"`
+	// TimeTolerance is the allowed difference of start, stop and request timestamps of the series
+	TimeTolerance time.Duration `toml:"time_tolerance"`
+	// ValueTolerance is the allowed absolute difference of values and xFilesFactor, 1e-10 by default
+	ValueTolerance float64       `toml:"value_tolerance"`
+	Timeout        time.Duration `toml:"timeout"`
+
+	FindChecks   []*FindCheck   `toml:"find_checks"`
+	TagsChecks   []*TagsCheck   `toml:"tags_checks"`
+	RenderChecks []*RenderCheck `toml:"render_checks"`
+}
+
+type FindCheck struct {
+	Name    string              `toml:"name"`
+	Formats []client.FormatType `toml:"formats"`
+	From    string              `toml:"from"`
+	Until   string              `toml:"until"`
+	Query   string              `toml:"query"`
+
+	Result      []client.FindMatch `toml:"result"`
+	ErrorRegexp string             `toml:"error_regexp"`
+}
+
+type TagsCheck struct {
+	Name    string              `toml:"name"`
+	Names   bool                `toml:"names"` // TagNames or TagValues
+	Formats []client.FormatType `toml:"formats"`
+	From    string              `toml:"from"`
+	Until   string              `toml:"until"`
+	Query   string              `toml:"query"`
+	Limits  uint64              `toml:"limits"`
+
+	Result      []string `toml:"result"`
+	ErrorRegexp string   `toml:"error_regexp"`
+}
+
+type Metric struct {
+	Name              string    `toml:"name"`
+	PathExpression    string    `toml:"path"`
+	ConsolidationFunc string    `toml:"consolidation"`
+	StartTime         string    `toml:"start"`
+	StopTime          string    `toml:"stop"`
+	StepTime          int64     `toml:"step"`
+	XFilesFactor      float32   `toml:"xfiles"`
+	Values            []float64 `toml:"values"`
+	AppliedFunctions  []string  `toml:"applied_functions"`
+	RequestStartTime  string    `toml:"req_start"`
+	RequestStopTime   string    `toml:"req_stop"`
+}
+
+type RenderCheck struct {
+	Name               string              `toml:"name"`
+	Formats            []client.FormatType `toml:"formats"`
+	From               string              `toml:"from"`
+	Until              string              `toml:"until"`
+	Targets            []string            `toml:"targets"`
+	MaxDataPoints      int64               `toml:"max_data_points"`
+	FilteringFunctions []string            `toml:"filtering_functions"`
+
+	Result      []Metric `toml:"result"`
+	ErrorRegexp string   `toml:"error_regexp"`
+}
+
+// checker runs checks against the address and collects mismatches
+type checker struct {
+	cfg     *CheckConfig
+	client  *http.Client
+	address string
+	tz      *time.Location
+	now     time.Time
+}
+
+func loadCheckConfig(filename string) (*CheckConfig, error) {
+	d, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &CheckConfig{}
+	if err = toml.Unmarshal(d, cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Minute
+	}
+
+	if cfg.ValueTolerance == 0 {
+		cfg.ValueTolerance = defaultValueTolerance
+	}
+
+	return cfg, nil
+}
+
+// runChecks runs all checks from the file and returns the number of checks and the errors
+func runChecks(filename, address string, tz *time.Location, now time.Time) (int, []string, error) {
+	cfg, err := loadCheckConfig(filename)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	c := &checker{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		address: address,
+		tz:      tz,
+		now:     now,
+	}
+
+	var errs []string
+
+	total := 0
+
+	for _, check := range cfg.FindChecks {
+		e, err := c.find(check)
+		if err != nil {
+			return total, errs, fmt.Errorf("find check '%s': %w", check.Query, err)
+		}
+
+		total++
+
+		errs = append(errs, e...)
+	}
+
+	for _, check := range cfg.TagsChecks {
+		e, err := c.tags(check)
+		if err != nil {
+			return total, errs, fmt.Errorf("tags check '%s': %w", check.Query, err)
+		}
+
+		total++
+
+		errs = append(errs, e...)
+	}
+
+	for _, check := range cfg.RenderChecks {
+		e, err := c.render(check)
+		if err != nil {
+			return total, errs, fmt.Errorf("render check %v: %w", check.Targets, err)
+		}
+
+		total++
+
+		errs = append(errs, e...)
+	}
+
+	return total, errs, nil
+}
+
+// timestamp converts the time from the file to epoch, empty string is 0
+func (c *checker) timestamp(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	ts := datetime.DateParamToEpoch(s, c.tz, c.now, c.cfg.Precision)
+	if ts == 0 {
+		return 0, fmt.Errorf("%w: %s", ErrTimestampInvalid, s)
+	}
+
+	return ts, nil
+}
+
+func (c *checker) interval(from, until string) (int64, int64, error) {
+	f, err := c.timestamp(from)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	u, err := c.timestamp(until)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return f, u, nil
+}
+
+func formats(f []client.FormatType) []client.FormatType {
+	if len(f) == 0 {
+		return []client.FormatType{client.FormatDefault}
+	}
+
+	return f
+}
+
+// checkError checks the error against the expected one and returns the mismatch or empty string
+func checkError(name, url, errorRegexp string, err error) (string, error) {
+	if err == nil {
+		if errorRegexp != "" {
+			return fmt.Sprintf("%s %s: want error with '%s'", name, url, errorRegexp), nil
+		}
+
+		return "", nil
+	}
+
+	errStr := strings.TrimRight(err.Error(), "\n")
+
+	if errorRegexp == "" {
+		return fmt.Sprintf("%s %s: %s", name, url, errStr), nil
+	}
+
+	re, rErr := regexp.Compile(errorRegexp)
+	if rErr != nil {
+		return "", rErr
+	}
+
+	if !re.MatchString(errStr) {
+		return fmt.Sprintf("%s %s: want error with '%s', got '%s'", name, url, errorRegexp, errStr), nil
+	}
+
+	return "", nil
+}
+
+func (c *checker) find(check *FindCheck) ([]string, error) {
+	from, until, err := c.interval(check.From, check.Until)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+
+	for _, format := range formats(check.Formats) {
+		url, result, _, err := client.MetricsFind(c.client, c.address, format, check.Query, from, until)
+
+		e, cErr := checkError("FIND"+checkName(check.Name), url, check.ErrorRegexp, err)
+		if cErr != nil {
+			return nil, cErr
+		}
+
+		if e != "" {
+			errs = append(errs, e)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		errs = append(errs, compareSlices("FIND"+checkName(check.Name), url, result, check.Result)...)
+	}
+
+	return errs, nil
+}
+
+func (c *checker) tags(check *TagsCheck) ([]string, error) {
+	from, until, err := c.interval(check.From, check.Until)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+
+	for _, format := range formats(check.Formats) {
+		var (
+			url    string
+			result []string
+		)
+
+		if check.Names {
+			url, result, _, err = client.TagsNames(c.client, c.address, format, check.Query, check.Limits, from, until)
+		} else {
+			url, result, _, err = client.TagsValues(c.client, c.address, format, check.Query, check.Limits, from, until)
+		}
+
+		e, cErr := checkError("TAGS"+checkName(check.Name), url, check.ErrorRegexp, err)
+		if cErr != nil {
+			return nil, cErr
+		}
+
+		if e != "" {
+			errs = append(errs, e)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		errs = append(errs, compareSlices("TAGS"+checkName(check.Name), url, result, check.Result)...)
+	}
+
+	return errs, nil
+}
+
+func (c *checker) render(check *RenderCheck) ([]string, error) {
+	from, until, err := c.interval(check.From, check.Until)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := make([]client.Metric, len(check.Result))
+
+	for i, m := range check.Result {
+		expected[i] = client.Metric{
+			Name:              m.Name,
+			PathExpression:    m.PathExpression,
+			ConsolidationFunc: m.ConsolidationFunc,
+			StepTime:          m.StepTime,
+			XFilesFactor:      m.XFilesFactor,
+			Values:            m.Values,
+			AppliedFunctions:  m.AppliedFunctions,
+		}
+
+		times := []struct {
+			s  string
+			ts *int64
+		}{
+			{m.StartTime, &expected[i].StartTime},
+			{m.StopTime, &expected[i].StopTime},
+			{m.RequestStartTime, &expected[i].RequestStartTime},
+			{m.RequestStopTime, &expected[i].RequestStopTime},
+		}
+
+		for _, t := range times {
+			if *t.ts, err = c.timestamp(t.s); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Slice(expected, func(i, j int) bool { return expected[i].Name < expected[j].Name })
+
+	var errs []string
+
+	for _, format := range formats(check.Formats) {
+		var filteringFunctions []*carbonapi_v3_pb.FilteringFunction
+
+		if format == client.FormatPb_v3 || format == client.FormatDefault {
+			if filteringFunctions, err = parseFilteringFunctions(check.FilteringFunctions); err != nil {
+				return nil, err
+			}
+		}
+
+		url, result, _, err := client.Render(c.client, c.address, format, check.Targets, filteringFunctions, check.MaxDataPoints, from, until)
+
+		e, cErr := checkError("RENDER"+checkName(check.Name), url, check.ErrorRegexp, err)
+		if cErr != nil {
+			return nil, cErr
+		}
+
+		if e != "" {
+			errs = append(errs, e)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		errs = append(errs, c.compareRender("RENDER"+checkName(check.Name), url, result, expected)...)
+	}
+
+	return errs, nil
+}
+
+func checkName(name string) string {
+	if name == "" {
+		return ""
+	}
+
+	return "[" + name + "]"
+}
+
+func parseFilteringFunctions(strFilteringFuncs []string) ([]*carbonapi_v3_pb.FilteringFunction, error) {
+	res := make([]*carbonapi_v3_pb.FilteringFunction, 0, len(strFilteringFuncs))
+
+	for _, strFF := range strFilteringFuncs {
+		strFFSplit := strings.Split(strFF, "(")
+		if len(strFFSplit) != 2 {
+			return nil, fmt.Errorf("could not parse filtering function: %s", strFF)
+		}
+
+		name := strFFSplit[0]
+
+		args := strings.Split(strFFSplit[1], ",")
+		for i := range args {
+			args[i] = strings.TrimSpace(args[i])
+			args[i] = strings.Trim(args[i], ")'")
+		}
+
+		res = append(res, &carbonapi_v3_pb.FilteringFunction{Name: name, Arguments: args})
+	}
+
+	return res, nil
+}
+
+func compareSlices[T comparable](name, url string, actual, expected []T) []string {
+	var errs []string
+
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		if i >= len(actual) {
+			errs = append(errs, fmt.Sprintf("- %s %s [%d] = %+v", name, url, i, expected[i]))
+		} else if i >= len(expected) {
+			errs = append(errs, fmt.Sprintf("+ %s %s [%d] = %+v", name, url, i, actual[i]))
+		} else if expected[i] != actual[i] {
+			errs = append(errs, fmt.Sprintf("- %s %s [%d] = %+v", name, url, i, expected[i]))
+			errs = append(errs, fmt.Sprintf("+ %s %s [%d] = %+v", name, url, i, actual[i]))
+		}
+	}
+
+	return errs
+}
+
+func (c *checker) nearlyEqual(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+
+	return math.Abs(a-b) <= c.cfg.ValueTolerance
+}
+
+func (c *checker) nearlyEqualTime(a, b int64) bool {
+	d := a - b
+	if d < 0 {
+		d = -d
+	}
+
+	return d <= int64(c.cfg.TimeTolerance.Seconds())
+}
+
+func (c *checker) compareRender(name, url string, actual, expected []client.Metric) []string {
+	var errs []string
+
+	sort.Slice(actual, func(i, j int) bool { return actual[i].Name < actual[j].Name })
+
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		if i >= len(actual) {
+			errs = append(errs, fmt.Sprintf("- %s %s [%d] = %+v", name, url, i, expected[i]))
+			continue
+		} else if i >= len(expected) {
+			errs = append(errs, fmt.Sprintf("+ %s %s [%d] = %+v", name, url, i, actual[i]))
+			continue
+		}
+
+		a, e := &actual[i], &expected[i]
+
+		if a.Name != e.Name {
+			errs = append(errs, fmt.Sprintf("- %s %s [%d] = %+v", name, url, i, *e))
+			errs = append(errs, fmt.Sprintf("+ %s %s [%d] = %+v", name, url, i, *a))
+
+			continue
+		}
+
+		mismatch := func(field string, got, want interface{}) {
+			errs = append(errs, fmt.Sprintf("%s %s '%s': mismatch [%d].%s, got %v, want %v", name, url, a.Name, i, field, got, want))
+		}
+
+		if a.PathExpression != e.PathExpression {
+			mismatch("PathExpression", a.PathExpression, e.PathExpression)
+		}
+
+		if a.ConsolidationFunc != e.ConsolidationFunc {
+			mismatch("ConsolidationFunc", a.ConsolidationFunc, e.ConsolidationFunc)
+		}
+
+		if a.StepTime != e.StepTime {
+			mismatch("StepTime", a.StepTime, e.StepTime)
+		}
+
+		times := []struct {
+			field     string
+			got, want int64
+		}{
+			{"StartTime", a.StartTime, e.StartTime},
+			{"StopTime", a.StopTime, e.StopTime},
+			{"RequestStartTime", a.RequestStartTime, e.RequestStartTime},
+			{"RequestStopTime", a.RequestStopTime, e.RequestStopTime},
+		}
+
+		for _, t := range times {
+			// not set in the file
+			if t.want != 0 && !c.nearlyEqualTime(t.got, t.want) {
+				mismatch(t.field, t.got, t.want)
+			}
+		}
+
+		if len(e.AppliedFunctions) != 0 && !reflect.DeepEqual(a.AppliedFunctions, e.AppliedFunctions) {
+			mismatch("AppliedFunctions", a.AppliedFunctions, e.AppliedFunctions)
+		}
+
+		if !c.nearlyEqual(float64(a.XFilesFactor), float64(e.XFilesFactor)) {
+			mismatch("XFilesFactor", a.XFilesFactor, e.XFilesFactor)
+		}
+
+		valuesEqual := len(a.Values) == len(e.Values)
+		for j := 0; valuesEqual && j < len(a.Values); j++ {
+			valuesEqual = c.nearlyEqual(a.Values[j], e.Values[j])
+		}
+
+		if !valuesEqual {
+			mismatch("Values", a.Values, e.Values)
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/find"
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/render"
+)
+
+func newGraphiteClickhouse(t *testing.T, now time.Time) string {
+	metrics.DisableMetrics()
+
+	ch := clickhouse.NewFakeServer()
+	t.Cleanup(ch.Close)
+
+	from := uint32(now.Add(-5 * time.Minute).Unix())
+
+	require.NoError(t, ch.AddIndex("graphite_index", now, "test.cpu", "test.mem"))
+	require.NoError(t, ch.AddPoints("graphite", "test.cpu",
+		point.Point{Time: from, Value: 1.5, Timestamp: from},
+		point.Point{Time: from + 60, Value: 2, Timestamp: from + 60},
+	))
+
+	cfg, _, err := config.Unmarshal([]byte(fmt.Sprintf(`
+[clickhouse]
+url = "%s"
+index-table = "graphite_index"
+
+[[data-table]]
+table = "graphite"
+rollup-conf = "none"
+rollup-default-precision = 60
+rollup-default-function = "avg"
+`, ch.URL)), false)
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics/find/", find.NewHandler(cfg))
+	mux.Handle("/render/", render.NewHandler(cfg))
+
+	gch := httptest.NewServer(mux)
+	t.Cleanup(gch.Close)
+
+	return gch.URL
+}
+
+func writeChecks(t *testing.T, checks string) string {
+	filename := path.Join(t.TempDir(), "checks.toml")
+	require.NoError(t, os.WriteFile(filename, []byte(checks), 0644))
+
+	return filename
+}
+
+func TestRunChecks(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	address := newGraphiteClickhouse(t, now)
+
+	tests := []struct {
+		name   string
+		checks string
+		want   []string
+	}{
+		{
+			name: "match",
+			checks: `
+precision = "1m"
+time_tolerance = "1m"
+value_tolerance = 0.01
+
+[[find_checks]]
+query = "test.*"
+from = "now-10m"
+until = "now"
+result = [{ path = "test.cpu", is_leaf = true }, { path = "test.mem", is_leaf = true }]
+
+[[render_checks]]
+formats = ["carbonapi_v3_pb", "json"]
+from = "now-5m"
+until = "now-1m"
+targets = ["test.cpu"]
+result = [{ name = "test.cpu", path = "test.cpu", consolidation = "avg", start = "now-5m", stop = "now", step = 60, values = [1.505, 2.0, nan, nan, nan] }]
+
+[[render_checks]]
+name = "no until"
+from = "now-5m"
+targets = ["test.cpu"]
+error_regexp = "^invalid until$"
+`,
+		},
+		{
+			name: "mismatch",
+			checks: `
+precision = "1m"
+
+[[find_checks]]
+name = "find"
+query = "test.*"
+from = "now-10m"
+until = "now"
+result = [{ path = "test.cpu", is_leaf = true }]
+
+[[render_checks]]
+name = "values"
+formats = ["json"]
+from = "now-5m"
+until = "now-1m"
+targets = ["test.cpu"]
+result = [{ name = "test.cpu", path = "test.cpu", consolidation = "avg", start = "now-6m", step = 60, values = [1.505, 2.0, nan, nan, nan] }]
+`,
+			want: []string{
+				"+ FIND[find] /metrics/find/?format=carbonapi_v3_pb, from=%[1]d, until=%[3]d, query test.* [1] = {Path:test.mem IsLeaf:true}",
+				"RENDER[values] /render/?format=json, from=%[2]d, until=%[4]d, targets [test.cpu] 'test.cpu': mismatch [0].StartTime, got %[2]d, want %[5]d",
+				"RENDER[values] /render/?format=json, from=%[2]d, until=%[4]d, targets [test.cpu] 'test.cpu': mismatch [0].Values, got [1.5 2 NaN NaN NaN], want [1.505 2 NaN NaN NaN]",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total, errs, err := runChecks(writeChecks(t, tt.checks), address, time.Local, now)
+			require.NoError(t, err)
+
+			for i := range tt.want {
+				tt.want[i] = fmt.Sprintf(tt.want[i],
+					now.Add(-10*time.Minute).Unix(), now.Add(-5*time.Minute).Unix(), now.Unix(), now.Add(-time.Minute).Unix(), now.Add(-6*time.Minute).Unix(),
+				)
+			}
+
+			assert.Equal(t, tt.want, errs)
+			assert.Greater(t, total, 0)
+		})
+	}
+}
+
+func TestRunChecks_InvalidTime(t *testing.T) {
+	_, _, err := runChecks(writeChecks(t, `
+[[find_checks]]
+query = "test.*"
+from = "not a time"
+`), "http://127.0.0.1:1", time.Local, time.Now())
+	assert.ErrorIs(t, err, ErrTimestampInvalid)
+}
@@ -43,6 +43,8 @@ func main() {
 
 	timeout := flag.Duration("timeout", time.Minute, "request timeout")
 
+	check := flag.String("check", "", "TOML file with requests and expected results, exit with non-zero code on mismatch")
+
 	var targets StringSlice
 
 	flag.Var(&targets, "target", "Target for /render")
@@ -62,6 +64,26 @@ func main() {
 
 	now := time.Now()
 
+	if *check != "" {
+		total, errs, err := runChecks(*check, *address, tz, now)
+		for _, e := range errs {
+			fmt.Println(e)
+		}
+
+		if err != nil {
+			fmt.Printf("check failed: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		fmt.Printf("checks: %d, mismatches: %d\n", total, len(errs))
+
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	from := datetime.DateParamToEpoch(*fromStr, tz, now, 0)
 	if from == 0 && len(targets) > 0 {
 		fmt.Printf("invalid from: %s\n", *fromStr)
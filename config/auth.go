@@ -0,0 +1,98 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AuthToken is a static bearer token
+type AuthToken struct {
+	Token string   `toml:"token" json:"-"`
+	User  string   `toml:"user"  json:"user"  comment:"user name for the token"`
+	Roles []string `toml:"roles" json:"roles" comment:"roles, granted to the token"`
+}
+
+// Role restricts metrics, which can be found or rendered
+type Role struct {
+	MetricPrefixes []string `toml:"metric-prefixes" json:"metric-prefixes" comment:"allowed prefixes of plain metrics (as stored in ClickHouse), empty string allows all plain metrics"`
+	TagValues      []string `toml:"tag-values"      json:"tag-values"      comment:"allowed tag=value pairs of tagged series, tag=* allows any tag value, * allows all tagged series"`
+}
+
+// Auth is the authentication and authorization config for HTTP endpoints
+type Auth struct {
+	Tokens        []AuthToken         `toml:"tokens"          json:"tokens"          comment:"static bearer tokens"                                                   commented:"true"`
+	HtpasswdFile  string              `toml:"htpasswd-file"   json:"htpasswd-file"   comment:"htpasswd file for basic auth (bcrypt and SHA1 hashes are supported)"`
+	JWKSFile      string              `toml:"jwks-file"       json:"jwks-file"       comment:"JWKS file with public keys for JWT bearer tokens verification"`
+	JWTIssuer     string              `toml:"jwt-issuer"      json:"jwt-issuer"      comment:"required JWT issuer (iss), not checked if empty"`
+	JWTAudience   string              `toml:"jwt-audience"    json:"jwt-audience"    comment:"required JWT audience (aud), not checked if empty"`
+	JWTUserClaim  string              `toml:"jwt-user-claim"  json:"jwt-user-claim"  comment:"JWT claim with user name"`
+	JWTRolesClaim string              `toml:"jwt-roles-claim" json:"jwt-roles-claim" comment:"JWT claim with roles (array or space-separated string)"`
+	UserRoles     map[string][]string `toml:"user-roles"      json:"user-roles"      comment:"additional roles by user name"                                          commented:"true"`
+	AdminRoles    []string            `toml:"admin-roles"     json:"admin-roles"     comment:"roles allowed to access /debug/config, any authenticated user if empty"`
+	Roles         map[string]*Role    `toml:"roles"           json:"roles"           comment:"ACL by role name, metrics are not restricted if empty"                 commented:"true"`
+}
+
+// Enabled returns true if any authentication method is configured
+func (a *Auth) Enabled() bool {
+	return len(a.Tokens) > 0 || a.HtpasswdFile != "" || a.JWKSFile != ""
+}
+
+// Restricted returns true if ACL should be applied to the authenticated users
+func (a *Auth) Restricted() bool {
+	return len(a.Roles) > 0
+}
+
+// IsAdmin returns true if the roles allow the access to administrative endpoints
+func (a *Auth) IsAdmin(roles []string) bool {
+	if len(a.AdminRoles) == 0 {
+		return true
+	}
+
+	for _, admin := range a.AdminRoles {
+		for _, role := range roles {
+			if role == admin {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (a *Auth) validate() error {
+	if !a.Enabled() {
+		if len(a.Roles) > 0 || len(a.AdminRoles) > 0 {
+			return fmt.Errorf("auth roles are set, but no authentication method is configured")
+		}
+
+		return nil
+	}
+
+	for i := range a.Tokens {
+		if a.Tokens[i].Token == "" {
+			return fmt.Errorf("auth token #%d is empty", i)
+		}
+
+		if a.Tokens[i].User == "" {
+			return fmt.Errorf("auth token #%d user not set", i)
+		}
+	}
+
+	if a.JWKSFile != "" && a.JWTUserClaim == "" {
+		return fmt.Errorf("jwt-user-claim not set")
+	}
+
+	for name, role := range a.Roles {
+		if role == nil {
+			return fmt.Errorf("auth role %q is empty", name)
+		}
+
+		for _, tv := range role.TagValues {
+			if tv != "*" && !strings.Contains(tv, "=") {
+				return fmt.Errorf("auth role %q has invalid tag value %q, must be tag=value", name, tv)
+			}
+		}
+	}
+
+	return nil
+}
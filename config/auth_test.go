@@ -0,0 +1,59 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuth(t *testing.T) {
+	body := []byte(`
+[auth]
+htpasswd-file = "/etc/graphite-clickhouse/htpasswd"
+admin-roles = ["admin"]
+tokens = [
+  { token = "secret", user = "grafana", roles = ["admin"] },
+]
+
+[auth.user-roles]
+alice = ["team_a"]
+
+[auth.roles.team_a]
+metric-prefixes = ["teams.a."]
+tag-values = ["team=a"]
+
+[auth.roles.admin]
+metric-prefixes = [""]
+tag-values = ["*"]
+`)
+
+	cfg, _, err := Unmarshal(body, true)
+	require.NoError(t, err)
+
+	assert.True(t, cfg.Auth.Enabled())
+	assert.True(t, cfg.Auth.Restricted())
+	assert.Equal(t, []AuthToken{{Token: "secret", User: "grafana", Roles: []string{"admin"}}}, cfg.Auth.Tokens)
+	assert.Equal(t, map[string][]string{"alice": {"team_a"}}, cfg.Auth.UserRoles)
+	assert.Equal(t, &Role{MetricPrefixes: []string{"teams.a."}, TagValues: []string{"team=a"}}, cfg.Auth.Roles["team_a"])
+	assert.Equal(t, "sub", cfg.Auth.JWTUserClaim)
+
+	assert.True(t, cfg.Auth.IsAdmin([]string{"team_a", "admin"}))
+	assert.False(t, cfg.Auth.IsAdmin([]string{"team_a"}))
+	assert.False(t, cfg.Auth.IsAdmin(nil))
+}
+
+func TestAuthInvalid(t *testing.T) {
+	tests := []string{
+		// roles without authentication
+		"[auth.roles.team_a]\nmetric-prefixes = [\"teams.a.\"]\n",
+		"[auth]\ntokens = [{ token = \"\", user = \"grafana\" }]\n",
+		"[auth]\ntokens = [{ token = \"secret\" }]\n",
+		"[auth]\nhtpasswd-file = \"htpasswd\"\n[auth.roles.team_a]\ntag-values = [\"team\"]\n",
+	}
+
+	for _, body := range tests {
+		_, _, err := Unmarshal([]byte(body), false)
+		assert.Error(t, err, body)
+	}
+}
@@ -27,7 +27,9 @@ import (
 	"github.com/lomik/graphite-clickhouse/cache"
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/helper/date"
+	"github.com/lomik/graphite-clickhouse/helper/indexstats"
 	"github.com/lomik/graphite-clickhouse/helper/rollup"
+	"github.com/lomik/graphite-clickhouse/helper/tlsserver"
 	"github.com/lomik/graphite-clickhouse/limiter"
 	"github.com/lomik/graphite-clickhouse/metrics"
 )
@@ -99,7 +101,9 @@ type Common struct {
 	MaxCPU                 int              `toml:"max-cpu"                    json:"max-cpu"`
 	MaxMetricsInFindAnswer int              `toml:"max-metrics-in-find-answer" json:"max-metrics-in-find-answer" comment:"limit number of results from find query, 0=unlimited"`
 	MaxMetricsPerTarget    int              `toml:"max-metrics-per-target"     json:"max-metrics-per-target"     comment:"limit numbers of queried metrics per target in /render requests, 0 or negative = unlimited"`
+	PartialResponse        bool             `toml:"partial-response"           json:"partial-response"           comment:"if true, /render and /metrics/find return the first metrics within max-metrics-per-target and max-metrics-in-find-answer instead of an error, the response is flagged with X-Gch-Partial-Response header"`
 	AppendEmptySeries      bool             `toml:"append-empty-series"        json:"append-empty-series"        comment:"if true, always return points for all metrics, replacing empty results with list of NaN"`
+	EvaluateFunctions      bool             `toml:"evaluate-functions"         json:"evaluate-functions"         comment:"if true, evaluate common graphite functions (sumSeries, aliasByNode, perSecond, etc.) in /render targets, for setups without carbonapi"`
 	TargetBlacklist        []string         `toml:"target-blacklist"           json:"target-blacklist"           comment:"daemon returns empty response if query matches any of regular expressions"                  commented:"true"`
 	Blacklist              []*regexp.Regexp `toml:"-"                          json:"-"` // compiled TargetBlacklist
 	MemoryReturnInterval   time.Duration    `toml:"memory-return-interval"     json:"memory-return-interval"     comment:"daemon will return the freed memory to the OS when it>0"`
@@ -114,9 +118,16 @@ type Common struct {
 	SDDc             []string      `toml:"service-discovery-ds"   json:"service-discovery-ds"   comment:"service discovery datacenters (first - is primary, in other register as backup)"`
 	SDExpire         time.Duration `toml:"service-discovery-expire"   json:"service-discovery-expire"   comment:"service discovery expire duration for cleanup (minimum is 24h, if enabled)"`
 
+	ShutdownDelay   time.Duration `toml:"shutdown-delay" json:"shutdown-delay" comment:"on shutdown keep serving requests for the delay after the healthcheck is failed and service discovery is unregistered, so load balancers could notice it (10s by default with service-discovery, 0 otherwise)"`
+	ShutdownTimeout time.Duration `toml:"shutdown-timeout" json:"shutdown-timeout" comment:"on shutdown wait for in-flight requests up to the timeout, after it the running ClickHouse queries are killed"`
+
 	FindCacheConfig CacheConfig `toml:"find-cache"      json:"find-cache"             comment:"find/tags cache config"`
 
 	FindCache cache.BytesCache `toml:"-" json:"-"`
+
+	TLSParams         config.TLS        `toml:"tls"                 json:"tls"                 comment:"HTTPS configuration for the general listener, client certificates are verified with client-auth and ca-cert" commented:"true"`
+	TLS               *tlsserver.Server `toml:"-"                   json:"-"`
+	TLSReloadInterval time.Duration     `toml:"tls-reload-interval" json:"tls-reload-interval" comment:"interval for checking the listeners certificates changes, 0 disables the reload"`
 }
 
 // FeatureFlags contains feature flags that significantly change how gch responds to some requests
@@ -147,6 +158,7 @@ const (
 	IndexAuto     = iota
 	IndexDirect   = iota
 	IndexReversed = iota
+	IndexStats    = iota
 )
 
 // IndexReverse maps setting name to value
@@ -154,10 +166,26 @@ var IndexReverse = map[string]uint8{
 	"direct":   IndexDirect,
 	"auto":     IndexAuto,
 	"reversed": IndexReversed,
+	"stats":    IndexStats,
 }
 
 // IndexReverseNames contains valid names for index-reverse setting
-var IndexReverseNames = []string{"auto", "direct", "reversed"}
+var IndexReverseNames = []string{"auto", "direct", "reversed", "stats"}
+
+// useIndexStats returns true if index-reverse or any of index-reverses uses the index statistics
+func (c *ClickHouse) useIndexStats() bool {
+	if c.IndexReverse == "stats" {
+		return true
+	}
+
+	for _, rule := range c.IndexReverses {
+		if rule.Reverse == "stats" {
+			return true
+		}
+	}
+
+	return false
+}
 
 type UserLimits struct {
 	MaxQueries        int `toml:"max-queries"      json:"max-queries"  comment:"Max queries to fetch data"`
@@ -228,8 +256,9 @@ type ClickHouse struct {
 	TagsLimiter           limiter.ServerLimiter `toml:"-"                        json:"-"`
 
 	WildcardMinDistance   int  `toml:"wildcard-min-distance" json:"wildcard-min-distance" comment:"If a wildcard appears both at the start and the end of a plain query at a distance (in terms of nodes) less than wildcard-min-distance, then it will be discarded. This parameter can be used to discard expensive queries."`
-	TrySplitQuery         bool `toml:"try-split-query" json:"try-split-query" comment:"Plain queries like '{first,second}.custom.metric.*' are also a subject to wildcard-min-distance restriction. But can be split into 2 queries: 'first.custom.metric.*', 'second.custom.metric.*'. Note that: only one list will be split; if there are wildcard in query before (after) list then reverse (direct) notation will be preferred; if there are wildcards before and after list, then query will not be split"`
+	TrySplitQuery         bool `toml:"try-split-query" json:"try-split-query" comment:"Plain queries like '{first,second}.custom.metric.*' are also a subject to wildcard-min-distance restriction. But can be split into 2 queries: 'first.custom.metric.*', 'second.custom.metric.*'. Note that: only one list will be split, unless max-split-subqueries is set; if there are wildcard in query before (after) list then reverse (direct) notation will be preferred; if there are wildcards before and after list, then query will not be split"`
 	MaxNodeToSplitIndex   int  `toml:"max-node-to-split-index" json:"max-node-to-split-index" comment:"Used only if try-split-query is true. Query that contains list will be split if its (list) node index is less or equal to max-node-to-split-index. By default is 0. It is recommended to have this value set to 2 or 3 and increase it very carefully, because 3 or 4 plain nodes without wildcards have good selectivity"`
+	MaxSplitSubqueries    int  `toml:"max-split-subqueries" json:"max-split-subqueries" comment:"Used only if try-split-query is true. The next lists in the split direction are split too, while there are no wildcards before them, their node index is less or equal to max-node-to-split-index and the count of subqueries is less or equal to max-split-subqueries. By default is 0, only one list is split"`
 	TagsMinInQuery        int  `toml:"tags-min-in-query" json:"tags-min-in-query" comment:"Minimum tags in seriesByTag query"`
 	TagsMinInAutocomplete int  `toml:"tags-min-in-autocomplete" json:"tags-min-in-autocomplete" comment:"Minimum tags in autocomplete query"`
 
@@ -239,6 +268,8 @@ type ClickHouse struct {
 	IndexUseDaily        bool                  `toml:"index-use-daily"          json:"index-use-daily"`
 	IndexReverse         string                `toml:"index-reverse"            json:"index-reverse"            comment:"see doc/config.md"`
 	IndexReverses        IndexReverses         `toml:"index-reverses"           json:"index-reverses"           comment:"see doc/config.md"                                                                                                              commented:"true"`
+	IndexStatsInterval   time.Duration         `toml:"index-stats-interval"     json:"index-stats-interval"     comment:"refresh interval of the index tree statistics, used by index-reverse = 'stats'"`
+	IndexStats           *indexstats.Stats     `toml:"-"                        json:"-"`
 	IndexTimeout         time.Duration         `toml:"index-timeout"            json:"index-timeout"            comment:"total timeout to fetch series list from index"`
 	TaggedTable          string                `toml:"tagged-table"             json:"tagged-table"             comment:"'tagged' table from carbon-clickhouse, required for seriesByTag"`
 	TagsCountTable       string                `toml:"tags-count-table"         json:"tags-count-table"         comment:"Table that contains the total amounts of each tag-value pair. It is used to avoid usage of high cardinality tag-value pairs when querying TaggedTable. If left empty, basic sorting will be used. See more detailed description in doc/config.md"`
@@ -260,6 +291,8 @@ type ClickHouse struct {
 	MaxDataPoints    int    `toml:"max-data-points"          json:"max-data-points"          comment:"max points per metric when internal-aggregation=true"`
 	// InternalAggregation controls if ClickHouse itself or graphite-clickhouse aggregates points to proper retention
 	InternalAggregation bool `toml:"internal-aggregation"     json:"internal-aggregation"     comment:"ClickHouse-side aggregation, see doc/aggregation.md"`
+	// SplitDataTables allows to read the time frame of the render request from several data tables
+	SplitDataTables bool `toml:"split-data-tables"        json:"split-data-tables"        comment:"read parts of the render request from several data tables split by max-age, see doc/config.md"`
 
 	TLSParams config.TLS  `toml:"tls"                      json:"tls"                      comment:"mTLS HTTPS configuration for connecting to clickhouse server"                                                                         commented:"true"`
 	TLSConfig *tls.Config `toml:"-"                        json:"-"`
@@ -309,6 +342,106 @@ type Prometheus struct {
 	PageTitle                  string        `toml:"page-title"                    json:"page-title"`
 	LookbackDelta              time.Duration `toml:"lookback-delta"                json:"lookback-delta"`
 	RemoteReadConcurrencyLimit int           `toml:"remote-read-concurrency-limit" json:"remote-read-concurrency-limit" comment:"concurrently handled remote read requests"`
+	QueryTimeout               time.Duration `toml:"query-timeout"                 json:"query-timeout"                 comment:"maximum time a PromQL query may take before being aborted"`
+	MaxSamples                 int           `toml:"max-samples"                   json:"max-samples"                   comment:"maximum number of samples a single PromQL query can load into memory"`
+	MaxConnections             int           `toml:"max-connections"               json:"max-connections"               comment:"maximum number of simultaneous connections to the listener"`
+	MaxConcurrentQueries       int           `toml:"max-concurrent-queries"        json:"max-concurrent-queries"        comment:"maximum number of PromQL queries executed concurrently, used with active-query-tracker-dir"`
+	ActiveQueryTrackerDir      string        `toml:"active-query-tracker-dir"      json:"active-query-tracker-dir"      comment:"directory for the active PromQL queries file, the queries are logged on the next start after a crash"`
+	QueryLogFile               string        `toml:"query-log-file"                json:"query-log-file"                comment:"file for JSON log of all PromQL queries"`
+	NativeHistograms           bool          `toml:"native-histograms"             json:"native-histograms"             comment:"reassemble classic histograms, stored as <name>_bucket series with le tag, into native histograms for <name> selectors"`
+	ExemplarTable              string        `toml:"exemplar-table"                json:"exemplar-table"                comment:"table with exemplars, enables exemplars API"`
+	RemoteWriteExemplars       bool          `toml:"remote-write-exemplars"        json:"remote-write-exemplars"        comment:"enables remote write receiver, which writes exemplars into exemplar-table and drops samples; without [auth] it has no authentication, so expose it only to a trusted network"`
+	RuleFiles                  []string      `toml:"rule-files"                    json:"rule-files"                    comment:"files with recording and alerting rules, globs are allowed"`
+	EvaluationInterval         time.Duration `toml:"evaluation-interval"           json:"evaluation-interval"           comment:"default interval of rule groups evaluation"`
+	RulesDataTable             string        `toml:"rules-data-table"              json:"rules-data-table"              comment:"table for points of recording rules, the first data table with prometheus context by default"`
+	RulesTaggedTable           string        `toml:"rules-tagged-table"            json:"rules-tagged-table"            comment:"table for series of recording rules, clickhouse.tagged-table by default"`
+	AlertmanagerURLs           []string      `toml:"alertmanager-urls"             json:"alertmanager-urls"             comment:"Alertmanager URLs for notifications of alerting rules"`
+	TrustedProxies             []string      `toml:"trusted-proxies"               json:"trusted-proxies"               comment:"addresses or CIDR networks of proxies, which are trusted to set X-Forwarded-User for user limits, when [auth] is not configured"`
+	trustedNets                []*net.IPNet
+
+	Mapping []PlainMapping `toml:"mapping" json:"mapping" comment:"rules to expose plain metrics as labelled series, the first matched rule is applied"`
+
+	TLSParams config.TLS        `toml:"tls" json:"tls" comment:"HTTPS configuration for prometheus listener, see [common.tls]" commented:"true"`
+	TLS       *tlsserver.Server `toml:"-"   json:"-"`
+}
+
+// IsTrustedProxy checks if the request from remoteAddr (host:port) comes from the trusted proxy
+func (p *Prometheus) IsTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range p.trustedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Prometheus) parseTrustedProxies() error {
+	for _, s := range p.TrustedProxies {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("invalid prometheus.trusted-proxies value %q", s)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			p.trustedNets = append(p.trustedNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid prometheus.trusted-proxies value %q", s)
+		}
+
+		p.trustedNets = append(p.trustedNets, n)
+	}
+
+	return nil
+}
+
+// PlainMapping is a graphite_exporter style rule, which exposes plain metrics as labelled series in Prometheus API
+type PlainMapping struct {
+	Match  string            `toml:"match"  json:"match"  comment:"glob for plain metrics, * matches a node or its part"`
+	Name   string            `toml:"name"   json:"name"   comment:"metric name, $n is replaced with the part matched by n-th *"`
+	Labels map[string]string `toml:"labels" json:"labels" comment:"labels, $n in values is replaced with the part matched by n-th *"`
+	Regexp *regexp.Regexp    `toml:"-"      json:"-"`
+}
+
+// compile builds Regexp with a group per * of Match
+func (m *PlainMapping) compile() error {
+	if m.Match == "" || m.Name == "" {
+		return fmt.Errorf("match and name are required for prometheus.mapping")
+	}
+
+	if strings.ContainsAny(m.Match, "?[]{}") {
+		return fmt.Errorf("only * wildcard is allowed in prometheus.mapping match %q", m.Match)
+	}
+
+	parts := strings.Split(m.Match, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+
+	var err error
+	m.Regexp, err = regexp.Compile("^" + strings.Join(parts, "([^.]*)") + "$")
+
+	return err
 }
 
 const (
@@ -341,6 +474,8 @@ type DataTable struct {
 	RollupDefaultPrecision uint32                `toml:"rollup-default-precision" json:"rollup-default-precision" comment:"is used when none of rules match"`
 	RollupDefaultFunction  string                `toml:"rollup-default-function"  json:"rollup-default-function"  comment:"is used when none of rules match"`
 	RollupUseReverted      bool                  `toml:"rollup-use-reverted"      json:"rollup-use-reverted"      comment:"should be set to true if you don't have reverted regexps in rollup-conf for reversed tables"`
+	Precision              time.Duration         `toml:"precision"                json:"precision"                comment:"native precision of the pre-aggregated table, it's used instead of the raw one for requests with the rollup step at least the precision"`
+	Aggregates             map[string]string     `toml:"aggregates"               json:"aggregates"               comment:"columns of the pre-aggregated table by the function: min, max, sum, count, any, anyLast"`
 	Context                []string              `toml:"context"                  json:"context"                  comment:"valid values are 'graphite' of 'prometheus'"`
 	ContextMap             map[string]bool       `toml:"-"                        json:"-"`
 	Rollup                 *rollup.Rollup        `toml:"-"                        json:"rollup-conf"`
@@ -354,6 +489,9 @@ type Debug struct {
 	// If ExternalDataPerm > 0 and X-Gch-Debug-Ext-Data HTTP header is set, the external data used in the query
 	// will be saved in the DebugDir directory
 	ExternalDataPerm os.FileMode `toml:"external-data-perm" json:"external-data-perm" comment:"permissions for directory, octal value is set as 0o640"`
+	// If RecordPerm > 0 and X-Gch-Debug-Record HTTP header is set, the request, ClickHouse queries and responses
+	// will be saved in the DebugDir directory
+	RecordPerm os.FileMode `toml:"record-perm" json:"record-perm" comment:"permissions for request recordings, octal value is set as 0o640"`
 }
 
 // Config is the daemon configuration
@@ -366,6 +504,8 @@ type Config struct {
 	Tags         Tags               `toml:"tags"          json:"tags"       comment:"is not recommended to use, https://github.com/lomik/graphite-clickhouse/wiki/TagsRU" commented:"true"`
 	Carbonlink   Carbonlink         `toml:"carbonlink"    json:"carbonlink"`
 	Prometheus   Prometheus         `toml:"prometheus"    json:"prometheus"`
+	Tenancy      Tenancy            `toml:"tenancy"       json:"tenancy"    comment:"per-tenant namespace isolation, see doc/config.md"`
+	Auth         Auth               `toml:"auth"          json:"auth"       comment:"HTTP endpoints authentication and metrics ACL, see doc/config.md"`
 	Debug        Debug              `toml:"debug"         json:"debug"      comment:"see doc/debugging.md"`
 	Logging      []zapwriter.Config `toml:"logging"       json:"logging"`
 }
@@ -389,8 +529,11 @@ func New() *Config {
 				ShortTimeoutSec:   0,
 				FindTimeoutSec:    0,
 			},
-			DegragedMultiply: 4.0,
-			DegragedLoad:     1.0,
+			DegragedMultiply:  4.0,
+			DegragedLoad:      1.0,
+			TLSReloadInterval: time.Minute,
+			ShutdownDelay:     0,
+			ShutdownTimeout:   time.Minute,
 		},
 		ClickHouse: ClickHouse{
 			URL:                     "http://localhost:8123?cancel_http_readonly_queries_on_client_close=1",
@@ -401,6 +544,7 @@ func New() *Config {
 			TaggedUseDaily:          true,
 			IndexReverse:            "auto",
 			IndexReverses:           IndexReverses{},
+			IndexStatsInterval:      10 * time.Minute,
 			IndexTimeout:            time.Minute,
 			TaggedTable:             "graphite_tagged",
 			TaggedAutocompleDays:    7,
@@ -430,11 +574,25 @@ func New() *Config {
 			Listen:                     ":9092",
 			LookbackDelta:              5 * time.Minute,
 			RemoteReadConcurrencyLimit: 10,
+			QueryTimeout:               time.Minute,
+			MaxSamples:                 50000000,
+			MaxConnections:             500,
+			MaxConcurrentQueries:       20,
+			EvaluationInterval:         time.Minute,
+		},
+		Tenancy: Tenancy{
+			Tag:      "tenant",
+			Required: true,
+		},
+		Auth: Auth{
+			JWTUserClaim:  "sub",
+			JWTRolesClaim: "roles",
 		},
 		Debug: Debug{
 			Directory:        "",
 			DirectoryPerm:    0755,
 			ExternalDataPerm: 0,
+			RecordPerm:       0,
 		},
 		Logging: nil,
 	}
@@ -569,6 +727,13 @@ func Unmarshal(body []byte, exactConfig bool) (cfg *Config, warns []zap.Field, e
 		if err != nil {
 			return nil, nil, err
 		}
+
+		// give load balancers time to notice the unregistered instance
+		if cfg.Common.SD != "" {
+			if tree, err := toml.LoadBytes(body); err == nil && !tree.Has("common.shutdown-delay") {
+				cfg.Common.ShutdownDelay = 10 * time.Second
+			}
+		}
 	}
 
 	if cfg.Logging == nil {
@@ -599,6 +764,32 @@ func Unmarshal(body []byte, exactConfig bool) (cfg *Config, warns []zap.Field, e
 		warns = append(warns, zap.Strings("tls-config", warnings))
 	}
 
+	if !reflect.DeepEqual(cfg.Common.TLSParams, config.TLS{}) {
+		var warnings []string
+
+		cfg.Common.TLS, warnings, err = tlsserver.New(&cfg.Common.TLSParams)
+		if err != nil {
+			return nil, nil, fmt.Errorf("common.tls: %w", err)
+		}
+
+		if len(warnings) > 0 {
+			warns = append(warns, zap.Strings("common-tls-config", warnings))
+		}
+	}
+
+	if !reflect.DeepEqual(cfg.Prometheus.TLSParams, config.TLS{}) {
+		var warnings []string
+
+		cfg.Prometheus.TLS, warnings, err = tlsserver.New(&cfg.Prometheus.TLSParams)
+		if err != nil {
+			return nil, nil, fmt.Errorf("prometheus.tls: %w", err)
+		}
+
+		if len(warnings) > 0 {
+			warns = append(warns, zap.Strings("prometheus-tls-config", warnings))
+		}
+	}
+
 	for i := range cfg.ClickHouse.QueryParams {
 		if cfg.ClickHouse.QueryParams[i].ConcurrentQueries > cfg.ClickHouse.QueryParams[i].MaxQueries && cfg.ClickHouse.QueryParams[i].MaxQueries > 0 {
 			cfg.ClickHouse.QueryParams[i].ConcurrentQueries = 0
@@ -665,6 +856,14 @@ func Unmarshal(body []byte, exactConfig bool) (cfg *Config, warns []zap.Field, e
 		return nil, nil, err
 	}
 
+	if cfg.ClickHouse.IndexTable != "" && cfg.ClickHouse.useIndexStats() {
+		if cfg.ClickHouse.IndexStatsInterval <= 0 {
+			return nil, nil, fmt.Errorf("index-stats-interval must be positive")
+		}
+
+		cfg.ClickHouse.IndexStats = indexstats.NewAuto(cfg.ClickHouse.URL, cfg.ClickHouse.TLSConfig, cfg.ClickHouse.IndexTable, cfg.ClickHouse.IndexStatsInterval)
+	}
+
 	if cfg.Common.FindCache, err = CreateCache("index", &cfg.Common.FindCacheConfig); err == nil {
 		if cfg.Common.FindCacheConfig.Type != "null" {
 			warns = append(warns, zap.Any("enable find cache", zap.String("type", cfg.Common.FindCacheConfig.Type)))
@@ -691,6 +890,14 @@ func Unmarshal(body []byte, exactConfig bool) (cfg *Config, warns []zap.Field, e
 		return nil, nil, err
 	}
 
+	if err = cfg.Tenancy.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	if err = cfg.Auth.validate(); err != nil {
+		return nil, nil, err
+	}
+
 	// compute prometheus external url
 	rawURL := cfg.Prometheus.ExternalURLRaw
 	if rawURL == "" {
@@ -714,6 +921,24 @@ func Unmarshal(body []byte, exactConfig bool) (cfg *Config, warns []zap.Field, e
 
 	cfg.Prometheus.ExternalURL.Path = strings.TrimRight(cfg.Prometheus.ExternalURL.Path, "/")
 
+	if err = cfg.Prometheus.parseTrustedProxies(); err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.Prometheus.RemoteWriteExemplars && cfg.Prometheus.ExemplarTable == "" {
+		return nil, nil, fmt.Errorf("prometheus.exemplar-table must be set for remote-write-exemplars")
+	}
+
+	if err = cfg.processPrometheusRules(); err != nil {
+		return nil, nil, err
+	}
+
+	for i := range cfg.Prometheus.Mapping {
+		if err = cfg.Prometheus.Mapping[i].compile(); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	checkDeprecations(cfg, deprecations)
 
 	if len(deprecations) != 0 {
@@ -821,6 +1046,51 @@ func (c *Config) NeedLoadAvgColect() bool {
 	return false
 }
 
+// PreAggregatedFunctions are the allowed keys of DataTable.Aggregates
+var PreAggregatedFunctions = map[string]bool{
+	"min":     true,
+	"max":     true,
+	"sum":     true,
+	"count":   true,
+	"any":     true,
+	"anyLast": true,
+}
+
+// IsPreAggregated returns true for tables, which store the aggregates of points per precision
+func (dt *DataTable) IsPreAggregated() bool {
+	return dt.Precision != 0
+}
+
+func (dt *DataTable) checkAggregates(internalAggregation bool) error {
+	if !dt.IsPreAggregated() && len(dt.Aggregates) == 0 {
+		return nil
+	}
+
+	if dt.Precision < time.Second || dt.Precision%time.Second != 0 {
+		return fmt.Errorf("data-table %q: precision must be a positive number of seconds", dt.Table)
+	}
+
+	if len(dt.Aggregates) == 0 {
+		return fmt.Errorf("data-table %q: aggregates must be set for the pre-aggregated table", dt.Table)
+	}
+
+	if !internalAggregation {
+		return fmt.Errorf("data-table %q: pre-aggregated tables require clickhouse.internal-aggregation", dt.Table)
+	}
+
+	for f, column := range dt.Aggregates {
+		if !PreAggregatedFunctions[f] {
+			return fmt.Errorf("data-table %q: unknown aggregate %q (allowed are min, max, sum, count, any, anyLast)", dt.Table, f)
+		}
+
+		if column == "" {
+			return fmt.Errorf("data-table %q: empty column for aggregate %q", dt.Table, f)
+		}
+	}
+
+	return nil
+}
+
 // ProcessDataTables checks if legacy `data`-table config is used, compiles regexps for `target-match-any` and `target-match-all`
 // parameters, sets the rollup configuration and proper context.
 func (c *Config) ProcessDataTables() (err error) {
@@ -883,6 +1153,10 @@ func (c *Config) ProcessDataTables() (err error) {
 			return err
 		}
 
+		if err := c.DataTable[i].checkAggregates(c.ClickHouse.InternalAggregation); err != nil {
+			return err
+		}
+
 		if len(c.DataTable[i].Context) == 0 {
 			c.DataTable[i].ContextMap = knownDataTableContext
 		} else {
@@ -900,6 +1174,47 @@ func (c *Config) ProcessDataTables() (err error) {
 	return nil
 }
 
+// processPrometheusRules sets default tables for recording rules and checks Alertmanager URLs
+func (c *Config) processPrometheusRules() error {
+	if len(c.Prometheus.RuleFiles) == 0 {
+		return nil
+	}
+
+	if c.Prometheus.RulesTaggedTable == "" {
+		c.Prometheus.RulesTaggedTable = c.ClickHouse.TaggedTable
+	}
+
+	if c.Prometheus.RulesDataTable == "" {
+		for i := range c.DataTable {
+			if c.DataTable[i].ContextMap[ContextPrometheus] {
+				c.Prometheus.RulesDataTable = c.DataTable[i].Table
+				break
+			}
+		}
+	}
+
+	if c.Prometheus.RulesDataTable == "" || c.Prometheus.RulesTaggedTable == "" {
+		return fmt.Errorf("prometheus.rules-data-table and prometheus.rules-tagged-table must be set for rule-files")
+	}
+
+	if c.Prometheus.EvaluationInterval <= 0 {
+		return fmt.Errorf("prometheus.evaluation-interval must be positive")
+	}
+
+	for _, rawURL := range c.Prometheus.AlertmanagerURLs {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return err
+		}
+
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid prometheus.alertmanager-urls value %q", rawURL)
+		}
+	}
+
+	return nil
+}
+
 func checkDeprecations(cfg *Config, d map[string]error) {
 	if cfg.ClickHouse.DataTableLegacy != "" {
 		d["data-table"] = fmt.Errorf("data-table parameter in [clickhouse] is deprecated; use [[data-table]]")
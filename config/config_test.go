@@ -225,6 +225,55 @@ func TestProcessDataTables(t *testing.T) {
 	}
 }
 
+func TestProcessDataTablesPreAggregated(t *testing.T) {
+	tests := []struct {
+		name  string
+		table DataTable
+		err   string
+	}{
+		{
+			name:  "valid",
+			table: DataTable{Table: "graphite_1h", Precision: time.Hour, Aggregates: map[string]string{"sum": "Sum", "count": "Count"}},
+		},
+		{
+			name:  "no aggregates",
+			table: DataTable{Table: "graphite_1h", Precision: time.Hour},
+			err:   `data-table "graphite_1h": aggregates must be set for the pre-aggregated table`,
+		},
+		{
+			name:  "no precision",
+			table: DataTable{Table: "graphite_1h", Aggregates: map[string]string{"sum": "Sum"}},
+			err:   `data-table "graphite_1h": precision must be a positive number of seconds`,
+		},
+		{
+			name:  "unknown aggregate",
+			table: DataTable{Table: "graphite_1h", Precision: time.Hour, Aggregates: map[string]string{"avg": "Avg"}},
+			err:   `data-table "graphite_1h": unknown aggregate "avg" (allowed are min, max, sum, count, any, anyLast)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := New()
+			tt.table.RollupConf = "none"
+			cfg.DataTable = []DataTable{tt.table}
+
+			err := cfg.ProcessDataTables()
+			if tt.err == "" {
+				assert.NoError(t, err)
+				assert.True(t, cfg.DataTable[0].IsPreAggregated())
+			} else {
+				assert.EqualError(t, err, tt.err)
+			}
+		})
+	}
+
+	cfg := New()
+	cfg.ClickHouse.InternalAggregation = false
+	cfg.DataTable = []DataTable{{Table: "graphite_1h", RollupConf: "none", Precision: time.Hour, Aggregates: map[string]string{"max": "Max"}}}
+	assert.EqualError(t, cfg.ProcessDataTables(), `data-table "graphite_1h": pre-aggregated tables require clickhouse.internal-aggregation`)
+}
+
 func TestKnownDataTableContext(t *testing.T) {
 	assert.Equal(t, map[string]bool{ContextGraphite: true, ContextPrometheus: true}, knownDataTableContext)
 }
@@ -346,8 +395,11 @@ sample-thereafter = 12
 			DefaultTimeoutSec: 0,
 			ShortTimeoutSec:   0,
 		},
-		DegragedMultiply: 4.0,
-		DegragedLoad:     1.0,
+		DegragedMultiply:  4.0,
+		DegragedLoad:      1.0,
+		TLSReloadInterval: time.Minute,
+		ShutdownDelay:     0,
+		ShutdownTimeout:   time.Minute,
 	}
 	expected.Metrics = metrics.Config{}
 
@@ -374,6 +426,7 @@ sample-thereafter = 12
 		IndexTable:              "graphite_index",
 		IndexReverse:            "direct",
 		IndexReverses:           make(IndexReverses, 2),
+		IndexStatsInterval:      10 * time.Minute,
 		IndexTimeout:            4000000000,
 		TaggedTable:             "graphite_tags",
 		TaggedAutocompleDays:    5,
@@ -404,13 +457,13 @@ sample-thereafter = 12
 	assert.Equal(t, expected.Carbonlink, config.Carbonlink)
 
 	// Prometheus
-	expected.Prometheus = Prometheus{Listen: ":9092", ExternalURLRaw: "https://server:3456/uri", PageTitle: "Prometheus Time Series", LookbackDelta: 5 * time.Minute, RemoteReadConcurrencyLimit: 10}
+	expected.Prometheus = Prometheus{Listen: ":9092", ExternalURLRaw: "https://server:3456/uri", PageTitle: "Prometheus Time Series", LookbackDelta: 5 * time.Minute, RemoteReadConcurrencyLimit: 10, QueryTimeout: time.Minute, MaxSamples: 50000000, MaxConnections: 500, MaxConcurrentQueries: 20, EvaluationInterval: time.Minute}
 	u, _ := url.Parse(expected.Prometheus.ExternalURLRaw)
 	expected.Prometheus.ExternalURL = u
 	assert.Equal(t, expected.Prometheus, config.Prometheus)
 
 	// Debug
-	expected.Debug = Debug{"tests_tmp", os.FileMode(0755), os.FileMode(0640)}
+	expected.Debug = Debug{"tests_tmp", os.FileMode(0755), os.FileMode(0640), os.FileMode(0)}
 	assert.Equal(t, expected.Debug, config.Debug)
 	assert.DirExists(t, "tests_tmp")
 
@@ -586,8 +639,11 @@ sample-thereafter = 12
 			DefaultTimeoutSec: 0,
 			ShortTimeoutSec:   0,
 		},
-		DegragedMultiply: 4.0,
-		DegragedLoad:     1.0,
+		DegragedMultiply:  4.0,
+		DegragedLoad:      1.0,
+		TLSReloadInterval: time.Minute,
+		ShutdownDelay:     0,
+		ShutdownTimeout:   time.Minute,
 	}
 	expected.Metrics = metrics.Config{
 		MetricEndpoint: "127.0.0.1:2003",
@@ -664,6 +720,7 @@ sample-thereafter = 12
 		IndexTable:           "graphite_index",
 		IndexReverse:         "direct",
 		IndexReverses:        make(IndexReverses, 2),
+		IndexStatsInterval:   10 * time.Minute,
 		IndexTimeout:         4000000000,
 		TaggedTable:          "graphite_tags",
 		TaggedAutocompleDays: 5,
@@ -716,13 +773,13 @@ sample-thereafter = 12
 	assert.Equal(t, expected.Carbonlink, config.Carbonlink)
 
 	// Prometheus
-	expected.Prometheus = Prometheus{Listen: ":9092", ExternalURLRaw: "https://server:3456/uri", PageTitle: "Prometheus Time Series", LookbackDelta: 5 * time.Minute, RemoteReadConcurrencyLimit: 10}
+	expected.Prometheus = Prometheus{Listen: ":9092", ExternalURLRaw: "https://server:3456/uri", PageTitle: "Prometheus Time Series", LookbackDelta: 5 * time.Minute, RemoteReadConcurrencyLimit: 10, QueryTimeout: time.Minute, MaxSamples: 50000000, MaxConnections: 500, MaxConcurrentQueries: 20, EvaluationInterval: time.Minute}
 	u, _ := url.Parse(expected.Prometheus.ExternalURLRaw)
 	expected.Prometheus.ExternalURL = u
 	assert.Equal(t, expected.Prometheus, config.Prometheus)
 
 	// Debug
-	expected.Debug = Debug{"tests_tmp", os.FileMode(0755), os.FileMode(0640)}
+	expected.Debug = Debug{"tests_tmp", os.FileMode(0755), os.FileMode(0640), os.FileMode(0)}
 	assert.Equal(t, expected.Debug, config.Debug)
 	assert.DirExists(t, "tests_tmp")
 
@@ -908,8 +965,11 @@ sample-thereafter = 12
 			DefaultTimeoutSec: 0,
 			ShortTimeoutSec:   0,
 		},
-		DegragedMultiply: 4.0,
-		DegragedLoad:     1.0,
+		DegragedMultiply:  4.0,
+		DegragedLoad:      1.0,
+		TLSReloadInterval: time.Minute,
+		ShutdownDelay:     0,
+		ShutdownTimeout:   time.Minute,
 	}
 	expected.Metrics = metrics.Config{
 		MetricEndpoint: "127.0.0.1:2003",
@@ -991,6 +1051,7 @@ sample-thereafter = 12
 		IndexTable:           "graphite_index",
 		IndexReverse:         "direct",
 		IndexReverses:        make(IndexReverses, 2),
+		IndexStatsInterval:   10 * time.Minute,
 		IndexTimeout:         4000000000,
 		TaggedTable:          "graphite_tags",
 		TaggedAutocompleDays: 5,
@@ -1043,13 +1104,13 @@ sample-thereafter = 12
 	assert.Equal(t, expected.Carbonlink, config.Carbonlink)
 
 	// Prometheus
-	expected.Prometheus = Prometheus{Listen: ":9092", ExternalURLRaw: "https://server:3456/uri", PageTitle: "Prometheus Time Series", LookbackDelta: 5 * time.Minute, RemoteReadConcurrencyLimit: 10}
+	expected.Prometheus = Prometheus{Listen: ":9092", ExternalURLRaw: "https://server:3456/uri", PageTitle: "Prometheus Time Series", LookbackDelta: 5 * time.Minute, RemoteReadConcurrencyLimit: 10, QueryTimeout: time.Minute, MaxSamples: 50000000, MaxConnections: 500, MaxConcurrentQueries: 20, EvaluationInterval: time.Minute}
 	u, _ := url.Parse(expected.Prometheus.ExternalURLRaw)
 	expected.Prometheus.ExternalURL = u
 	assert.Equal(t, expected.Prometheus, config.Prometheus)
 
 	// Debug
-	expected.Debug = Debug{"tests_tmp", os.FileMode(0755), os.FileMode(0640)}
+	expected.Debug = Debug{"tests_tmp", os.FileMode(0755), os.FileMode(0640), os.FileMode(0)}
 	assert.Equal(t, expected.Debug, config.Debug)
 	assert.DirExists(t, "tests_tmp")
 
@@ -1327,3 +1388,99 @@ func TestClickHouse_Validate(t *testing.T) {
 		})
 	}
 }
+
+func TestShutdownDelay(t *testing.T) {
+	config, _, err := Unmarshal([]byte("[common]\n"), false)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), config.Common.ShutdownDelay)
+
+	config, _, err = Unmarshal([]byte("[common]\nservice-discovery = \"localhost:8500\"\n"), false)
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, config.Common.ShutdownDelay)
+
+	config, _, err = Unmarshal([]byte("[common]\nservice-discovery = \"localhost:8500\"\nshutdown-delay = \"0s\"\n"), false)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), config.Common.ShutdownDelay)
+}
+
+func TestProcessPrometheusRules(t *testing.T) {
+	body := []byte(`
+[clickhouse]
+tagged-table = "graphite_tagged"
+
+[[data-table]]
+table = "graphite_data"
+context = ["graphite"]
+
+[[data-table]]
+table = "prometheus_data"
+context = ["prometheus"]
+
+[prometheus]
+rule-files = ["/etc/graphite-clickhouse/rules/*.yml"]
+alertmanager-urls = ["http://alertmanager:9093/prefix"]
+`)
+	config, _, err := Unmarshal(body, false)
+	require.NoError(t, err)
+	assert.Equal(t, "prometheus_data", config.Prometheus.RulesDataTable)
+	assert.Equal(t, "graphite_tagged", config.Prometheus.RulesTaggedTable)
+	assert.Equal(t, time.Minute, config.Prometheus.EvaluationInterval)
+
+	_, _, err = Unmarshal(append(body, []byte(`rules-data-table = "rules_data"`)...), false)
+	require.NoError(t, err)
+
+	body = []byte(`
+[[data-table]]
+table = "graphite_data"
+context = ["graphite"]
+
+[prometheus]
+rule-files = ["/etc/graphite-clickhouse/rules/*.yml"]
+`)
+	_, _, err = Unmarshal(body, false)
+	assert.EqualError(t, err, "prometheus.rules-data-table and prometheus.rules-tagged-table must be set for rule-files")
+
+	body = []byte(`
+[prometheus]
+rule-files = ["/etc/graphite-clickhouse/rules/*.yml"]
+rules-data-table = "rules_data"
+alertmanager-urls = ["alertmanager:9093"]
+`)
+	_, _, err = Unmarshal(body, false)
+	assert.EqualError(t, err, `invalid prometheus.alertmanager-urls value "alertmanager:9093"`)
+}
+
+func TestRemoteWriteExemplars(t *testing.T) {
+	_, _, err := Unmarshal([]byte("[prometheus]\nremote-write-exemplars = true\n"), false)
+	assert.EqualError(t, err, "prometheus.exemplar-table must be set for remote-write-exemplars")
+
+	config, _, err := Unmarshal([]byte("[prometheus]\nexemplar-table = \"graphite_exemplars\"\nremote-write-exemplars = true\n"), false)
+	require.NoError(t, err)
+	assert.True(t, config.Prometheus.RemoteWriteExemplars)
+}
+
+func TestPlainMapping(t *testing.T) {
+	body := []byte(`
+[[prometheus.mapping]]
+match = "servers.*.cpu.*"
+name = "cpu_usage"
+labels = { host = "$1", mode = "$2" }
+`)
+	config, _, err := Unmarshal(body, false)
+	require.NoError(t, err)
+	require.Len(t, config.Prometheus.Mapping, 1)
+	assert.Equal(t, `^servers\.([^.]*)\.cpu\.([^.]*)$`, config.Prometheus.Mapping[0].Regexp.String())
+
+	_, _, err = Unmarshal([]byte(`
+[[prometheus.mapping]]
+match = "servers.{a,b}.cpu"
+name = "cpu_usage"
+`), false)
+	assert.EqualError(t, err, `only * wildcard is allowed in prometheus.mapping match "servers.{a,b}.cpu"`)
+
+	_, _, err = Unmarshal([]byte(`
+[[prometheus.mapping]]
+match = "servers.*.cpu"
+`), false)
+	assert.EqualError(t, err, "match and name are required for prometheus.mapping")
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+var (
+	ErrTenantRequired = errors.New("tenant is required")
+	ErrTenantUnknown  = errors.New("unknown tenant")
+	ErrTenantDenied   = errors.New("tenant is not allowed for user")
+)
+
+// Tenant describes the namespace of a single tenant
+type Tenant struct {
+	Name     string   `toml:"-"         json:"-"`
+	Prefix   string   `toml:"prefix"    json:"prefix"    comment:"plain metrics prefix (w/o trailing dot), prepended to queries and stripped from the results"`
+	TagValue string   `toml:"tag-value" json:"tag-value" comment:"tenant tag value for tagged series, tenant name by default"`
+	Users    []string `toml:"users"     json:"users"     comment:"authenticated users of the tenant, the user with the tenant name belongs to it too"`
+}
+
+// HasUser checks if the authenticated user belongs to the tenant
+func (t *Tenant) HasUser(user string) bool {
+	if user == t.Name {
+		return true
+	}
+
+	for _, u := range t.Users {
+		if u == user {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Tenancy is the per-tenant namespace isolation config
+type Tenancy struct {
+	Header   string             `toml:"header"   json:"header"   comment:"request header with the tenant name, X-Forwarded-User is used if empty"`
+	Tag      string             `toml:"tag"      json:"tag"      comment:"tag name, added to seriesByTag and autocomplete queries"`
+	Required bool               `toml:"required" json:"required" comment:"reject requests without a known tenant, otherwise they aren't isolated"`
+	Tenants  map[string]*Tenant `toml:"tenants"  json:"tenants"  comment:"tenants by name"                                                         commented:"true"`
+
+	userTenants map[string]string // tenant of the authenticated user, if header is not set
+}
+
+// Enabled returns true if any tenant is configured
+func (t *Tenancy) Enabled() bool {
+	return len(t.Tenants) > 0
+}
+
+// Get returns tenant by name or nil
+func (t *Tenancy) Get(name string) *Tenant {
+	if name == "" || len(t.Tenants) == 0 {
+		return nil
+	}
+
+	return t.Tenants[name]
+}
+
+// Resolve returns the tenant name for the request. Empty name means no isolation for the request.
+// For the authenticated requests the tenant is bound to the user: the tenant from the header must have the user,
+// without the header the tenant of the user is used.
+func (t *Tenancy) Resolve(r *http.Request) (string, error) {
+	if len(t.Tenants) == 0 {
+		return "", nil
+	}
+
+	user := scope.User(r.Context())
+
+	var name string
+	if t.Header != "" {
+		name = r.Header.Get(t.Header)
+	} else if user != "" {
+		name = t.userTenants[user]
+	} else {
+		name = r.Header.Get("X-Forwarded-User")
+	}
+
+	if name == "" {
+		if t.Required {
+			return "", ErrTenantRequired
+		}
+
+		return "", nil
+	}
+
+	tenant, ok := t.Tenants[name]
+	if !ok {
+		if t.Required || t.Header != "" {
+			return "", fmt.Errorf("%w: %s", ErrTenantUnknown, name)
+		}
+
+		// not all users are tenants
+		return "", nil
+	}
+
+	if user != "" && !tenant.HasUser(user) {
+		return "", fmt.Errorf("%w: %s", ErrTenantDenied, name)
+	}
+
+	return name, nil
+}
+
+func (t *Tenancy) validate() error {
+	if len(t.Tenants) == 0 {
+		return nil
+	}
+
+	if t.Tag == "" {
+		return fmt.Errorf("tenancy tag not set")
+	}
+
+	for name, tenant := range t.Tenants {
+		if tenant == nil {
+			return fmt.Errorf("tenant %q is empty", name)
+		}
+
+		tenant.Name = name
+
+		if tenant.Prefix == "" {
+			return fmt.Errorf("tenant %q prefix not set", name)
+		}
+
+		if strings.HasPrefix(tenant.Prefix, ".") || strings.HasSuffix(tenant.Prefix, ".") ||
+			strings.ContainsAny(tenant.Prefix, "*?[]{}") {
+			return fmt.Errorf("tenant %q prefix %q is invalid", name, tenant.Prefix)
+		}
+
+		if tenant.TagValue == "" {
+			tenant.TagValue = name
+		}
+	}
+
+	if t.Header == "" {
+		t.userTenants = make(map[string]string)
+
+		for name, tenant := range t.Tenants {
+			for _, user := range append([]string{name}, tenant.Users...) {
+				if other, ok := t.userTenants[user]; ok && other != name {
+					return fmt.Errorf("user %q belongs to tenants %q and %q, tenancy header must be set to choose one", user, other, name)
+				}
+
+				t.userTenants[user] = name
+			}
+		}
+	}
+
+	return nil
+}
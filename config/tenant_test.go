@@ -0,0 +1,169 @@
+package config
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+func TestTenancy(t *testing.T) {
+	body := []byte(`
+[tenancy]
+header = "X-Scope-OrgID"
+required = true
+
+[tenancy.tenants.team_a]
+prefix = "teams.a"
+
+[tenancy.tenants.team_b]
+prefix = "teams.b"
+tag-value = "b"
+`)
+
+	cfg, _, err := Unmarshal(body, false)
+	require.NoError(t, err)
+
+	assert.Equal(t, "tenant", cfg.Tenancy.Tag)
+	assert.Equal(t, &Tenant{Name: "team_a", Prefix: "teams.a", TagValue: "team_a"}, cfg.Tenancy.Get("team_a"))
+	assert.Equal(t, &Tenant{Name: "team_b", Prefix: "teams.b", TagValue: "b"}, cfg.Tenancy.Get("team_b"))
+	assert.Nil(t, cfg.Tenancy.Get("team_c"))
+
+	tests := []struct {
+		header  string
+		want    string
+		wantErr error
+	}{
+		{header: "team_a", want: "team_a"},
+		{header: "", wantErr: ErrTenantRequired},
+		{header: "team_c", wantErr: ErrTenantUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/render/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Scope-OrgID", tt.header)
+			}
+
+			got, err := cfg.Tenancy.Resolve(r)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTenancyDefaults(t *testing.T) {
+	body := []byte(`
+[tenancy.tenants.team_a]
+prefix = "teams.a"
+`)
+
+	cfg, _, err := Unmarshal(body, false)
+	require.NoError(t, err)
+
+	// unknown users fail closed
+	r, _ := http.NewRequest(http.MethodGet, "/render/", nil)
+	r.Header.Set("X-Forwarded-User", "bob")
+	_, err = cfg.Tenancy.Resolve(r)
+	assert.ErrorIs(t, err, ErrTenantUnknown)
+
+	r.Header.Del("X-Forwarded-User")
+	_, err = cfg.Tenancy.Resolve(r)
+	assert.ErrorIs(t, err, ErrTenantRequired)
+
+	cfg.Tenancy.Required = false
+	got, err := cfg.Tenancy.Resolve(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "", got)
+}
+
+func TestTenancyAuthenticated(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		user    string
+		tenant  string
+		want    string
+		wantErr error
+	}{
+		{name: "tenant name", user: "team_a", want: "team_a"},
+		{name: "tenant users", user: "alice", want: "team_b"},
+		{name: "unknown user", user: "bob", wantErr: ErrTenantRequired},
+		{name: "header", header: "X-Scope-OrgID", user: "alice", tenant: "team_b", want: "team_b"},
+		{name: "header denied", header: "X-Scope-OrgID", user: "alice", tenant: "team_a", wantErr: ErrTenantDenied},
+		{name: "header unknown", header: "X-Scope-OrgID", user: "alice", tenant: "team_c", wantErr: ErrTenantUnknown},
+		{name: "header required", header: "X-Scope-OrgID", user: "alice", wantErr: ErrTenantRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := []byte(`
+[tenancy]
+header = "` + tt.header + `"
+
+[tenancy.tenants.team_a]
+prefix = "teams.a"
+
+[tenancy.tenants.team_b]
+prefix = "teams.b"
+users = ["alice"]
+`)
+
+			cfg, _, err := Unmarshal(body, false)
+			require.NoError(t, err)
+
+			r, _ := http.NewRequest(http.MethodGet, "/render/", nil)
+			r = r.WithContext(scope.WithUser(r.Context(), tt.user))
+			// the authentication replaces X-Forwarded-User
+			r.Header.Set("X-Forwarded-User", tt.user)
+
+			if tt.tenant != "" {
+				r.Header.Set(tt.header, tt.tenant)
+			}
+
+			got, err := cfg.Tenancy.Resolve(r)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTenancyAmbiguousUser(t *testing.T) {
+	body := []byte(`
+[tenancy.tenants.team_a]
+prefix = "teams.a"
+users = ["alice"]
+
+[tenancy.tenants.team_b]
+prefix = "teams.b"
+users = ["alice"]
+`)
+
+	_, _, err := Unmarshal(body, false)
+	assert.ErrorContains(t, err, `user "alice" belongs to tenants`)
+
+	_, _, err = Unmarshal(append([]byte("[tenancy]\nheader = \"X-Scope-OrgID\"\n"), body...), false)
+	assert.NoError(t, err)
+}
+
+func TestTenancyInvalidPrefix(t *testing.T) {
+	for _, prefix := range []string{"", "teams.", ".teams", "teams.*"} {
+		body := []byte("[tenancy.tenants.team_a]\nprefix = \"" + prefix + "\"\n")
+		_, _, err := Unmarshal(body, false)
+		assert.Error(t, err, prefix)
+	}
+}
@@ -19,17 +19,26 @@ type Find struct {
 	context context.Context
 	query   string // original query
 	result  finder.Result
+	rows    [][]byte // sorted results of the page
 }
 
-func NewCached(config *config.Config, body []byte) *Find {
+func NewCached(config *config.Config, ctx context.Context, body []byte, page finder.Page) *Find {
+	result := finder.NewCachedIndex(body)
+	if tenant := finder.Tenant(ctx, config); tenant != nil {
+		// cached body contains the full metric names
+		result = finder.WrapTenant(result, tenant.Prefix)
+	}
+
 	return &Find{
-		config: config,
-		result: finder.NewCachedIndex(body),
+		config:  config,
+		context: ctx,
+		result:  result,
+		rows:    page.Apply(result.List()),
 	}
 }
 
-func New(config *config.Config, ctx context.Context, query string) (*Find, error) {
-	res, err := finder.Find(config, ctx, query, 0, 0)
+func New(config *config.Config, ctx context.Context, query string, page finder.Page) (*Find, error) {
+	res, err := finder.FindPage(config, ctx, query, 0, 0, page)
 	if err != nil {
 		return nil, err
 	}
@@ -39,6 +48,7 @@ func New(config *config.Config, ctx context.Context, query string) (*Find, error
 		config:  config,
 		context: ctx,
 		result:  res,
+		rows:    page.Apply(res.List()),
 	}, nil
 }
 
@@ -47,8 +57,17 @@ func (f *Find) isResultsLimitExceeded(numResults int) bool {
 		numResults >= f.config.Common.MaxMetricsInFindAnswer
 }
 
+// truncated returns count of the results, skipped due to max-metrics-in-find-answer
+func (f *Find) truncated() int {
+	if f.config.Common.MaxMetricsInFindAnswer == 0 || len(f.rows) <= f.config.Common.MaxMetricsInFindAnswer {
+		return 0
+	}
+
+	return len(f.rows) - f.config.Common.MaxMetricsInFindAnswer
+}
+
 func (f *Find) WritePickle(w io.Writer) error {
-	rows := f.result.List()
+	rows := f.rows
 
 	if len(rows) == 0 { // empty
 		w.Write(pickle.EmptyList)
@@ -92,7 +111,7 @@ func (f *Find) WritePickle(w io.Writer) error {
 }
 
 func (f *Find) WriteProtobuf(w io.Writer) error {
-	rows := f.result.List()
+	rows := f.rows
 
 	if len(rows) == 0 { // empty
 		return nil
@@ -142,7 +161,7 @@ func (f *Find) WriteProtobuf(w io.Writer) error {
 }
 
 func (f *Find) WriteProtobufV3(w io.Writer) error {
-	rows := f.result.List()
+	rows := f.rows
 
 	if len(rows) == 0 { // empty
 		return nil
@@ -198,7 +217,7 @@ func (f *Find) WriteProtobufV3(w io.Writer) error {
 }
 
 func (f *Find) WriteJSON(w io.Writer) error {
-	rows := f.result.List()
+	rows := f.rows
 
 	if len(rows) == 0 { // empty
 		return nil
@@ -11,7 +11,9 @@ import (
 	"github.com/go-graphite/carbonapi/pkg/parser"
 	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
 	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/headers"
 	"github.com/lomik/graphite-clickhouse/helper/utils"
 	"github.com/lomik/graphite-clickhouse/logs"
 	"github.com/lomik/graphite-clickhouse/metrics"
@@ -131,12 +133,20 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	page, err := parsePage(r)
+	if err != nil {
+		status = http.StatusBadRequest
+		http.Error(w, fmt.Sprintf("Failed to parse request: %v", err), status)
+
+		return
+	}
+
 	var key string
 	// params := []string{query}
 	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache"))
 	if useCache {
 		ts := utils.TimestampTruncate(time.Now().Unix(), time.Duration(h.config.Common.FindCacheConfig.FindTimeoutSec)*time.Second)
-		key = "1970-02-12;query=" + query + ";ts=" + strconv.FormatInt(ts, 10)
+		key = "1970-02-12;query=" + query + ";ts=" + strconv.FormatInt(ts, 10) + page.CacheKey() + scope.CacheKey(r.Context())
 
 		body, err := h.config.Common.FindCache.Get(key)
 		if err == nil {
@@ -147,8 +157,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			findCache = true
 
 			w.Header().Set("X-Cached-Find", strconv.Itoa(int(h.config.Common.FindCacheConfig.FindTimeoutSec)))
-			f := NewCached(h.config, body)
-			metricsCount = int64(len(f.result.List()))
+			f := NewCached(h.config, r.Context(), body, page)
+			metricsCount = int64(len(f.rows))
 			logger.Info("finder", zap.String("get_cache", key),
 				zap.Int64("metrics", metricsCount), zap.Bool("find_cached", true),
 				zap.Int32("ttl", h.config.Common.FindCacheConfig.FindTimeoutSec))
@@ -194,7 +204,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}()
 	}
 
-	f, err := New(h.config, r.Context(), query)
+	f, err := New(h.config, r.Context(), query, page)
 
 	if entered {
 		// release early as possible
@@ -221,13 +231,52 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	metricsCount = int64(len(f.result.List()))
+	metricsCount = int64(len(f.rows))
 	status = h.Reply(w, r, f)
 }
 
+// parsePage reads limit, offset and filter parameters of the request
+func parsePage(r *http.Request) (finder.Page, error) {
+	var (
+		page finder.Page
+		err  error
+	)
+
+	if v := r.FormValue("limit"); v != "" {
+		if page.Limit, err = strconv.Atoi(v); err != nil || page.Limit < 0 {
+			return page, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+
+	if v := r.FormValue("offset"); v != "" {
+		if page.Offset, err = strconv.Atoi(v); err != nil || page.Offset < 0 {
+			return page, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+
+	switch page.Filter = r.FormValue("filter"); page.Filter {
+	case "", finder.PageLeaves, finder.PageBranches:
+	default:
+		return page, fmt.Errorf("invalid filter %q, allowed are %s and %s", page.Filter, finder.PageLeaves, finder.PageBranches)
+	}
+
+	return page, nil
+}
+
 func (h *Handler) Reply(w http.ResponseWriter, r *http.Request, f *Find) (status int) {
 	status = http.StatusOK
 
+	if h.config.Common.PartialResponse {
+		if truncated := f.truncated(); truncated > 0 {
+			warning := fmt.Sprintf("metrics limit exceeded: %d metrics are skipped, limit is %d", truncated, h.config.Common.MaxMetricsInFindAnswer)
+			scope.Logger(r.Context()).Warn("partial response", zap.Int("truncated", truncated), zap.Int("limit", h.config.Common.MaxMetricsInFindAnswer))
+
+			metrics.FindRequestMetric.Truncated.Add(1)
+
+			w.Header().Set(headers.PartialResponse, warning)
+		}
+	}
+
 	switch r.FormValue("format") {
 	case "json":
 		f.WriteJSON(w)
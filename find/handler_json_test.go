@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/headers"
 	"github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
 	"github.com/lomik/graphite-clickhouse/metrics"
 	"github.com/stretchr/testify/assert"
@@ -171,3 +172,157 @@ func TestHandler_ServeValuesCachedJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_ServeValuesJSON_FakeServer(t *testing.T) {
+	metrics.DisableMetrics()
+
+	srv := clickhouse.NewFakeServer()
+	defer srv.Close()
+
+	err := srv.AddIndex("graphite_index", time.Now(),
+		"DB.mysql.host1.cpu.load_avg",
+		"DB.postgres.host1.cpu.load_avg",
+		"DB.postgres.host2.cpu.load_avg",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL
+
+	h := NewHandler(cfg)
+
+	tests := []testStruct{
+		{
+			request:     NewRequest("GET", srv.URL+"/metrics/find/?format=json&query=DB.postgres.%2A", nil),
+			wantCode:    http.StatusOK,
+			want:        "[{path=\"DB.postgres.host1\"},{path=\"DB.postgres.host2\"}]\r\n",
+			wantContent: "text/plain; charset=utf-8",
+		},
+		{
+			request:     NewRequest("GET", srv.URL+"/metrics/find/?format=json&query=DB.%2A.host1.cpu.load_avg", nil),
+			wantCode:    http.StatusOK,
+			want:        "[{path=\"DB.mysql.host1.cpu.load_avg\",leaf=1},{path=\"DB.postgres.host1.cpu.load_avg\",leaf=1}]\r\n",
+			wantContent: "text/plain; charset=utf-8",
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.request.URL.RawQuery+"#"+strconv.Itoa(i), func(t *testing.T) {
+			testResponce(t, 0, h, &tt, "")
+		})
+	}
+}
+
+func TestHandler_PartialResponse_FakeServer(t *testing.T) {
+	metrics.DisableMetrics()
+
+	srv := clickhouse.NewFakeServer()
+	defer srv.Close()
+
+	err := srv.AddIndex("graphite_index", time.Now(),
+		"DB.postgres.host1.cpu.load_avg",
+		"DB.postgres.host2.cpu.load_avg",
+		"DB.postgres.host3.cpu.load_avg",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.Common.MaxMetricsInFindAnswer = 2
+	cfg.Common.PartialResponse = true
+
+	h := NewHandler(cfg)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, NewRequest("GET", srv.URL+"/metrics/find/?format=json&query=DB.postgres.%2A", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "metrics limit exceeded: 1 metrics are skipped, limit is 2", w.Header().Get(headers.PartialResponse))
+	assert.Equal(t, "[{path=\"DB.postgres.host1\"},{path=\"DB.postgres.host2\"}]\r\n", w.Body.String())
+}
+
+func TestHandler_Page_FakeServer(t *testing.T) {
+	metrics.DisableMetrics()
+
+	srv := clickhouse.NewFakeServer()
+	defer srv.Close()
+
+	err := srv.AddIndex("graphite_index", time.Now(),
+		"DB.postgres.host3.cpu",
+		"DB.postgres.host1.cpu",
+		"DB.postgres.host2.cpu",
+		"DB.postgres.uptime",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL
+
+	h := NewHandler(cfg)
+
+	tests := []struct {
+		params    string
+		wantCode  int
+		want      string
+		wantQuery string
+	}{
+		{
+			params: "",
+			want:   "[{path=\"DB.postgres.host1\"},{path=\"DB.postgres.host2\"},{path=\"DB.postgres.host3\"},{path=\"DB.postgres.uptime\",leaf=1}]\r\n",
+		},
+		{
+			params:    "&limit=2&offset=1",
+			want:      "[{path=\"DB.postgres.host2\"},{path=\"DB.postgres.host3\"}]\r\n",
+			wantQuery: "SELECT Path FROM graphite_index WHERE ((Level=20003) AND (Path LIKE 'DB.postgres.%')) AND (Date='1970-02-12') GROUP BY Path ORDER BY Path LIMIT 3 FORMAT TabSeparatedRaw",
+		},
+		{
+			params:    "&filter=branches&offset=2",
+			want:      "[{path=\"DB.postgres.host3\"}]\r\n",
+			wantQuery: "SELECT Path FROM graphite_index WHERE (((Level=20003) AND (Path LIKE 'DB.postgres.%')) AND (Date='1970-02-12')) AND (Path LIKE '%.') GROUP BY Path FORMAT TabSeparatedRaw",
+		},
+		{
+			params: "&filter=leaves&limit=10",
+			want:   "[{path=\"DB.postgres.uptime\",leaf=1}]\r\n",
+		},
+		{
+			params: "&limit=2&offset=10",
+			want:   "",
+		},
+		{
+			params:   "&limit=-1",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			params:   "&filter=nodes",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.params, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, NewRequest("GET", srv.URL+"/metrics/find/?format=json&query=DB.postgres.%2A"+tt.params, nil))
+
+			if tt.wantCode == 0 {
+				tt.wantCode = http.StatusOK
+			}
+
+			assert.Equal(t, tt.wantCode, w.Code, w.Body.String())
+
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, tt.want, w.Body.String())
+			}
+
+			if tt.wantQuery != "" {
+				queries := srv.Queries()
+				assert.Equal(t, tt.wantQuery, queries[len(queries)-1])
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package finder
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/msaf1980/go-stringutils"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// ACL is the merged access list for the request roles
+type ACL struct {
+	prefixes  [][]byte
+	tagValues map[string]bool // tag=value, tag=* and * for all
+}
+
+// NewACL returns merged access list for roles. Unknown roles grant nothing
+func NewACL(auth *config.Auth, roles []string) *ACL {
+	acl := &ACL{tagValues: make(map[string]bool)}
+
+	for _, name := range roles {
+		role, ok := auth.Roles[name]
+		if !ok {
+			continue
+		}
+
+		for _, p := range role.MetricPrefixes {
+			acl.prefixes = append(acl.prefixes, []byte(p))
+		}
+
+		for _, tv := range role.TagValues {
+			acl.tagValues[tv] = true
+		}
+	}
+
+	return acl
+}
+
+// RequestACL returns the access list for the authenticated request or nil, if metrics are not restricted
+func RequestACL(ctx context.Context, config *config.Config) *ACL {
+	if !config.Auth.Restricted() || scope.User(ctx) == "" {
+		return nil
+	}
+
+	return NewACL(&config.Auth, scope.Roles(ctx))
+}
+
+// AllowedPlain checks the plain metric name. Parent nodes of the allowed prefixes are visible for the navigation
+func (a *ACL) AllowedPlain(name []byte) bool {
+	isBranch := len(name) > 0 && name[len(name)-1] == '.'
+
+	for _, p := range a.prefixes {
+		if bytes.HasPrefix(name, p) {
+			return true
+		}
+
+		if isBranch && bytes.HasPrefix(p, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowedTagged checks the tagged series name
+func (a *ACL) AllowedTagged(name []byte) bool {
+	if len(a.tagValues) == 0 {
+		return false
+	}
+
+	if a.tagValues["*"] {
+		return true
+	}
+
+	metricName, tags, err := tagsParse(stringutils.UnsafeString(name))
+	if err != nil {
+		return false
+	}
+
+	if a.tagValues["__name__="+metricName] || a.tagValues["__name__=*"] {
+		return true
+	}
+
+	for _, tag := range tags {
+		if a.tagValues[tag] {
+			return true
+		}
+
+		if k, _, ok := strings.Cut(tag, "="); ok && a.tagValues[k+"=*"] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowedTag checks the tag name for autocomplete, it's allowed if any of its values is allowed
+func (a *ACL) AllowedTag(tag string) bool {
+	if a.tagValues["*"] {
+		return true
+	}
+
+	for tv := range a.tagValues {
+		if strings.HasPrefix(tv, tag+"=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowedTagValue checks the tag value for autocomplete
+func (a *ACL) AllowedTagValue(tag, value string) bool {
+	return a.tagValues["*"] || a.tagValues[tag+"=*"] || a.tagValues[tag+"="+value]
+}
+
+// ACLFinder filters out the metrics, which are not allowed by ACL
+type ACLFinder struct {
+	wrapped Finder
+	acl     *ACL
+	tagged  bool
+}
+
+func WrapACL(f Finder, acl *ACL, tagged bool) *ACLFinder {
+	return &ACLFinder{
+		wrapped: f,
+		acl:     acl,
+		tagged:  tagged,
+	}
+}
+
+func (p *ACLFinder) Execute(ctx context.Context, config *config.Config, query string, from int64, until int64) error {
+	return p.wrapped.Execute(ctx, config, query, from, until)
+}
+
+func (p *ACLFinder) filter(list [][]byte) [][]byte {
+	result := make([][]byte, 0, len(list))
+
+	for _, v := range list {
+		if len(v) == 0 {
+			continue
+		}
+
+		if p.tagged {
+			if p.acl.AllowedTagged(v) {
+				result = append(result, v)
+			}
+		} else if p.acl.AllowedPlain(v) {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+func (p *ACLFinder) List() [][]byte {
+	return p.filter(p.wrapped.List())
+}
+
+// For Render
+func (p *ACLFinder) Series() [][]byte {
+	return p.filter(p.wrapped.Series())
+}
+
+func (p *ACLFinder) Abs(v []byte) []byte {
+	return p.wrapped.Abs(v)
+}
+
+func (p *ACLFinder) Bytes() ([]byte, error) {
+	// wrapped body is not filtered
+	return nil, ErrNotImplemented
+}
+
+func (p *ACLFinder) Stats() []metrics.FinderStat {
+	return p.wrapped.Stats()
+}
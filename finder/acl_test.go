@@ -0,0 +1,114 @@
+package finder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/stretchr/testify/assert"
+)
+
+func aclConfig() *config.Config {
+	cfg := config.New()
+	cfg.Auth.Tokens = []config.AuthToken{{Token: "secret", User: "grafana"}}
+	cfg.Auth.Roles = map[string]*config.Role{
+		"team_a": {MetricPrefixes: []string{"teams.a."}, TagValues: []string{"team=a"}},
+		"dc":     {TagValues: []string{"dc=*"}},
+		"admin":  {MetricPrefixes: []string{""}, TagValues: []string{"*"}},
+	}
+
+	return cfg
+}
+
+func TestRequestACL(t *testing.T) {
+	cfg := aclConfig()
+
+	assert.Nil(t, RequestACL(context.Background(), cfg))
+
+	ctx := scope.WithUser(context.Background(), "grafana")
+	acl := RequestACL(ctx, cfg)
+	assert.NotNil(t, acl)
+	assert.False(t, acl.AllowedPlain([]byte("teams.a.cpu")), "user without roles")
+
+	cfg.Auth.Roles = nil
+	assert.Nil(t, RequestACL(ctx, cfg))
+}
+
+func TestACLAllowed(t *testing.T) {
+	cfg := aclConfig()
+
+	tests := []struct {
+		roles  []string
+		name   string
+		tagged bool
+		want   bool
+	}{
+		{roles: []string{"team_a"}, name: "teams.a.cpu", want: true},
+		{roles: []string{"team_a"}, name: "teams.", want: true},
+		{roles: []string{"team_a"}, name: "teams.a.", want: true},
+		{roles: []string{"team_a"}, name: "teams.b.", want: false},
+		{roles: []string{"team_a"}, name: "teams.b.cpu", want: false},
+		{roles: []string{"team_a"}, name: "teams", want: false},
+		{roles: []string{"team_a"}, name: "cpu?dc=ru&team=a", tagged: true, want: true},
+		{roles: []string{"team_a"}, name: "cpu?dc=ru&team=b", tagged: true, want: false},
+		{roles: []string{"dc"}, name: "cpu?dc=ru&team=b", tagged: true, want: true},
+		{roles: []string{"dc"}, name: "cpu?team=b", tagged: true, want: false},
+		{roles: []string{"dc"}, name: "teams.a.cpu", want: false},
+		{roles: []string{"admin"}, name: "any.metric", want: true},
+		{roles: []string{"admin"}, name: "cpu?team=b", tagged: true, want: true},
+		{roles: []string{"unknown"}, name: "any.metric", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := NewACL(&cfg.Auth, tt.roles)
+			if tt.tagged {
+				assert.Equal(t, tt.want, acl.AllowedTagged([]byte(tt.name)), tt.roles)
+			} else {
+				assert.Equal(t, tt.want, acl.AllowedPlain([]byte(tt.name)), tt.roles)
+			}
+		})
+	}
+}
+
+func TestACLAllowedTag(t *testing.T) {
+	cfg := aclConfig()
+
+	acl := NewACL(&cfg.Auth, []string{"team_a", "dc"})
+	assert.True(t, acl.AllowedTag("team"))
+	assert.True(t, acl.AllowedTag("dc"))
+	assert.False(t, acl.AllowedTag("host"))
+	assert.False(t, acl.AllowedTag("te"))
+	assert.True(t, acl.AllowedTagValue("team", "a"))
+	assert.False(t, acl.AllowedTagValue("team", "b"))
+	assert.True(t, acl.AllowedTagValue("dc", "ru"))
+
+	acl = NewACL(&cfg.Auth, []string{"admin"})
+	assert.True(t, acl.AllowedTag("host"))
+	assert.True(t, acl.AllowedTagValue("host", "any"))
+}
+
+func TestACLFinder(t *testing.T) {
+	cfg := aclConfig()
+
+	m := NewMockFinder([][]byte{
+		[]byte("teams."),
+		[]byte("teams.a.cpu"),
+		[]byte("teams.b.cpu"),
+		[]byte("other.cpu"),
+	})
+	f := WrapACL(m, NewACL(&cfg.Auth, []string{"team_a"}), false)
+
+	assert.NoError(t, f.Execute(context.Background(), cfg, "*", 0, 0))
+
+	list := make([]string, 0)
+	for _, v := range f.List() {
+		list = append(list, string(v))
+	}
+
+	assert.Equal(t, []string{"teams.", "teams.a.cpu"}, list)
+
+	_, err := f.Bytes()
+	assert.ErrorIs(t, err, ErrNotImplemented)
+}
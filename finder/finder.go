@@ -46,6 +46,10 @@ func newPlainFinder(ctx context.Context, config *config.Config, query string, fr
 			config.ClickHouse.TaggedCosts,
 		)
 
+		if acl := RequestACL(ctx, config); acl != nil {
+			f = WrapACL(f, acl, true)
+		}
+
 		if len(config.Common.Blacklist) > 0 {
 			f = WrapBlacklist(f, config.Common.Blacklist)
 		}
@@ -60,6 +64,7 @@ func newPlainFinder(ctx context.Context, config *config.Config, query string, fr
 			config.ClickHouse.IndexUseDaily,
 			config.ClickHouse.IndexReverse,
 			config.ClickHouse.IndexReverses,
+			config.ClickHouse.IndexStats,
 			opts,
 			useCache,
 		)
@@ -73,6 +78,7 @@ func newPlainFinder(ctx context.Context, config *config.Config, query string, fr
 				config.ClickHouse.IndexUseDaily,
 				config.ClickHouse.IndexReverse,
 				config.ClickHouse.IndexReverses,
+				config.ClickHouse.IndexStats,
 				opts,
 				useCache,
 			)
@@ -93,6 +99,14 @@ func newPlainFinder(ctx context.Context, config *config.Config, query string, fr
 		f = WrapTag(f, config.ClickHouse.URL, config.ClickHouse.TagTable, opts)
 	}
 
+	if acl := RequestACL(ctx, config); acl != nil {
+		f = WrapACL(f, acl, false)
+	}
+
+	if tenant := Tenant(ctx, config); tenant != nil {
+		f = WrapTenant(f, tenant.Prefix)
+	}
+
 	if config.ClickHouse.ExtraPrefix != "" {
 		f = WrapPrefix(f, config.ClickHouse.ExtraPrefix)
 	}
@@ -156,7 +170,7 @@ func FindTagged(ctx context.Context, config *config.Config, terms []TaggedTerm,
 		config.ClickHouse.TaggedCosts,
 	)
 
-	err := fnd.ExecutePrepared(ctx, terms, from, until)
+	err := fnd.ExecutePrepared(ctx, appendTenantTerm(ctx, config, terms), from, until)
 	if err != nil {
 		return nil, err
 	}
@@ -11,9 +11,12 @@ import (
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/helper/date"
 	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/helper/indexstats"
 	"github.com/lomik/graphite-clickhouse/metrics"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
 	"github.com/lomik/graphite-clickhouse/pkg/where"
+
+	"go.uber.org/zap"
 )
 
 const ReverseLevelOffset = 10000
@@ -26,6 +29,7 @@ const (
 	queryAuto     = config.IndexAuto
 	queryDirect   = config.IndexDirect
 	queryReversed = config.IndexReversed
+	queryStats    = config.IndexStats
 )
 
 type IndexFinder struct {
@@ -35,12 +39,17 @@ type IndexFinder struct {
 	dailyEnabled bool
 	confReverse  uint8
 	confReverses config.IndexReverses
+	indexStats   *indexstats.Stats
 	reverse      uint8  // calculated in IndexFinder.useReverse only once
 	body         []byte // clickhouse response body
 	rows         [][]byte
 	stats        []metrics.FinderStat
 	useCache     bool // rotate body if needed (for store in cache)
 	useDaily     bool
+	page         Page // pushed into the query for the direct order only
+	estimated    bool // reverse is chosen by the index statistics
+	directRows   float64
+	reversedRows float64
 }
 
 func NewCachedIndex(body []byte) Finder {
@@ -53,7 +62,7 @@ func NewCachedIndex(body []byte) Finder {
 	return idx
 }
 
-func NewIndex(url string, table string, dailyEnabled bool, reverse string, reverses config.IndexReverses, opts clickhouse.Options, useCache bool) Finder {
+func NewIndex(url string, table string, dailyEnabled bool, reverse string, reverses config.IndexReverses, stats *indexstats.Stats, opts clickhouse.Options, useCache bool) Finder {
 	return &IndexFinder{
 		url:          url,
 		table:        table,
@@ -61,6 +70,7 @@ func NewIndex(url string, table string, dailyEnabled bool, reverse string, rever
 		dailyEnabled: dailyEnabled,
 		confReverse:  config.IndexReverse[reverse],
 		confReverses: reverses,
+		indexStats:   stats,
 		stats:        make([]metrics.FinderStat, 0),
 		useCache:     useCache,
 	}
@@ -104,7 +114,11 @@ func (idx *IndexFinder) useReverse(query string) bool {
 		return true
 	}
 
-	if idx.reverse = idx.checkReverses(query); idx.reverse != queryAuto {
+	if idx.reverse = idx.checkReverses(query); idx.reverse == queryStats {
+		idx.reverse = idx.statsReverse(query)
+	}
+
+	if idx.reverse != queryAuto {
 		return idx.useReverse(query)
 	}
 
@@ -129,6 +143,52 @@ func (idx *IndexFinder) useReverse(query string) bool {
 	return idx.useReverse(query)
 }
 
+// statsReverse compares the index rows, estimated for the direct and reversed queries. Every fixed node before the
+// first wildcard or after the last one divides the rows on the query level by count of the unique names on its level.
+// It returns queryAuto if the statistics is not loaded yet.
+func (idx *IndexFinder) statsReverse(query string) uint8 {
+	levels := idx.indexStats.Levels()
+	nodes := strings.Split(query, ".")
+
+	rows := float64(levels[len(nodes)].Nodes)
+	if rows == 0 {
+		if metrics.IndexStatsMetrics != nil {
+			metrics.IndexStatsMetrics.Fallback.Add(1)
+		}
+
+		return queryAuto
+	}
+
+	idx.estimated = true
+	idx.directRows, idx.reversedRows = rows, rows
+
+	for i := 0; i < len(nodes) && !where.HasWildcard(nodes[i]); i++ {
+		if names := levels[i+1].Names; names > 0 {
+			idx.directRows /= float64(names)
+		}
+	}
+
+	for i := len(nodes) - 1; i >= 0 && !where.HasWildcard(nodes[i]); i-- {
+		if names := levels[i+1].Names; names > 0 {
+			idx.reversedRows /= float64(names)
+		}
+	}
+
+	if idx.reversedRows < idx.directRows {
+		if metrics.IndexStatsMetrics != nil {
+			metrics.IndexStatsMetrics.Reversed.Add(1)
+		}
+
+		return queryReversed
+	}
+
+	if metrics.IndexStatsMetrics != nil {
+		metrics.IndexStatsMetrics.Direct.Add(1)
+	}
+
+	return queryDirect
+}
+
 func useDaily(dailyEnabled bool, from, until int64) bool {
 	return dailyEnabled && from > 0 && until > 0
 }
@@ -204,6 +264,21 @@ func (idx *IndexFinder) Execute(ctx context.Context, config *config.Config, quer
 
 	w := idx.whereFilter(query, from, until)
 
+	if idx.estimated {
+		scope.Logger(ctx).Info("index_reverse",
+			zap.String("query", query),
+			zap.Bool("reverse", idx.useReverse(query)),
+			zap.Float64("direct_rows", idx.directRows),
+			zap.Float64("reversed_rows", idx.reversedRows),
+		)
+	}
+
+	var orderLimit string
+	if !idx.useReverse(query) {
+		idx.page.where(w)
+		orderLimit = idx.page.orderLimit()
+	}
+
 	idx.stats = append(idx.stats, metrics.FinderStat{})
 	stat := &idx.stats[len(idx.stats)-1]
 
@@ -211,7 +286,7 @@ func (idx *IndexFinder) Execute(ctx context.Context, config *config.Config, quer
 		scope.WithTable(ctx, idx.table),
 		idx.url,
 		// TODO: consider consistent query generator
-		fmt.Sprintf("SELECT Path FROM %s WHERE %s GROUP BY Path FORMAT TabSeparatedRaw", idx.table, w),
+		fmt.Sprintf("SELECT Path FROM %s WHERE %s GROUP BY Path%s FORMAT TabSeparatedRaw", idx.table, w, orderLimit),
 		idx.opts,
 		nil,
 	)
@@ -8,6 +8,7 @@ import (
 	"github.com/lomik/graphite-clickhouse/config"
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/helper/date"
+	"github.com/lomik/graphite-clickhouse/helper/indexstats"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -60,6 +61,40 @@ func Test_useReverseWithSetConfig(t *testing.T) {
 	}
 }
 
+func Test_useReverseWithStats(t *testing.T) {
+	stats := indexstats.New(map[int]indexstats.Level{
+		1: {Nodes: 3, Names: 3},        // environments
+		2: {Nodes: 30, Names: 10},      // services
+		3: {Nodes: 30000, Names: 1000}, // hosts
+		4: {Nodes: 300000, Names: 10},  // metrics
+	})
+
+	table := []struct {
+		query        string
+		result       bool
+		directRows   float64
+		reversedRows float64
+	}{
+		{"prod.*.host1.*", false, 100000, 300000},
+		{"prod.*.*.cpu", true, 100000, 30000},
+		{"*.api.*.cpu", true, 300000, 30000},
+		{"prod.api.*.cpu", false, 10000, 30000},
+		// the host is more selective than the environment and the service
+		{"*.*.host1.cpu", true, 300000, 30},
+		// the statistics for the level is unknown, the decision is made by the wildcards positions
+		{"prod.*.host1.cpu.user", true, 0, 0},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.query, func(t *testing.T) {
+			idx := IndexFinder{confReverse: queryStats, indexStats: stats}
+			assert.Equal(t, tt.result, idx.useReverse(tt.query))
+			assert.Equal(t, tt.directRows, idx.directRows)
+			assert.Equal(t, tt.reversedRows, idx.reversedRows)
+		})
+	}
+}
+
 func Test_checkReverses(t *testing.T) {
 	assert := assert.New(t)
 
@@ -190,7 +225,7 @@ func TestIndexFinder_whereFilter(t *testing.T) {
 				tt.indexReverse = "auto"
 			}
 
-			idx := NewIndex("http://localhost:8123/", "graphite_index", tt.dailyEnabled, tt.indexReverse, tt.indexReverses, clickhouse.Options{}, false).(*IndexFinder)
+			idx := NewIndex("http://localhost:8123/", "graphite_index", tt.dailyEnabled, tt.indexReverse, tt.indexReverses, nil, clickhouse.Options{}, false).(*IndexFinder)
 			if got := idx.whereFilter(tt.query, tt.from, tt.until); got.String() != tt.want {
 				t.Errorf("IndexFinder.whereFilter() = %v, want %v", got, tt.want)
 			}
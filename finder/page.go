@@ -0,0 +1,98 @@
+package finder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/pkg/where"
+)
+
+// Filters of the page nodes
+const (
+	PageLeaves   = "leaves"
+	PageBranches = "branches"
+)
+
+// Page is the part of the find results, sorted by path
+type Page struct {
+	Limit  int    // 0 is unlimited
+	Offset int    // count of the skipped results
+	Filter string // PageLeaves, PageBranches or empty for all nodes
+}
+
+// CacheKey returns the suffix for cache keys, which separates the pages of the same query
+func (p *Page) CacheKey() string {
+	if *p == (Page{}) {
+		return ""
+	}
+
+	return fmt.Sprintf(";limit=%d;offset=%d;filter=%s", p.Limit, p.Offset, p.Filter)
+}
+
+// where adds the nodes filter to the index query
+func (p *Page) where(w *where.Where) {
+	switch p.Filter {
+	case PageLeaves:
+		w.And("NOT " + where.Like("Path", "%."))
+	case PageBranches:
+		w.And(where.Like("Path", "%."))
+	}
+}
+
+// orderLimit returns ORDER BY and LIMIT clauses of the index query, the offset is applied by Page.Apply
+func (p *Page) orderLimit() string {
+	if p.Limit <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" ORDER BY Path LIMIT %d", p.Offset+p.Limit)
+}
+
+// Apply filters and sorts the rows and returns the page
+func (p *Page) Apply(rows [][]byte) [][]byte {
+	result := make([][]byte, 0, len(rows))
+
+	for _, row := range rows {
+		if len(row) == 0 {
+			continue
+		}
+
+		if p.Filter != "" {
+			if _, isLeaf := Leaf(row); isLeaf != (p.Filter == PageLeaves) {
+				continue
+			}
+		}
+
+		result = append(result, row)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return bytes.Compare(result[i], result[j]) < 0 })
+
+	if p.Offset >= len(result) {
+		return result[:0]
+	}
+
+	result = result[p.Offset:]
+	if p.Limit > 0 && p.Limit < len(result) {
+		result = result[:p.Limit]
+	}
+
+	return result
+}
+
+// FindPage is Find, which pushes the page filter, ORDER BY and LIMIT into the index query, if the results are not
+// filtered or reversed after it. The results should be cut by Page.Apply anyway.
+func FindPage(config *config.Config, ctx context.Context, query string, from int64, until int64, page Page) (Result, error) {
+	fnd := newPlainFinder(ctx, config, query, from, until, config.Common.FindCache != nil)
+
+	if idx, ok := fnd.(*IndexFinder); ok {
+		idx.page = page
+	}
+
+	err := fnd.Execute(ctx, config, query, from, until)
+
+	return fnd.(Result), err
+}
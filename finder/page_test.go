@@ -0,0 +1,39 @@
+package finder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPage_Apply(t *testing.T) {
+	rows := [][]byte{
+		[]byte("a.c"),
+		[]byte("a.b."),
+		[]byte(""),
+		[]byte("a.a"),
+		[]byte("a.d."),
+	}
+
+	tests := []struct {
+		page Page
+		want []string
+	}{
+		{page: Page{}, want: []string{"a.a", "a.b.", "a.c", "a.d."}},
+		{page: Page{Limit: 2, Offset: 1}, want: []string{"a.b.", "a.c"}},
+		{page: Page{Filter: PageLeaves}, want: []string{"a.a", "a.c"}},
+		{page: Page{Filter: PageBranches, Offset: 1}, want: []string{"a.d."}},
+		{page: Page{Offset: 4}, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.page.CacheKey(), func(t *testing.T) {
+			got := make([]string, 0)
+			for _, row := range tt.page.Apply(rows) {
+				got = append(got, string(row))
+			}
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
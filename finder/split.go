@@ -9,7 +9,9 @@ import (
 	"github.com/lomik/graphite-clickhouse/config"
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/helper/indexstats"
 	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/dry"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
 	"github.com/lomik/graphite-clickhouse/pkg/where"
 )
@@ -22,10 +24,12 @@ type indexFinderParams struct {
 	useCache     bool
 	reverse      string
 	confReverses config.IndexReverses
+	indexStats   *indexstats.Stats
 }
 
 // SplitIndexFinder will try to split queries like {first,second}.some.metric into n queries (n - number of cases inside {}).
-// No matter if '{}' in first node or not. Only one {} will be split.
+// No matter if '{}' in first node or not. Only one {} will be split, unless max-split-subqueries is set, then the
+// cartesian product of several lists is split.
 type SplitIndexFinder struct {
 	indexFinderParams
 	// wrapped finder will be called if we can't split query.
@@ -48,6 +52,7 @@ func WrapSplitIndex(
 	dailyEnabled bool,
 	reverse string,
 	reverses config.IndexReverses,
+	stats *indexstats.Stats,
 	opts clickhouse.Options,
 	useCache bool,
 ) *SplitIndexFinder {
@@ -62,6 +67,7 @@ func WrapSplitIndex(
 			dailyEnabled: dailyEnabled,
 			reverse:      reverse,
 			confReverses: reverses,
+			indexStats:   stats,
 			opts:         opts,
 			useCache:     useCache,
 		},
@@ -89,11 +95,14 @@ func (splitFinder *SplitIndexFinder) Execute(
 		return splitFinder.wrapped.Execute(ctx, config, query, from, until)
 	}
 
-	splitQueries, err := splitQuery(query, config.ClickHouse.MaxNodeToSplitIndex)
+	splitQueries, err := splitQuery(query, config.ClickHouse.MaxNodeToSplitIndex, config.ClickHouse.MaxSplitSubqueries)
 	if err != nil {
 		return err
 	}
 
+	// the lists may contain the same choices, the results of the subqueries are merged by GROUP BY Path
+	splitQueries = dry.RemoveDuplicateStrings(splitQueries)
+
 	if len(splitQueries) <= 1 {
 		splitFinder.useWrapped = true
 		return splitFinder.wrapped.Execute(ctx, config, query, from, until)
@@ -127,7 +136,7 @@ func (splitFinder *SplitIndexFinder) Execute(
 	return nil
 }
 
-func splitQuery(query string, maxNodeToSplitIdx int) ([]string, error) {
+func splitQuery(query string, maxNodeToSplitIdx, maxSubqueries int) ([]string, error) {
 	splitQueries := make([]string, 0, 1)
 
 	firstClosingBracketIndex := strings.Index(query, "}")
@@ -206,12 +215,14 @@ func splitQuery(query string, maxNodeToSplitIdx int) ([]string, error) {
 
 	var prefix, suffix, queryPart string
 	if useDirect {
+		end := directListsEnd(query, firstClosingBracketIndex+1, choicesInLeftMost+1, maxNodeToSplitIdx, maxSubqueries)
 		prefix = ""
-		queryPart = query[:firstClosingBracketIndex+1]
-		suffix = query[firstClosingBracketIndex+1:]
+		queryPart = query[:end]
+		suffix = query[end:]
 	} else {
-		prefix = query[:lastOpenBracketIndex]
-		queryPart = query[lastOpenBracketIndex:]
+		start := reverseListsStart(query, lastOpenBracketIndex, choicesInRightMost+1, maxNodeToSplitIdx, maxSubqueries)
+		prefix = query[:start]
+		queryPart = query[start:]
 		suffix = ""
 	}
 
@@ -223,6 +234,59 @@ func splitQuery(query string, maxNodeToSplitIdx int) ([]string, error) {
 	return splitQueries, nil
 }
 
+// directListsEnd returns the end of the query part, which is split in direct notation. The first list ends at end,
+// the next lists are added while there are no wildcards before them, their node index is less or equal to
+// maxNodeToSplitIdx and the count of subqueries is less or equal to maxSubqueries.
+func directListsEnd(query string, end, subqueries, maxNodeToSplitIdx, maxSubqueries int) int {
+	for maxSubqueries > 0 {
+		openIdx := strings.Index(query[end:], "{")
+		if openIdx < 0 {
+			break
+		}
+
+		openIdx += end
+		if where.HasWildcard(query[end:openIdx]) || strings.Count(query[:openIdx], ".") > maxNodeToSplitIdx {
+			break
+		}
+
+		closeIdx := openIdx + strings.Index(query[openIdx:], "}")
+
+		subqueries *= strings.Count(query[openIdx:closeIdx], ",") + 1
+		if subqueries > maxSubqueries {
+			break
+		}
+
+		end = closeIdx + 1
+	}
+
+	return end
+}
+
+// reverseListsStart is directListsEnd for reverse notation, it returns the start of the split query part.
+func reverseListsStart(query string, start, subqueries, maxNodeToSplitIdx, maxSubqueries int) int {
+	for maxSubqueries > 0 {
+		closeIdx := strings.LastIndex(query[:start], "}")
+		if closeIdx < 0 {
+			break
+		}
+
+		if where.HasWildcard(query[closeIdx+1:start]) || strings.Count(query[closeIdx:], ".") > maxNodeToSplitIdx {
+			break
+		}
+
+		openIdx := strings.LastIndex(query[:closeIdx], "{")
+
+		subqueries *= strings.Count(query[openIdx:closeIdx], ",") + 1
+		if subqueries > maxSubqueries {
+			break
+		}
+
+		start = openIdx
+	}
+
+	return start
+}
+
 func splitPartOfQuery(prefix, queryPart, suffix string) ([]string, error) {
 	splitQueries := make([]string, 0)
 
@@ -256,6 +320,7 @@ func (splitFinder *SplitIndexFinder) whereFilter(queries []string, from, until i
 		splitFinder.useReverse = (&IndexFinder{
 			confReverses: splitFinder.confReverses,
 			confReverse:  config.IndexReverse[splitFinder.reverse],
+			indexStats:   splitFinder.indexStats,
 		}).useReverse(queries[queryWithWildcardIdx])
 	} else {
 		splitFinder.useReverse = false
@@ -1,8 +1,11 @@
 package finder
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net/http"
+	"sort"
 	"testing"
 	"time"
 
@@ -10,13 +13,16 @@ import (
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/helper/date"
 	"github.com/lomik/graphite-clickhouse/helper/errs"
+	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_splitQuery(t *testing.T) {
 	type testcase struct {
 		givenQuery               string
 		givenMaxNodeToSplitIndex int
+		givenMaxSubqueries       int
 		expectedQueries          []string
 		expectedErr              error
 		desc                     string
@@ -188,11 +194,72 @@ func Test_splitQuery(t *testing.T) {
 			expectedErr: nil,
 			desc:        "query split if MaxNodeToSplitIndex is greater than nodes amount in query",
 		},
+		{
+			givenQuery:               "{a,b}.{first,second}.metric.*",
+			givenMaxNodeToSplitIndex: 3,
+			givenMaxSubqueries:       4,
+			expectedQueries: []string{
+				"a.first.metric.*",
+				"a.second.metric.*",
+				"b.first.metric.*",
+				"b.second.metric.*",
+			},
+			expectedErr: nil,
+			desc:        "two lists with wildcard on reverse are split",
+		},
+		{
+			givenQuery:               "{a,b}.{first,second}.metric.*",
+			givenMaxNodeToSplitIndex: 3,
+			givenMaxSubqueries:       3,
+			expectedQueries: []string{
+				"a.{first,second}.metric.*",
+				"b.{first,second}.metric.*",
+			},
+			expectedErr: nil,
+			desc:        "second list is not split, because subqueries count is greater than given in config",
+		},
+		{
+			givenQuery:               "some.{a,b}.{c,d}.{first,second}.*",
+			givenMaxNodeToSplitIndex: 2,
+			givenMaxSubqueries:       10,
+			expectedQueries: []string{
+				"some.a.c.{first,second}.*",
+				"some.a.d.{first,second}.*",
+				"some.b.c.{first,second}.*",
+				"some.b.d.{first,second}.*",
+			},
+			expectedErr: nil,
+			desc:        "third list is not split, because its node index is greater than given in config",
+		},
+		{
+			givenQuery:               "{a,b}.*.{first,second}.metric",
+			givenMaxNodeToSplitIndex: 3,
+			givenMaxSubqueries:       10,
+			expectedQueries: []string{
+				"{a,b}.*.first.metric",
+				"{a,b}.*.second.metric",
+			},
+			expectedErr: nil,
+			desc:        "list after wildcard is not split",
+		},
+		{
+			givenQuery:               "*.{a,b}.x.{first,second}",
+			givenMaxNodeToSplitIndex: 3,
+			givenMaxSubqueries:       10,
+			expectedQueries: []string{
+				"*.a.x.first",
+				"*.a.x.second",
+				"*.b.x.first",
+				"*.b.x.second",
+			},
+			expectedErr: nil,
+			desc:        "two lists with wildcard on direct are split",
+		},
 	}
 
 	for i, singleCase := range cases {
 		t.Run(fmt.Sprintf("case %v: %s", i+1, singleCase.desc), func(t *testing.T) {
-			gotQueries, gotErr := splitQuery(singleCase.givenQuery, singleCase.givenMaxNodeToSplitIndex)
+			gotQueries, gotErr := splitQuery(singleCase.givenQuery, singleCase.givenMaxNodeToSplitIndex, singleCase.givenMaxSubqueries)
 
 			assert.Equal(t, singleCase.expectedQueries, gotQueries, singleCase.desc)
 			assert.Equal(t, singleCase.expectedErr, gotErr, singleCase.desc)
@@ -343,6 +410,7 @@ func TestSplitIndexFinder_whereFilter(t *testing.T) {
 				tc.dailyEnabled,
 				tc.reverse,
 				tc.confReverses,
+				nil,
 				clickhouse.Options{},
 				false)
 
@@ -355,3 +423,42 @@ func TestSplitIndexFinder_whereFilter(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitIndexFinder_Execute_FakeServer(t *testing.T) {
+	srv := chtest.NewFakeServer()
+	defer srv.Close()
+
+	require.NoError(t, srv.AddIndex("graphite_index", time.Now(),
+		"a.first.cpu",
+		"a.second.cpu",
+		"b.first.cpu",
+		"b.third.cpu",
+		"c.first.cpu",
+	))
+
+	cfg := config.New()
+	cfg.ClickHouse.MaxNodeToSplitIndex = 3
+	cfg.ClickHouse.MaxSplitSubqueries = 10
+
+	f := WrapSplitIndex(
+		&IndexFinder{},
+		0,
+		srv.URL,
+		"graphite_index",
+		false,
+		"",
+		nil,
+		nil,
+		clickhouse.Options{Timeout: time.Second, ConnectTimeout: time.Second},
+		false)
+
+	require.NoError(t, f.Execute(context.Background(), cfg, "{a,b,a}.{first,second,first}.cpu", 0, 0))
+
+	queries := srv.Queries()
+	require.Len(t, queries, 1)
+	assert.Contains(t, queries[0], "Path IN ('a.first.cpu','a.first.cpu.','a.second.cpu','a.second.cpu.','b.first.cpu','b.first.cpu.','b.second.cpu','b.second.cpu.')")
+
+	list := f.List()
+	sort.Slice(list, func(i, j int) bool { return bytes.Compare(list[i], list[j]) < 0 })
+	assert.Equal(t, [][]byte{[]byte("a.first.cpu"), []byte("a.second.cpu"), []byte("b.first.cpu")}, list)
+}
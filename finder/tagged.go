@@ -617,6 +617,8 @@ func (t *TaggedFinder) PrepareTaggedTerms(ctx context.Context, cfg *config.Confi
 		return nil, err
 	}
 
+	terms = appendTenantTerm(ctx, cfg, terms)
+
 	var tagCounts map[string]*config.Costs = nil
 	if t.tcq != nil {
 		tagCounts, err = t.tcq.GetCostsFromCountTable(ctx, terms, from, until)
@@ -0,0 +1,106 @@
+package finder
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// TenantFinder hides the tenant namespace: the prefix is prepended to the query
+// and stripped from the found metrics
+type TenantFinder struct {
+	wrapped     Finder
+	prefix      string // with trailing dot
+	prefixBytes []byte // same prefix with []bytes type
+}
+
+func WrapTenant(f Finder, prefix string) *TenantFinder {
+	return &TenantFinder{
+		wrapped:     f,
+		prefix:      prefix + ".",
+		prefixBytes: []byte(prefix + "."),
+	}
+}
+
+// Tenant returns the tenant, resolved for the request, or nil
+func Tenant(ctx context.Context, config *config.Config) *config.Tenant {
+	return config.Tenancy.Get(scope.Tenant(ctx))
+}
+
+// TenantTaggedTerm returns the term, which restricts tagged series with the tenant tag
+func TenantTaggedTerm(tenant *config.Tenant, config *config.Config) TaggedTerm {
+	return TaggedTerm{
+		Key:   config.Tenancy.Tag,
+		Op:    TaggedTermEq,
+		Value: tenant.TagValue,
+	}
+}
+
+// appendTenantTerm adds the tenant term to terms if the request has the tenant
+func appendTenantTerm(ctx context.Context, config *config.Config, terms []TaggedTerm) []TaggedTerm {
+	if tenant := Tenant(ctx, config); tenant != nil {
+		return append(terms, TenantTaggedTerm(tenant, config))
+	}
+
+	return terms
+}
+
+func (t *TenantFinder) Execute(ctx context.Context, config *config.Config, query string, from int64, until int64) error {
+	return t.wrapped.Execute(ctx, config, t.prefix+query, from, until)
+}
+
+func (t *TenantFinder) strip(v []byte) []byte {
+	if bytes.HasPrefix(v, t.prefixBytes) {
+		return v[len(t.prefixBytes):]
+	}
+
+	return nil
+}
+
+func (t *TenantFinder) List() [][]byte {
+	list := t.wrapped.List()
+	result := make([][]byte, 0, len(list))
+
+	for i := 0; i < len(list); i++ {
+		if v := t.strip(list[i]); len(v) > 0 {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+// For Render
+func (t *TenantFinder) Series() [][]byte {
+	series := t.wrapped.Series()
+	result := make([][]byte, 0, len(series))
+
+	for i := 0; i < len(series); i++ {
+		// series names are used as is for the data fetch, only check the namespace
+		if bytes.HasPrefix(series[i], t.prefixBytes) {
+			result = append(result, series[i])
+		}
+	}
+
+	return result
+}
+
+func (t *TenantFinder) Abs(v []byte) []byte {
+	abs := t.wrapped.Abs(v)
+	if stripped := t.strip(abs); len(stripped) > 0 {
+		return stripped
+	}
+
+	return abs
+}
+
+func (t *TenantFinder) Bytes() ([]byte, error) {
+	return t.wrapped.Bytes()
+}
+
+func (t *TenantFinder) Stats() []metrics.FinderStat {
+	return t.wrapped.Stats()
+}
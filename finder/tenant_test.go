@@ -0,0 +1,64 @@
+package finder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantFinder(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewMockFinder([][]byte{
+		[]byte("team_a.host1."),
+		[]byte("team_a.host1.cpu"),
+		[]byte("team_b.host2.cpu"),
+	})
+	f := WrapTenant(m, "team_a")
+
+	err := f.Execute(context.Background(), config.New(), "host*.*", 0, 0)
+	assert.NoError(err)
+	assert.Equal("team_a.host*.*", m.query)
+
+	list := make([]string, 0)
+	for _, v := range f.List() {
+		list = append(list, string(v))
+	}
+
+	assert.Equal([]string{"host1.", "host1.cpu"}, list)
+
+	series := make([]string, 0)
+	for _, v := range f.Series() {
+		series = append(series, string(v))
+	}
+
+	assert.Equal([]string{"team_a.host1.", "team_a.host1.cpu"}, series)
+
+	assert.Equal("host1.cpu", string(f.Abs([]byte("team_a.host1.cpu"))))
+}
+
+func TestTenantTaggedTerm(t *testing.T) {
+	cfg := config.New()
+	cfg.Tenancy.Tenants = map[string]*config.Tenant{
+		"team_a": {Name: "team_a", Prefix: "team_a", TagValue: "a"},
+	}
+
+	terms := []TaggedTerm{{Key: "__name__", Op: TaggedTermEq, Value: "cpu"}}
+
+	assert.Equal(t, terms, appendTenantTerm(context.Background(), cfg, terms))
+
+	ctx := scope.WithTenant(context.Background(), "team_a")
+	assert.Equal(t,
+		[]TaggedTerm{
+			{Key: "__name__", Op: TaggedTermEq, Value: "cpu"},
+			{Key: "tenant", Op: TaggedTermEq, Value: "a"},
+		},
+		appendTenantTerm(ctx, cfg, terms),
+	)
+
+	ctx = scope.WithTenant(context.Background(), "team_unknown")
+	assert.Equal(t, terms, appendTenantTerm(ctx, cfg, terms))
+}
@@ -9,7 +9,9 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
 	"runtime"
@@ -22,15 +24,18 @@ import (
 	"github.com/lomik/zapwriter"
 	"go.uber.org/zap"
 
+	"github.com/lomik/graphite-clickhouse/auth"
 	"github.com/lomik/graphite-clickhouse/autocomplete"
 	"github.com/lomik/graphite-clickhouse/capabilities"
 	"github.com/lomik/graphite-clickhouse/config"
 	"github.com/lomik/graphite-clickhouse/find"
 	"github.com/lomik/graphite-clickhouse/healthcheck"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/helper/rollup"
 	"github.com/lomik/graphite-clickhouse/index"
 	"github.com/lomik/graphite-clickhouse/logs"
 	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/record"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
 	"github.com/lomik/graphite-clickhouse/prometheus"
 	"github.com/lomik/graphite-clickhouse/render"
@@ -74,9 +79,74 @@ func WrapResponseWriter(w http.ResponseWriter) *LogResponseWriter {
 
 type App struct {
 	config *config.Config
+	auth   *auth.Chain
 }
 
 func (app *App) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		healthcheck.Enter()
+		defer healthcheck.Leave()
+
+		r = scope.HttpRequest(r)
+
+		w.Header().Add("X-Gch-Request-ID", scope.RequestID(r.Context()))
+
+		if app.auth != nil {
+			id, err := app.auth.Authenticate(r)
+			if err != nil {
+				scope.Logger(r.Context()).Named("http").Warn("auth",
+					zap.String("url", r.URL.String()),
+					zap.String("peer", r.RemoteAddr),
+					zap.Error(err),
+				)
+				w.Header().Set("WWW-Authenticate", app.auth.Challenge())
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+				// the handlers write the access log for the authenticated requests only
+				accessLogger := scope.LoggerWithHeaders(r.Context(), r, app.config.Common.HeadersToLog)
+				logs.AccessLog(accessLogger, app.config, r, http.StatusUnauthorized, time.Since(start), time.Duration(0), false, false)
+
+				return
+			}
+
+			r = auth.Request(r, id)
+		}
+
+		// the request is recorded after the authentication, so unauthenticated clients can't write the files
+		if record.Enabled(r, app.config.Debug.RecordPerm) {
+			var (
+				rec *record.Recorder
+				err error
+			)
+
+			if w, r, rec, err = record.Start(w, r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			defer app.saveRecord(r, rec)
+		}
+
+		handler.ServeHTTP(WrapResponseWriter(w), r)
+	})
+}
+
+func (app *App) saveRecord(r *http.Request, rec *record.Recorder) {
+	logger := scope.Logger(r.Context()).Named("record")
+
+	filename, err := rec.Save(app.config.Debug.Directory, app.config.Debug.RecordPerm)
+	if err != nil {
+		logger.Warn("record", zap.Error(err))
+		return
+	}
+
+	logger.Info("record", zap.String("file", filename))
+}
+
+// PublicHandler is the Handler without authentication, for health checks
+func (app *App) PublicHandler(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		writer := WrapResponseWriter(w)
 
@@ -88,6 +158,74 @@ func (app *App) Handler(handler http.Handler) http.Handler {
 	})
 }
 
+// TenantHandler resolves the request tenant for handlers with the metrics access
+func (app *App) TenantHandler(handler http.Handler) http.Handler {
+	if !app.config.Tenancy.Enabled() {
+		return app.Handler(handler)
+	}
+
+	return app.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := app.config.Tenancy.Resolve(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		if tenant != "" {
+			r = r.WithContext(scope.WithTenant(r.Context(), tenant))
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+// Mux returns the handler of HTTP API
+func (app *App) Mux() *http.ServeMux {
+	cfg := app.config
+	mux := http.NewServeMux()
+	mux.Handle("/_internal/capabilities/", app.Handler(capabilities.NewHandler(cfg)))
+	mux.Handle("/metrics/find/", app.TenantHandler(find.NewHandler(cfg)))
+	mux.Handle("/metrics/index.json", app.TenantHandler(index.NewHandler(cfg)))
+	mux.Handle("/render/", app.TenantHandler(render.NewHandler(cfg)))
+	mux.Handle("/tags/autoComplete/tags", app.TenantHandler(autocomplete.NewTags(cfg)))
+	mux.Handle("/tags/autoComplete/values", app.TenantHandler(autocomplete.NewValues(cfg)))
+	mux.HandleFunc("/alive", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "Graphite-clickhouse is alive.\n")
+	})
+	mux.Handle("/health", app.PublicHandler(healthcheck.NewHandler(cfg)))
+	mux.Handle("/debug/config", app.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		start := time.Now()
+
+		accessLogger := scope.LoggerWithHeaders(r.Context(), r, app.config.Common.HeadersToLog)
+
+		defer func() {
+			d := time.Since(start)
+			logs.AccessLog(accessLogger, app.config, r, status, d, time.Duration(0), false, false)
+		}()
+
+		if app.auth != nil && !app.config.Auth.IsAdmin(scope.Roles(r.Context())) {
+			status = http.StatusForbidden
+			http.Error(w, http.StatusText(status), status)
+
+			return
+		}
+
+		b, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			status = http.StatusInternalServerError
+			http.Error(w, err.Error(), status)
+
+			return
+		}
+
+		w.Write(b)
+	})))
+
+	return mux
+}
+
 var (
 	BuildVersion = "(development build)"
 	srv          *http.Server
@@ -412,6 +550,92 @@ func checkRollupMatch(name string, args []string) {
 	}
 }
 
+// stubURL replaces the host of ClickHouse URL by the stub one, the path and params are kept
+func stubURL(chURL, stub string) string {
+	u, err := url.Parse(chURL)
+	if err != nil {
+		return stub
+	}
+
+	s, _ := url.Parse(stub)
+	u.Scheme, u.Host, u.User = s.Scheme, s.Host, nil
+
+	return u.String()
+}
+
+func replay(name string, args []string) {
+	descr := "Replay recorded requests and compare responses"
+	flagName := "replay"
+	flagSet := flag.NewFlagSet(descr, flag.ExitOnError)
+	help := flagSet.Bool("help", false, "Print help")
+	configFile := flagSet.String("config", "/etc/graphite-clickhouse/graphite-clickhouse.conf", "Filename of config")
+	exactConfig := flagSet.Bool("exact-config", false, "Ensure that all config params are contained in the target struct.")
+	stub := flagSet.Bool("stub", true, "Answer ClickHouse queries with the recorded responses, otherwise query ClickHouse from config")
+	flagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s %s:\n", name, flagName)
+		flagSet.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "  RECORDING []string\n    	List of recording files (record-<request_id>.json)\n")
+	}
+	flagSet.Parse(args)
+
+	if *help || flagSet.NArg() == 0 {
+		flagSet.Usage()
+		return
+	}
+
+	cfg, _, err := config.ReadConfig(*configFile, *exactConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	chURL := cfg.ClickHouse.URL
+	paramsURL := make([]string, len(cfg.ClickHouse.QueryParams))
+
+	for i := range cfg.ClickHouse.QueryParams {
+		paramsURL[i] = cfg.ClickHouse.QueryParams[i].URL
+	}
+
+	// the credentials are not recorded, the recorded identity is set by record.Replay
+	app := App{config: cfg}
+	// handlers read ClickHouse URLs from the config on every request
+	mux := app.Mux()
+	ec := 0
+
+	for _, filename := range flagSet.Args() {
+		rec, err := record.Load(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var chStub *httptest.Server
+
+		if *stub {
+			chStub = httptest.NewServer(record.Stub(rec))
+
+			cfg.ClickHouse.URL = stubURL(chURL, chStub.URL)
+			for i := range cfg.ClickHouse.QueryParams {
+				cfg.ClickHouse.QueryParams[i].URL = stubURL(paramsURL[i], chStub.URL)
+			}
+		}
+
+		replayed := record.Replay(mux, rec)
+
+		if chStub != nil {
+			chStub.Close()
+		}
+
+		if diff := record.Diff(&rec.Response, replayed); diff != "" {
+			ec = 1
+
+			fmt.Printf("FAIL %s %s %s\n%s\n", filename, rec.Request.Method, rec.Request.URL, diff)
+		} else {
+			fmt.Printf("OK   %s %s %s\n", filename, rec.Request.Method, rec.Request.URL)
+		}
+	}
+
+	os.Exit(ec)
+}
+
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
@@ -445,6 +669,7 @@ func main() {
 		fmt.Fprintf(os.Stderr, "	sd-clean	Cleanup expired registered nodes in SD\n")
 		fmt.Fprintf(os.Stderr, "	sd-expired	List expired registered nodes in SD\n")
 		fmt.Fprintf(os.Stderr, "	match	Match metric against rollup rules\n")
+		fmt.Fprintf(os.Stderr, "	replay	Replay recorded requests and compare responses\n")
 	}
 
 	if len(os.Args) > 1 {
@@ -467,6 +692,9 @@ func main() {
 		case "match", "-match":
 			checkRollupMatch(os.Args[0], os.Args[2:])
 			return
+		case "replay", "-replay":
+			replay(os.Args[0], os.Args[2:])
+			return
 		}
 	}
 
@@ -556,44 +784,17 @@ func main() {
 
 	/* CONSOLE COMMANDS end */
 
-	app := App{config: cfg}
-
-	mux := http.NewServeMux()
-	mux.Handle("/_internal/capabilities/", app.Handler(capabilities.NewHandler(cfg)))
-	mux.Handle("/metrics/find/", app.Handler(find.NewHandler(cfg)))
-	mux.Handle("/metrics/index.json", app.Handler(index.NewHandler(cfg)))
-	mux.Handle("/render/", app.Handler(render.NewHandler(cfg)))
-	mux.Handle("/tags/autoComplete/tags", app.Handler(autocomplete.NewTags(cfg)))
-	mux.Handle("/tags/autoComplete/values", app.Handler(autocomplete.NewValues(cfg)))
-	mux.HandleFunc("/alive", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		io.WriteString(w, "Graphite-clickhouse is alive.\n")
-	})
-	mux.Handle("/health", app.Handler(healthcheck.NewHandler(cfg)))
-	mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
-		status := http.StatusOK
-		start := time.Now()
-
-		accessLogger := scope.LoggerWithHeaders(r.Context(), r, app.config.Common.HeadersToLog)
-
-		defer func() {
-			d := time.Since(start)
-			logs.AccessLog(accessLogger, app.config, r, status, d, time.Duration(0), false, false)
-		}()
+	authChain, err := auth.New(&cfg.Auth)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		b, err := json.MarshalIndent(cfg, "", "  ")
-		if err != nil {
-			status = http.StatusInternalServerError
-			http.Error(w, err.Error(), status)
+	app := App{config: cfg, auth: authChain}
 
-			return
-		}
-
-		w.Write(b)
-	})
+	mux := app.Mux()
 
 	if cfg.Prometheus.Listen != "" {
-		if err := prometheus.Run(cfg); err != nil {
+		if err := prometheus.Run(cfg, authChain); err != nil {
 			log.Fatal(err)
 		}
 	}
@@ -609,12 +810,22 @@ func main() {
 		Handler: mux,
 	}
 
-	exitWait.Add(1)
+	if cfg.Common.TLS != nil {
+		srv.TLSConfig = cfg.Common.TLS.Config()
+
+		go cfg.Common.TLS.Watch(context.Background(), cfg.Common.TLSReloadInterval, localManager.Logger("tls"))
+	}
 
 	go func() {
-		defer exitWait.Done()
+		var err error
+		if srv.TLSConfig != nil {
+			// certificates are set in TLSConfig
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
 
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		if err != http.ErrServerClosed {
 			// unexpected error. port in use?
 			log.Fatalf("ListenAndServe(): %v", err)
 		}
@@ -629,21 +840,45 @@ func main() {
 		}()
 	}
 
+	exitWait.Add(1)
+
 	go func() {
+		defer exitWait.Done()
+
 		stop := make(chan os.Signal, 1)
 		signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
 		<-stop
 		logger.Info("stoping graphite-clickhouse")
 
+		// fail healthcheck and unregister SD, so no new requests are sent to us
+		healthcheck.Drain()
+
 		if cfg.Common.SD != "" {
-			// unregister SD
 			sd.Stop()
-			time.Sleep(10 * time.Second)
 		}
-		// initiating the shutdown
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-		srv.Shutdown(ctx)
-		cancel()
+
+		if cfg.Common.ShutdownDelay > 0 {
+			time.Sleep(cfg.Common.ShutdownDelay)
+		}
+
+		// stop accepting new requests and wait for in-flight ones
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Common.ShutdownTimeout)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Warn("shutdown timeout exceeded",
+				zap.Int64("in_flight", healthcheck.InFlight()),
+				zap.Strings("running_queries", clickhouse.Running()),
+			)
+
+			killCtx, killCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if n := clickhouse.KillRunning(killCtx, logger); n > 0 {
+				logger.Info("clickhouse queries killed", zap.Int("count", n))
+			}
+			killCancel()
+
+			srv.Close()
+		}
 	}()
 
 	exitWait.Wait()
@@ -0,0 +1,21 @@
+package healthcheck
+
+import "sync/atomic"
+
+// in-flight requests, served by the API handlers
+var inFlight int64
+
+// Enter counts the request as in-flight, Leave must be called when it's served
+func Enter() {
+	atomic.AddInt64(&inFlight, 1)
+}
+
+// Leave releases the request counted by Enter
+func Leave() {
+	atomic.AddInt64(&inFlight, -1)
+}
+
+// InFlight returns the count of requests, which are served now
+func InFlight() int64 {
+	return atomic.LoadInt64(&inFlight)
+}
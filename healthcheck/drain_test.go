@@ -0,0 +1,15 @@
+package healthcheck
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInFlight(t *testing.T) {
+	Enter()
+	require.Equal(t, int64(1), InFlight())
+
+	Leave()
+	require.Equal(t, int64(0), InFlight())
+}
@@ -15,6 +15,14 @@ import (
 	"go.uber.org/zap"
 )
 
+// draining is set on shutdown, so load balancers stop sending new requests
+var draining int32
+
+// Drain switches the healthcheck to failed state until exit
+func Drain() {
+	atomic.StoreInt32(&draining, 1)
+}
+
 // Handler serves /render requests
 type Handler struct {
 	config *config.Config
@@ -33,6 +41,11 @@ func NewHandler(config *config.Config) *Handler {
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&draining) == 1 {
+		http.Error(w, "Graphite-clickhouse is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	var (
 		query  string
 		failed int32
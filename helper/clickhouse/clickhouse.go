@@ -1,6 +1,7 @@
 package clickhouse
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
@@ -21,6 +22,7 @@ import (
 	"github.com/lomik/graphite-clickhouse/helper/errs"
 	httpHelper "github.com/lomik/graphite-clickhouse/helper/http"
 	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/pkg/record"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
 
 	"go.uber.org/zap"
@@ -178,6 +180,7 @@ type LoggedReader struct {
 	start      time.Time
 	finished   bool
 	queryID    string
+	runningID  string
 	read_rows  int64
 	read_bytes int64
 }
@@ -186,6 +189,7 @@ func (r *LoggedReader) Read(p []byte) (int, error) {
 	n, err := r.reader.Read(p)
 	if err != nil && !r.finished {
 		r.finished = true
+		finishQuery(r.runningID)
 		r.logger.Info("query", zap.String("query_id", r.queryID), zap.Duration("time", time.Since(r.start)))
 	}
 
@@ -197,6 +201,7 @@ func (r *LoggedReader) Close() error {
 
 	if !r.finished {
 		r.finished = true
+		finishQuery(r.runningID)
 		r.logger.Info("query", zap.String("query_id", r.queryID), zap.Duration("time", time.Since(r.start)))
 	}
 
@@ -274,6 +279,31 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 		}
 	}()
 
+	var runningID string
+
+	defer func() {
+		if err != nil && runningID != "" {
+			finishQuery(runningID)
+		}
+	}()
+
+	recorder := record.FromContext(ctx)
+
+	var recorded *record.Query
+
+	if recorder != nil {
+		if recorded, postBody, err = recordQuery(query, postBody, encoding, extData); err != nil {
+			return
+		}
+
+		defer func() {
+			if err != nil {
+				recorded.Error = err.Error()
+				recorder.Add(recorded)
+			}
+		}()
+	}
+
 	p, err := url.Parse(dsn)
 	if err != nil {
 		return
@@ -284,8 +314,10 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 	binary.LittleEndian.PutUint64(b[:], rand.Uint64())
 	queryID := fmt.Sprintf("%x", b)
 
+	runningID = fmt.Sprintf("%s::%s", requestID, queryID)
+
 	q := p.Query()
-	q.Set("query_id", fmt.Sprintf("%s::%s", requestID, queryID))
+	q.Set("query_id", runningID)
 	// Get X-Clickhouse-Summary header
 	// TODO: remove when https://github.com/ClickHouse/ClickHouse/issues/16207 is done
 	q.Set("send_progress_in_http_headers", "1")
@@ -335,6 +367,8 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 		return nil, fmt.Errorf("unknown encoding: %s", encoding)
 	}
 
+	startQuery(runningID, dsn, opts)
+
 	var resp *http.Response
 	if opts.CheckRequestProgress {
 		resp, err = sendRequestWithProgressCheck(req, &opts)
@@ -357,6 +391,17 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 
 	// chproxy overwrite our query id. So read it again
 	chQueryID = resp.Header.Get("X-ClickHouse-Query-Id")
+	if chQueryID != "" && chQueryID != runningID {
+		finishQuery(runningID)
+
+		runningID = chQueryID
+		startQuery(runningID, dsn, opts)
+	}
+
+	if recorded != nil {
+		recorded.Status = resp.StatusCode
+		recorded.Summary = resp.Header.Get(ClickHouseSummaryHeader)
+	}
 
 	stats, err := getQueryStats(resp, ClickHouseSummaryHeader)
 	if err != nil {
@@ -382,22 +427,29 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 	if resp.StatusCode > http.StatusInternalServerError && resp.StatusCode < 512 {
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
+		recordResponse(recorded, body)
 		err = errs.NewErrorWithCode(string(body), resp.StatusCode)
 
 		return
 	} else if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
+		recordResponse(recorded, body)
 		err = NewErrWithDescr("clickhouse response status "+strconv.Itoa(resp.StatusCode), string(body))
 
 		return
 	}
 
+	if recorded != nil {
+		resp.Body = recorder.Tee(recorded, resp.Body)
+	}
+
 	bodyReader = &LoggedReader{
 		reader:     resp.Body,
 		logger:     logger,
 		start:      start,
 		queryID:    chQueryID,
+		runningID:  runningID,
 		read_rows:  read_rows,
 		read_bytes: read_bytes,
 	}
@@ -405,6 +457,49 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 	return
 }
 
+// recordQuery returns the query for the recording, the read post body is replaced by the copy
+func recordQuery(query string, postBody io.Reader, encoding ContentEncoding, extData *ExternalData) (*record.Query, io.Reader, error) {
+	q := &record.Query{Query: query}
+
+	if postBody != nil {
+		body, err := io.ReadAll(postBody)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		q.Body = body
+		postBody = bytes.NewReader(body)
+
+		if encoding != ContentEncodingNone {
+			q.Encoding = string(encoding)
+		}
+	}
+
+	if extData != nil {
+		for _, t := range extData.Tables {
+			structure := make([]string, 0, len(t.Columns))
+			for _, c := range t.Columns {
+				structure = append(structure, c.String())
+			}
+
+			q.External = append(q.External, record.ExternalTable{
+				Name:      t.Name,
+				Structure: strings.Join(structure, ","),
+				Format:    t.Format,
+				Data:      t.Data,
+			})
+		}
+	}
+
+	return q, postBody, nil
+}
+
+func recordResponse(q *record.Query, body []byte) {
+	if q != nil {
+		q.Response = body
+	}
+}
+
 func getQueryStats(resp *http.Response, statsHeaderName string) (queryStats, error) {
 	read_rows := int64(-1)
 	read_bytes := int64(-1)
@@ -0,0 +1,118 @@
+package clickhouse
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type runningQuery struct {
+	dsn  string
+	opts Options
+}
+
+// running queries by query_id, for cancel them on shutdown
+var (
+	runningLock sync.Mutex
+	running     = make(map[string]runningQuery)
+)
+
+func startQuery(queryID, dsn string, opts Options) {
+	runningLock.Lock()
+	running[queryID] = runningQuery{dsn: dsn, opts: opts}
+	runningLock.Unlock()
+}
+
+func finishQuery(queryID string) {
+	runningLock.Lock()
+	delete(running, queryID)
+	runningLock.Unlock()
+}
+
+// Running returns query_id of the not finished queries
+func Running() []string {
+	runningLock.Lock()
+
+	ids := make([]string, 0, len(running))
+	for id := range running {
+		ids = append(ids, id)
+	}
+
+	runningLock.Unlock()
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// killDSN strips query settings (like max_execution_time), except credentials
+func killDSN(dsn string) string {
+	p, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+
+	q := p.Query()
+	for k := range q {
+		if k != "user" && k != "password" && k != "database" {
+			q.Del(k)
+		}
+	}
+
+	p.RawQuery = q.Encode()
+
+	return p.String()
+}
+
+// KillRunning sends KILL QUERY for all not finished queries, grouped by ClickHouse DSN
+func KillRunning(ctx context.Context, logger *zap.Logger) int {
+	byDSN := make(map[string][]string)
+	opts := make(map[string]Options)
+
+	runningLock.Lock()
+
+	for id, q := range running {
+		byDSN[q.dsn] = append(byDSN[q.dsn], id)
+		opts[q.dsn] = q.opts
+	}
+
+	runningLock.Unlock()
+
+	killed := 0
+
+	for dsn, ids := range byDSN {
+		sort.Strings(ids)
+
+		quoted := make([]string, len(ids))
+		for i := range ids {
+			quoted[i] = quoteString(ids[i])
+		}
+
+		query := "KILL QUERY WHERE query_id IN (" + strings.Join(quoted, ",") + ") ASYNC"
+
+		o := opts[dsn]
+		o.CheckRequestProgress = false
+
+		if o.Timeout <= 0 || o.Timeout > 5*time.Second {
+			o.Timeout = 5 * time.Second
+		}
+
+		if _, _, _, err := Query(ctx, killDSN(dsn), query, o, nil); err != nil {
+			logger.Error("kill queries", zap.Strings("query_id", ids), zap.Error(err))
+			continue
+		}
+
+		killed += len(ids)
+	}
+
+	return killed
+}
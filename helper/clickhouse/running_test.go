@@ -0,0 +1,75 @@
+package clickhouse
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestKillRunning(t *testing.T) {
+	var (
+		lock   sync.Mutex
+		killed []string
+	)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasPrefix(string(body), "KILL QUERY") {
+			assert.Empty(t, r.URL.Query().Get("max_execution_time"))
+
+			lock.Lock()
+			killed = append(killed, string(body))
+			lock.Unlock()
+
+			close(release)
+
+			return
+		}
+
+		close(started)
+		<-release
+	}))
+	defer srv.Close()
+
+	done := make(chan error)
+
+	go func() {
+		_, _, _, err := Query(context.Background(), srv.URL+"/?max_execution_time=60", "SELECT sleep(60)", Options{Timeout: 10 * time.Second, ConnectTimeout: time.Second}, nil)
+		done <- err
+	}()
+
+	<-started
+
+	ids := Running()
+	require.Len(t, ids, 1)
+
+	assert.Equal(t, 1, KillRunning(context.Background(), zap.NewNop()))
+	require.NoError(t, <-done)
+
+	assert.Equal(t, []string{"KILL QUERY WHERE query_id IN ('" + ids[0] + "') ASYNC"}, killed)
+	assert.Empty(t, Running())
+}
+
+func TestRunningFinishedOnError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Code: 60. DB::Exception: Table default.graphite does not exist", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	_, _, _, err := Query(context.Background(), srv.URL, "SELECT 1", Options{Timeout: time.Second, ConnectTimeout: time.Second}, nil)
+	require.Error(t, err)
+
+	assert.Empty(t, Running())
+}
@@ -17,3 +17,13 @@ func NewHttpError(statusCode int, message string) *HttpError {
 func (e *HttpError) Error() string {
 	return strconv.Itoa(e.statusCode) + ": " + e.message
 }
+
+// StatusCode returns HTTP status of the response
+func (e *HttpError) StatusCode() int {
+	return e.statusCode
+}
+
+// Message returns the body of the response
+func (e *HttpError) Message() string {
+	return e.message
+}
@@ -0,0 +1,33 @@
+package client
+
+import (
+	"io"
+	"net/http"
+)
+
+// Raw do the request with URI as it's received by graphite-clickhouse, e.g. from the access log. Statuses other than
+// 200 and 404 are returned as HttpError
+func Raw(client *http.Client, address, method, uri string) (int, []byte, error) {
+	req, err := http.NewRequest(method, address+uri, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return resp.StatusCode, nil, NewHttpError(resp.StatusCode, string(b))
+	}
+
+	return resp.StatusCode, b, nil
+}
@@ -227,13 +227,19 @@ func Decode(b []byte, format FormatType) ([]Metric, error) {
 				}
 			}
 
+			// metadata keys are absent in replies of old versions
+			consolidationFunc, _ := m["consolidationFunc"].(string)
+			xFilesFactor, _ := m["xFilesFactor"].(float64)
+
 			metrics = append(metrics, Metric{
-				Name:           m["name"].(string),
-				PathExpression: m["pathExpression"].(string),
-				StartTime:      m["start"].(int64),
-				StopTime:       m["end"].(int64),
-				StepTime:       m["step"].(int64),
-				Values:         values,
+				Name:              m["name"].(string),
+				PathExpression:    m["pathExpression"].(string),
+				ConsolidationFunc: consolidationFunc,
+				StartTime:         m["start"].(int64),
+				StopTime:          m["end"].(int64),
+				StepTime:          m["step"].(int64),
+				XFilesFactor:      float32(xFilesFactor),
+				Values:            values,
 			})
 		}
 	case FormatJSON:
@@ -258,12 +264,17 @@ func Decode(b []byte, format FormatType) ([]Metric, error) {
 			}
 
 			metrics = append(metrics, Metric{
-				Name:           m.Name,
-				PathExpression: m.PathExpression,
-				StartTime:      m.StartTime,
-				StopTime:       m.StopTime,
-				StepTime:       m.StepTime,
-				Values:         values,
+				Name:              m.Name,
+				PathExpression:    m.PathExpression,
+				ConsolidationFunc: m.ConsolidationFunc,
+				StartTime:         m.StartTime,
+				StopTime:          m.StopTime,
+				StepTime:          m.StepTime,
+				XFilesFactor:      m.XFilesFactor,
+				Values:            values,
+				AppliedFunctions:  m.AppliedFunctions,
+				RequestStartTime:  m.RequestStartTime,
+				RequestStopTime:   m.RequestStopTime,
 			})
 		}
 	default:
@@ -279,10 +290,15 @@ type jsonResponse struct {
 }
 
 type jsonMetric struct {
-	Name           string     `json:"name"`
-	PathExpression string     `json:"pathExpression"`
-	Values         []*float64 `json:"values"`
-	StartTime      int64      `json:"startTime"`
-	StopTime       int64      `json:"stopTime"`
-	StepTime       int64      `json:"stepTime"`
+	Name              string     `json:"name"`
+	PathExpression    string     `json:"pathExpression"`
+	ConsolidationFunc string     `json:"consolidationFunc"`
+	Values            []*float64 `json:"values"`
+	StartTime         int64      `json:"startTime"`
+	StopTime          int64      `json:"stopTime"`
+	StepTime          int64      `json:"stepTime"`
+	XFilesFactor      float32    `json:"xFilesFactor"`
+	AppliedFunctions  []string   `json:"appliedFunctions"`
+	RequestStartTime  int64      `json:"requestStartTime"`
+	RequestStopTime   int64      `json:"requestStopTime"`
 }
@@ -2,6 +2,9 @@ package headers
 
 import "net/http"
 
+// PartialResponse is set with the warning, if the response is truncated to the metrics limit
+const PartialResponse = "X-Gch-Partial-Response"
+
 func GetHeaders(header *http.Header, keys []string) map[string]string {
 	if len(keys) > 0 {
 		headers := make(map[string]string)
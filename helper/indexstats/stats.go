@@ -0,0 +1,158 @@
+package indexstats
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lomik/zapwriter"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+var timeoutStatsLoad = time.Minute
+
+// Level contains the statistics of the index tree nodes on the level
+type Level struct {
+	Nodes uint64 // count of the nodes
+	Names uint64 // count of the unique node names
+}
+
+// Stats contains the per-level statistics of the index tree, which is refreshed from the index table
+type Stats struct {
+	mu        sync.RWMutex
+	levels    map[int]Level
+	tlsConfig *tls.Config
+	addr      string
+	table     string
+	interval  time.Duration
+}
+
+// New returns the static statistics
+func New(levels map[int]Level) *Stats {
+	return &Stats{levels: levels}
+}
+
+// NewAuto returns the statistics, which is loaded from the index table every interval
+func NewAuto(addr string, tlsConfig *tls.Config, table string, interval time.Duration) *Stats {
+	s := &Stats{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		table:     table,
+		interval:  interval,
+	}
+
+	go s.updateWorker()
+
+	return s
+}
+
+// Levels returns the statistics per level, it's nil until the first load
+func (s *Stats) Levels() map[int]Level {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	levels := s.levels
+	s.mu.RUnlock()
+
+	return levels
+}
+
+// Load reads the statistics of the tree nodes, which are stored with the constant date and Level = 20000+level
+func Load(addr string, tlsConfig *tls.Config, table string) (map[int]Level, error) {
+	query := fmt.Sprintf(
+		"SELECT Level - 20000 AS level, uniq(Path) AS nodes, uniq(splitByChar('.', Path)[level]) AS names FROM %s "+
+			"WHERE (Date = '1970-02-12') AND (Level > 20000) AND (Level < 30000) GROUP BY level FORMAT TabSeparatedRaw",
+		table,
+	)
+
+	body, _, _, err := clickhouse.Query(
+		scope.New(context.Background()).WithLogger(zapwriter.Logger("index-stats")).WithTable(table),
+		addr,
+		query,
+		clickhouse.Options{
+			Timeout:                 timeoutStatsLoad,
+			ConnectTimeout:          timeoutStatsLoad,
+			TLSConfig:               tlsConfig,
+			CheckRequestProgress:    false,
+			ProgressSendingInterval: 10 * time.Second,
+		},
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return parse(body)
+}
+
+func parse(body []byte) (map[int]Level, error) {
+	levels := make(map[int]Level)
+
+	for _, line := range bytes.Split(body, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+
+		fields := bytes.Split(line, []byte{'\t'})
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid index stats row %q", line)
+		}
+
+		level, err := strconv.Atoi(string(fields[0]))
+		if err != nil {
+			return nil, err
+		}
+
+		var l Level
+
+		if l.Nodes, err = strconv.ParseUint(string(fields[1]), 10, 64); err != nil {
+			return nil, err
+		}
+
+		if l.Names, err = strconv.ParseUint(string(fields[2]), 10, 64); err != nil {
+			return nil, err
+		}
+
+		levels[level] = l
+	}
+
+	return levels, nil
+}
+
+func (s *Stats) update() error {
+	levels, err := Load(s.addr, s.tlsConfig, s.table)
+	if err != nil {
+		zapwriter.Logger("index-stats").Error(fmt.Sprintf("index stats update failed for table %#v", s.table), zap.Error(err))
+		return err
+	}
+
+	s.mu.Lock()
+	s.levels = levels
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *Stats) updateWorker() {
+	for {
+		err := s.update()
+
+		// If we still have no stats - try every second to fetch them
+		if err != nil && s.Levels() == nil {
+			time.Sleep(1 * time.Second)
+		} else if s.interval != 0 {
+			time.Sleep(s.interval)
+		} else {
+			break
+		}
+	}
+}
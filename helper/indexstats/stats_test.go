@@ -0,0 +1,42 @@
+package indexstats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+)
+
+func TestLoad(t *testing.T) {
+	srv := clickhouse.NewFakeServer()
+	defer srv.Close()
+
+	require.NoError(t, srv.AddIndex("graphite_index", time.Now(),
+		"DB.postgres.host1.cpu",
+		"DB.postgres.host2.cpu",
+		"DB.mysql.host1.cpu",
+		"Servers.host1.cpu",
+	))
+
+	levels, err := Load(srv.URL, nil, "graphite_index")
+	require.NoError(t, err)
+
+	assert.Equal(t, map[int]Level{
+		1: {Nodes: 2, Names: 2},
+		2: {Nodes: 3, Names: 3},
+		3: {Nodes: 4, Names: 3},
+		4: {Nodes: 3, Names: 1},
+	}, levels)
+}
+
+func TestParse(t *testing.T) {
+	levels, err := parse([]byte("1\t10\t10\n2\t1000\t25\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[int]Level{1: {Nodes: 10, Names: 10}, 2: {Nodes: 1000, Names: 25}}, levels)
+
+	_, err = parse([]byte("1\t10\n"))
+	assert.Error(t, err)
+}
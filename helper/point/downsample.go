@@ -0,0 +1,172 @@
+package point
+
+import "math"
+
+// alignedStart returns the first timestamp multiple of step, which is not less than from
+func alignedStart(from, step uint32) uint32 {
+	start := from - from%step
+	if start < from {
+		start += step
+	}
+
+	return start
+}
+
+// buckets splits ordered points of one metric into the time intervals [start+N*width, start+(N+1)*width) and returns
+// them with the intervals start time. Points before start are added to the first interval, NaN values are skipped.
+func buckets(points []Point, start, width uint32) ([][]Point, []uint32) {
+	result := make([][]Point, 0)
+	times := make([]uint32, 0)
+
+	for i := range points {
+		if math.IsNaN(points[i].Value) {
+			continue
+		}
+
+		bucketStart := start
+		if points[i].Time > start {
+			bucketStart = points[i].Time - (points[i].Time-start)%width
+		}
+
+		if len(times) == 0 || bucketStart != times[len(times)-1] {
+			times = append(times, bucketStart)
+			result = append(result, make([]Point, 0, 1))
+		}
+
+		result[len(result)-1] = append(result[len(result)-1], points[i])
+	}
+
+	return result, times
+}
+
+// LTTB accepts an ordered []Point for one metric and downsamples them with Largest-Triangle-Three-Buckets algorithm.
+// One point is selected for every interval of step, beginning from the first multiple of step after from. The point is
+// returned with the interval start time. It forms the largest triangle with the point selected for the previous
+// interval and the average of the next one.
+func LTTB(points []Point, from, step uint32) []Point {
+	bb, times := buckets(points, alignedStart(from, step), step)
+	result := make([]Point, 0, len(bb))
+
+	var a Point
+
+	for i, b := range bb {
+		if i == 0 {
+			// the first point of the series is the left vertex for the first bucket
+			a = b[0]
+		}
+
+		// the right vertex is the average of the next bucket, or the last point of the series
+		var cTime, cValue float64
+		if i+1 < len(bb) {
+			for _, p := range bb[i+1] {
+				cTime += float64(p.Time)
+				cValue += p.Value
+			}
+
+			cTime /= float64(len(bb[i+1]))
+			cValue /= float64(len(bb[i+1]))
+		} else {
+			cTime, cValue = float64(b[len(b)-1].Time), b[len(b)-1].Value
+		}
+
+		selected := b[0]
+		maxArea := -1.0
+
+		for _, p := range b {
+			area := math.Abs((float64(a.Time)-cTime)*(p.Value-a.Value) - (float64(a.Time)-float64(p.Time))*(cValue-a.Value))
+			if area > maxArea {
+				maxArea = area
+				selected = p
+			}
+		}
+
+		a = selected
+		selected.Time = times[i]
+		result = append(result, selected)
+	}
+
+	return result
+}
+
+// MinMax accepts an ordered []Point for one metric and downsamples them to the min and max envelope.
+// Every interval of 2*step, beginning from the first multiple of step after from, returns two points: min and max in
+// the order of their appearance. Points keep their own step-aligned time, when it's possible, so the interval in the
+// end of [from, until] may return only one point.
+func MinMax(points []Point, from, until, step uint32) []Point {
+	bb, times := buckets(points, alignedStart(from, step), 2*step)
+	result := make([]Point, 0, 2*len(bb))
+
+	for i, b := range bb {
+		start := times[i]
+
+		min, max := b[0], b[0]
+
+		for _, p := range b[1:] {
+			if p.Value < min.Value {
+				min = p
+			}
+
+			if p.Value > max.Value {
+				max = p
+			}
+		}
+
+		if min.Time == max.Time {
+			min.Time = slotTime(min, start, step)
+			result = append(result, min)
+
+			continue
+		}
+
+		first, second := min, max
+		if max.Time < min.Time {
+			first, second = max, min
+		}
+
+		first.Time = slotTime(first, start, step)
+		second.Time = slotTime(second, start, step)
+
+		if first.Time == second.Time {
+			if first.Time == start+step {
+				first.Time = start
+			} else if second.Time = start + step; second.Time > until {
+				// the interval has the only slot, keep the point farther from the previous one, so the peak isn't lost
+				second.Time = first.Time
+				result = append(result, extreme(result, first, second))
+				continue
+			}
+		}
+
+		result = append(result, first, second)
+	}
+
+	return result
+}
+
+// extreme returns the point of a and b, which is farther from the last point of result, or the max of them for the
+// first point
+func extreme(result []Point, a, b Point) Point {
+	if a.Value < b.Value {
+		a, b = b, a
+	}
+
+	if len(result) == 0 {
+		return a
+	}
+
+	last := result[len(result)-1].Value
+	if math.Abs(b.Value-last) > math.Abs(a.Value-last) {
+		return b
+	}
+
+	return a
+}
+
+// slotTime returns the start or the middle of the interval [start, start+2*step) for the point
+func slotTime(p Point, start, step uint32) uint32 {
+	if p.Time >= start+step {
+		return start + step
+	}
+
+	return start
+}
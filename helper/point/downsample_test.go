@@ -0,0 +1,134 @@
+package point
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pointsFromValues(start, step uint32, values ...float64) []Point {
+	points := make([]Point, 0, len(values))
+
+	for i, v := range values {
+		points = append(points, Point{MetricID: 1, Time: start + uint32(i)*step, Value: v})
+	}
+
+	return points
+}
+
+func TestLTTB(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     []Point
+		step   uint32
+		expect []Point
+	}{
+		{
+			name:   "empty",
+			in:     []Point{},
+			step:   60,
+			expect: []Point{},
+		},
+		{
+			name:   "step is not changed",
+			in:     pointsFromValues(60, 60, 1, 2, 3),
+			step:   60,
+			expect: pointsFromValues(60, 60, 1, 2, 3),
+		},
+		{
+			name: "peaks are kept",
+			in:   pointsFromValues(0, 60, 1, 1, 10, 1, 1, 1, -10, 1, 1),
+			step: 180,
+			expect: []Point{
+				{MetricID: 1, Time: 0, Value: 10},
+				{MetricID: 1, Time: 180, Value: 1},
+				{MetricID: 1, Time: 360, Value: -10},
+			},
+		},
+		{
+			name: "NaN and absent points",
+			in: []Point{
+				{MetricID: 1, Time: 0, Value: 1},
+				{MetricID: 1, Time: 60, Value: nan},
+				{MetricID: 1, Time: 360, Value: 5},
+			},
+			step: 120,
+			expect: []Point{
+				{MetricID: 1, Time: 0, Value: 1},
+				{MetricID: 1, Time: 360, Value: 5},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, LTTB(tt.in, 0, tt.step))
+		})
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     []Point
+		step   uint32
+		expect []Point
+	}{
+		{
+			name:   "empty",
+			in:     []Point{},
+			step:   60,
+			expect: []Point{},
+		},
+		{
+			name:   "step is not changed",
+			in:     pointsFromValues(0, 60, 1, 2, 3, 4),
+			step:   60,
+			expect: pointsFromValues(0, 60, 1, 2, 3, 4),
+		},
+		{
+			name: "envelope",
+			in:   pointsFromValues(0, 60, 5, 9, 1, 3, 2, 2, 0, 8),
+			step: 120,
+			expect: []Point{
+				{MetricID: 1, Time: 0, Value: 9},
+				{MetricID: 1, Time: 120, Value: 1},
+				{MetricID: 1, Time: 240, Value: 0},
+				{MetricID: 1, Time: 360, Value: 8},
+			},
+		},
+		{
+			name: "single point in interval",
+			in: []Point{
+				{MetricID: 1, Time: 60, Value: 1},
+				{MetricID: 1, Time: 300, Value: 2},
+				{MetricID: 1, Time: 360, Value: nan},
+			},
+			step: 120,
+			expect: []Point{
+				{MetricID: 1, Time: 0, Value: 1},
+				{MetricID: 1, Time: 240, Value: 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, MinMax(tt.in, 0, 1000, tt.step))
+		})
+	}
+
+	// intervals begin from the aligned from, the last one is cut by until and keeps the peak
+	assert.Equal(t, []Point{
+		{MetricID: 1, Time: 120, Value: 1},
+		{MetricID: 1, Time: 240, Value: 5},
+		{MetricID: 1, Time: 360, Value: 9},
+	}, MinMax(pointsFromValues(60, 60, 3, 1, 5, 2, 3, 4, 9), 100, 479, 120))
+
+	// the dip is kept too
+	assert.Equal(t, []Point{
+		{MetricID: 1, Time: 120, Value: 1},
+		{MetricID: 1, Time: 240, Value: 5},
+		{MetricID: 1, Time: 360, Value: 0},
+	}, MinMax(pointsFromValues(60, 60, 3, 1, 5, 2, 3, 4, 0), 100, 479, 120))
+}
@@ -13,6 +13,7 @@ type Points struct {
 	steps   []uint32
 	aggs    []*string
 	uniqAgg []string
+	xffs    []float32
 }
 
 // NextMetric returns the list of points for one metric name
@@ -130,6 +131,32 @@ func (pp *Points) SetAggregations(functions map[string][]string) {
 	}
 }
 
+// GetXFilesFactor returns xFilesFactor for given metric id, 0 when it isn't set
+func (pp *Points) GetXFilesFactor(id uint32) float32 {
+	i := int(id)
+	if i < 1 || len(pp.xffs) < i {
+		return 0
+	}
+
+	return pp.xffs[i-1]
+}
+
+// SetXFilesFactors accepts map of metric name as keys and xFilesFactor as values and sets them for existing metrics in Data.Points
+func (pp *Points) SetXFilesFactors(xffs map[string]float32) {
+	pp.xffs = nil
+	if len(xffs) == 0 {
+		return
+	}
+
+	pp.xffs = make([]float32, len(pp.metrics))
+
+	for m, xff := range xffs {
+		if id, ok := pp.idMap[m]; ok {
+			pp.xffs[id-1] = xff
+		}
+	}
+}
+
 func (pp *Points) Len() int {
 	return len(pp.list)
 }
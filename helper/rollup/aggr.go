@@ -1,16 +1,22 @@
 package rollup
 
 import (
+	"math"
+
 	"github.com/lomik/graphite-clickhouse/helper/point"
 )
 
+// RateFunction is the name of the counter-aware aggregation, it returns per-second rate of the monotonic counter
+const RateFunction = "rate"
+
 var AggrMap = map[string]*Aggr{
-	"avg":     {"avg", AggrAvg},
-	"max":     {"max", AggrMax},
-	"min":     {"min", AggrMin},
-	"sum":     {"sum", AggrSum},
-	"any":     {"any", AggrAny},
-	"anyLast": {"anyLast", AggrAnyLast},
+	"avg":        {"avg", AggrAvg},
+	"max":        {"max", AggrMax},
+	"min":        {"min", AggrMin},
+	"sum":        {"sum", AggrSum},
+	"any":        {"any", AggrAny},
+	"anyLast":    {"anyLast", AggrAnyLast},
+	RateFunction: {RateFunction, AggrRate},
 }
 
 type Aggr struct {
@@ -34,6 +40,11 @@ func (ag *Aggr) String() string {
 	return ag.name
 }
 
+// IsRate returns true for the counter-aware aggregation, which needs the last point of the previous interval
+func (ag *Aggr) IsRate() bool {
+	return ag != nil && ag.name == RateFunction
+}
+
 func (ag *Aggr) Do(points []point.Point) (r float64) {
 	if ag == nil || ag.f == nil {
 		return 0
@@ -103,3 +114,21 @@ func AggrAnyLast(points []point.Point) (r float64) {
 
 	return
 }
+
+// AggrRate returns per-second rate of the counter for points sorted by time. The decreased value is treated as the
+// counter reset, and the value itself is used as the increase then. NaN is returned when points cover no time.
+func AggrRate(points []point.Point) (r float64) {
+	if len(points) < 2 || points[len(points)-1].Time <= points[0].Time {
+		return math.NaN()
+	}
+
+	for i := 1; i < len(points); i++ {
+		if points[i].Value >= points[i-1].Value {
+			r += points[i].Value - points[i-1].Value
+		} else {
+			r += points[i].Value
+		}
+	}
+
+	return r / float64(points[len(points)-1].Time-points[0].Time)
+}
@@ -15,12 +15,13 @@ import (
 )
 
 type rollupRulesResponseRecord struct {
-	RuleType  RuleType `json:"rule_type"`
-	Regexp    string   `json:"regexp"`
-	Function  string   `json:"function"`
-	Age       string   `json:"age"`
-	Precision string   `json:"precision"`
-	IsDefault int      `json:"is_default"`
+	RuleType     RuleType `json:"rule_type"`
+	Regexp       string   `json:"regexp"`
+	Function     string   `json:"function"`
+	Age          string   `json:"age"`
+	Precision    string   `json:"precision"`
+	IsDefault    int      `json:"is_default"`
+	XFilesFactor *float32 `json:"xFilesFactor"`
 }
 type rollupRulesResponse struct {
 	Data []rollupRulesResponseRecord `json:"data"`
@@ -63,6 +64,8 @@ func parseJson(body []byte) (*Rules, error) {
 	defaultFunction := ""
 	defaultRetention := make([]Retention, 0)
 
+	var defaultXFilesFactor *float32
+
 	// var last *Pattern
 	for _, d := range resp.Data {
 		if d.IsDefault == 1 {
@@ -70,6 +73,10 @@ func parseJson(body []byte) (*Rules, error) {
 				defaultFunction = d.Function
 			}
 
+			if d.XFilesFactor != nil {
+				defaultXFilesFactor = d.XFilesFactor
+			}
+
 			if d.Age != "" && d.Precision != "" && d.Precision != "0" {
 				rt, err := makeRetention(&d)
 				if err != nil {
@@ -88,6 +95,10 @@ func parseJson(body []byte) (*Rules, error) {
 				})
 			}
 
+			if d.XFilesFactor != nil {
+				last().XFilesFactor = d.XFilesFactor
+			}
+
 			if d.Age != "" && d.Precision != "" && d.Precision != "0" {
 				rt, err := makeRetention(&d)
 				if err != nil {
@@ -99,11 +110,12 @@ func parseJson(body []byte) (*Rules, error) {
 		}
 	}
 
-	if defaultFunction != "" || len(defaultRetention) != 0 {
+	if defaultFunction != "" || len(defaultRetention) != 0 || defaultXFilesFactor != nil {
 		r.Pattern = append(r.Pattern, Pattern{
-			Regexp:    "",
-			Function:  defaultFunction,
-			Retention: defaultRetention,
+			Regexp:       "",
+			Function:     defaultFunction,
+			Retention:    defaultRetention,
+			XFilesFactor: defaultXFilesFactor,
 		})
 	}
 
@@ -3,6 +3,7 @@ package rollup
 import (
 	"encoding/xml"
 	"fmt"
+	"math"
 	"regexp"
 	"sort"
 	"strings"
@@ -139,8 +140,11 @@ type Pattern struct {
 	Regexp    string      `json:"regexp"`
 	Function  string      `json:"function"`
 	Retention []Retention `json:"retention"`
-	aggr      *Aggr
-	re        *regexp.Regexp
+	// XFilesFactor is the minimal ratio of the rollup intervals with points in the interval of aggregation.
+	// nil means it's not set by the pattern
+	XFilesFactor *float32 `json:"xFilesFactor,omitempty"`
+	aggr         *Aggr
+	re           *regexp.Regexp
 }
 
 type Rules struct {
@@ -198,6 +202,10 @@ func (p *Pattern) compile() error {
 		}
 	}
 
+	if p.XFilesFactor != nil && (*p.XFilesFactor < 0 || *p.XFilesFactor > 1) {
+		return fmt.Errorf("xFilesFactor %v for %#v is out of range [0, 1]", *p.XFilesFactor, p.Regexp)
+	}
+
 	if len(p.Retention) > 0 {
 		// reverse sort by age
 		sort.Slice(p.Retention, func(i, j int) bool { return p.Retention[i].Age < p.Retention[j].Age })
@@ -362,12 +370,42 @@ func lookup(metric string, age uint32, patterns []Pattern, verbose bool) (precis
 	return
 }
 
+// LookupXFilesFactor returns xFilesFactor of the first pattern matching the metric, which has it, or 0
+func (r *Rules) LookupXFilesFactor(metric string) float32 {
+	patterns := r.Pattern
+	if r.Separated {
+		patterns = r.PatternPlain
+		if strings.Contains(metric, "?") {
+			patterns = r.PatternTagged
+		}
+	}
+
+	for _, p := range patterns {
+		if p.XFilesFactor == nil || (p.re != nil && !p.re.MatchString(metric)) {
+			continue
+		}
+
+		return *p.XFilesFactor
+	}
+
+	return 0
+}
+
 // LookupBytes returns precision and aggregate function for metric name and age
 func (r *Rules) LookupBytes(metric []byte, age uint32, verbose bool) (precision uint32, ag *Aggr, aggrPattern, retentionPattern *Pattern) {
 	return r.Lookup(dry.UnsafeString(metric), age, verbose)
 }
 
+// RollupPrecision rolls up points of ONE metric sorted by time to the precision with the aggregation function
+func RollupPrecision(points []point.Point, precision uint32, aggr *Aggr) []point.Point {
+	return doMetricPrecision(points, precision, aggr)
+}
+
 func doMetricPrecision(points []point.Point, precision uint32, aggr *Aggr) []point.Point {
+	if aggr.IsRate() {
+		return doMetricRate(points, precision, aggr)
+	}
+
 	l := len(points)
 
 	var i, n int
@@ -406,6 +444,119 @@ func doMetricPrecision(points []point.Point, precision uint32, aggr *Aggr) []poi
 	return point.CleanUp(points)
 }
 
+// doMetricRate rolls up points of the counter. The aggregation gets the raw points of an interval together with the last
+// raw point of the previous one, so the increase between intervals isn't lost
+func doMetricRate(points []point.Point, precision uint32, aggr *Aggr) []point.Point {
+	window := make([]point.Point, 0)
+
+	var prev point.Point
+
+	// n - position of the first record with time rounded to precision
+	for n := 0; n < len(points); {
+		t := points[n].Time - points[n].Time%precision
+
+		i := n + 1
+		for i < len(points) && points[i].Time-points[i].Time%precision == t {
+			i++
+		}
+
+		window = window[:0]
+		if n > 0 {
+			window = append(window, prev)
+		}
+
+		window = append(window, points[n:i]...)
+		prev = points[i-1]
+
+		points[n].Value = aggr.Do(window)
+		points[n].Time = t
+
+		for j := n + 1; j < i; j++ {
+			points[j].MetricID = 0
+		}
+
+		n = i
+	}
+
+	return point.CleanUp(points)
+}
+
+// MinXFilesFactorPoints returns the minimal number of rollup intervals of precision with points, which are required
+// in the interval of step
+func MinXFilesFactorPoints(step, precision uint32, xff float32) int {
+	if precision == 0 {
+		return 1
+	}
+
+	return int(math.Ceil(float64(xff) * float64(step) / float64(precision)))
+}
+
+// doXFilesFactor removes points of the intervals of step, where less than xff share of the rollup intervals of precision
+// have points. Points must be sorted by time
+func doXFilesFactor(points []point.Point, step, precision uint32, xff float32) []point.Point {
+	minPoints := MinXFilesFactorPoints(step, precision, xff)
+	if minPoints <= 1 || len(points) == 0 {
+		return points
+	}
+
+	drop := func(p []point.Point) {
+		for i := range p {
+			p[i].MetricID = 0
+		}
+	}
+
+	// n - position of the first point in the current interval of step
+	n := 0
+	slots := 1
+
+	for i := 1; i < len(points); i++ {
+		if points[i].Time/step != points[n].Time/step {
+			if slots < minPoints {
+				drop(points[n:i])
+			}
+
+			n = i
+			slots = 1
+
+			continue
+		}
+
+		if points[i].Time/precision != points[i-1].Time/precision {
+			slots++
+		}
+	}
+
+	if slots < minPoints {
+		drop(points[n:])
+	}
+
+	return point.CleanUp(points)
+}
+
+// doRateXFilesFactor rolls up points of the counter and removes the rates of the intervals of step, where less than xff
+// share of the rollup intervals of precision have points. The rate of an interval depends on the previous one, so the
+// intervals are removed after the rollup.
+func doRateXFilesFactor(points []point.Point, step, precision uint32, xff float32, aggr *Aggr) []point.Point {
+	kept := doXFilesFactor(append([]point.Point(nil), points...), step, precision, xff)
+	rates := doMetricPrecision(points, step, aggr)
+
+	// k - position of the first kept point with time not less than the current rate
+	k := 0
+	result := rates[:0]
+
+	for _, r := range rates {
+		for k < len(kept) && kept[k].Time-kept[k].Time%step < r.Time {
+			k++
+		}
+
+		if k < len(kept) && kept[k].Time-kept[k].Time%step == r.Time {
+			result = append(result, r)
+		}
+	}
+
+	return result
+}
+
 // RollupMetricAge rolling up list of points of ONE metric sorted by key "time"
 // returns (new points slice, precision)
 func (r *Rules) RollupMetricAge(metricName string, age uint32, points []point.Point) ([]point.Point, uint32, error) {
@@ -458,7 +609,8 @@ func (r *Rules) RollupPoints(pp *point.Points, from int64, step int64) error {
 	oldPoints := pp.List()
 	newPoints := make([]point.Point, 0, pp.Len())
 	rollup := func(p []point.Point) ([]point.Point, error) {
-		metricName := pp.MetricName(p[0].MetricID)
+		id := p[0].MetricID
+		metricName := pp.MetricName(id)
 
 		var err error
 
@@ -466,11 +618,20 @@ func (r *Rules) RollupPoints(pp *point.Points, from int64, step int64) error {
 			p, _, err = r.RollupMetricAge(metricName, uint32(age), p)
 		} else {
 			_, agg, _, _ := r.Lookup(metricName, uint32(from), false)
-			p = doMetricPrecision(p, uint32(step), agg)
+			if xff := pp.GetXFilesFactor(id); xff > 0 {
+				precision, _, _, _ := r.Lookup(metricName, uint32(age), false)
+				if agg.IsRate() {
+					p = doRateXFilesFactor(p, uint32(step), precision, xff, agg)
+				} else {
+					p = doMetricPrecision(doXFilesFactor(p, uint32(step), precision, xff), uint32(step), agg)
+				}
+			} else {
+				p = doMetricPrecision(p, uint32(step), agg)
+			}
 		}
 
 		for i := range p {
-			p[i].MetricID = p[0].MetricID
+			p[i].MetricID = id
 		}
 
 		return p, err
@@ -2,6 +2,7 @@ package rollup
 
 import (
 	"fmt"
+	"math"
 	"regexp"
 	"strconv"
 	"testing"
@@ -33,6 +34,47 @@ func TestMetricPrecision(t *testing.T) {
 	}
 }
 
+func TestMetricPrecisionRate(t *testing.T) {
+	in := []point.Point{
+		{MetricID: 1, Time: 0, Value: 10},
+		{MetricID: 1, Time: 30, Value: 40},
+		// the increase between intervals belongs to the next one
+		{MetricID: 1, Time: 60, Value: 70},
+		// reset
+		{MetricID: 1, Time: 90, Value: 30},
+		{MetricID: 1, Time: 180, Value: 60},
+	}
+	out := []point.Point{
+		{MetricID: 1, Time: 0, Value: 1},
+		{MetricID: 1, Time: 60, Value: 1},
+		{MetricID: 1, Time: 180, Value: float64(30) / 90},
+	}
+
+	assert.Equal(t, out, doMetricPrecision(in, 60, AggrMap[RateFunction]))
+
+	// the first interval with one point has no rate
+	assert.Equal(t,
+		[]point.Point{{MetricID: 1, Time: 60, Value: 0.5}},
+		doMetricPrecision([]point.Point{{MetricID: 1, Time: 10, Value: 5}, {MetricID: 1, Time: 70, Value: 35}}, 60, AggrMap[RateFunction]),
+	)
+
+	assert.True(t, math.IsNaN(AggrRate([]point.Point{{Time: 10, Value: 5}})))
+
+	// xFilesFactor removes the sparse interval, but its points are used for the rate of the next one
+	assert.Equal(t,
+		[]point.Point{{MetricID: 1, Time: 0, Value: 1}, {MetricID: 1, Time: 120, Value: 0.375}},
+		doRateXFilesFactor([]point.Point{
+			{MetricID: 1, Time: 0, Value: 10},
+			{MetricID: 1, Time: 10, Value: 20},
+			{MetricID: 1, Time: 20, Value: 30},
+			{MetricID: 1, Time: 60, Value: 40},
+			{MetricID: 1, Time: 120, Value: 50},
+			{MetricID: 1, Time: 130, Value: 60},
+			{MetricID: 1, Time: 140, Value: 70},
+		}, 60, 10, 0.5, AggrMap[RateFunction]),
+	)
+}
+
 func Test_buildTaggedRegex(t *testing.T) {
 	tests := []struct {
 		tagsStr string
@@ -857,3 +899,84 @@ func BenchmarkLookupDefaultTaggedSeparated(b *testing.B) {
 		_ = ag
 	}
 }
+
+func TestXFilesFactor(t *testing.T) {
+	xml := `
+<graphite_rollup>
+	<pattern>
+		<regexp>^sparse\.</regexp>
+		<function>sum</function>
+		<xFilesFactor>0.2</xFilesFactor>
+	</pattern>
+	<pattern>
+		<regexp>^dense\.</regexp>
+		<retention>
+			<age>0</age>
+			<precision>10</precision>
+		</retention>
+	</pattern>
+	<default>
+		<function>avg</function>
+		<xFilesFactor>0.5</xFilesFactor>
+		<retention>
+			<age>0</age>
+			<precision>60</precision>
+		</retention>
+	</default>
+</graphite_rollup>`
+
+	json := `{"data": [
+		{"regexp": "^sparse\\.", "function": "sum", "age": "0", "precision": "0", "is_default": 0, "xFilesFactor": 0.2},
+		{"regexp": "^dense\\.", "function": "", "age": "0", "precision": "10", "is_default": 0},
+		{"regexp": "", "function": "avg", "age": "0", "precision": "60", "is_default": 1, "xFilesFactor": 0.5}
+	]}`
+
+	fromXML, err := parseXML([]byte(xml))
+	require.NoError(t, err)
+
+	fromJSON, err := parseJson([]byte(json))
+	require.NoError(t, err)
+
+	for name, r := range map[string]*Rules{"xml": fromXML, "json": fromJSON} {
+		assert.Equal(t, float32(0.2), r.LookupXFilesFactor("sparse.metric"), name)
+		// the default is used for patterns without xFilesFactor
+		assert.Equal(t, float32(0.5), r.LookupXFilesFactor("dense.metric"), name)
+		assert.Equal(t, float32(0.5), r.LookupXFilesFactor("other.metric"), name)
+	}
+
+	r, err := NewMockRules(nil, 60, "avg")
+	require.NoError(t, err)
+	assert.Equal(t, float32(0), r.LookupXFilesFactor("other.metric"))
+
+	_, err = parseXML([]byte(`<graphite_rollup><default><xFilesFactor>1.5</xFilesFactor></default></graphite_rollup>`))
+	assert.Error(t, err)
+}
+
+func TestRules_RollupPointsXFilesFactor(t *testing.T) {
+	r, err := parseCompact(`;sum;0:10`)
+	require.NoError(t, err)
+
+	timeNow = func() time.Time {
+		return time.Unix(10010, 0)
+	}
+
+	pp := point.NewPoints()
+	id := pp.MetricID("metric")
+	// 0-59: 3 intervals of 10s have points, 60-119: only one
+	pp.AppendPoint(id, 1.0, 0, 0)
+	pp.AppendPoint(id, 1.0, 5, 0)
+	pp.AppendPoint(id, 2.0, 20, 0)
+	pp.AppendPoint(id, 3.0, 50, 0)
+	pp.AppendPoint(id, 4.0, 60, 0)
+	pp.AppendPoint(id, 4.0, 61, 0)
+	pp.AppendPoint(id, 4.0, 62, 0)
+	pp.SetXFilesFactors(map[string]float32{"metric": 0.5})
+
+	require.NoError(t, r.RollupPoints(pp, 10000, 60))
+	assert.Equal(t, []point.Point{{MetricID: id, Value: 7.0, Time: 0}}, pp.List())
+	assert.Equal(t, float32(0.5), pp.GetXFilesFactor(id))
+
+	assert.Equal(t, 1, MinXFilesFactorPoints(60, 60, 1))
+	assert.Equal(t, 3, MinXFilesFactorPoints(60, 10, 0.5))
+	assert.Equal(t, 4, MinXFilesFactorPoints(60, 10, 0.51))
+}
@@ -9,6 +9,7 @@ import (
  	<pattern>
  		<regexp>click_cost</regexp>
  		<function>any</function>
+ 		<xFilesFactor>0.5</xFilesFactor>
  		<retention>
  			<age>0</age>
  			<precision>3600</precision>
@@ -46,10 +47,11 @@ type RetentionXML struct {
 }
 
 type PatternXML struct {
-	RuleType  RuleType        `xml:"rule_type"`
-	Regexp    string          `xml:"regexp"`
-	Function  string          `xml:"function"`
-	Retention []*RetentionXML `xml:"retention"`
+	RuleType     RuleType        `xml:"rule_type"`
+	Regexp       string          `xml:"regexp"`
+	Function     string          `xml:"function"`
+	XFilesFactor *float32        `xml:"xFilesFactor"`
+	Retention    []*RetentionXML `xml:"retention"`
 }
 
 type RulesXML struct {
@@ -63,10 +65,11 @@ func (r *RetentionXML) retention() Retention {
 
 func (p *PatternXML) pattern() Pattern {
 	result := Pattern{
-		RuleType:  p.RuleType,
-		Regexp:    p.Regexp,
-		Function:  p.Function,
-		Retention: make([]Retention, 0, len(p.Retention)),
+		RuleType:     p.RuleType,
+		Regexp:       p.Regexp,
+		Function:     p.Function,
+		XFilesFactor: p.XFilesFactor,
+		Retention:    make([]Retention, 0, len(p.Retention)),
 	}
 
 	for _, r := range p.Retention {
@@ -0,0 +1,1530 @@
+package clickhouse
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Value is the value of ClickHouse column: nil (NULL), string (String and Date as YYYY-MM-DD), uint8, uint16,
+// uint32, uint64, int64, float64, []Value (Array) or Tuple
+type Value = interface{}
+
+// Tuple is the value of ClickHouse Tuple
+type Tuple []Value
+
+// chError is the ClickHouse exception
+type chError struct {
+	code   int
+	name   string
+	status int
+	msg    string
+}
+
+func (e *chError) Error() string {
+	return fmt.Sprintf("Code: %d. DB::Exception: %s. (%s) (version fake)", e.code, e.msg, e.name)
+}
+
+func errSyntax(err error) error {
+	return &chError{code: 62, name: "SYNTAX_ERROR", status: http.StatusBadRequest, msg: err.Error()}
+}
+
+func errUnknownTable(name string) error {
+	return &chError{code: 60, name: "UNKNOWN_TABLE", status: http.StatusNotFound, msg: "Table default." + name + " doesn't exist"}
+}
+
+func errUnknownIdentifier(name string) error {
+	return &chError{code: 47, name: "UNKNOWN_IDENTIFIER", status: http.StatusNotFound, msg: "Missing columns: '" + name + "'"}
+}
+
+func errUnknownFunction(name string) error {
+	return &chError{code: 46, name: "UNKNOWN_FUNCTION", status: http.StatusNotFound, msg: "Unknown function " + name}
+}
+
+func errBadArguments(format string, args ...interface{}) error {
+	return &chError{code: 42, name: "NUMBER_OF_ARGUMENTS_DOESNT_MATCH", status: http.StatusBadRequest, msg: fmt.Sprintf(format, args...)}
+}
+
+func errIllegalType(format string, args ...interface{}) error {
+	return &chError{code: 43, name: "ILLEGAL_TYPE_OF_ARGUMENT", status: http.StatusBadRequest, msg: fmt.Sprintf(format, args...)}
+}
+
+func errNotImplemented(format string, args ...interface{}) error {
+	return &chError{code: 48, name: "NOT_IMPLEMENTED", status: http.StatusInternalServerError, msg: fmt.Sprintf(format, args...)}
+}
+
+// row is the set of named columns
+type row map[string]Value
+
+// evalContext evaluates expressions for the row, or for the group of rows in aggregating queries
+type evalContext struct {
+	exec    *executor
+	aliases map[string]expr
+	row     row
+	group   []row
+	grouped bool
+	params  map[string]Value
+	// resolving aliases refer to columns with the same names, as in argMax(Value, Timestamp) AS Value
+	resolving map[string]bool
+	// cache of aliases values for the row or group
+	cache map[string]Value
+}
+
+func (c *evalContext) forRow(r row) *evalContext {
+	return &evalContext{
+		exec:      c.exec,
+		aliases:   c.aliases,
+		row:       r,
+		resolving: c.resolving,
+		cache:     make(map[string]Value),
+	}
+}
+
+func (c *evalContext) forGroup(group []row) *evalContext {
+	return &evalContext{
+		exec:      c.exec,
+		aliases:   c.aliases,
+		group:     group,
+		grouped:   true,
+		resolving: c.resolving,
+		cache:     make(map[string]Value),
+	}
+}
+
+func (c *evalContext) withParams(names []string, values []Value) *evalContext {
+	params := make(map[string]Value, len(c.params)+len(names))
+	for k, v := range c.params {
+		params[k] = v
+	}
+
+	for i, name := range names {
+		params[name] = values[i]
+	}
+
+	l := *c
+	l.params = params
+
+	return &l
+}
+
+func (c *evalContext) lookup(name string) (Value, error) {
+	if v, ok := c.params[name]; ok {
+		return v, nil
+	}
+
+	if e, ok := c.aliases[name]; ok && !c.resolving[name] {
+		if v, ok := c.cache[name]; ok {
+			return v, nil
+		}
+
+		c.resolving[name] = true
+		v, err := c.eval(e)
+		delete(c.resolving, name)
+
+		if err == nil {
+			c.cache[name] = v
+		}
+
+		return v, err
+	}
+
+	r := c.row
+	if c.grouped {
+		if len(c.group) == 0 {
+			return nil, nil
+		}
+
+		r = c.group[0]
+	}
+
+	if v, ok := r[name]; ok {
+		return v, nil
+	}
+
+	return nil, errUnknownIdentifier(name)
+}
+
+func (c *evalContext) eval(e expr) (Value, error) {
+	switch e := e.(type) {
+	case *literal:
+		return e.value, nil
+	case *ident:
+		return c.lookup(e.name)
+	case *call:
+		return c.evalCall(e)
+	case *index:
+		return c.evalIndex(e)
+	case *tupleElement:
+		v, err := c.eval(e.tuple)
+		if err != nil || v == nil {
+			return nil, err
+		}
+
+		t, ok := v.(Tuple)
+		if !ok {
+			return nil, errIllegalType("%v is not a tuple", v)
+		}
+
+		if e.n < 1 || e.n > len(t) {
+			return nil, errBadArguments("tuple index %d is out of range", e.n)
+		}
+
+		return t[e.n-1], nil
+	case *inExpr:
+		return c.evalIn(e)
+	case *subquery:
+		res, err := c.exec.scalar(e.query)
+		if err != nil {
+			return nil, err
+		}
+
+		return res, nil
+	case *lambda:
+		return nil, errIllegalType("lambda is allowed only as an argument of higher-order function")
+	default:
+		return nil, errNotImplemented("expression %T", e)
+	}
+}
+
+func (c *evalContext) evalIndex(e *index) (Value, error) {
+	v, err := c.eval(e.array)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	i, err := c.eval(e.index)
+	if err != nil {
+		return nil, err
+	}
+
+	n, ok := toInt64(i)
+	if !ok {
+		return nil, errIllegalType("array index must be integer, got %v", i)
+	}
+
+	switch a := v.(type) {
+	case []Value:
+		if n < 0 {
+			n += int64(len(a)) + 1
+		}
+
+		if n < 1 || n > int64(len(a)) {
+			return defaultOf(a), nil
+		}
+
+		return a[n-1], nil
+	case Tuple:
+		if n < 1 || n > int64(len(a)) {
+			return nil, errBadArguments("tuple index %d is out of range", n)
+		}
+
+		return a[n-1], nil
+	default:
+		return nil, errIllegalType("%v is not an array", v)
+	}
+}
+
+// defaultOf returns the default value for the type of array elements
+func defaultOf(a []Value) Value {
+	if len(a) == 0 {
+		return nil
+	}
+
+	switch a[0].(type) {
+	case string:
+		return ""
+	case uint8:
+		return uint8(0)
+	case uint16:
+		return uint16(0)
+	case uint32:
+		return uint32(0)
+	case uint64:
+		return uint64(0)
+	case int64:
+		return int64(0)
+	case float64:
+		return float64(0)
+	case []Value:
+		return []Value{}
+	default:
+		return nil
+	}
+}
+
+func (c *evalContext) evalIn(e *inExpr) (Value, error) {
+	v, err := c.eval(e.value)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	var set map[string]bool
+
+	switch {
+	case e.table != "":
+		set, err = c.exec.tableSet(e.table)
+	case e.query != nil:
+		set, err = c.exec.querySet(e.query)
+	default:
+		set = make(map[string]bool, len(e.list))
+
+		for _, item := range e.list {
+			iv, err := c.eval(item)
+			if err != nil {
+				return nil, err
+			}
+
+			set[valueKey(iv)] = true
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return boolValue(set[valueKey(v)] != e.not), nil
+}
+
+func (c *evalContext) evalArgs(args []expr) ([]Value, error) {
+	values := make([]Value, len(args))
+
+	for i, a := range args {
+		v, err := c.eval(a)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = v
+	}
+
+	return values, nil
+}
+
+func (c *evalContext) evalCall(e *call) (Value, error) {
+	if e.name == "arrayJoin" {
+		v, ok := c.row[arrayJoinColumn(e)]
+		if !ok && c.grouped && len(c.group) != 0 {
+			v, ok = c.group[0][arrayJoinColumn(e)]
+		}
+
+		if !ok {
+			return nil, errNotImplemented("arrayJoin is supported only in SELECT")
+		}
+
+		return v, nil
+	}
+
+	if _, ok := aggregateFunction(e.name); ok {
+		return c.evalAggregate(e)
+	}
+
+	switch e.name {
+	case "and", "or":
+		left, err := c.eval(e.args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if (e.name == "and" && left != nil && !isTrue(left)) || (e.name == "or" && isTrue(left)) {
+			return boolValue(e.name == "or"), nil
+		}
+
+		right, err := c.eval(e.args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		if left == nil || right == nil {
+			if e.name == "and" && right != nil && !isTrue(right) {
+				return uint8(0), nil
+			}
+
+			if e.name == "or" && isTrue(right) {
+				return uint8(1), nil
+			}
+
+			return nil, nil
+		}
+
+		return boolValue(isTrue(right)), nil
+	case "if":
+		if len(e.args) != 3 {
+			return nil, errBadArguments("if requires 3 arguments")
+		}
+
+		cond, err := c.eval(e.args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if isTrue(cond) {
+			return c.eval(e.args[1])
+		}
+
+		return c.eval(e.args[2])
+	}
+
+	if f, ok := higherOrderFunctions[e.name]; ok {
+		if len(e.args) < 2 {
+			return nil, errBadArguments("%s requires a function and arrays", e.name)
+		}
+
+		arrays := make([][]Value, 0, len(e.args))
+
+		l, ok := e.args[0].(*lambda)
+
+		args := e.args[1:]
+		if !ok {
+			if e.name != "arraySort" {
+				return nil, errIllegalType("first argument of %s must be a function", e.name)
+			}
+
+			args = e.args
+		}
+
+		for _, a := range args {
+			v, err := c.eval(a)
+			if err != nil {
+				return nil, err
+			}
+
+			array, ok := v.([]Value)
+			if !ok {
+				return nil, errIllegalType("argument of %s must be an array, got %v", e.name, v)
+			}
+
+			if len(arrays) != 0 && len(array) != len(arrays[0]) {
+				return nil, &chError{code: 190, name: "SIZES_OF_ARRAYS_DONT_MATCH", status: http.StatusBadRequest, msg: "Arrays passed to " + e.name + " must have equal size"}
+			}
+
+			arrays = append(arrays, array)
+		}
+
+		if l != nil && len(l.params) != len(arrays) {
+			return nil, errBadArguments("lambda of %s requires %d arguments", e.name, len(arrays))
+		}
+
+		apply := func(i int) (Value, error) {
+			if l == nil {
+				return arrays[0][i], nil
+			}
+
+			values := make([]Value, len(arrays))
+			for j := range arrays {
+				values[j] = arrays[j][i]
+			}
+
+			return c.withParams(l.params, values).eval(l.body)
+		}
+
+		return f(arrays, apply)
+	}
+
+	f, ok := scalarFunctions[e.name]
+	if !ok {
+		return nil, errUnknownFunction(e.name)
+	}
+
+	args, err := c.evalArgs(e.args)
+	if err != nil {
+		return nil, err
+	}
+
+	return f(args)
+}
+
+func (c *evalContext) evalAggregate(e *call) (Value, error) {
+	if !c.grouped {
+		return nil, &chError{code: 184, name: "ILLEGAL_AGGREGATION", status: http.StatusBadRequest, msg: "Aggregate function " + e.name + " is found in wrong place in query"}
+	}
+
+	name, resample := e.name, false
+	if strings.HasSuffix(name, "Resample") {
+		name, resample = strings.TrimSuffix(name, "Resample"), true
+	}
+
+	newAggregator, _ := aggregateFunction(name)
+
+	if !resample {
+		agg := newAggregator()
+
+		for _, r := range c.group {
+			args, err := c.forRow(r).evalArgs(e.args)
+			if err != nil {
+				return nil, err
+			}
+
+			if err = agg.add(args); err != nil {
+				return nil, err
+			}
+		}
+
+		return agg.result(), nil
+	}
+
+	// fResample(start, end, step)(args..., key) aggregates args in intervals [start + i*step, start + (i+1)*step)
+	params, err := c.evalArgs(e.params)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(params) != 3 || len(e.args) < 2 {
+		return nil, errBadArguments("%s requires (start, end, step) parameters and the resampling key", e.name)
+	}
+
+	start, ok1 := toInt64(params[0])
+	end, ok2 := toInt64(params[1])
+	step, ok3 := toInt64(params[2])
+
+	if !ok1 || !ok2 || !ok3 || step <= 0 || end < start {
+		return nil, errBadArguments("invalid parameters of %s", e.name)
+	}
+
+	aggs := make([]aggregator, (end-start+step-1)/step)
+	for i := range aggs {
+		aggs[i] = newAggregator()
+	}
+
+	for _, r := range c.group {
+		args, err := c.forRow(r).evalArgs(e.args)
+		if err != nil {
+			return nil, err
+		}
+
+		key, ok := toInt64(args[len(args)-1])
+		if !ok || key < start || key >= end {
+			continue
+		}
+
+		if err = aggs[(key-start)/step].add(args[:len(args)-1]); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]Value, len(aggs))
+	for i, agg := range aggs {
+		result[i] = agg.result()
+	}
+
+	return result, nil
+}
+
+func arrayJoinColumn(e *call) string {
+	return "\x00arrayJoin" + strconv.Itoa(e.id)
+}
+
+// walk calls f for every node of the expression, until f returns false
+func walk(e expr, f func(expr) bool) {
+	if !f(e) {
+		return
+	}
+
+	switch e := e.(type) {
+	case *call:
+		for _, p := range e.params {
+			walk(p, f)
+		}
+
+		for _, a := range e.args {
+			walk(a, f)
+		}
+	case *lambda:
+		walk(e.body, f)
+	case *index:
+		walk(e.array, f)
+		walk(e.index, f)
+	case *tupleElement:
+		walk(e.tuple, f)
+	case *inExpr:
+		walk(e.value, f)
+
+		for _, item := range e.list {
+			walk(item, f)
+		}
+	}
+}
+
+func isTrue(v Value) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case string:
+		return v != ""
+	default:
+		if f, ok := toFloat64(v); ok {
+			return f != 0
+		}
+
+		return true
+	}
+}
+
+func boolValue(b bool) Value {
+	if b {
+		return uint8(1)
+	}
+
+	return uint8(0)
+}
+
+func isNumber(v Value) bool {
+	switch v.(type) {
+	case uint8, uint16, uint32, uint64, int64, float64:
+		return true
+	}
+
+	return false
+}
+
+func toInt64(v Value) (int64, bool) {
+	switch v := v.(type) {
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		return i, err == nil
+	}
+
+	return 0, false
+}
+
+func toFloat64(v Value) (float64, bool) {
+	switch v := v.(type) {
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+// compareValues compares values of compatible types, numbers are compared with strings as numbers
+func compareValues(a, b Value) (int, error) {
+	if isNumber(a) && isNumber(b) {
+		_, af := a.(float64)
+		_, bf := b.(float64)
+		_, au := a.(uint64)
+		_, bu := b.(uint64)
+
+		if af || bf || au || bu {
+			x, _ := toFloat64(a)
+			y, _ := toFloat64(b)
+
+			return compareOrdered(x, y), nil
+		}
+
+		x, _ := toInt64(a)
+		y, _ := toInt64(b)
+
+		return compareOrdered(x, y), nil
+	}
+
+	as, aString := a.(string)
+	bs, bString := b.(string)
+
+	switch {
+	case aString && bString:
+		return strings.Compare(as, bs), nil
+	case aString && isNumber(b):
+		x, ok := toFloat64(as)
+		if !ok {
+			return 0, errIllegalType("cannot compare %q with number", as)
+		}
+
+		y, _ := toFloat64(b)
+
+		return compareOrdered(x, y), nil
+	case bString && isNumber(a):
+		c, err := compareValues(b, a)
+		return -c, err
+	}
+
+	x, xArray := toList(a)
+	y, yArray := toList(b)
+
+	if !xArray || !yArray {
+		return 0, errIllegalType("cannot compare %v with %v", a, b)
+	}
+
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if x[i] == nil || y[i] == nil {
+			continue
+		}
+
+		c, err := compareValues(x[i], y[i])
+		if err != nil || c != 0 {
+			return c, err
+		}
+	}
+
+	return compareOrdered(len(x), len(y)), nil
+}
+
+func toList(v Value) ([]Value, bool) {
+	switch v := v.(type) {
+	case []Value:
+		return v, true
+	case Tuple:
+		return v, true
+	}
+
+	return nil, false
+}
+
+func compareOrdered[T int | int64 | float64](x, y T) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// valueKey returns the key for grouping and sets, equal numbers of different types have the same key
+func valueKey(v Value) string {
+	switch v := v.(type) {
+	case nil:
+		return "\x00N"
+	case string:
+		return "s" + v
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			return "n" + strconv.FormatInt(int64(v), 10)
+		}
+
+		return "n" + strconv.FormatFloat(v, 'g', -1, 64)
+	case uint64:
+		return "n" + strconv.FormatUint(v, 10)
+	case []Value, Tuple:
+		list, _ := toList(v)
+
+		var b strings.Builder
+
+		b.WriteByte('[')
+
+		for _, item := range list {
+			k := valueKey(item)
+			b.WriteString(strconv.Itoa(len(k)))
+			b.WriteByte(':')
+			b.WriteString(k)
+		}
+
+		b.WriteByte(']')
+
+		return b.String()
+	default:
+		i, _ := toInt64(v)
+		return "n" + strconv.FormatInt(i, 10)
+	}
+}
+
+func rowKey(values []Value) string {
+	return valueKey(values)
+}
+
+var higherOrderFunctions = map[string]func(arrays [][]Value, apply func(int) (Value, error)) (Value, error){
+	"arrayMap": func(arrays [][]Value, apply func(int) (Value, error)) (Value, error) {
+		result := make([]Value, len(arrays[0]))
+
+		for i := range result {
+			v, err := apply(i)
+			if err != nil {
+				return nil, err
+			}
+
+			result[i] = v
+		}
+
+		return result, nil
+	},
+	"arrayFilter": func(arrays [][]Value, apply func(int) (Value, error)) (Value, error) {
+		result := make([]Value, 0, len(arrays[0]))
+
+		for i := range arrays[0] {
+			v, err := apply(i)
+			if err != nil {
+				return nil, err
+			}
+
+			if isTrue(v) {
+				result = append(result, arrays[0][i])
+			}
+		}
+
+		return result, nil
+	},
+	"arrayExists": func(arrays [][]Value, apply func(int) (Value, error)) (Value, error) {
+		for i := range arrays[0] {
+			v, err := apply(i)
+			if err != nil {
+				return nil, err
+			}
+
+			if isTrue(v) {
+				return uint8(1), nil
+			}
+		}
+
+		return uint8(0), nil
+	},
+	"arrayAll": func(arrays [][]Value, apply func(int) (Value, error)) (Value, error) {
+		for i := range arrays[0] {
+			v, err := apply(i)
+			if err != nil {
+				return nil, err
+			}
+
+			if !isTrue(v) {
+				return uint8(0), nil
+			}
+		}
+
+		return uint8(1), nil
+	},
+	"arraySort": func(arrays [][]Value, apply func(int) (Value, error)) (Value, error) {
+		keys := make([]Value, len(arrays[0]))
+
+		for i := range keys {
+			v, err := apply(i)
+			if err != nil {
+				return nil, err
+			}
+
+			keys[i] = v
+		}
+
+		idx := make([]int, len(keys))
+		for i := range idx {
+			idx[i] = i
+		}
+
+		var err error
+
+		sort.SliceStable(idx, func(i, j int) bool {
+			c, e := compareValues(keys[idx[i]], keys[idx[j]])
+			if e != nil {
+				err = e
+			}
+
+			return c < 0
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		result := make([]Value, len(idx))
+		for i, j := range idx {
+			result[i] = arrays[0][j]
+		}
+
+		return result, nil
+	},
+}
+
+func argsCount(name string, args []Value, n int) error {
+	if len(args) != n {
+		return errBadArguments("function %s requires %d arguments, passed %d", name, n, len(args))
+	}
+
+	return nil
+}
+
+// nullable returns nil, if any of args is NULL
+func nullable(n int, f func(args []Value) (Value, error)) func(args []Value) (Value, error) {
+	return func(args []Value) (Value, error) {
+		if len(args) != n {
+			return nil, errBadArguments("function requires %d arguments, passed %d", n, len(args))
+		}
+
+		for _, a := range args {
+			if a == nil {
+				return nil, nil
+			}
+		}
+
+		return f(args)
+	}
+}
+
+func comparison(f func(int) bool) func(args []Value) (Value, error) {
+	return nullable(2, func(args []Value) (Value, error) {
+		c, err := compareValues(args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		return boolValue(f(c)), nil
+	})
+}
+
+func arithmetic(i func(x, y int64) (int64, error), f func(x, y float64) float64) func(args []Value) (Value, error) {
+	return nullable(2, func(args []Value) (Value, error) {
+		if !isNumber(args[0]) || !isNumber(args[1]) {
+			return nil, errIllegalType("arithmetic on %v and %v", args[0], args[1])
+		}
+
+		_, xf := args[0].(float64)
+		_, yf := args[1].(float64)
+
+		if xf || yf || i == nil {
+			x, _ := toFloat64(args[0])
+			y, _ := toFloat64(args[1])
+
+			return f(x, y), nil
+		}
+
+		x, _ := toInt64(args[0])
+		y, _ := toInt64(args[1])
+
+		return i(x, y)
+	})
+}
+
+var errDivisionByZero = &chError{code: 153, name: "ILLEGAL_DIVISION", status: http.StatusBadRequest, msg: "Division by zero"}
+
+var regexps sync.Map
+
+func compileRegexp(re string) (*regexp.Regexp, error) {
+	if r, ok := regexps.Load(re); ok {
+		return r.(*regexp.Regexp), nil
+	}
+
+	r, err := regexp.Compile(re)
+	if err != nil {
+		return nil, &chError{code: 427, name: "CANNOT_COMPILE_REGEXP", status: http.StatusBadRequest, msg: "OptimizedRegularExpression: cannot compile re2: " + re + ", error: " + err.Error()}
+	}
+
+	regexps.Store(re, r)
+
+	return r, nil
+}
+
+// likeRegexp converts LIKE pattern to the regular expression
+func likeRegexp(pattern string) string {
+	var b strings.Builder
+
+	b.WriteString("(?s)^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteByte('.')
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+
+	b.WriteByte('$')
+
+	return b.String()
+}
+
+func like(args []Value) (bool, error) {
+	s, ok1 := args[0].(string)
+	pattern, ok2 := args[1].(string)
+
+	if !ok1 || !ok2 {
+		return false, errIllegalType("LIKE requires strings")
+	}
+
+	re, err := compileRegexp(likeRegexp(pattern))
+	if err != nil {
+		return false, err
+	}
+
+	return re.MatchString(s), nil
+}
+
+func stringArg(name string, v Value) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", errIllegalType("illegal type of argument of function %s: %v", name, v)
+	}
+
+	return s, nil
+}
+
+func toUInt(bits uint) func(args []Value) (Value, error) {
+	return nullable(1, func(args []Value) (Value, error) {
+		var u uint64
+
+		switch v := args[0].(type) {
+		case float64:
+			u = uint64(int64(v))
+		case string:
+			var err error
+			if u, err = strconv.ParseUint(v, 10, 64); err != nil {
+				return nil, &chError{code: 6, name: "CANNOT_PARSE_TEXT", status: http.StatusBadRequest, msg: "Cannot parse string '" + v + "' as UInt"}
+			}
+		default:
+			i, ok := toInt64(v)
+			if !ok {
+				return nil, errIllegalType("illegal type of argument of function toUInt%d: %v", bits, v)
+			}
+
+			u = uint64(i)
+		}
+
+		switch bits {
+		case 8:
+			return uint8(u), nil
+		case 16:
+			return uint16(u), nil
+		case 32:
+			return uint32(u), nil
+		default:
+			return u, nil
+		}
+	})
+}
+
+var scalarFunctions = map[string]func(args []Value) (Value, error){
+	"not": nullable(1, func(args []Value) (Value, error) {
+		return boolValue(!isTrue(args[0])), nil
+	}),
+	"equals":          comparison(func(c int) bool { return c == 0 }),
+	"notEquals":       comparison(func(c int) bool { return c != 0 }),
+	"less":            comparison(func(c int) bool { return c < 0 }),
+	"lessOrEquals":    comparison(func(c int) bool { return c <= 0 }),
+	"greater":         comparison(func(c int) bool { return c > 0 }),
+	"greaterOrEquals": comparison(func(c int) bool { return c >= 0 }),
+	"plus": arithmetic(
+		func(x, y int64) (int64, error) { return x + y, nil },
+		func(x, y float64) float64 { return x + y },
+	),
+	"minus": arithmetic(
+		func(x, y int64) (int64, error) { return x - y, nil },
+		func(x, y float64) float64 { return x - y },
+	),
+	"multiply": arithmetic(
+		func(x, y int64) (int64, error) { return x * y, nil },
+		func(x, y float64) float64 { return x * y },
+	),
+	"divide": arithmetic(nil, func(x, y float64) float64 { return x / y }),
+	"intDiv": arithmetic(
+		func(x, y int64) (int64, error) {
+			if y == 0 {
+				return 0, errDivisionByZero
+			}
+
+			return x / y, nil
+		},
+		func(x, y float64) float64 { return math.Trunc(x / y) },
+	),
+	"modulo": arithmetic(
+		func(x, y int64) (int64, error) {
+			if y == 0 {
+				return 0, errDivisionByZero
+			}
+
+			return x % y, nil
+		},
+		math.Mod,
+	),
+	"negate": nullable(1, func(args []Value) (Value, error) {
+		if f, ok := args[0].(float64); ok {
+			return -f, nil
+		}
+
+		i, ok := toInt64(args[0])
+		if !ok {
+			return nil, errIllegalType("illegal type of argument of function negate: %v", args[0])
+		}
+
+		return -i, nil
+	}),
+	"like": nullable(2, func(args []Value) (Value, error) {
+		ok, err := like(args)
+		return boolValue(ok), err
+	}),
+	"notLike": nullable(2, func(args []Value) (Value, error) {
+		ok, err := like(args)
+		return boolValue(!ok), err
+	}),
+	"match": nullable(2, func(args []Value) (Value, error) {
+		s, err := stringArg("match", args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		pattern, err := stringArg("match", args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		re, err := compileRegexp(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		return boolValue(re.MatchString(s)), nil
+	}),
+	"startsWith": nullable(2, func(args []Value) (Value, error) {
+		s, err := stringArg("startsWith", args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		prefix, err := stringArg("startsWith", args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		return boolValue(strings.HasPrefix(s, prefix)), nil
+	}),
+	"has": nullable(2, func(args []Value) (Value, error) {
+		array, ok := args[0].([]Value)
+		if !ok {
+			return nil, errIllegalType("first argument of function has must be an array")
+		}
+
+		for _, v := range array {
+			if c, err := compareValues(v, args[1]); err == nil && c == 0 {
+				return uint8(1), nil
+			}
+		}
+
+		return uint8(0), nil
+	}),
+	"length": nullable(1, func(args []Value) (Value, error) {
+		switch v := args[0].(type) {
+		case string:
+			return uint64(len(v)), nil
+		case []Value:
+			return uint64(len(v)), nil
+		}
+
+		return nil, errIllegalType("illegal type of argument of function length: %v", args[0])
+	}),
+	"empty": nullable(1, func(args []Value) (Value, error) {
+		switch v := args[0].(type) {
+		case string:
+			return boolValue(len(v) == 0), nil
+		case []Value:
+			return boolValue(len(v) == 0), nil
+		}
+
+		return nil, errIllegalType("illegal type of argument of function empty: %v", args[0])
+	}),
+	"substr": func(args []Value) (Value, error) {
+		if len(args) != 2 && len(args) != 3 {
+			return nil, errBadArguments("function substr requires 2 or 3 arguments")
+		}
+
+		s, err := stringArg("substr", args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		offset, _ := toInt64(args[1])
+
+		switch {
+		case offset < 0:
+			offset += int64(len(s))
+		case offset > 0:
+			offset--
+		}
+
+		if offset < 0 {
+			offset = 0
+		}
+
+		if offset > int64(len(s)) {
+			return "", nil
+		}
+
+		s = s[offset:]
+
+		if len(args) == 3 {
+			length, _ := toInt64(args[2])
+			if length >= 0 && length < int64(len(s)) {
+				s = s[:length]
+			}
+		}
+
+		return s, nil
+	},
+	"splitByChar": nullable(2, func(args []Value) (Value, error) {
+		sep, err := stringArg("splitByChar", args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := stringArg("splitByChar", args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		if len(sep) != 1 {
+			return nil, errBadArguments("illegal separator for function splitByChar, must be exactly one byte")
+		}
+
+		parts := strings.Split(s, sep)
+		result := make([]Value, len(parts))
+
+		for i, p := range parts {
+			result[i] = p
+		}
+
+		return result, nil
+	}),
+	"concat": func(args []Value) (Value, error) {
+		var b strings.Builder
+
+		for _, a := range args {
+			if a == nil {
+				return nil, nil
+			}
+
+			s, err := stringArg("concat", a)
+			if err != nil {
+				return nil, err
+			}
+
+			b.WriteString(s)
+		}
+
+		return b.String(), nil
+	},
+	"toString": nullable(1, func(args []Value) (Value, error) {
+		return formatText(args[0], false, true), nil
+	}),
+	"toUInt8":  toUInt(8),
+	"toUInt16": toUInt(16),
+	"toUInt32": toUInt(32),
+	"toUInt64": toUInt(64),
+	"toInt64": nullable(1, func(args []Value) (Value, error) {
+		i, ok := toInt64(args[0])
+		if !ok {
+			return nil, errIllegalType("illegal type of argument of function toInt64: %v", args[0])
+		}
+
+		return i, nil
+	}),
+	"toFloat64": nullable(1, func(args []Value) (Value, error) {
+		f, ok := toFloat64(args[0])
+		if !ok {
+			return nil, errIllegalType("illegal type of argument of function toFloat64: %v", args[0])
+		}
+
+		return f, nil
+	}),
+	"tuple": func(args []Value) (Value, error) {
+		return Tuple(args), nil
+	},
+	"array": func(args []Value) (Value, error) {
+		return append([]Value{}, args...), nil
+	},
+	"arrayEnumerate": nullable(1, func(args []Value) (Value, error) {
+		array, ok := args[0].([]Value)
+		if !ok {
+			return nil, errIllegalType("argument of function arrayEnumerate must be an array")
+		}
+
+		result := make([]Value, len(array))
+		for i := range array {
+			result[i] = uint32(i + 1)
+		}
+
+		return result, nil
+	}),
+}
+
+func init() {
+	scalarFunctions["substring"] = scalarFunctions["substr"]
+}
+
+// aggregator accumulates values of the aggregate function
+type aggregator interface {
+	add(args []Value) error
+	result() Value
+}
+
+type aggregatorFunc struct {
+	addFunc    func(args []Value) error
+	resultFunc func() Value
+}
+
+func (a *aggregatorFunc) add(args []Value) error { return a.addFunc(args) }
+func (a *aggregatorFunc) result() Value          { return a.resultFunc() }
+
+// numberSum sums integers as int64 until the first float
+type numberSum struct {
+	i       int64
+	f       float64
+	isFloat bool
+}
+
+func (s *numberSum) add(v Value) error {
+	if v == nil {
+		return nil
+	}
+
+	if f, ok := v.(float64); ok {
+		if !s.isFloat {
+			s.isFloat, s.f = true, float64(s.i)
+		}
+
+		s.f += f
+
+		return nil
+	}
+
+	i, ok := toInt64(v)
+	if !ok || !isNumber(v) {
+		return errIllegalType("illegal type %v of argument for aggregate function sum", v)
+	}
+
+	if s.isFloat {
+		s.f += float64(i)
+	} else {
+		s.i += i
+	}
+
+	return nil
+}
+
+func (s *numberSum) value() Value {
+	if s.isFloat {
+		return s.f
+	}
+
+	return s.i
+}
+
+func extremum(name string, better func(c int) bool) func() aggregator {
+	return func() aggregator {
+		var value Value
+
+		return &aggregatorFunc{
+			addFunc: func(args []Value) error {
+				if err := argsCount(name, args, 1); err != nil || args[0] == nil {
+					return err
+				}
+
+				if value == nil {
+					value = args[0]
+					return nil
+				}
+
+				c, err := compareValues(args[0], value)
+				if err == nil && better(c) {
+					value = args[0]
+				}
+
+				return err
+			},
+			resultFunc: func() Value { return value },
+		}
+	}
+}
+
+func argExtremum(name string, better func(c int) bool) func() aggregator {
+	return func() aggregator {
+		var value, key Value
+
+		return &aggregatorFunc{
+			addFunc: func(args []Value) error {
+				if err := argsCount(name, args, 2); err != nil {
+					return err
+				}
+
+				if key == nil {
+					value, key = args[0], args[1]
+					return nil
+				}
+
+				c, err := compareValues(args[1], key)
+				if err == nil && better(c) {
+					value, key = args[0], args[1]
+				}
+
+				return err
+			},
+			resultFunc: func() Value { return value },
+		}
+	}
+}
+
+var aggregateFunctions = map[string]func() aggregator{
+	"sum": func() aggregator {
+		s := &numberSum{}
+
+		return &aggregatorFunc{
+			addFunc: func(args []Value) error {
+				if err := argsCount("sum", args, 1); err != nil {
+					return err
+				}
+
+				return s.add(args[0])
+			},
+			resultFunc: s.value,
+		}
+	},
+	"avg": func() aggregator {
+		var (
+			sum   float64
+			count int
+		)
+
+		return &aggregatorFunc{
+			addFunc: func(args []Value) error {
+				if err := argsCount("avg", args, 1); err != nil || args[0] == nil {
+					return err
+				}
+
+				f, ok := toFloat64(args[0])
+				if !ok || !isNumber(args[0]) {
+					return errIllegalType("illegal type %v of argument for aggregate function avg", args[0])
+				}
+
+				sum += f
+				count++
+
+				return nil
+			},
+			resultFunc: func() Value { return sum / float64(count) },
+		}
+	},
+	"min":    extremum("min", func(c int) bool { return c < 0 }),
+	"max":    extremum("max", func(c int) bool { return c > 0 }),
+	"argMin": argExtremum("argMin", func(c int) bool { return c < 0 }),
+	"argMax": argExtremum("argMax", func(c int) bool { return c > 0 }),
+	"any": func() aggregator {
+		var value Value
+
+		return &aggregatorFunc{
+			addFunc: func(args []Value) error {
+				if err := argsCount("any", args, 1); err != nil {
+					return err
+				}
+
+				if value == nil {
+					value = args[0]
+				}
+
+				return nil
+			},
+			resultFunc: func() Value { return value },
+		}
+	},
+	"anyLast": func() aggregator {
+		var value Value
+
+		return &aggregatorFunc{
+			addFunc: func(args []Value) error {
+				if err := argsCount("anyLast", args, 1); err != nil {
+					return err
+				}
+
+				if args[0] != nil {
+					value = args[0]
+				}
+
+				return nil
+			},
+			resultFunc: func() Value { return value },
+		}
+	},
+	"count": func() aggregator {
+		var count uint64
+
+		return &aggregatorFunc{
+			addFunc: func(args []Value) error {
+				if len(args) == 0 || args[0] != nil {
+					count++
+				}
+
+				return nil
+			},
+			resultFunc: func() Value { return count },
+		}
+	},
+	"uniqExact": func() aggregator {
+		seen := make(map[string]bool)
+
+		return &aggregatorFunc{
+			addFunc: func(args []Value) error {
+				seen[rowKey(args)] = true
+				return nil
+			},
+			resultFunc: func() Value { return uint64(len(seen)) },
+		}
+	},
+	"groupArray": func() aggregator {
+		values := []Value{}
+
+		return &aggregatorFunc{
+			addFunc: func(args []Value) error {
+				if err := argsCount("groupArray", args, 1); err != nil {
+					return err
+				}
+
+				if args[0] != nil {
+					values = append(values, args[0])
+				}
+
+				return nil
+			},
+			resultFunc: func() Value { return values },
+		}
+	},
+}
+
+func init() {
+	aggregateFunctions["uniq"] = aggregateFunctions["uniqExact"]
+}
+
+// aggregateFunction returns the aggregate function by the name, the names of standard functions are case-insensitive
+// as in ClickHouse: Max(Version). Resample combinator is supported.
+func aggregateFunction(name string) (func() aggregator, bool) {
+	name = strings.TrimSuffix(name, "Resample")
+
+	if f, ok := aggregateFunctions[name]; ok {
+		return f, true
+	}
+
+	switch lower := strings.ToLower(name); lower {
+	case "sum", "avg", "min", "max", "count", "any":
+		return aggregateFunctions[lower], true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,576 @@
+package clickhouse
+
+import (
+	"sort"
+)
+
+// table is the in-memory table
+type table struct {
+	columns []column
+	rows    []row
+}
+
+type column struct {
+	name string
+	typ  string
+}
+
+// result of the select query
+type result struct {
+	columns []string
+	rows    [][]Value
+}
+
+// executor executes the query over the snapshot of tables and external data
+type executor struct {
+	tables   map[string]*table
+	external map[string]*table
+	readRows int64
+	sets     map[interface{}]map[string]bool
+}
+
+func newExecutor(tables, external map[string]*table) *executor {
+	return &executor{
+		tables:   tables,
+		external: external,
+		sets:     make(map[interface{}]map[string]bool),
+	}
+}
+
+func (x *executor) table(name string) (*table, error) {
+	if t, ok := x.external[name]; ok {
+		return t, nil
+	}
+
+	if t, ok := x.tables[name]; ok {
+		return t, nil
+	}
+
+	return nil, errUnknownTable(name)
+}
+
+// tableSet returns the values of the first column of the table for IN operator
+func (x *executor) tableSet(name string) (map[string]bool, error) {
+	if set, ok := x.sets[name]; ok {
+		return set, nil
+	}
+
+	t, err := x.table(name)
+	if err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool, len(t.rows))
+
+	if len(t.columns) != 0 {
+		for _, r := range t.rows {
+			set[valueKey(r[t.columns[0].name])] = true
+		}
+	}
+
+	x.sets[name] = set
+
+	return set, nil
+}
+
+// querySet returns the values of the first column of the subquery for IN operator
+func (x *executor) querySet(q *selectQuery) (map[string]bool, error) {
+	if set, ok := x.sets[q]; ok {
+		return set, nil
+	}
+
+	res, err := x.selectQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool, len(res.rows))
+	for _, r := range res.rows {
+		set[valueKey(r[0])] = true
+	}
+
+	x.sets[q] = set
+
+	return set, nil
+}
+
+// scalar returns the first value of the scalar subquery
+func (x *executor) scalar(q *selectQuery) (Value, error) {
+	res, err := x.selectQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.rows) == 0 || len(res.rows[0]) == 0 {
+		return nil, nil
+	}
+
+	return res.rows[0][0], nil
+}
+
+func (x *executor) source(q *selectQuery) ([]row, error) {
+	if q.from != nil {
+		res, err := x.selectQuery(q.from)
+		if err != nil {
+			return nil, err
+		}
+
+		rows := make([]row, len(res.rows))
+
+		for i, values := range res.rows {
+			r := make(row, len(values))
+			for j, name := range res.columns {
+				r[name] = values[j]
+			}
+
+			rows[i] = r
+		}
+
+		return rows, nil
+	}
+
+	t, err := x.table(q.table)
+	if err != nil {
+		return nil, err
+	}
+
+	x.readRows += int64(len(t.rows))
+
+	return t.rows, nil
+}
+
+func (x *executor) selectQuery(q *selectQuery) (*result, error) {
+	rows, err := x.source(q)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := &evalContext{
+		exec:      x,
+		aliases:   make(map[string]expr),
+		resolving: make(map[string]bool),
+	}
+
+	for _, item := range q.with {
+		ctx.aliases[item.name] = item.expr
+	}
+
+	for _, item := range q.items {
+		if item.alias {
+			ctx.aliases[item.name] = item.expr
+		}
+	}
+
+	if rows, err = x.arrayJoin(ctx, q, rows); err != nil {
+		return nil, err
+	}
+
+	for _, cond := range []expr{q.prewhere, q.where} {
+		if rows, err = filter(ctx, cond, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if rows, err = expandArrayJoins(ctx, q, rows); err != nil {
+		return nil, err
+	}
+
+	res := &result{columns: make([]string, len(q.items))}
+	for i, item := range q.items {
+		res.columns[i] = item.name
+	}
+
+	// envs are used by ORDER BY and LIMIT BY, they contain the source columns and the result ones
+	var envs []row
+
+	add := func(c *evalContext, source row) error {
+		values := make([]Value, len(q.items))
+
+		for i, item := range q.items {
+			var err error
+
+			// aliases are resolved by the name, so the same name inside refers to the column
+			if item.alias {
+				values[i], err = c.lookup(item.name)
+			} else {
+				values[i], err = c.eval(item.expr)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		env := make(row, len(source)+len(values))
+		for k, v := range source {
+			env[k] = v
+		}
+
+		for i, name := range res.columns {
+			env[name] = values[i]
+		}
+
+		res.rows = append(res.rows, values)
+		envs = append(envs, env)
+
+		return nil
+	}
+
+	if len(q.groupBy) != 0 || isAggregating(ctx, q) {
+		groups, err := groupRows(ctx, q, rows)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, group := range groups {
+			var first row
+			if len(group) != 0 {
+				first = group[0]
+			}
+
+			if q.having != nil {
+				v, err := ctx.forGroup(group).eval(q.having)
+				if err != nil {
+					return nil, err
+				}
+
+				if !isTrue(v) {
+					continue
+				}
+			}
+
+			if err = add(ctx.forGroup(group), first); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		for _, r := range rows {
+			if err = add(ctx.forRow(r), r); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if q.distinct {
+		seen := make(map[string]bool, len(res.rows))
+		n := 0
+
+		for i, values := range res.rows {
+			key := rowKey(values)
+			if seen[key] {
+				continue
+			}
+
+			seen[key] = true
+			res.rows[n], envs[n] = values, envs[i]
+			n++
+		}
+
+		res.rows, envs = res.rows[:n], envs[:n]
+	}
+
+	if len(q.orderBy) != 0 {
+		if err = orderRows(ctx, q, res, envs); err != nil {
+			return nil, err
+		}
+	}
+
+	if q.limit > 0 || len(q.limitBy) != 0 {
+		if err = limitRows(ctx, q, res, envs); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// arrayJoin applies ARRAY JOIN clause, the arrays of the row are zipped into rows
+func (x *executor) arrayJoin(ctx *evalContext, q *selectQuery, rows []row) ([]row, error) {
+	if len(q.arrayJoin) == 0 {
+		return rows, nil
+	}
+
+	var result []row
+
+	for _, r := range rows {
+		c := ctx.forRow(r)
+		arrays := make([][]Value, len(q.arrayJoin))
+
+		for i, item := range q.arrayJoin {
+			v, err := c.eval(item.expr)
+			if err != nil {
+				return nil, err
+			}
+
+			array, ok := v.([]Value)
+			if !ok {
+				return nil, errIllegalType("ARRAY JOIN requires array argument, got %v", v)
+			}
+
+			if i > 0 && len(array) != len(arrays[0]) {
+				return nil, errIllegalType("sizes of ARRAY-JOIN-ed arrays do not match")
+			}
+
+			arrays[i] = array
+		}
+
+		for j := range arrays[0] {
+			joined := make(row, len(r)+len(arrays))
+			for k, v := range r {
+				joined[k] = v
+			}
+
+			for i, item := range q.arrayJoin {
+				joined[item.alias] = arrays[i][j]
+			}
+
+			result = append(result, joined)
+		}
+	}
+
+	return result, nil
+}
+
+// expandArrayJoins applies arrayJoin functions of SELECT, the row is repeated for every element of the array
+func expandArrayJoins(ctx *evalContext, q *selectQuery, rows []row) ([]row, error) {
+	var calls []*call
+
+	for _, item := range append(append([]selectItem{}, q.with...), q.items...) {
+		walk(item.expr, func(e expr) bool {
+			if c, ok := e.(*call); ok && c.name == "arrayJoin" {
+				calls = append(calls, c)
+			}
+
+			return true
+		})
+	}
+
+	for _, aj := range calls {
+		if len(aj.args) != 1 {
+			return nil, errBadArguments("function arrayJoin requires exactly one argument")
+		}
+
+		var expanded []row
+
+		for _, r := range rows {
+			v, err := ctx.forRow(r).eval(aj.args[0])
+			if err != nil {
+				return nil, err
+			}
+
+			array, ok := v.([]Value)
+			if !ok {
+				return nil, errIllegalType("argument of function arrayJoin must be an array, got %v", v)
+			}
+
+			for _, item := range array {
+				joined := make(row, len(r)+1)
+				for k, v := range r {
+					joined[k] = v
+				}
+
+				joined[arrayJoinColumn(aj)] = item
+				expanded = append(expanded, joined)
+			}
+		}
+
+		rows = expanded
+	}
+
+	return rows, nil
+}
+
+func filter(ctx *evalContext, cond expr, rows []row) ([]row, error) {
+	if cond == nil {
+		return rows, nil
+	}
+
+	var result []row
+
+	for _, r := range rows {
+		v, err := ctx.forRow(r).eval(cond)
+		if err != nil {
+			return nil, err
+		}
+
+		if isTrue(v) {
+			result = append(result, r)
+		}
+	}
+
+	return result, nil
+}
+
+// isAggregating returns true, if select items contain aggregate functions
+func isAggregating(ctx *evalContext, q *selectQuery) bool {
+	found := false
+	visiting := make(map[string]bool)
+
+	var check func(e expr) bool
+
+	check = func(e expr) bool {
+		switch e := e.(type) {
+		case *call:
+			if _, ok := aggregateFunction(e.name); ok {
+				found = true
+			}
+		case *ident:
+			if a, ok := ctx.aliases[e.name]; ok && !visiting[e.name] {
+				visiting[e.name] = true
+				walk(a, check)
+				delete(visiting, e.name)
+			}
+		case *subquery:
+			return false
+		}
+
+		return !found
+	}
+
+	for _, item := range q.items {
+		visiting[item.name] = item.alias
+		walk(item.expr, check)
+		delete(visiting, item.name)
+	}
+
+	return found
+}
+
+// groupRows groups rows by GROUP BY keys in the order of the first appearance
+func groupRows(ctx *evalContext, q *selectQuery, rows []row) ([][]row, error) {
+	if len(q.groupBy) == 0 {
+		return [][]row{rows}, nil
+	}
+
+	var groups [][]row
+
+	index := make(map[string]int)
+
+	for _, r := range rows {
+		keys, err := ctx.forRow(r).evalArgs(q.groupBy)
+		if err != nil {
+			return nil, err
+		}
+
+		key := rowKey(keys)
+
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+
+		groups[i] = append(groups[i], r)
+	}
+
+	return groups, nil
+}
+
+func envContext(ctx *evalContext, env row) *evalContext {
+	c := ctx.forRow(env)
+	// the result columns are already evaluated
+	c.aliases = nil
+
+	return c
+}
+
+func orderRows(ctx *evalContext, q *selectQuery, res *result, envs []row) error {
+	keys := make([][]Value, len(res.rows))
+
+	for i, env := range envs {
+		c := envContext(ctx, env)
+		keys[i] = make([]Value, len(q.orderBy))
+
+		for j, item := range q.orderBy {
+			v, err := c.eval(item.expr)
+			if err != nil {
+				return err
+			}
+
+			keys[i][j] = v
+		}
+	}
+
+	idx := make([]int, len(res.rows))
+	for i := range idx {
+		idx[i] = i
+	}
+
+	var err error
+
+	sort.SliceStable(idx, func(a, b int) bool {
+		for j, item := range q.orderBy {
+			x, y := keys[idx[a]][j], keys[idx[b]][j]
+			if x == nil || y == nil {
+				if (x == nil) != (y == nil) {
+					// NULLs are last
+					return y == nil
+				}
+
+				continue
+			}
+
+			c, e := compareValues(x, y)
+			if e != nil {
+				err = e
+				return false
+			}
+
+			if c != 0 {
+				return (c < 0) != item.desc
+			}
+		}
+
+		return false
+	})
+
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]Value, len(idx))
+	sorted := make([]row, len(idx))
+
+	for i, j := range idx {
+		rows[i], sorted[i] = res.rows[j], envs[j]
+	}
+
+	res.rows = rows
+	copy(envs, sorted)
+
+	return nil
+}
+
+func limitRows(ctx *evalContext, q *selectQuery, res *result, envs []row) error {
+	if len(q.limitBy) == 0 {
+		if q.limit < len(res.rows) {
+			res.rows = res.rows[:q.limit]
+		}
+
+		return nil
+	}
+
+	counts := make(map[string]int)
+	n := 0
+
+	for i, env := range envs {
+		keys, err := envContext(ctx, env).evalArgs(q.limitBy)
+		if err != nil {
+			return err
+		}
+
+		key := rowKey(keys)
+		if counts[key] >= q.limit {
+			continue
+		}
+
+		counts[key]++
+		res.rows[n] = res.rows[i]
+		n++
+	}
+
+	res.rows = res.rows[:n]
+
+	return nil
+}
@@ -0,0 +1,429 @@
+package clickhouse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/lomik/carbon-clickhouse/helper/escape"
+
+	"github.com/lomik/graphite-clickhouse/helper/date"
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/pkg/reverse"
+)
+
+// Structures of graphite tables, as carbon-clickhouse writes them
+const (
+	IndexStructure  = "Date Date, Level UInt32, Path String, Version UInt32"
+	TaggedStructure = "Date Date, Tag1 String, Path String, Tags Array(String), Version UInt32"
+	PointsStructure = "Path String, Value Float64, Time UInt32, Date Date, Timestamp UInt32"
+)
+
+// Level offsets and the date of the tree in the index table
+const (
+	reverseLevelOffset     = 10000
+	treeLevelOffset        = 20000
+	reverseTreeLevelOffset = 30000
+	defaultTreeDate        = "1970-02-12"
+)
+
+// FakeServer is the in-memory ClickHouse for tests. It executes the subset of SQL generated by graphite-clickhouse:
+// selects from the index, tagged and data tables with -Resample aggregation, ARRAY JOIN and subqueries, external data
+// and inserts. The results are returned in TabSeparated, TabSeparatedRaw, RowBinary or JSONEachRow formats.
+type FakeServer struct {
+	*httptest.Server
+	mu      sync.RWMutex
+	tables  map[string]*table
+	queries []string
+}
+
+// NewFakeServer starts the server without tables
+func NewFakeServer() *FakeServer {
+	s := &FakeServer{tables: make(map[string]*table)}
+	s.Server = httptest.NewServer(s)
+
+	return s
+}
+
+// CreateTable creates the empty table with the structure: "Path String, Level UInt32". It does nothing, if the table exists.
+func (s *FakeServer) CreateTable(name, structure string) error {
+	columns, err := parseStructure(structure)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tables[name]; !ok {
+		s.tables[name] = &table{columns: columns}
+	}
+
+	return nil
+}
+
+// Insert appends the row to the table, values are converted to the column types in the order of columns
+func (s *FakeServer) Insert(name string, values ...interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tables[name]
+	if !ok {
+		return errUnknownTable(name)
+	}
+
+	if len(values) != len(t.columns) {
+		return errBadArguments("table %s has %d columns, passed %d values", name, len(t.columns), len(values))
+	}
+
+	r := make(row, len(values))
+
+	for i, c := range t.columns {
+		v, err := convert(c.typ, values[i])
+		if err != nil {
+			return fmt.Errorf("column %s: %w", c.name, err)
+		}
+
+		r[c.name] = v
+	}
+
+	t.rows = append(t.rows, r)
+
+	return nil
+}
+
+// Truncate deletes all rows of the table
+func (s *FakeServer) Truncate(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.tables[name]; ok {
+		t.rows = nil
+	}
+}
+
+// Queries returns the executed queries
+func (s *FakeServer) Queries() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]string(nil), s.queries...)
+}
+
+// AddIndex adds plain metrics to the index table as carbon-clickhouse does: the tree with all parent nodes, the reversed
+// tree and the daily index for the day. The table is created, if it doesn't exist.
+func (s *FakeServer) AddIndex(name string, day time.Time, paths ...string) error {
+	if err := s.CreateTable(name, IndexStructure); err != nil {
+		return err
+	}
+
+	days := date.DefaultTimeToDaysFormat(day)
+	version := day.Unix()
+
+	for _, path := range paths {
+		level := strings.Count(path, ".") + 1
+		reversed := reverse.String(path)
+
+		for l, p := level, path; l > 0; l-- {
+			if l < level {
+				p = p[:strings.LastIndexByte(p, '.')+1]
+			}
+
+			if err := s.Insert(name, defaultTreeDate, l+treeLevelOffset, p, version); err != nil {
+				return err
+			}
+
+			p = strings.TrimSuffix(p, ".")
+		}
+
+		rows := [][]interface{}{
+			{defaultTreeDate, level + reverseTreeLevelOffset, reversed, version},
+			{days, level, path, version},
+			{days, level + reverseLevelOffset, reversed, version},
+		}
+
+		for _, values := range rows {
+			if err := s.Insert(name, values...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// AddTagged adds tagged metrics (name?tag1=value1&tag2=value2) to the tagged table for the day as carbon-clickhouse
+// does: a row per tag. The table is created, if it doesn't exist.
+func (s *FakeServer) AddTagged(name string, day time.Time, paths ...string) error {
+	if err := s.CreateTable(name, TaggedStructure); err != nil {
+		return err
+	}
+
+	days := date.DefaultTimeToDaysFormat(day)
+	version := day.Unix()
+
+	for _, path := range paths {
+		delim := strings.IndexByte(path, '?')
+		if delim < 1 {
+			return fmt.Errorf("incomplete tags in '%s'", path)
+		}
+
+		metric, err := url.PathUnescape(path[:delim])
+		if err != nil {
+			return fmt.Errorf("invalid name tag in '%s'", path)
+		}
+
+		tags := []string{"__name__=" + metric}
+		for _, tag := range strings.Split(path[delim+1:], "&") {
+			tags = append(tags, escape.Unescape(tag))
+		}
+
+		for _, tag1 := range tags {
+			if err := s.Insert(name, days, tag1, path, tags, version); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// AddPoints adds points of the metric to the data table, MetricID of points is ignored. The table is created, if it
+// doesn't exist.
+func (s *FakeServer) AddPoints(name, path string, points ...point.Point) error {
+	if err := s.CreateTable(name, PointsStructure); err != nil {
+		return err
+	}
+
+	for _, p := range points {
+		days := date.DefaultTimestampToDaysFormat(int64(p.Time))
+		if err := s.Insert(name, path, p.Value, p.Time, days, p.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Query executes the query and returns the result in the format of the query
+func (s *FakeServer) Query(query string) ([]byte, error) {
+	var out bytes.Buffer
+
+	_, err := s.execute(&out, query, nil, nil)
+
+	return out.Bytes(), err
+}
+
+func (s *FakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query, data, external, err := s.parseRequest(r)
+	if err == nil {
+		var out bytes.Buffer
+
+		var readRows int64
+
+		readRows, err = s.execute(&out, query, data, external)
+		if err == nil {
+			if id := r.URL.Query().Get("query_id"); id != "" {
+				w.Header().Set("X-ClickHouse-Query-Id", id)
+			}
+
+			w.Header().Set(
+				"X-ClickHouse-Summary",
+				fmt.Sprintf(`{"read_rows":"%d","read_bytes":"%d","written_rows":"0","written_bytes":"0","total_rows_to_read":"%d"}`, readRows, out.Len(), readRows),
+			)
+			w.Write(out.Bytes())
+
+			return
+		}
+	}
+
+	status := http.StatusInternalServerError
+
+	var chErr *chError
+	if errors.As(err, &chErr) {
+		status = chErr.status
+	} else {
+		err = &chError{code: 1001, name: "STD_EXCEPTION", status: status, msg: err.Error()}
+	}
+
+	http.Error(w, err.Error(), status)
+}
+
+// parseRequest returns the query, the body for inserts and external tables
+func (s *FakeServer) parseRequest(r *http.Request) (string, []byte, map[string]*table, error) {
+	params := r.URL.Query()
+	query := params.Get("query")
+
+	body, err := readBody(r)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	mediaType, mediaParams, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		if query == "" {
+			return string(body), nil, nil, nil
+		}
+
+		return query, body, nil, nil
+	}
+
+	external := make(map[string]*table)
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.Header.Set("Content-Type", mime.FormatMediaType(mediaType, mediaParams))
+
+	if err = r.ParseMultipartForm(32 << 20); err != nil {
+		return "", nil, nil, err
+	}
+
+	for name, files := range r.MultipartForm.File {
+		f, err := files[0].Open()
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		data, err := io.ReadAll(f)
+		f.Close()
+
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		columns, err := parseStructure(params.Get(name + "_structure"))
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		format := params.Get(name + "_format")
+		if format == "" {
+			format = "TabSeparated"
+		}
+
+		rows, err := readRows(format, columns, data)
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		external[name] = &table{columns: columns, rows: rows}
+	}
+
+	return query, nil, external, nil
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	var rd io.Reader = r.Body
+
+	switch r.Header.Get("Content-Encoding") {
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		defer gz.Close()
+
+		rd = gz
+	case "zstd":
+		zr, err := zstd.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		defer zr.Close()
+
+		rd = zr
+	}
+
+	return io.ReadAll(rd)
+}
+
+// execute executes the query and returns the number of read rows
+func (s *FakeServer) execute(w io.Writer, query string, data []byte, external map[string]*table) (int64, error) {
+	s.mu.Lock()
+	s.queries = append(s.queries, query)
+	s.mu.Unlock()
+
+	parsed, err := parse(query)
+	if err != nil {
+		return 0, errSyntax(err)
+	}
+
+	switch q := parsed.(type) {
+	case *insertQuery:
+		return 0, s.insert(q, data)
+	case *selectQuery:
+		s.mu.RLock()
+		x := newExecutor(s.tables, external)
+		res, err := x.selectQuery(q)
+		s.mu.RUnlock()
+
+		if err != nil {
+			return x.readRows, err
+		}
+
+		return x.readRows, writeResult(w, q.format, res)
+	}
+
+	return 0, errNotImplemented("query %q", query)
+}
+
+func (s *FakeServer) insert(q *insertQuery, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tables[q.table]
+	if !ok {
+		return errUnknownTable(q.table)
+	}
+
+	columns := t.columns
+
+	if len(q.columns) != 0 {
+		columns = make([]column, len(q.columns))
+
+	COLUMNS:
+		for i, name := range q.columns {
+			for _, c := range t.columns {
+				if c.name == name {
+					columns[i] = c
+					continue COLUMNS
+				}
+			}
+
+			return &chError{code: 16, name: "NO_SUCH_COLUMN_IN_TABLE", status: http.StatusBadRequest, msg: "No such column " + name + " in table " + q.table}
+		}
+	}
+
+	format := q.format
+	if format == "" {
+		format = "TabSeparated"
+	}
+
+	rows, err := readRows(format, columns, data)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		for _, c := range t.columns {
+			if _, ok := r[c.name]; !ok {
+				r[c.name] = zeroValue(c.typ)
+			}
+		}
+	}
+
+	t.rows = append(t.rows, rows...)
+
+	return nil
+}
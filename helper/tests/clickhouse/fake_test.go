@@ -0,0 +1,209 @@
+package clickhouse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+)
+
+func newFakeServer(t *testing.T) *FakeServer {
+	s := NewFakeServer()
+	t.Cleanup(s.Close)
+
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.Local)
+
+	require.NoError(t, s.AddIndex("graphite_index", day, "DB.postgres.host1.cpu", "DB.postgres.host2.cpu"))
+	require.NoError(t, s.AddTagged("graphite_tagged", day,
+		"cpu?dc=east&host=web1",
+		"cpu?dc=west&host=web2",
+		"mem?dc=east&host=web1",
+	))
+
+	return s
+}
+
+func query(t *testing.T, s *FakeServer, q string) string {
+	out, err := s.Query(q)
+	require.NoError(t, err, q)
+
+	return string(out)
+}
+
+func TestFakeServer_Index(t *testing.T) {
+	s := newFakeServer(t)
+
+	assert.Equal(t,
+		"DB.postgres.host1.\nDB.postgres.host2.\n",
+		query(t, s, "SELECT Path FROM graphite_index WHERE ((Level=20003) AND (Path LIKE 'DB.postgres.%')) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw"),
+	)
+	assert.Equal(t,
+		"DB.postgres.host2.cpu\n",
+		query(t, s, "SELECT Path FROM graphite_index WHERE ((Level=20004) AND (Path LIKE 'DB.postgres.%' AND match(Path, '^DB[.]postgres[.]([^.]*?)2[.]cpu[.]?$'))) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw"),
+	)
+	assert.Equal(t,
+		"cpu.host1.postgres.DB\ncpu.host2.postgres.DB\n",
+		query(t, s, "SELECT Path FROM graphite_index WHERE (Level=10004) AND (Path IN ('cpu.host1.postgres.DB','cpu.host2.postgres.DB','cpu.host3.postgres.DB')) AND (Date >= '2023-01-01' AND Date <= '2023-01-03') GROUP BY Path FORMAT TabSeparatedRaw"),
+	)
+	assert.Equal(t,
+		"4\n",
+		query(t, s, "SELECT count() FROM graphite_index WHERE Date = '2023-01-02'"),
+	)
+	assert.Equal(t,
+		"4\t2\n10004\t2\n",
+		query(t, s, "SELECT Level, count() AS c FROM graphite_index WHERE Date = '2023-01-02' GROUP BY Level HAVING c > 1 ORDER BY Level"),
+	)
+}
+
+func TestFakeServer_Tagged(t *testing.T) {
+	s := newFakeServer(t)
+
+	assert.Equal(t,
+		"cpu?dc=east&host=web1\n",
+		query(t, s, "SELECT Path FROM graphite_tagged WHERE ((Tag1='__name__=cpu') AND (arrayExists((x) -> x='dc=east', Tags))) AND (Date >='2023-01-02') GROUP BY Path FORMAT TabSeparatedRaw"),
+	)
+	assert.Equal(t,
+		"cpu?dc=west&host=web2\n",
+		query(t, s, "SELECT Path FROM graphite_tagged PREWHERE Tag1='__name__=cpu' WHERE NOT arrayExists((x) -> x LIKE 'dc=east%', Tags) GROUP BY Path FORMAT TabSeparatedRaw"),
+	)
+	assert.Equal(t,
+		"web1\nweb2\n",
+		query(t, s, "SELECT substr(arrayFilter(x -> x LIKE 'host=%', Tags)[1], 6) AS value FROM graphite_tagged WHERE (Tag1='__name__=cpu') AND (arrayExists(x -> x LIKE 'host=%', Tags)) GROUP BY value ORDER BY value LIMIT 10000"),
+	)
+	assert.Equal(t,
+		"__name__\ndc\nhost\n",
+		query(t, s, "SELECT splitByChar('=', arrayJoin(Tags))[1] AS value FROM graphite_tagged WHERE Tag1 LIKE '__name__=%' GROUP BY value ORDER BY value LIMIT 10000"),
+	)
+	assert.Equal(t,
+		"dc=east\t2\ndc=west\t1\n",
+		query(t, s, "SELECT Tag1, count() as cnt FROM graphite_tagged WHERE Tag1 LIKE 'dc=%' GROUP BY Tag1 ORDER BY cnt DESC, Tag1 FORMAT TabSeparatedRaw"),
+	)
+	assert.Equal(t,
+		"mem?dc=east&host=web1\n",
+		query(t, s, "SELECT Path FROM graphite_tagged WHERE Version >= (SELECT Max(Version) FROM graphite_tagged WHERE Tag1 = '__name__=cpu') AND has(Tags, 'host=web1') AND Tag1 = '__name__=mem' GROUP BY Path"),
+	)
+}
+
+func TestFakeServer_Errors(t *testing.T) {
+	s := newFakeServer(t)
+
+	tests := []struct {
+		query string
+		code  string
+	}{
+		{"SELECT Path FROM unknown", "Code: 60."},
+		{"SELECT Path FROM graphite_index WHERE", "Code: 62."},
+		{"SELECT Unknown FROM graphite_index", "Code: 47."},
+		{"SELECT unknownFunction(Path) FROM graphite_index", "Code: 46."},
+		{"SELECT Path FROM graphite_index WHERE match(Path, '(')", "Code: 427."},
+		{"SELECT Path FROM graphite_index FORMAT Unknown", "Code: 73."},
+	}
+
+	for _, tt := range tests {
+		_, err := s.Query(tt.query)
+		require.Error(t, err, tt.query)
+		assert.True(t, strings.HasPrefix(err.Error(), tt.code), err.Error())
+	}
+}
+
+func TestFakeServer_Points(t *testing.T) {
+	s := NewFakeServer()
+	defer s.Close()
+
+	require.NoError(t, s.AddPoints("graphite_data", "a.b",
+		point.Point{Time: 60, Value: 1, Timestamp: 60},
+		point.Point{Time: 70, Value: 3, Timestamp: 70},
+		point.Point{Time: 70, Value: 4, Timestamp: 80},
+		point.Point{Time: 130, Value: 2, Timestamp: 130},
+	))
+	require.NoError(t, s.AddPoints("graphite_data", "c.d", point.Point{Time: 60, Value: 10, Timestamp: 60}))
+
+	// -Resample aggregation with the mask of intervals with points
+	out := query(t, s, `WITH anyResample(60, 179, 60)(toUInt32(intDiv(Time, 60)*60), Time) AS mask
+SELECT Path,
+ arrayFilter(m->m!=0, mask) AS times,
+ arrayFilter((v,m)->m!=0, avgResample(60, 179, 60)(Value, Time), mask) AS values
+FROM graphite_data
+PREWHERE Date >= '1970-01-01' AND Date <= '1970-01-01'
+WHERE (Path in ('a.b')) AND (Time >= 60 AND Time <= 179)
+GROUP BY Path
+FORMAT TabSeparated`)
+	assert.Equal(t, "a.b\t[60,120]\t[2.6666666666666665,2]\n", out)
+
+	// deduplication by the latest Timestamp
+	out = query(t, s, `SELECT Path, arrayMap(p->p.1, points) AS times, arrayMap(p->p.2, points) AS values
+FROM (
+ SELECT Path, arraySort(p->p.1, groupArray((Time, Value))) AS points
+ FROM (
+  SELECT Path, Time, argMax(Value, Timestamp) AS Value
+  FROM graphite_data
+  WHERE Path = 'a.b'
+  GROUP BY Path, Time
+ )
+ GROUP BY Path
+)`)
+	assert.Equal(t, "a.b\t[60,70,130]\t[1,4,2]\n", out)
+
+	// RowBinary output
+	out = query(t, s, "SELECT Path, groupArray(Time), groupArray(Value), groupArray(Timestamp) FROM graphite_data WHERE Path = 'c.d' GROUP BY Path FORMAT RowBinary")
+
+	var expected bytes.Buffer
+
+	expected.Write([]byte{3, 'c', '.', 'd', 1})
+	_ = binary.Write(&expected, binary.LittleEndian, uint32(60))
+	expected.WriteByte(1)
+	_ = binary.Write(&expected, binary.LittleEndian, math.Float64bits(10))
+	expected.WriteByte(1)
+	_ = binary.Write(&expected, binary.LittleEndian, uint32(60))
+
+	assert.Equal(t, expected.String(), out)
+}
+
+func TestFakeServer_HTTP(t *testing.T) {
+	s := NewFakeServer()
+	defer s.Close()
+
+	require.NoError(t, s.CreateTable("exemplars", "Date Date, Path String, Labels Array(String), Value Float64, Timestamp Int64"))
+
+	post := func(query string, body io.Reader) (int, string) {
+		resp, err := http.Post(s.URL+"/?query="+url.QueryEscape(query), "text/plain", body)
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp.StatusCode, string(data)
+	}
+
+	code, _ := post(
+		"INSERT INTO exemplars (Date, Path, Labels, Value, Timestamp) FORMAT JSONEachRow",
+		strings.NewReader(`{"Date":"2023-01-02","Path":"cpu?host=web1","Labels":["trace_id=1"],"Value":1.5,"Timestamp":1672617600000}`+"\n"),
+	)
+	require.Equal(t, http.StatusOK, code)
+
+	code, body := post("SELECT Path, Labels, Value, Timestamp FROM exemplars ORDER BY Path, Timestamp LIMIT 1 BY Path, Timestamp, Labels FORMAT JSONEachRow", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"Path":"cpu?host=web1","Labels":["trace_id=1"],"Value":1.5,"Timestamp":"1672617600000"}`+"\n", body)
+
+	code, body = post("SELECT Path FROM unknown", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Contains(t, body, "Code: 60. DB::Exception: Table default.unknown doesn't exist")
+
+	assert.Equal(t, []string{
+		"INSERT INTO exemplars (Date, Path, Labels, Value, Timestamp) FORMAT JSONEachRow",
+		"SELECT Path, Labels, Value, Timestamp FROM exemplars ORDER BY Path, Timestamp LIMIT 1 BY Path, Timestamp, Labels FORMAT JSONEachRow",
+		"SELECT Path FROM unknown",
+	}, s.Queries())
+}
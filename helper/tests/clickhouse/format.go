@@ -0,0 +1,681 @@
+package clickhouse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func errUnknownFormat(format string) error {
+	return &chError{code: 73, name: "UNKNOWN_FORMAT", status: http.StatusBadRequest, msg: "Unknown format " + format}
+}
+
+func errCannotParse(format string, args ...interface{}) error {
+	return &chError{code: 27, name: "CANNOT_PARSE_INPUT_ASSERTION_FAILED", status: http.StatusBadRequest, msg: fmt.Sprintf(format, args...)}
+}
+
+// writeResult writes the result in the format, TabSeparated is the default one
+func writeResult(w io.Writer, format string, res *result) error {
+	buf := bufio.NewWriter(w)
+
+	switch format {
+	case "", "TabSeparated", "TSV", "TabSeparatedRaw", "TSVRaw":
+		raw := strings.HasSuffix(format, "Raw")
+
+		for _, values := range res.rows {
+			for i, v := range values {
+				if i > 0 {
+					buf.WriteByte('\t')
+				}
+
+				buf.WriteString(formatText(v, false, raw))
+			}
+
+			buf.WriteByte('\n')
+		}
+	case "RowBinary":
+		for _, values := range res.rows {
+			for _, v := range values {
+				if err := writeBinary(buf, v); err != nil {
+					return err
+				}
+			}
+		}
+	case "JSONEachRow":
+		for _, values := range res.rows {
+			buf.WriteByte('{')
+
+			for i, v := range values {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+
+				name, _ := json.Marshal(res.columns[i])
+				buf.Write(name)
+				buf.WriteByte(':')
+				buf.WriteString(formatJSON(v))
+			}
+
+			buf.WriteString("}\n")
+		}
+	default:
+		return errUnknownFormat(format)
+	}
+
+	return buf.Flush()
+}
+
+var tsvEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r", "\x00", "\\0", "\b", "\\b", "\f", "\\f")
+
+var tsvUnescaper = strings.NewReplacer("\\\\", "\\", "\\t", "\t", "\\n", "\n", "\\r", "\r", "\\0", "\x00", "\\b", "\b", "\\f", "\f", "\\'", "'")
+
+// formatText formats the value as ClickHouse text formats do, strings in arrays and tuples are quoted
+func formatText(v Value, nested bool, raw bool) string {
+	switch v := v.(type) {
+	case nil:
+		if nested {
+			return "NULL"
+		}
+
+		return "\\N"
+	case string:
+		if nested {
+			return "'" + strings.ReplaceAll(strings.ReplaceAll(v, "\\", "\\\\"), "'", "\\'") + "'"
+		}
+
+		if raw {
+			return v
+		}
+
+		return tsvEscaper.Replace(v)
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "nan"
+		case math.IsInf(v, 1):
+			return "inf"
+		case math.IsInf(v, -1):
+			return "-inf"
+		}
+
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []Value, Tuple:
+		list, _ := toList(v)
+		open, close := "[", "]"
+
+		if _, ok := v.(Tuple); ok {
+			open, close = "(", ")"
+		}
+
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = formatText(item, true, raw)
+		}
+
+		return open + strings.Join(items, ",") + close
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	default:
+		i, _ := toInt64(v)
+		return strconv.FormatInt(i, 10)
+	}
+}
+
+// formatJSON formats the value as JSONEachRow does, 64-bit integers are quoted
+func formatJSON(v Value) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		b, _ := json.Marshal(v)
+		return string(b)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "null"
+		}
+
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case uint64, int64:
+		return `"` + formatText(v, false, true) + `"`
+	case []Value, Tuple:
+		list, _ := toList(v)
+
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = formatJSON(item)
+		}
+
+		return "[" + strings.Join(items, ",") + "]"
+	default:
+		return formatText(v, false, true)
+	}
+}
+
+func writeBinary(w *bufio.Writer, v Value) error {
+	var b [binary.MaxVarintLen64]byte
+
+	switch v := v.(type) {
+	case string:
+		w.Write(b[:binary.PutUvarint(b[:], uint64(len(v)))])
+		w.WriteString(v)
+	case uint8:
+		w.WriteByte(v)
+	case uint16:
+		binary.LittleEndian.PutUint16(b[:], v)
+		w.Write(b[:2])
+	case uint32:
+		binary.LittleEndian.PutUint32(b[:], v)
+		w.Write(b[:4])
+	case uint64:
+		binary.LittleEndian.PutUint64(b[:], v)
+		w.Write(b[:8])
+	case int64:
+		binary.LittleEndian.PutUint64(b[:], uint64(v))
+		w.Write(b[:8])
+	case float64:
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		w.Write(b[:8])
+	case []Value:
+		w.Write(b[:binary.PutUvarint(b[:], uint64(len(v)))])
+
+		for _, item := range v {
+			if err := writeBinary(w, item); err != nil {
+				return err
+			}
+		}
+	case Tuple:
+		for _, item := range v {
+			if err := writeBinary(w, item); err != nil {
+				return err
+			}
+		}
+	default:
+		return errIllegalType("value %v can't be written in RowBinary format", v)
+	}
+
+	return nil
+}
+
+// parseStructure parses the table structure: "Path String, Level UInt32"
+func parseStructure(structure string) ([]column, error) {
+	var columns []column
+
+	for _, def := range splitTopLevel(structure) {
+		fields := strings.Fields(def)
+		if len(fields) < 2 {
+			return nil, errSyntax(fmt.Errorf("invalid column definition %q", def))
+		}
+
+		typ := strings.Join(fields[1:], "")
+		if _, err := baseType(typ); err != nil {
+			return nil, err
+		}
+
+		columns = append(columns, column{name: fields[0], typ: typ})
+	}
+
+	return columns, nil
+}
+
+// splitTopLevel splits the list by commas outside of parentheses
+func splitTopLevel(s string) []string {
+	var (
+		parts []string
+		depth int
+		start int
+	)
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		parts = append(parts, last)
+	}
+
+	return parts
+}
+
+// baseType strips Nullable and LowCardinality wrappers and checks the type is supported
+func baseType(typ string) (string, error) {
+	for _, wrapper := range []string{"Nullable(", "LowCardinality("} {
+		if strings.HasPrefix(typ, wrapper) && strings.HasSuffix(typ, ")") {
+			return baseType(typ[len(wrapper) : len(typ)-1])
+		}
+	}
+
+	if strings.HasPrefix(typ, "Array(") && strings.HasSuffix(typ, ")") {
+		if _, err := baseType(typ[6 : len(typ)-1]); err != nil {
+			return "", err
+		}
+
+		return typ, nil
+	}
+
+	switch typ {
+	case "String", "UInt8", "UInt16", "UInt32", "UInt64", "Int8", "Int16", "Int32", "Int64", "Float32", "Float64",
+		"Date", "DateTime":
+		return typ, nil
+	}
+
+	return "", &chError{code: 50, name: "UNKNOWN_TYPE", status: http.StatusBadRequest, msg: "Unknown data type " + typ}
+}
+
+func daysToDate(days int64) string {
+	return time.Unix(days*86400, 0).UTC().Format("2006-01-02")
+}
+
+// convert converts Go value to the value of the column type
+func convert(typ string, v interface{}) (Value, error) {
+	typ, err := baseType(typ)
+	if err != nil {
+		return nil, err
+	}
+
+	if v == nil {
+		return nil, nil
+	}
+
+	if n, ok := v.(json.Number); ok {
+		v = string(n)
+	}
+
+	if strings.HasPrefix(typ, "Array(") {
+		elemType := typ[6 : len(typ)-1]
+
+		var items []interface{}
+
+		switch a := v.(type) {
+		case []Value:
+			items = a
+		case []string:
+			for _, s := range a {
+				items = append(items, s)
+			}
+		case string:
+			return convertTextArray(elemType, a)
+		default:
+			return nil, errIllegalType("can't convert %v to %s", v, typ)
+		}
+
+		result := make([]Value, len(items))
+
+		for i, item := range items {
+			if result[i], err = convert(elemType, item); err != nil {
+				return nil, err
+			}
+		}
+
+		return result, nil
+	}
+
+	switch typ {
+	case "String":
+		switch s := v.(type) {
+		case string:
+			return s, nil
+		case []byte:
+			return string(s), nil
+		}
+
+		return nil, errIllegalType("can't convert %v to String", v)
+	case "Date":
+		switch d := v.(type) {
+		case time.Time:
+			return d.Format("2006-01-02"), nil
+		case string:
+			if _, err := time.Parse("2006-01-02", d); err != nil {
+				return nil, errCannotParse("cannot parse date %q", d)
+			}
+
+			return d, nil
+		}
+
+		if days, ok := toInt64(goNumber(v)); ok {
+			return daysToDate(days), nil
+		}
+
+		return nil, errIllegalType("can't convert %v to Date", v)
+	case "Float32", "Float64":
+		f, ok := toFloat64(goNumber(v))
+		if !ok {
+			return nil, errIllegalType("can't convert %v to %s", v, typ)
+		}
+
+		if typ == "Float32" {
+			f = float64(float32(f))
+		}
+
+		return f, nil
+	}
+
+	if t, ok := v.(time.Time); ok {
+		v = t.Unix()
+	}
+
+	if s, ok := v.(string); ok && strings.HasPrefix(typ, "UInt") {
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, errCannotParse("cannot parse %q as %s", s, typ)
+		}
+
+		v = u
+	}
+
+	i, ok := toInt64(goNumber(v))
+	if !ok {
+		return nil, errIllegalType("can't convert %v to %s", v, typ)
+	}
+
+	switch typ {
+	case "UInt8":
+		return uint8(i), nil
+	case "UInt16":
+		return uint16(i), nil
+	case "UInt32", "DateTime":
+		return uint32(i), nil
+	case "UInt64":
+		if u, ok := v.(uint64); ok {
+			return u, nil
+		}
+
+		return uint64(i), nil
+	default:
+		return i, nil
+	}
+}
+
+// goNumber converts Go numbers to Value numbers
+func goNumber(v interface{}) Value {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int8:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case uint:
+		return uint64(n)
+	case float32:
+		return float64(n)
+	}
+
+	return v
+}
+
+// convertTextArray parses array in the text format: ['a','b'] or [1,2]
+func convertTextArray(elemType, s string) (Value, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || s[0] != '[' || s[len(s)-1] != ']' {
+		return nil, errCannotParse("cannot parse array %q", s)
+	}
+
+	tokens, err := lex(s[1 : len(s)-1])
+	if err != nil {
+		return nil, errCannotParse("cannot parse array %q: %s", s, err.Error())
+	}
+
+	result := []Value{}
+
+	for _, t := range tokens {
+		switch t.kind {
+		case tokenString, tokenNumber:
+			v, err := convert(elemType, t.text)
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, v)
+		case tokenOp:
+			if t.text != "," && t.text != "-" {
+				return nil, errCannotParse("cannot parse array %q", s)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// readRows reads rows of the columns in the input format
+func readRows(format string, columns []column, body []byte) ([]row, error) {
+	var rows []row
+
+	switch format {
+	case "TabSeparated", "TSV", "TabSeparatedRaw", "TSVRaw":
+		if len(body) == 0 {
+			return nil, nil
+		}
+
+		raw := strings.HasSuffix(format, "Raw")
+
+		for _, line := range strings.Split(strings.TrimSuffix(string(body), "\n"), "\n") {
+			fields := strings.Split(line, "\t")
+			if len(fields) != len(columns) {
+				return nil, errCannotParse("expected %d columns in %q", len(columns), line)
+			}
+
+			r := make(row, len(columns))
+
+			for i, c := range columns {
+				field := fields[i]
+				if !raw {
+					field = tsvUnescaper.Replace(field)
+				}
+
+				v, err := convert(c.typ, field)
+				if err != nil {
+					return nil, err
+				}
+
+				r[c.name] = v
+			}
+
+			rows = append(rows, r)
+		}
+	case "RowBinary":
+		rd := bytes.NewReader(body)
+
+		for rd.Len() > 0 {
+			r := make(row, len(columns))
+
+			for _, c := range columns {
+				v, err := readBinary(rd, c.typ)
+				if err != nil {
+					return nil, errCannotParse("cannot read %s of column %s: %s", c.typ, c.name, err.Error())
+				}
+
+				r[c.name] = v
+			}
+
+			rows = append(rows, r)
+		}
+	case "JSONEachRow":
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+
+		for dec.More() {
+			var object map[string]interface{}
+			if err := dec.Decode(&object); err != nil {
+				return nil, errCannotParse("cannot parse JSON: %s", err.Error())
+			}
+
+			r := make(row, len(columns))
+
+			for _, c := range columns {
+				v, err := convert(c.typ, jsonValue(object[c.name]))
+				if err != nil {
+					return nil, err
+				}
+
+				if v == nil {
+					v = zeroValue(c.typ)
+				}
+
+				r[c.name] = v
+			}
+
+			rows = append(rows, r)
+		}
+	default:
+		return nil, errUnknownFormat(format)
+	}
+
+	return rows, nil
+}
+
+func jsonValue(v interface{}) interface{} {
+	if a, ok := v.([]interface{}); ok {
+		values := make([]Value, len(a))
+		for i, item := range a {
+			values[i] = jsonValue(item)
+		}
+
+		return values
+	}
+
+	return v
+}
+
+// zeroValue is the default value of the column type
+func zeroValue(typ string) Value {
+	typ, _ = baseType(typ)
+	if strings.HasPrefix(typ, "Array(") {
+		return []Value{}
+	}
+
+	switch typ {
+	case "String":
+		return ""
+	case "Date":
+		return daysToDate(0)
+	}
+
+	v, _ := convert(typ, int64(0))
+
+	return v
+}
+
+func readBinary(rd *bytes.Reader, typ string) (Value, error) {
+	typ, err := baseType(typ)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(typ, "Array(") {
+		n, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return nil, err
+		}
+
+		result := make([]Value, n)
+
+		for i := range result {
+			if result[i], err = readBinary(rd, typ[6:len(typ)-1]); err != nil {
+				return nil, err
+			}
+		}
+
+		return result, nil
+	}
+
+	var b [8]byte
+
+	read := func(n int) ([]byte, error) {
+		_, err := io.ReadFull(rd, b[:n])
+		return b[:n], err
+	}
+
+	switch typ {
+	case "String":
+		n, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return nil, err
+		}
+
+		s := make([]byte, n)
+		if _, err = io.ReadFull(rd, s); err != nil {
+			return nil, err
+		}
+
+		return string(s), nil
+	case "UInt8", "Int8":
+		v, err := read(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if typ == "Int8" {
+			return int64(int8(v[0])), nil
+		}
+
+		return v[0], nil
+	case "UInt16", "Int16", "Date":
+		v, err := read(2)
+		if err != nil {
+			return nil, err
+		}
+
+		u := binary.LittleEndian.Uint16(v)
+
+		switch typ {
+		case "Int16":
+			return int64(int16(u)), nil
+		case "Date":
+			return daysToDate(int64(u)), nil
+		}
+
+		return u, nil
+	case "UInt32", "Int32", "Float32", "DateTime":
+		v, err := read(4)
+		if err != nil {
+			return nil, err
+		}
+
+		u := binary.LittleEndian.Uint32(v)
+
+		switch typ {
+		case "Int32":
+			return int64(int32(u)), nil
+		case "Float32":
+			return float64(math.Float32frombits(u)), nil
+		}
+
+		return u, nil
+	default: // UInt64, Int64, Float64
+		v, err := read(8)
+		if err != nil {
+			return nil, err
+		}
+
+		u := binary.LittleEndian.Uint64(v)
+
+		switch typ {
+		case "Int64":
+			return int64(u), nil
+		case "Float64":
+			return math.Float64frombits(u), nil
+		}
+
+		return u, nil
+	}
+}
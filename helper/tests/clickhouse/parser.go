@@ -0,0 +1,981 @@
+package clickhouse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lex splits the query to tokens, string literals are unescaped
+func lex(query string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(query); {
+		c := query[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || isLetter(c):
+			start := i
+			for i < len(query) && (query[i] == '_' || isLetter(query[i]) || isDigit(query[i])) {
+				i++
+			}
+
+			tokens = append(tokens, token{kind: tokenIdent, text: query[start:i], pos: start})
+		case c == '`':
+			end := strings.IndexByte(query[i+1:], '`')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated identifier at %d", i)
+			}
+
+			tokens = append(tokens, token{kind: tokenIdent, text: query[i+1 : i+1+end], pos: i})
+			i += end + 2
+		case isDigit(c):
+			start := i
+			for i < len(query) && (isDigit(query[i]) || query[i] == '.' || query[i] == 'e' || query[i] == 'E' ||
+				((query[i] == '-' || query[i] == '+') && (query[i-1] == 'e' || query[i-1] == 'E'))) {
+				i++
+			}
+
+			tokens = append(tokens, token{kind: tokenNumber, text: query[start:i], pos: start})
+		case c == '\'':
+			start := i
+
+			var s strings.Builder
+
+			for i++; ; i++ {
+				if i >= len(query) {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+
+				if query[i] == '\'' {
+					i++
+					break
+				}
+
+				if query[i] == '\\' && i+1 < len(query) {
+					i++
+					s.WriteByte(unescapeChar(query[i]))
+
+					continue
+				}
+
+				s.WriteByte(query[i])
+			}
+
+			tokens = append(tokens, token{kind: tokenString, text: s.String(), pos: start})
+		default:
+			op := string(c)
+			if i+1 < len(query) {
+				switch two := query[i : i+2]; two {
+				case "->", "!=", "<>", "<=", ">=", "==":
+					op = two
+				}
+			}
+
+			if !strings.Contains("()[],.=!<>+-*/%;", op[:1]) {
+				return nil, fmt.Errorf("unexpected symbol %q at %d", c, i)
+			}
+
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(query)}), nil
+}
+
+func isLetter(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+
+func unescapeChar(c byte) byte {
+	switch c {
+	case '0':
+		return 0
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	case 'b':
+		return '\b'
+	case 'f':
+		return '\f'
+	default:
+		return c
+	}
+}
+
+// expr is the node of the parsed expression
+type expr interface{}
+
+type (
+	literal struct{ value Value }
+	ident   struct{ name string }
+	call    struct {
+		name   string
+		params []expr // parameters of parametric aggregate functions, e.g. Resample
+		args   []expr
+		id     int // unique id of arrayJoin calls
+	}
+	lambda struct {
+		params []string
+		body   expr
+	}
+	index struct {
+		array expr
+		index expr
+	}
+	tupleElement struct {
+		tuple expr
+		n     int
+	}
+	inExpr struct {
+		value expr
+		list  []expr
+		table string
+		query *selectQuery
+		not   bool
+	}
+	subquery struct{ query *selectQuery }
+)
+
+type selectItem struct {
+	expr  expr
+	name  string
+	alias bool
+}
+
+type arrayJoinItem struct {
+	expr  expr
+	alias string
+}
+
+type orderItem struct {
+	expr expr
+	desc bool
+}
+
+type selectQuery struct {
+	with      []selectItem
+	items     []selectItem
+	distinct  bool
+	table     string
+	from      *selectQuery
+	arrayJoin []arrayJoinItem
+	prewhere  expr
+	where     expr
+	groupBy   []expr
+	having    expr
+	orderBy   []orderItem
+	limit     int
+	limitBy   []expr
+	format    string
+}
+
+type insertQuery struct {
+	table   string
+	columns []string
+	format  string
+}
+
+type parser struct {
+	query   string
+	tokens  []token
+	pos     int
+	callIDs int
+}
+
+// parse returns *selectQuery or *insertQuery
+func parse(query string) (interface{}, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{query: query, tokens: tokens}
+
+	var result interface{}
+
+	if p.isKeyword("INSERT") {
+		result, err = p.parseInsert()
+	} else {
+		result, err = p.parseSelect()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.acceptOp(";")
+
+	if p.peek().kind != tokenEOF {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+
+	return result, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at position %d: %s", p.peek().pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+func (p *parser) peekAt(n int) token {
+	if p.pos+n >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+
+	return p.tokens[p.pos+n]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) isKeyword(keywords ...string) bool {
+	for i, k := range keywords {
+		t := p.peekAt(i)
+		if t.kind != tokenIdent || !strings.EqualFold(t.text, k) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *parser) acceptKeyword(keywords ...string) bool {
+	if !p.isKeyword(keywords...) {
+		return false
+	}
+
+	p.pos += len(keywords)
+
+	return true
+}
+
+func (p *parser) expectKeyword(keywords ...string) error {
+	if !p.acceptKeyword(keywords...) {
+		return p.errorf("expected %s", strings.Join(keywords, " "))
+	}
+
+	return nil
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokenOp && t.text == op
+}
+
+func (p *parser) acceptOp(op string) bool {
+	if !p.isOp(op) {
+		return false
+	}
+
+	p.pos++
+
+	return true
+}
+
+func (p *parser) expectOp(op string) error {
+	if !p.acceptOp(op) {
+		return p.errorf("expected %q, got %q", op, p.peek().text)
+	}
+
+	return nil
+}
+
+func (p *parser) expectIdent() (string, error) {
+	if p.peek().kind != tokenIdent {
+		return "", p.errorf("expected identifier, got %q", p.peek().text)
+	}
+
+	return p.next().text, nil
+}
+
+func (p *parser) expectInt() (int, error) {
+	if p.peek().kind != tokenNumber {
+		return 0, p.errorf("expected number, got %q", p.peek().text)
+	}
+
+	return strconv.Atoi(p.next().text)
+}
+
+// clauseKeywords stop the parsing of aliases
+var clauseKeywords = map[string]bool{
+	"FROM": true, "WHERE": true, "PREWHERE": true, "GROUP": true, "HAVING": true, "ORDER": true, "LIMIT": true, "FORMAT": true,
+	"ARRAY": true, "SELECT": true, "BY": true, "ASC": true, "DESC": true, "SETTINGS": true, "UNION": true,
+}
+
+func (p *parser) parseInsert() (*insertQuery, error) {
+	if err := p.expectKeyword("INSERT", "INTO"); err != nil {
+		return nil, err
+	}
+
+	q := &insertQuery{}
+
+	var err error
+
+	if q.table, err = p.expectIdent(); err != nil {
+		return nil, err
+	}
+
+	if p.acceptOp("(") {
+		for {
+			column, err := p.expectIdent()
+			if err != nil {
+				return nil, err
+			}
+
+			q.columns = append(q.columns, column)
+
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+
+		if err = p.expectOp(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.acceptKeyword("FORMAT") {
+		if q.format, err = p.expectIdent(); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+func (p *parser) parseSelect() (*selectQuery, error) {
+	q := &selectQuery{}
+
+	var err error
+
+	if p.acceptKeyword("WITH") {
+		if q.with, err = p.parseItems(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+
+	q.distinct = p.acceptKeyword("DISTINCT")
+
+	if q.items, err = p.parseItems(); err != nil {
+		return nil, err
+	}
+
+	if err = p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+
+	if p.acceptOp("(") {
+		if q.from, err = p.parseSelect(); err != nil {
+			return nil, err
+		}
+
+		if err = p.expectOp(")"); err != nil {
+			return nil, err
+		}
+	} else if q.table, err = p.expectIdent(); err != nil {
+		return nil, err
+	}
+
+	if p.acceptKeyword("ARRAY", "JOIN") {
+		for {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+
+			item := arrayJoinItem{expr: e}
+			if id, ok := e.(*ident); ok {
+				item.alias = id.name
+			}
+
+			if p.acceptKeyword("AS") {
+				if item.alias, err = p.expectIdent(); err != nil {
+					return nil, err
+				}
+			}
+
+			q.arrayJoin = append(q.arrayJoin, item)
+
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("PREWHERE") {
+		if q.prewhere, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.acceptKeyword("WHERE") {
+		if q.where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.acceptKeyword("GROUP", "BY") {
+		if q.groupBy, err = p.parseExprList(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.acceptKeyword("HAVING") {
+		if q.having, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.acceptKeyword("ORDER", "BY") {
+		for {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+
+			item := orderItem{expr: e}
+			if p.acceptKeyword("DESC") {
+				item.desc = true
+			} else {
+				p.acceptKeyword("ASC")
+			}
+
+			q.orderBy = append(q.orderBy, item)
+
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("LIMIT") {
+		if q.limit, err = p.expectInt(); err != nil {
+			return nil, err
+		}
+
+		if p.acceptKeyword("BY") {
+			if q.limitBy, err = p.parseExprList(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if p.acceptKeyword("FORMAT") {
+		if q.format, err = p.expectIdent(); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+func (p *parser) parseItems() ([]selectItem, error) {
+	var items []selectItem
+
+	for {
+		start := p.peek().pos
+
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		item := selectItem{expr: e, name: strings.TrimSpace(p.query[start:p.peek().pos])}
+		if id, ok := e.(*ident); ok {
+			item.name = id.name
+		}
+
+		if p.acceptKeyword("AS") {
+			if item.name, err = p.expectIdent(); err != nil {
+				return nil, err
+			}
+
+			item.alias = true
+		}
+
+		items = append(items, item)
+
+		if !p.acceptOp(",") {
+			return items, nil
+		}
+	}
+}
+
+func (p *parser) parseExprList() ([]expr, error) {
+	var list []expr
+
+	for {
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, e)
+
+		if !p.acceptOp(",") {
+			return list, nil
+		}
+	}
+}
+
+// parseExpr parses the expression with the lowest priority: lambda or OR
+func (p *parser) parseExpr() (expr, error) {
+	if params, ok := p.lambdaParams(); ok {
+		body, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		return &lambda{params: params, body: body}, nil
+	}
+
+	return p.parseOr()
+}
+
+// lambdaParams consumes `x ->` or `(x, y) ->`
+func (p *parser) lambdaParams() ([]string, bool) {
+	if p.peek().kind == tokenIdent && p.peekAt(1).kind == tokenOp && p.peekAt(1).text == "->" {
+		name := p.next().text
+		p.next()
+
+		return []string{name}, true
+	}
+
+	if !p.isOp("(") {
+		return nil, false
+	}
+
+	var params []string
+
+	for i := 1; ; i += 2 {
+		t := p.peekAt(i)
+		if t.kind != tokenIdent {
+			return nil, false
+		}
+
+		params = append(params, t.text)
+
+		sep := p.peekAt(i + 1)
+		if sep.kind != tokenOp {
+			return nil, false
+		}
+
+		if sep.text == ")" {
+			arrow := p.peekAt(i + 2)
+			if arrow.kind != tokenOp || arrow.text != "->" {
+				return nil, false
+			}
+
+			p.pos += i + 3
+
+			return params, true
+		}
+
+		if sep.text != "," {
+			return nil, false
+		}
+	}
+}
+
+func (p *parser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &call{name: "or", args: []expr{left, right}}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &call{name: "and", args: []expr{left, right}}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseNot() (expr, error) {
+	if p.acceptKeyword("NOT") {
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		return &call{name: "not", args: []expr{e}}, nil
+	}
+
+	return p.parseComparison()
+}
+
+var comparisonFunctions = map[string]string{
+	"=": "equals", "==": "equals", "!=": "notEquals", "<>": "notEquals",
+	"<": "less", "<=": "lessOrEquals", ">": "greater", ">=": "greaterOrEquals",
+}
+
+func (p *parser) parseComparison() (expr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if name, ok := comparisonFunctions[t.text]; ok && t.kind == tokenOp {
+		p.next()
+
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+
+		return &call{name: name, args: []expr{left, right}}, nil
+	}
+
+	not := p.acceptKeyword("NOT")
+
+	switch {
+	case p.acceptKeyword("LIKE"):
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+
+		name := "like"
+		if not {
+			name = "notLike"
+		}
+
+		return &call{name: name, args: []expr{left, right}}, nil
+	case p.acceptKeyword("IN"):
+		return p.parseIn(left, not)
+	case not:
+		return nil, p.errorf("expected LIKE or IN after NOT")
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseIn(value expr, not bool) (expr, error) {
+	in := &inExpr{value: value, not: not}
+
+	if !p.acceptOp("(") {
+		table, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+
+		in.table = table
+
+		return in, nil
+	}
+
+	var err error
+
+	if p.isKeyword("SELECT") || p.isKeyword("WITH") {
+		in.query, err = p.parseSelect()
+	} else if !p.isOp(")") {
+		in.list, err = p.parseExprList()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return in, p.expectOp(")")
+}
+
+func (p *parser) parseAdditive() (expr, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var name string
+
+		switch {
+		case p.acceptOp("+"):
+			name = "plus"
+		case p.acceptOp("-"):
+			name = "minus"
+		default:
+			return left, nil
+		}
+
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &call{name: name, args: []expr{left, right}}
+	}
+}
+
+func (p *parser) parseMultiplicative() (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var name string
+
+		switch {
+		case p.acceptOp("*"):
+			name = "multiply"
+		case p.acceptOp("/"):
+			name = "divide"
+		case p.acceptOp("%"):
+			name = "modulo"
+		default:
+			return left, nil
+		}
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &call{name: name, args: []expr{left, right}}
+	}
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	if p.acceptOp("-") {
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		if l, ok := e.(*literal); ok {
+			switch v := l.value.(type) {
+			case int64:
+				return &literal{value: -v}, nil
+			case float64:
+				return &literal{value: -v}, nil
+			}
+		}
+
+		return &call{name: "negate", args: []expr{e}}, nil
+	}
+
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (expr, error) {
+	e, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case p.acceptOp("["):
+			i, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+
+			if err = p.expectOp("]"); err != nil {
+				return nil, err
+			}
+
+			e = &index{array: e, index: i}
+		case p.isOp(".") && p.peekAt(1).kind == tokenNumber:
+			p.next()
+
+			n, err := p.expectInt()
+			if err != nil {
+				return nil, err
+			}
+
+			e = &tupleElement{tuple: e, n: n}
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.peek()
+
+	switch t.kind {
+	case tokenNumber:
+		p.next()
+
+		if i, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return &literal{value: i}, nil
+		}
+
+		if u, err := strconv.ParseUint(t.text, 10, 64); err == nil {
+			return &literal{value: u}, nil
+		}
+
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", t.text)
+		}
+
+		return &literal{value: f}, nil
+	case tokenString:
+		p.next()
+		return &literal{value: t.text}, nil
+	case tokenIdent:
+		if clauseKeywords[strings.ToUpper(t.text)] {
+			return nil, p.errorf("unexpected %s", t.text)
+		}
+
+		p.next()
+
+		switch strings.ToUpper(t.text) {
+		case "NULL":
+			return &literal{value: nil}, nil
+		case "TRUE":
+			return &literal{value: uint8(1)}, nil
+		case "FALSE":
+			return &literal{value: uint8(0)}, nil
+		}
+
+		if !p.acceptOp("(") {
+			return &ident{name: t.text}, nil
+		}
+
+		return p.parseCall(t.text)
+	case tokenOp:
+		switch t.text {
+		case "(":
+			p.next()
+
+			if p.isKeyword("SELECT") || p.isKeyword("WITH") {
+				q, err := p.parseSelect()
+				if err != nil {
+					return nil, err
+				}
+
+				return &subquery{query: q}, p.expectOp(")")
+			}
+
+			list, err := p.parseExprList()
+			if err != nil {
+				return nil, err
+			}
+
+			if err = p.expectOp(")"); err != nil {
+				return nil, err
+			}
+
+			if len(list) == 1 {
+				return list[0], nil
+			}
+
+			return &call{name: "tuple", args: list}, nil
+		case "[":
+			p.next()
+
+			var (
+				list []expr
+				err  error
+			)
+
+			if !p.isOp("]") {
+				if list, err = p.parseExprList(); err != nil {
+					return nil, err
+				}
+			}
+
+			return &call{name: "array", args: list}, p.expectOp("]")
+		}
+	}
+
+	return nil, p.errorf("unexpected %q", t.text)
+}
+
+// parseCall parses the arguments of the function, the name and ( are already consumed
+func (p *parser) parseCall(name string) (expr, error) {
+	c := &call{name: name}
+
+	var err error
+
+	if !p.isOp(")") {
+		if c.args, err = p.parseExprList(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = p.expectOp(")"); err != nil {
+		return nil, err
+	}
+
+	// parametric function: f(params)(args)
+	if p.acceptOp("(") {
+		c.params = c.args
+		c.args = nil
+
+		if !p.isOp(")") {
+			if c.args, err = p.parseExprList(); err != nil {
+				return nil, err
+			}
+		}
+
+		if err = p.expectOp(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if name == "arrayJoin" {
+		p.callIDs++
+		c.id = p.callIDs
+	}
+
+	return c, nil
+}
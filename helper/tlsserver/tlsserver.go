@@ -0,0 +1,196 @@
+package tlsserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/config"
+	"go.uber.org/zap"
+)
+
+// Server is the listener TLS config. Certificates and client CA are reloaded, when files are changed
+type Server struct {
+	params *config.TLS
+	base   *tls.Config // static params (versions, ciphers, curves, client auth, protocols)
+
+	lock    sync.RWMutex
+	current *tls.Config
+	mtimes  map[string]time.Time // modification time of loaded files
+}
+
+// New checks TLS params and loads certificates. Warnings are returned about insecure ciphers
+func New(params *config.TLS) (*Server, []string, error) {
+	if len(params.Certificates) == 0 {
+		return nil, nil, fmt.Errorf("no tls certificates provided")
+	}
+
+	minVersion, err := config.ParseTLSVersion(params.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	maxVersion, err := config.ParseTLSVersion(params.MaxVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	curves, err := config.ParseCurves(params.Curves)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ciphers, warns, err := config.CipherSuitesToUint16(params.CipherSuites)
+	if err != nil {
+		return nil, warns, err
+	}
+
+	clientAuth, err := config.ParseClientAuthType(params.ClientAuth)
+	if err != nil {
+		return nil, warns, err
+	}
+
+	if (clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert) && len(params.CACertFiles) == 0 {
+		return nil, warns, fmt.Errorf("client-auth %s requires ca-cert", params.ClientAuth)
+	}
+
+	if params.InsecureSkipVerify {
+		warns = append(warns, "insecure-skip-verify is ignored for the server")
+	}
+
+	s := &Server{
+		params: params,
+		base: &tls.Config{
+			MinVersion:       minVersion,
+			MaxVersion:       maxVersion,
+			CipherSuites:     ciphers,
+			CurvePreferences: curves,
+			ClientAuth:       clientAuth,
+			// the config for the client replaces the listener one, so the protocols must be set here for HTTP/2
+			NextProtos: []string{"h2", "http/1.1"},
+		},
+	}
+
+	if _, err = s.load(); err != nil {
+		return nil, warns, err
+	}
+
+	return s, warns, nil
+}
+
+func (s *Server) files() []string {
+	files := make([]string, 0, 2*len(s.params.Certificates)+len(s.params.CACertFiles))
+	for _, c := range s.params.Certificates {
+		files = append(files, c.CertFile, c.KeyFile)
+	}
+
+	return append(files, s.params.CACertFiles...)
+}
+
+// load reads files, if any of them was modified since the previous load
+func (s *Server) load() (bool, error) {
+	mtimes := make(map[string]time.Time)
+	changed := false
+
+	for _, f := range s.files() {
+		st, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+
+		mtimes[f] = st.ModTime()
+
+		if prev, ok := s.mtimes[f]; !ok || !prev.Equal(st.ModTime()) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	certificates := make([]tls.Certificate, 0, len(s.params.Certificates))
+
+	for _, c := range s.params.Certificates {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return false, err
+		}
+
+		certificates = append(certificates, cert)
+	}
+
+	cfg := s.base.Clone()
+	cfg.Certificates = certificates
+
+	if len(s.params.CACertFiles) > 0 {
+		pool := x509.NewCertPool()
+
+		for _, f := range s.params.CACertFiles {
+			pem, err := os.ReadFile(f)
+			if err != nil {
+				return false, err
+			}
+
+			if !pool.AppendCertsFromPEM(pem) {
+				return false, fmt.Errorf("no certificates found in %s", f)
+			}
+		}
+
+		cfg.ClientCAs = pool
+	}
+
+	s.lock.Lock()
+	s.current = cfg
+	s.mtimes = mtimes
+	s.lock.Unlock()
+
+	return true, nil
+}
+
+// Reload loads changed certificates. On error the previous certificates are still used
+func (s *Server) Reload() (bool, error) {
+	return s.load()
+}
+
+// Config returns *tls.Config for the listener, which always uses the last loaded certificates
+func (s *Server) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: s.base.MinVersion,
+		NextProtos: s.base.NextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+
+			return s.current, nil
+		},
+	}
+}
+
+// Watch checks files for modifications with interval until ctx is done
+func (s *Server) Watch(ctx context.Context, interval time.Duration, logger *zap.Logger) {
+	if interval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			reloaded, err := s.Reload()
+			if err != nil {
+				logger.Error("tls certificates reload failed", zap.Error(err))
+			} else if reloaded {
+				logger.Info("tls certificates reloaded")
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package tlsserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert writes the certificate, signed by parent (self-signed if nil)
+func writeCert(t *testing.T, dir, name, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert, key
+}
+
+func serve(t *testing.T, s *Server) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	srv.TLS = s.Config()
+	srv.StartTLS()
+
+	return srv
+}
+
+func servedCN(t *testing.T, url string) string {
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	return resp.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+func TestServerReload(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "server", "first", nil, nil)
+
+	s, _, err := New(&config.TLS{
+		Certificates: []config.CertificatePair{{CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.key")}},
+	})
+	require.NoError(t, err)
+
+	srv := serve(t, s)
+	defer srv.Close()
+
+	assert.Equal(t, "first", servedCN(t, srv.URL))
+
+	reloaded, err := s.Reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded)
+
+	writeCert(t, dir, "server", "second", nil, nil)
+
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "server.crt"), future, future))
+
+	reloaded, err = s.Reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+
+	srv.CloseClientConnections()
+	assert.Equal(t, "second", servedCN(t, srv.URL))
+}
+
+func TestServerHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "server", "server", nil, nil)
+
+	s, _, err := New(&config.TLS{
+		Certificates: []config.CertificatePair{{CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.key")}},
+	})
+	require.NoError(t, err)
+
+	srv := serve(t, s)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, "h2", resp.TLS.NegotiatedProtocol)
+}
+
+func TestServerClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", "ca", nil, nil)
+	writeCert(t, dir, "server", "server", ca, caKey)
+	writeCert(t, dir, "client", "client", ca, caKey)
+
+	params := &config.TLS{
+		Certificates: []config.CertificatePair{{CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.key")}},
+		ClientAuth:   "RequireAndVerifyClientCert",
+	}
+
+	_, _, err := New(params)
+	assert.Error(t, err, "ca-cert is required")
+
+	params.CACertFiles = []string{filepath.Join(dir, "ca.crt")}
+
+	s, _, err := New(params)
+	require.NoError(t, err)
+
+	srv := serve(t, s)
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	noCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	_, err = noCert.Get(srv.URL)
+	assert.Error(t, err)
+
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	require.NoError(t, err)
+
+	withCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}}}
+	resp, err := withCert.Get(srv.URL)
+	require.NoError(t, err)
+
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "ok", string(body))
+}
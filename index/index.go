@@ -13,11 +13,14 @@ import (
 	"github.com/lomik/graphite-clickhouse/finder"
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/pkg/where"
 )
 
 type Index struct {
 	config     *config.Config
 	rowsReader io.ReadCloser
+	prefix     []byte      // tenant prefix, stripped from the output
+	acl        *finder.ACL // nil, if metrics are not restricted
 }
 
 func New(config *config.Config, ctx context.Context) (*Index, error) {
@@ -31,14 +34,27 @@ func New(config *config.Config, ctx context.Context) (*Index, error) {
 		CheckRequestProgress:    config.FeatureFlags.LogQueryProgress,
 		ProgressSendingInterval: config.ClickHouse.ProgressSendingInterval,
 	}
+
+	var (
+		prefix      []byte
+		indexFilter string
+		treeFilter  string
+	)
+
+	if tenant := finder.Tenant(ctx, config); tenant != nil {
+		prefix = []byte(tenant.Prefix + ".")
+		indexFilter = " AND " + where.HasPrefix("Path", tenant.Prefix+".")
+		treeFilter = " WHERE " + where.HasPrefix("Path", tenant.Prefix+".")
+	}
+
 	if config.ClickHouse.IndexTable != "" {
 		opts.Timeout = config.ClickHouse.IndexTimeout
 		reader, err = clickhouse.Reader(
 			scope.WithTable(ctx, config.ClickHouse.IndexTable),
 			config.ClickHouse.URL,
 			fmt.Sprintf(
-				"SELECT Path FROM %s WHERE Date = '%s' AND Level >= %d AND Level < %d GROUP BY Path",
-				config.ClickHouse.IndexTable, finder.DefaultTreeDate, finder.TreeLevelOffset, finder.ReverseTreeLevelOffset,
+				"SELECT Path FROM %s WHERE Date = '%s' AND Level >= %d AND Level < %d%s GROUP BY Path",
+				config.ClickHouse.IndexTable, finder.DefaultTreeDate, finder.TreeLevelOffset, finder.ReverseTreeLevelOffset, indexFilter,
 			),
 			opts,
 			nil,
@@ -48,7 +64,7 @@ func New(config *config.Config, ctx context.Context) (*Index, error) {
 		reader, err = clickhouse.Reader(
 			scope.WithTable(ctx, config.ClickHouse.TreeTable),
 			config.ClickHouse.URL,
-			fmt.Sprintf("SELECT Path FROM %s GROUP BY Path", config.ClickHouse.TreeTable),
+			fmt.Sprintf("SELECT Path FROM %s%s GROUP BY Path", config.ClickHouse.TreeTable, treeFilter),
 			opts,
 			nil,
 		)
@@ -61,6 +77,8 @@ func New(config *config.Config, ctx context.Context) (*Index, error) {
 	return &Index{
 		config:     config,
 		rowsReader: reader,
+		prefix:     prefix,
+		acl:        finder.RequestACL(ctx, config),
 	}, nil
 }
 
@@ -87,6 +105,18 @@ func (i *Index) WriteJSON(w http.ResponseWriter) error {
 			continue
 		}
 
+		if i.acl != nil && !i.acl.AllowedPlain(b) {
+			continue
+		}
+
+		if len(i.prefix) > 0 {
+			if !bytes.HasPrefix(b, i.prefix) {
+				continue
+			}
+
+			b = b[len(i.prefix):]
+		}
+
 		json_b, err := json.Marshal(string(b))
 		if err != nil {
 			return err
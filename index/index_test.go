@@ -2,11 +2,16 @@ package index
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
 )
 
 func TestWriteJSONEmptyRows(t *testing.T) {
@@ -67,6 +72,25 @@ func TestWriteJSONEmptyIndex(t *testing.T) {
 	}
 }
 
+func TestWriteJSONACL(t *testing.T) {
+	cfg := config.New()
+	cfg.Auth.Roles = map[string]*config.Role{"team_a": {MetricPrefixes: []string{"teams.a."}}}
+
+	ctx := scope.WithRoles(scope.WithUser(context.Background(), "alice"), []string{"team_a"})
+
+	index := indexForBytes([]byte("teams.\nteams.a.\nteams.a.cpu\nteams.b.cpu\n"))
+	index.acl = finder.RequestACL(ctx, cfg)
+
+	mockResponse := httptest.NewRecorder()
+	if err := index.WriteJSON(mockResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := mockResponse.Body.String(); body != `["teams.a.cpu"]` {
+		t.Fatalf("Wrong metrics contents: %s", body)
+	}
+}
+
 func indexForBytes(b []byte) *Index {
 	buffer := bytes.NewBuffer(b)
 
@@ -17,6 +17,10 @@ func AccessLog(logger *zap.Logger, config *config.Config, r *http.Request, statu
 		logger = logger.With(zap.String("grafana", grafana))
 	}
 
+	if user := scope.User(r.Context()); user != "" {
+		logger = logger.With(zap.String("user", user))
+	}
+
 	var peer string
 	if peer = r.Header.Get("X-Real-Ip"); peer == "" {
 		peer = r.RemoteAddr
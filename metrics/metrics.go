@@ -39,11 +39,21 @@ var FinderCacheMetrics *CacheMetric
 var ShortCacheMetrics *CacheMetric
 var DefaultCacheMetrics *CacheMetric
 
+// IndexStatsMetric counts the decisions of index-reverse = "stats"
+type IndexStatsMetric struct {
+	Direct   metrics.Counter
+	Reversed metrics.Counter
+	Fallback metrics.Counter // no statistics, the decision is made by the wildcards positions
+}
+
+var IndexStatsMetrics *IndexStatsMetric
+
 // var WaitMetrics []WaitMetric
 
 type ReqMetric struct {
 	RequestsH        metrics.Histogram
 	Errors           metrics.Counter
+	Truncated        metrics.Counter // partial responses, truncated to the metrics limit
 	Requests200      metrics.Counter
 	Requests400      metrics.Counter
 	Requests403      metrics.Counter
@@ -149,10 +159,25 @@ func initFindCacheMetrics(c *Config) {
 	}
 }
 
+func initIndexStatsMetrics(c *Config) {
+	IndexStatsMetrics = &IndexStatsMetric{
+		Direct:   metrics.NewCounter(),
+		Reversed: metrics.NewCounter(),
+		Fallback: metrics.NewCounter(),
+	}
+
+	if c != nil && Graphite != nil {
+		metrics.Register("index_stats_direct", IndexStatsMetrics.Direct)
+		metrics.Register("index_stats_reversed", IndexStatsMetrics.Reversed)
+		metrics.Register("index_stats_fallback", IndexStatsMetrics.Fallback)
+	}
+}
+
 func initFindMetrics(scope string, c *Config, waitQueue bool) *FindMetrics {
 	requestMetric := &FindMetrics{
 		ReqMetric: ReqMetric{
 			Errors:           metrics.NewCounter(),
+			Truncated:        metrics.NewCounter(),
 			MetricsCountName: scope + ".all.metrics",
 			PointsCountName:  scope + ".all.points",
 		},
@@ -184,6 +209,7 @@ func initFindMetrics(scope string, c *Config, waitQueue bool) *FindMetrics {
 		requestMetric.RequestsH = metrics.NewVSumHistogram(c.BucketsWidth, c.BucketsLabels).SetNameTotal("")
 		metrics.Register(scope+".all.requests", requestMetric.RequestsH)
 		metrics.Register(scope+".all.errors", requestMetric.Errors)
+		metrics.Register(scope+".all.truncated", requestMetric.Truncated)
 
 		if c.ExtendedStat {
 			metrics.Register(scope+".all.requests_status_code.200", requestMetric.Requests200)
@@ -244,6 +270,7 @@ func initRenderMetrics(scope string, c *Config) *RenderMetrics {
 		RenderMetric: RenderMetric{
 			ReqMetric: ReqMetric{
 				Errors:           metrics.NewCounter(),
+				Truncated:        metrics.NewCounter(),
 				MetricsCountName: scope + ".all.metrics",
 				PointsCountName:  scope + ".all.points",
 			},
@@ -278,6 +305,7 @@ func initRenderMetrics(scope string, c *Config) *RenderMetrics {
 		metrics.Register(scope+".all.requests", requestMetric.RequestsH)
 		metrics.Register(scope+".all.requests_finder", requestMetric.FinderH)
 		metrics.Register(scope+".all.errors", requestMetric.Errors)
+		metrics.Register(scope+".all.truncated", requestMetric.Truncated)
 
 		if c.ExtendedStat {
 			metrics.Register(scope+".all.requests_status_code.200", requestMetric.Requests200)
@@ -681,6 +709,7 @@ func InitMetrics(c *Config, findWaitQueue, tagsWaitQueue bool) {
 	}
 
 	initFindCacheMetrics(c)
+	initIndexStatsMetrics(c)
 	FindRequestMetric = initFindMetrics("find", c, findWaitQueue)
 	TagsRequestMetric = initFindMetrics("tags", c, tagsWaitQueue)
 	RenderRequestMetric = initRenderMetrics("render", c)
@@ -451,6 +451,7 @@ func TestInitMetrics(t *testing.T) {
 			assert.Equal(t, tt.want, c)
 			// FindRequestH
 			compareInterface(t, "find.all.requests", FindRequestMetric.RequestsH, true)
+			compareInterface(t, "find.all.truncated", FindRequestMetric.Truncated, true)
 			// FindRequestCount
 			compareInterface(t, "find.all.requests_status_code.200", FindRequestMetric.Requests200, c.ExtendedStat)
 			compareInterface(t, "find.all.requests_status_code.400", FindRequestMetric.Requests400, c.ExtendedStat)
@@ -498,6 +499,7 @@ func TestInitMetrics(t *testing.T) {
 			// RenderRequestH
 			compareInterface(t, "render.all.requests", RenderRequestMetric.RequestsH, true)
 			compareInterface(t, "render.all.requests_finder", RenderRequestMetric.FinderH, true)
+			compareInterface(t, "render.all.truncated", RenderRequestMetric.Truncated, true)
 			// RenderRequestCount
 			compareInterface(t, "render.all.requests_status_code.200", RenderRequestMetric.Requests200, c.ExtendedStat)
 			compareInterface(t, "render.all.requests_status_code.400", RenderRequestMetric.Requests400, c.ExtendedStat)
@@ -2,6 +2,7 @@ package alias
 
 import (
 	"bytes"
+	"sort"
 	"sync"
 
 	"github.com/lomik/graphite-clickhouse/finder"
@@ -69,6 +70,13 @@ func (m *Map) MergeTarget(r finder.Result, target string, saveCache bool) []byte
 	}
 }
 
+// Append adds the value for the metric
+func (m *Map) Append(metric string, v Value) {
+	m.lock.Lock()
+	m.data[metric] = append(m.data[metric], v)
+	m.lock.Unlock()
+}
+
 // Len returns count of keys
 func (m *Map) Len() int {
 	m.lock.RLock()
@@ -77,6 +85,29 @@ func (m *Map) Len() int {
 	return len(m.data)
 }
 
+// Truncate keeps the first n metrics in the sorted order and returns count of the removed ones
+func (m *Map) Truncate(n int) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if n < 0 || len(m.data) <= n {
+		return 0
+	}
+
+	series := make([]string, 0, len(m.data))
+	for k := range m.data {
+		series = append(series, k)
+	}
+
+	sort.Strings(series)
+
+	for _, k := range series[n:] {
+		delete(m.data, k)
+	}
+
+	return len(series) - n
+}
+
 // Size returns count of values
 func (m *Map) Size() int {
 	s := 0
@@ -159,6 +159,27 @@ func TestGet(t *testing.T) {
 	assert.Equal(t, []Value{{Target: "*.name.*", DisplayName: "5_sec.name.max"}}, am.Get("5_sec.name.max"))
 }
 
+func TestAppend(t *testing.T) {
+	am := New()
+	am.Append("1", Value{Target: "sumSeries(a.*)", DisplayName: "sumSeries(a.*)"})
+	am.Append("1", Value{Target: "a.*", DisplayName: "a.b"})
+
+	assert.Equal(t, 1, am.Len())
+	assert.Equal(t, []Value{{Target: "sumSeries(a.*)", DisplayName: "sumSeries(a.*)"}, {Target: "a.*", DisplayName: "a.b"}}, am.Get("1"))
+}
+
+func TestTruncate(t *testing.T) {
+	am := createAM()
+	assert.Equal(t, 0, am.Truncate(4))
+	assert.Equal(t, 4, am.Len())
+
+	assert.Equal(t, 2, am.Truncate(2))
+
+	series := am.Series(false)
+	sort.Strings(series)
+	assert.Equal(t, []string{"10_min.name.any", "1_min.name.avg"}, series)
+}
+
 func Benchmark_MergeTargetFinder(b *testing.B) {
 	result := [][]byte{
 		[]byte("5_sec.name.any"),
@@ -17,3 +17,22 @@ func RemoveEmptyStrings(stringList []string) []string {
 
 	return stringList[:len(stringList)-rm]
 }
+
+// RemoveDuplicateStrings removes repeated strings from list, keeping the order of the first occurrences, and returns
+// truncated slice
+func RemoveDuplicateStrings(stringList []string) []string {
+	seen := make(map[string]struct{}, len(stringList))
+	n := 0
+
+	for _, s := range stringList {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+
+		seen[s] = struct{}{}
+		stringList[n] = s
+		n++
+	}
+
+	return stringList[:n]
+}
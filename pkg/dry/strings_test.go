@@ -13,3 +13,11 @@ func TestRemoveEmptyStrings(t *testing.T) {
 		RemoveEmptyStrings([]string{"", "", "lorem", "", " ", "ipsum", ""}),
 	)
 }
+
+func TestRemoveDuplicateStrings(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]string{"lorem", "ipsum", ""},
+		RemoveDuplicateStrings([]string{"lorem", "ipsum", "lorem", "", "ipsum", ""}),
+	)
+}
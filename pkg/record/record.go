@@ -0,0 +1,249 @@
+package record
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// DebugHeader is the name of X-Gch-Debug-* header, which enables the recording of the request
+const DebugHeader = "Record"
+
+// credentialHeaders are not saved, the authenticated identity is recorded instead
+var credentialHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// Recording is the incoming HTTP request, ClickHouse queries made while serving it and the responses
+type Recording struct {
+	RequestID string    `json:"request_id"`
+	Time      time.Time `json:"time"`
+	User      string    `json:"user,omitempty"`
+	Roles     []string  `json:"roles,omitempty"`
+	Request   Request   `json:"request"`
+	Response  Response  `json:"response"`
+	Queries   []Query   `json:"queries"`
+}
+
+// Request is the recorded incoming HTTP request
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// Response is the recorded HTTP response
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// Query is the recorded ClickHouse query
+type Query struct {
+	Query    string          `json:"query"`
+	Body     []byte          `json:"body,omitempty"`
+	Encoding string          `json:"encoding,omitempty"`
+	External []ExternalTable `json:"external,omitempty"`
+	Status   int             `json:"status"`
+	Summary  string          `json:"summary,omitempty"`
+	Response []byte          `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// ExternalTable is the external data passed with the query
+type ExternalTable struct {
+	Name      string `json:"name"`
+	Structure string `json:"structure"`
+	Format    string `json:"format"`
+	Data      []byte `json:"data"`
+}
+
+// Recorder collects the recording of the single request
+type Recorder struct {
+	mu  sync.Mutex
+	rec Recording
+}
+
+type ctxKey struct{}
+
+// FromContext returns the recorder of the request or nil, if the request is not recorded
+func FromContext(ctx context.Context) *Recorder {
+	if r, ok := ctx.Value(ctxKey{}).(*Recorder); ok {
+		return r
+	}
+
+	return nil
+}
+
+// Enabled returns true if the request should be recorded
+func Enabled(r *http.Request, perm os.FileMode) bool {
+	return perm > 0 && scope.Debug(r.Context(), DebugHeader)
+}
+
+// Start begins the recording of the authenticated request. The body of the request is read and restored, the
+// returned writer captures the response. The credentials headers are not saved.
+func Start(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, *Recorder, error) {
+	header := r.Header.Clone()
+	for _, name := range credentialHeaders {
+		header.Del(name)
+	}
+
+	rec := &Recorder{
+		rec: Recording{
+			RequestID: scope.RequestID(r.Context()),
+			Time:      time.Now(),
+			User:      scope.User(r.Context()),
+			Roles:     scope.Roles(r.Context()),
+			Request: Request{
+				Method: r.Method,
+				URL:    r.URL.RequestURI(),
+				Header: header,
+			},
+		},
+	}
+
+	if r.Body != nil {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+
+		if err != nil {
+			return w, r, nil, err
+		}
+
+		rec.rec.Request.Body = body
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, rec))
+
+	return &responseWriter{ResponseWriter: w, rec: rec}, r, rec, nil
+}
+
+// Add appends the query to the recording
+func (r *Recorder) Add(q *Query) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rec.Queries = append(r.rec.Queries, *q)
+}
+
+// Tee returns the reader, which saves the response of the query and adds the query to the recording on EOF or Close
+func (r *Recorder) Tee(q *Query, body io.ReadCloser) io.ReadCloser {
+	return &teeReader{body: body, rec: r, query: q}
+}
+
+// Recording returns the copy of collected data
+func (r *Recorder) Recording() Recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec := r.rec
+	rec.Queries = append([]Query(nil), r.rec.Queries...)
+
+	return rec
+}
+
+// Save writes the recording as record-<request_id>.json into the directory and returns the file name
+func (r *Recorder) Save(dir string, perm os.FileMode) (string, error) {
+	rec := r.Recording()
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	filename := path.Join(dir, fmt.Sprintf("record-%s.json", rec.RequestID))
+
+	return filename, os.WriteFile(filename, data, perm)
+}
+
+// Load reads the recording from the file
+func Load(filename string) (*Recording, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := new(Recording)
+	if err = json.Unmarshal(data, rec); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return rec, nil
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	rec         *Recorder
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+
+		w.rec.mu.Lock()
+		w.rec.rec.Response.Status = status
+		w.rec.rec.Response.Header = w.Header().Clone()
+		w.rec.mu.Unlock()
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	w.rec.mu.Lock()
+	w.rec.rec.Response.Body = append(w.rec.rec.Response.Body, p...)
+	w.rec.mu.Unlock()
+
+	return w.ResponseWriter.Write(p)
+}
+
+type teeReader struct {
+	body  io.ReadCloser
+	rec   *Recorder
+	query *Query
+	buf   bytes.Buffer
+	once  sync.Once
+}
+
+func (t *teeReader) Read(p []byte) (int, error) {
+	n, err := t.body.Read(p)
+	t.buf.Write(p[:n])
+
+	if err != nil {
+		t.done(err)
+	}
+
+	return n, err
+}
+
+func (t *teeReader) Close() error {
+	t.done(nil)
+
+	return t.body.Close()
+}
+
+func (t *teeReader) done(err error) {
+	t.once.Do(func() {
+		t.query.Response = t.buf.Bytes()
+		if err != nil && err != io.EOF {
+			t.query.Error = err.Error()
+		}
+
+		t.rec.Add(t.query)
+	})
+}
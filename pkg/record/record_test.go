@@ -0,0 +1,127 @@
+package record_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	chclient "github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+	"github.com/lomik/graphite-clickhouse/pkg/record"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+const (
+	levelQuery = "SELECT Path FROM graphite_index WHERE Level=20001 GROUP BY Path FORMAT TabSeparatedRaw"
+	extQuery   = "SELECT Path FROM graphite_index WHERE Path IN metrics_list AND Level=2 GROUP BY Path FORMAT TabSeparatedRaw"
+)
+
+func newHandler(url *string, suffix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _, _, err := chclient.Query(r.Context(), *url, levelQuery, chclient.Options{Timeout: time.Second}, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		extData := chclient.NewExternalData(chclient.ExternalTable{
+			Name:    "metrics_list",
+			Columns: []chclient.Column{{Name: "Path", Type: "String"}},
+			Format:  "TSV",
+			Data:    []byte("a.b\nc.d\n"),
+		})
+
+		ext, _, _, err := chclient.Query(r.Context(), *url, extQuery, chclient.Options{Timeout: time.Second}, extData)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(body)
+		w.Write(ext)
+		w.Write([]byte(suffix))
+	})
+}
+
+func TestRecordReplay(t *testing.T) {
+	srv := clickhouse.NewFakeServer()
+	defer srv.Close()
+
+	require.NoError(t, srv.AddIndex("graphite_index", time.Now(), "a.b", "c.d", "e.f"))
+
+	url := srv.URL
+	h := newHandler(&url, "")
+
+	r := httptest.NewRequest("GET", "/metrics/find/?query=*", nil)
+	r.Header.Set("X-Gch-Debug-Record", "1")
+	r.Header.Set("X-Request-Id", "test-request")
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Cookie", "session=secret")
+	r = scope.HttpRequest(r)
+	r = r.WithContext(scope.WithRoles(scope.WithUser(r.Context(), "alice"), []string{"team_a"}))
+
+	require.True(t, record.Enabled(r, 0640))
+	require.False(t, record.Enabled(r, 0))
+
+	w := httptest.NewRecorder()
+
+	rw, r, rec, err := record.Start(w, r)
+	require.NoError(t, err)
+
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, "a.\nc.\ne.\na.b\nc.d\n", w.Body.String())
+
+	filename, err := rec.Save(t.TempDir(), 0640)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(filename, "/record-test-request.json"), filename)
+
+	recording, err := record.Load(filename)
+	require.NoError(t, err)
+
+	assert.Equal(t, "test-request", recording.RequestID)
+	assert.Equal(t, "/metrics/find/?query=*", recording.Request.URL)
+	assert.Equal(t, "alice", recording.User)
+	assert.Equal(t, []string{"team_a"}, recording.Roles)
+	assert.Empty(t, recording.Request.Header.Get("Authorization"))
+	assert.Empty(t, recording.Request.Header.Get("Cookie"))
+	assert.Equal(t, "1", recording.Request.Header.Get("X-Gch-Debug-Record"))
+	assert.Equal(t, http.StatusOK, recording.Response.Status)
+	assert.Equal(t, w.Body.String(), string(recording.Response.Body))
+
+	require.Len(t, recording.Queries, 2)
+	assert.Equal(t, levelQuery, recording.Queries[0].Query)
+	assert.Equal(t, "a.\nc.\ne.\n", string(recording.Queries[0].Response))
+	assert.Equal(t, http.StatusOK, recording.Queries[0].Status)
+	assert.Equal(t, extQuery, recording.Queries[1].Query)
+	assert.Equal(t, []record.ExternalTable{{Name: "metrics_list", Structure: "Path String", Format: "TSV", Data: []byte("a.b\nc.d\n")}}, recording.Queries[1].External)
+
+	// the replay with stub doesn't query ClickHouse
+	srv.Close()
+
+	stub := httptest.NewServer(record.Stub(recording))
+	defer stub.Close()
+
+	url = stub.URL
+	assert.Equal(t, "", record.Diff(&recording.Response, record.Replay(h, recording)))
+
+	diff := record.Diff(&recording.Response, record.Replay(newHandler(&url, "g.h\n"), recording))
+	assert.Equal(t, "--- recorded\n+++ replayed\n@@ -4,2 +4,3 @@\n a.b\n c.d\n+g.h\n", diff)
+
+	// the recorded identity is set for the replayed request
+	identity := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(scope.User(r.Context()) + " " + strings.Join(scope.Roles(r.Context()), ",")))
+	})
+	assert.Equal(t, "alice team_a", string(record.Replay(identity, recording).Body))
+
+	// not recorded queries fail
+	_, _, _, err = chclient.Query(context.Background(), stub.URL, "SELECT 1", chclient.Options{Timeout: time.Second}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,133 @@
+package record
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pmezard/go-difflib/difflib"
+
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// Stub returns the ClickHouse handler, which answers the recorded queries with the recorded responses. Queries are
+// matched by the text, the same queries are answered in the order of the recording. Not recorded queries fail.
+func Stub(rec *Recording) http.Handler {
+	var mu sync.Mutex
+
+	responses := make(map[string][]Query)
+	for _, q := range rec.Queries {
+		responses[q.Query] = append(responses[q.Query], q)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		if query == "" {
+			body, _ := io.ReadAll(r.Body)
+			query = string(body)
+		}
+
+		mu.Lock()
+
+		queue := responses[query]
+		if len(queue) == 0 {
+			mu.Unlock()
+			http.Error(w, "Code: 1001. DB::Exception: query is not recorded: "+query, http.StatusNotFound)
+
+			return
+		}
+
+		q := queue[0]
+		if len(queue) > 1 {
+			// the last response is reused, if the query is repeated more times than recorded
+			responses[query] = queue[1:]
+		}
+
+		mu.Unlock()
+
+		if q.Summary != "" {
+			w.Header().Set("X-Clickhouse-Summary", q.Summary)
+		}
+
+		status := q.Status
+		if status == 0 {
+			// the query failed without the response, e.g. by timeout
+			status = http.StatusBadGateway
+			q.Response = []byte(q.Error)
+		}
+
+		w.WriteHeader(status)
+		w.Write(q.Response)
+	})
+}
+
+// Replay executes the recorded request with the handler and returns the response. The credentials are not recorded,
+// so the handler should not authenticate the request, the recorded identity is set instead.
+func Replay(h http.Handler, rec *Recording) *Response {
+	r := httptest.NewRequest(rec.Request.Method, rec.Request.URL, bytes.NewReader(rec.Request.Body))
+	r.Header = rec.Request.Header.Clone()
+	// do not record the replayed request again
+	r.Header.Del("X-Gch-Debug-" + DebugHeader)
+
+	if rec.User != "" {
+		r = r.WithContext(scope.WithRoles(scope.WithUser(r.Context(), rec.User), rec.Roles))
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return &Response{
+		Status: w.Code,
+		Header: w.Header(),
+		Body:   w.Body.Bytes(),
+	}
+}
+
+// Diff returns the human readable difference of status codes and bodies, or empty string if responses are equal
+func Diff(want, got *Response) string {
+	var sb strings.Builder
+
+	if want.Status != got.Status {
+		fmt.Fprintf(&sb, "status: recorded %d, replayed %d\n", want.Status, got.Status)
+	}
+
+	if bytes.Equal(want.Body, got.Body) {
+		return sb.String()
+	}
+
+	if !utf8.Valid(want.Body) || !utf8.Valid(got.Body) {
+		i := 0
+		for i < len(want.Body) && i < len(got.Body) && want.Body[i] == got.Body[i] {
+			i++
+		}
+
+		fmt.Fprintf(&sb, "body: recorded %d bytes, replayed %d bytes, differ at offset %d\n", len(want.Body), len(got.Body), i)
+
+		return sb.String()
+	}
+
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(want.Body),
+		B:        splitLines(got.Body),
+		FromFile: "recorded",
+		ToFile:   "replayed",
+		Context:  2,
+	})
+	sb.WriteString(diff)
+
+	return sb.String()
+}
+
+func splitLines(b []byte) []string {
+	lines := strings.SplitAfter(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
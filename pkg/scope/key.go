@@ -3,6 +3,7 @@ package scope
 import (
 	"context"
 	"fmt"
+	"strings"
 )
 
 // key is type for context.Value keys
@@ -51,6 +52,54 @@ func Table(ctx context.Context) string {
 	return String(ctx, "table")
 }
 
+// WithTenant ...
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return With(ctx, "tenant", tenant)
+}
+
+// Tenant ...
+func Tenant(ctx context.Context) string {
+	return String(ctx, "tenant")
+}
+
+// WithUser sets the authenticated user
+func WithUser(ctx context.Context, user string) context.Context {
+	return With(ctx, "user", user)
+}
+
+// User returns the authenticated user
+func User(ctx context.Context) string {
+	return String(ctx, "user")
+}
+
+// WithRoles sets the roles of the authenticated user
+func WithRoles(ctx context.Context, roles []string) context.Context {
+	return With(ctx, "roles", roles)
+}
+
+// Roles returns the roles of the authenticated user
+func Roles(ctx context.Context) []string {
+	if value, ok := ctx.Value(scopeKey("roles")).([]string); ok {
+		return value
+	}
+
+	return nil
+}
+
+// CacheKey returns the suffix for cache keys, which separates the results visible with the different tenants and roles
+func CacheKey(ctx context.Context) string {
+	var key string
+	if tenant := Tenant(ctx); tenant != "" {
+		key = ";tenant=" + tenant
+	}
+
+	if roles := Roles(ctx); len(roles) > 0 {
+		key += ";roles=" + strings.Join(roles, ",")
+	}
+
+	return key
+}
+
 // WithDebug returns the context with debug-name
 func WithDebug(ctx context.Context, name string) context.Context {
 	return With(ctx, "debug-"+name, true)
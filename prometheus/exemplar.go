@@ -4,11 +4,29 @@
 package prometheus
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/lomik/carbon-clickhouse/helper/escape"
 	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/metadata"
 	"github.com/prometheus/prometheus/storage"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/pkg/where"
 )
 
 type nopExemplarQueryable struct {
@@ -27,3 +45,339 @@ func (e *nopExemplarQueryable) ExemplarQuerier(ctx context.Context) (storage.Exe
 func (e *nopExemplarQuerier) Select(start, end int64, matchers ...[]*labels.Matcher) ([]exemplar.QueryResult, error) {
 	return []exemplar.QueryResult{}, nil
 }
+
+// exemplarRow is a row of the exemplar table in JSONEachRow format:
+//
+//	CREATE TABLE graphite_exemplars (
+//	  Date Date,
+//	  Path String,
+//	  Labels Array(String),
+//	  Value Float64,
+//	  Timestamp Int64
+//	) ENGINE = ReplacingMergeTree
+//	PARTITION BY toYYYYMM(Date)
+//	ORDER BY (Path, Timestamp);
+//
+// Path is the series in the same form as in the tagged table, Labels are exemplar labels as name=value and Timestamp
+// is in milliseconds
+type exemplarRow struct {
+	Date      string      `json:"Date,omitempty"`
+	Path      string      `json:"Path"`
+	Labels    []string    `json:"Labels"`
+	Value     float64     `json:"Value"`
+	Timestamp json.Number `json:"Timestamp"`
+}
+
+// exemplarPathsTable is the external table with the paths of the matched series
+const exemplarPathsTable = "metrics_list"
+
+type exemplarQueryable struct {
+	config *config.Config
+}
+
+var _ storage.ExemplarQueryable = &exemplarQueryable{}
+
+// newExemplarQueryable returns the exemplar storage in prometheus.exemplar-table or the empty one, if it's not set
+func newExemplarQueryable(config *config.Config) storage.ExemplarQueryable {
+	if config.Prometheus.ExemplarTable == "" {
+		return &nopExemplarQueryable{}
+	}
+
+	return &exemplarQueryable{config: config}
+}
+
+func (e *exemplarQueryable) ExemplarQuerier(ctx context.Context) (storage.ExemplarQuerier, error) {
+	return &ExemplarQuerier{ctx: ctx, config: e.config}, nil
+}
+
+// ExemplarQuerier provides reading access to exemplars of series.
+type ExemplarQuerier struct {
+	ctx    context.Context
+	config *config.Config
+}
+
+var _ storage.ExemplarQuerier = &ExemplarQuerier{}
+
+// Select returns exemplars in [start, end] milliseconds range for series, matched by any of matchers sets.
+func (q *ExemplarQuerier) Select(start, end int64, matchers ...[]*labels.Matcher) ([]exemplar.QueryResult, error) {
+	from, until := start/1000, (end+999)/1000
+
+	unique := make(map[string]bool)
+	paths := make([]string, 0)
+
+	for _, m := range matchers {
+		terms, err := makeTaggedFromPromQL(m)
+		if err != nil {
+			return nil, err
+		}
+
+		fndResult, err := finder.FindTagged(q.ctx, q.config, terms, from, until)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range fndResult.List() {
+			if !unique[string(path)] {
+				unique[string(path)] = true
+				paths = append(paths, string(path))
+			}
+		}
+	}
+
+	if len(paths) == 0 {
+		return []exemplar.QueryResult{}, nil
+	}
+
+	sort.Strings(paths)
+
+	table := q.config.Prometheus.ExemplarTable
+
+	body, _, _, err := clickhouse.Query(
+		scope.WithTable(q.ctx, table),
+		q.config.ClickHouse.URL,
+		exemplarQuery(table, start, end),
+		clickhouse.Options{
+			TLSConfig:               q.config.ClickHouse.TLSConfig,
+			Timeout:                 q.config.ClickHouse.DataTimeout,
+			ConnectTimeout:          q.config.ClickHouse.ConnectTimeout,
+			CheckRequestProgress:    q.config.FeatureFlags.LogQueryProgress,
+			ProgressSendingInterval: q.config.ClickHouse.ProgressSendingInterval,
+		},
+		q.pathsExtData(paths),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseExemplars(body)
+}
+
+// pathsExtData passes the series paths as the external table, so the query size doesn't depend on the matched series
+func (q *ExemplarQuerier) pathsExtData(paths []string) *clickhouse.ExternalData {
+	var body strings.Builder
+
+	for _, path := range paths {
+		body.WriteString(path)
+		body.WriteByte('\n')
+	}
+
+	extData := clickhouse.NewExternalData(clickhouse.ExternalTable{
+		Name: exemplarPathsTable,
+		Columns: []clickhouse.Column{{
+			Name: "Path",
+			Type: "String",
+		}},
+		Format: "TSV",
+		Data:   []byte(body.String()),
+	})
+	extData.SetDebug(q.config.Debug.Directory, q.config.Debug.ExternalDataPerm)
+
+	return extData
+}
+
+func exemplarQuery(table string, start, end int64) string {
+	w := where.New()
+	w.Andf(
+		"Date >= '%s' AND Date <= '%s'",
+		time.UnixMilli(start).UTC().Format("2006-01-02"),
+		time.UnixMilli(end).UTC().Format("2006-01-02"),
+	)
+	w.And(where.InTable("Path", exemplarPathsTable))
+	w.Andf("Timestamp >= %d AND Timestamp <= %d", start, end)
+
+	return fmt.Sprintf(
+		"SELECT Path, Labels, Value, Timestamp FROM %s %s ORDER BY Path, Timestamp LIMIT 1 BY Path, Timestamp, Labels FORMAT JSONEachRow",
+		table, w.SQL(),
+	)
+}
+
+// parseExemplars groups exemplars, sorted by Path, into the results for series
+func parseExemplars(body []byte) ([]exemplar.QueryResult, error) {
+	result := make([]exemplar.QueryResult, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+
+	path := ""
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var row exemplarRow
+		if err := json.Unmarshal(line, &row); err != nil {
+			return nil, err
+		}
+
+		ts, err := row.Timestamp.Int64()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(result) == 0 || row.Path != path {
+			path = row.Path
+			result = append(result, exemplar.QueryResult{SeriesLabels: Labels(path)})
+		}
+
+		r := &result[len(result)-1]
+		r.Exemplars = append(r.Exemplars, exemplar.Exemplar{
+			Labels: exemplarLabels(row.Labels),
+			Value:  row.Value,
+			Ts:     ts,
+			HasTs:  true,
+		})
+	}
+
+	return result, scanner.Err()
+}
+
+// exemplarLabels parses name=value pairs
+func exemplarLabels(pairs []string) labels.Labels {
+	lb := make(labels.Labels, 0, len(pairs))
+
+	for _, p := range pairs {
+		name, value, _ := strings.Cut(p, "=")
+		lb = append(lb, labels.Label{Name: name, Value: value})
+	}
+
+	sort.Slice(lb, func(i, j int) bool { return lb[i].Name < lb[j].Name })
+
+	return lb
+}
+
+// seriesPath returns the series in the form of carbon-clickhouse prometheus receiver: name?label1=value1&label2=value2
+func seriesPath(lb labels.Labels) string {
+	var buf strings.Builder
+
+	buf.WriteString(escape.Path(lb.Get(labels.MetricName)))
+	buf.WriteByte('?')
+
+	n := 0
+
+	lb.Range(func(l labels.Label) {
+		if l.Name == labels.MetricName {
+			return
+		}
+
+		if n > 0 {
+			buf.WriteByte('&')
+		}
+
+		n++
+
+		buf.WriteString(escape.Query(l.Name))
+		buf.WriteByte('=')
+		buf.WriteString(escape.Query(l.Value))
+	})
+
+	return buf.String()
+}
+
+// exemplarAppender writes exemplars from remote write requests into prometheus.exemplar-table. Samples are ignored,
+// they are written by carbon-clickhouse.
+type exemplarAppender struct {
+	ctx    context.Context
+	config *config.Config
+	rows   []exemplarRow
+}
+
+var _ storage.Appender = &exemplarAppender{}
+
+func (a *exemplarAppender) Append(ref storage.SeriesRef, l labels.Labels, t int64, v float64) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+// AppendExemplar adds the exemplar to the rows for the next Commit. Exemplars with non-finite values are skipped,
+// since they can't be passed in JSON.
+func (a *exemplarAppender) AppendExemplar(ref storage.SeriesRef, l labels.Labels, e exemplar.Exemplar) (storage.SeriesRef, error) {
+	length := 0
+	pairs := make([]string, 0, e.Labels.Len())
+
+	e.Labels.Range(func(l labels.Label) {
+		length += utf8.RuneCountInString(l.Name) + utf8.RuneCountInString(l.Value)
+		pairs = append(pairs, l.Name+"="+l.Value)
+	})
+
+	if length > exemplar.ExemplarMaxLabelSetLength {
+		return ref, storage.ErrExemplarLabelLength
+	}
+
+	if math.IsNaN(e.Value) || math.IsInf(e.Value, 0) {
+		return ref, nil
+	}
+
+	a.rows = append(a.rows, exemplarRow{
+		Date:      time.UnixMilli(e.Ts).UTC().Format("2006-01-02"),
+		Path:      seriesPath(l),
+		Labels:    pairs,
+		Value:     e.Value,
+		Timestamp: json.Number(fmt.Sprint(e.Ts)),
+	})
+
+	return ref, nil
+}
+
+func (a *exemplarAppender) AppendHistogram(ref storage.SeriesRef, l labels.Labels, t int64, h *histogram.Histogram, fh *histogram.FloatHistogram) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+func (a *exemplarAppender) UpdateMetadata(ref storage.SeriesRef, l labels.Labels, m metadata.Metadata) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+func (a *exemplarAppender) AppendCTZeroSample(ref storage.SeriesRef, l labels.Labels, t, ct int64) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+// Commit inserts the appended exemplars.
+func (a *exemplarAppender) Commit() error {
+	if len(a.rows) == 0 {
+		return nil
+	}
+
+	body, err := exemplarRows(a.rows)
+	a.rows = nil
+
+	if err != nil {
+		return err
+	}
+
+	table := a.config.Prometheus.ExemplarTable
+
+	_, _, _, err = clickhouse.Post(
+		scope.WithTable(a.ctx, table),
+		a.config.ClickHouse.URL,
+		"INSERT INTO "+table+" (Date, Path, Labels, Value, Timestamp) FORMAT JSONEachRow",
+		body,
+		clickhouse.Options{
+			TLSConfig:      a.config.ClickHouse.TLSConfig,
+			Timeout:        a.config.ClickHouse.DataTimeout,
+			ConnectTimeout: a.config.ClickHouse.ConnectTimeout,
+		},
+		nil,
+	)
+
+	return err
+}
+
+// Rollback drops the appended exemplars.
+func (a *exemplarAppender) Rollback() error {
+	a.rows = nil
+
+	return nil
+}
+
+func exemplarRows(rows []exemplarRow) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	for i := range rows {
+		if err := enc.Encode(&rows[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &buf, nil
+}
@@ -0,0 +1,104 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesPath(t *testing.T) {
+	lb := labels.FromStrings("__name__", "http_requests", "instance", "host:9090", "code", "200", "A", "b c")
+	path := seriesPath(lb)
+
+	assert.Equal(t, "http_requests?A=b+c&code=200&instance=host%3A9090", path)
+	assert.Equal(t, lb, Labels(path))
+	assert.Equal(t, "up?", seriesPath(labels.FromStrings("__name__", "up")))
+}
+
+func TestExemplarQuery(t *testing.T) {
+	assert.Equal(t,
+		"SELECT Path, Labels, Value, Timestamp FROM graphite_exemplars "+
+			"WHERE ((Date >= '2021-01-01' AND Date <= '2021-01-02') AND (Path in metrics_list)) AND (Timestamp >= 1609502400000 AND Timestamp <= 1609588800000) "+
+			"ORDER BY Path, Timestamp LIMIT 1 BY Path, Timestamp, Labels FORMAT JSONEachRow",
+		exemplarQuery("graphite_exemplars", 1609502400000, 1609588800000),
+	)
+}
+
+func TestParseExemplars(t *testing.T) {
+	body := []byte(`{"Path":"a?x=1","Labels":["trace_id=abc","span_id=1"],"Value":0.5,"Timestamp":"1609502400000"}
+{"Path":"a?x=1","Labels":["trace_id=def"],"Value":1,"Timestamp":1609502460000}
+{"Path":"b?x=2","Labels":[],"Value":2,"Timestamp":"1609502400000"}
+`)
+
+	result, err := parseExemplars(body)
+	require.NoError(t, err)
+
+	assert.Equal(t, []exemplar.QueryResult{
+		{
+			SeriesLabels: labels.FromStrings("__name__", "a", "x", "1"),
+			Exemplars: []exemplar.Exemplar{
+				{Labels: labels.FromStrings("trace_id", "abc", "span_id", "1"), Value: 0.5, Ts: 1609502400000, HasTs: true},
+				{Labels: labels.FromStrings("trace_id", "def"), Value: 1, Ts: 1609502460000, HasTs: true},
+			},
+		},
+		{
+			SeriesLabels: labels.FromStrings("__name__", "b", "x", "2"),
+			Exemplars: []exemplar.Exemplar{
+				{Labels: labels.Labels{}, Value: 2, Ts: 1609502400000, HasTs: true},
+			},
+		},
+	}, result)
+
+	_, err = parseExemplars([]byte("not json\n"))
+	assert.Error(t, err)
+}
+
+func TestExemplarAppender(t *testing.T) {
+	a := &exemplarAppender{}
+	series := labels.FromStrings("__name__", "http_requests", "code", "200")
+
+	_, err := a.Append(0, series, 1609502400000, 1)
+	require.NoError(t, err)
+
+	_, err = a.AppendExemplar(0, series, exemplar.Exemplar{
+		Labels: labels.FromStrings("trace_id", "abc"), Value: 0.5, Ts: 1609502400000, HasTs: true,
+	})
+	require.NoError(t, err)
+
+	// skipped
+	_, err = a.AppendExemplar(0, series, exemplar.Exemplar{
+		Labels: labels.FromStrings("trace_id", "def"), Value: math.NaN(), Ts: 1609502400000, HasTs: true,
+	})
+	require.NoError(t, err)
+
+	long := make([]byte, exemplar.ExemplarMaxLabelSetLength)
+	_, err = a.AppendExemplar(0, series, exemplar.Exemplar{
+		Labels: labels.FromStrings("trace_id", string(long)), Value: 1, Ts: 1609502400000, HasTs: true,
+	})
+	assert.ErrorIs(t, err, storage.ErrExemplarLabelLength)
+
+	body, err := exemplarRows(a.rows)
+	require.NoError(t, err)
+	assert.Equal(t,
+		`{"Date":"2021-01-01","Path":"http_requests?code=200","Labels":["trace_id=abc"],"Value":0.5,"Timestamp":1609502400000}`+"\n",
+		body.String(),
+	)
+
+	// the written rows are read back
+	result, err := parseExemplars(body.Bytes())
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	assert.Equal(t, series, result[0].SeriesLabels)
+
+	require.NoError(t, a.Rollback())
+	assert.Empty(t, a.rows)
+	assert.NoError(t, a.Commit())
+}
@@ -0,0 +1,86 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"unsafe"
+
+	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/util/httputil"
+	"github.com/prometheus/prometheus/web"
+	apiv1 "github.com/prometheus/prometheus/web/api/v1"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/auth"
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// unexportedField returns the value of the unexported field of the struct, pointed by v
+func unexportedField(v interface{}, name string) (reflect.Value, error) {
+	f := reflect.ValueOf(v).Elem().FieldByName(name)
+	if !f.IsValid() {
+		return f, fmt.Errorf("field %s not found in %T", name, v)
+	}
+
+	return reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem(), nil
+}
+
+// newHTTPHandler returns the UI and API handler of h, the same as web.Handler.Run serves with RoutePrefix "/".
+// web.Handler doesn't export them, but the requests must pass the middleware before the API.
+func newHTTPHandler(h *web.Handler) (http.Handler, error) {
+	router, err := unexportedField(h, "router")
+	if err != nil {
+		return nil, err
+	}
+
+	api, err := unexportedField(h, "apiV1")
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", router.Interface().(*route.Router))
+
+	av1 := route.New().WithInstrumentation(func(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			handler(w, r.WithContext(httputil.ContextWithPath(r.Context(), "/api/v1"+r.URL.Path)))
+		}
+	})
+	api.Interface().(*apiv1.API).Register(av1)
+
+	mux.Handle("/api/v1/", http.StripPrefix("/api/v1", av1))
+
+	return mux, nil
+}
+
+// userHandler puts the request user into the context for per-user limits. The user is authenticated, if [auth] is
+// configured, otherwise X-Forwarded-User header is taken from the trusted proxies only.
+func userHandler(cfg *config.Config, authChain *auth.Chain, logger *zap.Logger, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authChain != nil {
+			id, err := authChain.Authenticate(r)
+			if err != nil {
+				logger.Warn("auth",
+					zap.String("url", r.URL.String()),
+					zap.String("peer", r.RemoteAddr),
+					zap.Error(err),
+				)
+				w.Header().Set("WWW-Authenticate", authChain.Challenge())
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+				return
+			}
+
+			r = auth.Request(r, id)
+		} else if user := r.Header.Get("X-Forwarded-User"); user != "" && cfg.Prometheus.IsTrustedProxy(r.RemoteAddr) {
+			r = r.WithContext(scope.WithUser(r.Context(), user))
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,97 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/prometheus/web"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/auth"
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+func TestNewHTTPHandler(t *testing.T) {
+	promHandler := web.New(nil, &web.Options{
+		ExternalURL: &url.URL{Scheme: "http", Host: "localhost:9092"},
+		RoutePrefix: "/",
+		Flags:       map[string]string{"storage": "graphite-clickhouse"},
+		Gatherer:    &nopGatherer{},
+	})
+	promHandler.SetReady(true)
+
+	handler, err := newHTTPHandler(promHandler)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/status/flags", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"success","data":{"storage":"graphite-clickhouse"}}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestUserHandler(t *testing.T) {
+	var user string
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = scope.User(r.Context())
+	})
+
+	request := func(h http.Handler, remoteAddr string, header map[string]string) int {
+		user = ""
+
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		r.RemoteAddr = remoteAddr
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		return w.Code
+	}
+
+	cfg, _, err := config.Unmarshal([]byte("[prometheus]\ntrusted-proxies = [\"10.0.0.0/8\", \"::1\"]\n"), false)
+	require.NoError(t, err)
+
+	h := userHandler(cfg, nil, zap.NewNop(), handler)
+
+	assert.Equal(t, http.StatusOK, request(h, "10.1.2.3:5000", map[string]string{"X-Forwarded-User": "alice"}))
+	assert.Equal(t, "alice", user)
+
+	assert.Equal(t, http.StatusOK, request(h, "[::1]:5000", map[string]string{"X-Forwarded-User": "alice"}))
+	assert.Equal(t, "alice", user)
+
+	// untrusted peer
+	assert.Equal(t, http.StatusOK, request(h, "192.168.1.1:5000", map[string]string{"X-Forwarded-User": "alice"}))
+	assert.Equal(t, "", user)
+
+	// the authenticated user overrides the header
+	authCfg := config.New().Auth
+	authCfg.Tokens = []config.AuthToken{{Token: "secret", User: "grafana"}}
+	authChain, err := auth.New(&authCfg)
+	require.NoError(t, err)
+
+	h = userHandler(cfg, authChain, zap.NewNop(), handler)
+
+	assert.Equal(t, http.StatusOK, request(h, "10.1.2.3:5000", map[string]string{
+		"Authorization":    "Bearer secret",
+		"X-Forwarded-User": "alice",
+	}))
+	assert.Equal(t, "grafana", user)
+
+	assert.Equal(t, http.StatusUnauthorized, request(h, "10.1.2.3:5000", map[string]string{"X-Forwarded-User": "alice"}))
+	assert.Equal(t, "", user)
+}
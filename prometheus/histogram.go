@@ -0,0 +1,271 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/render/data"
+)
+
+const (
+	histogramBucketSuffix = "_bucket"
+	histogramSumSuffix    = "_sum"
+	histogramBoundLabel   = "le"
+)
+
+// histogramSample is a native histogram with custom buckets at the timestamp t in milliseconds
+type histogramSample struct {
+	t int64
+	h *histogram.FloatHistogram
+}
+
+// histogramBucket is a series of classic histogram bucket with the upper bound le
+type histogramBucket struct {
+	le     float64
+	points []point.Point
+}
+
+// histogramGroup contains classic histogram series with the same labels besides le
+type histogramGroup struct {
+	labels  labels.Labels
+	buckets []histogramBucket
+	sum     []point.Point
+}
+
+// histogramMatchers replaces the equal matcher for the metric name X with the regexp, which matches X_bucket and X_sum
+// as well. It returns the new matchers and X, or matchers as is and an empty name, when there is no such matcher.
+func histogramMatchers(matchers []*labels.Matcher) ([]*labels.Matcher, string) {
+	for i, m := range matchers {
+		if m == nil || m.Name != labels.MetricName || m.Type != labels.MatchEqual || m.Value == "" {
+			continue
+		}
+
+		re, err := labels.NewMatcher(
+			labels.MatchRegexp, labels.MetricName,
+			"^"+regexp.QuoteMeta(m.Value)+"("+histogramBucketSuffix+"|"+histogramSumSuffix+")?$",
+		)
+		if err != nil {
+			return matchers, ""
+		}
+
+		result := make([]*labels.Matcher, len(matchers))
+		copy(result, matchers)
+		result[i] = re
+
+		return result, m.Value
+	}
+
+	return matchers, ""
+}
+
+// makeHistogramSeriesSet returns the float series of the metric name and native histograms, reassembled from
+// name_bucket series with le label and name_sum series
+func makeHistogramSeriesSet(data *data.Data, step int64, name string) (storage.SeriesSet, error) {
+	ss := &seriesSet{series: make([]series, 0), current: -1}
+	if data == nil || data.Len() == 0 {
+		return ss, nil
+	}
+
+	groups := make(map[string]*histogramGroup)
+	keys := make([]string, 0)
+
+	group := func(lb labels.Labels) *histogramGroup {
+		lb = labels.NewBuilder(lb).Del(histogramBoundLabel).Set(labels.MetricName, name).Labels()
+		key := lb.String()
+
+		g, ok := groups[key]
+		if !ok {
+			g = &histogramGroup{labels: lb}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+
+		return g
+	}
+
+	nextMetric := data.GroupByMetric()
+
+	for {
+		points := nextMetric()
+		if len(points) == 0 {
+			break
+		}
+
+		metricName := data.MetricName(points[0].MetricID)
+		for _, v := range data.AM.Get(metricName) {
+			lb := Labels(v.DisplayName)
+
+			switch lb.Get(labels.MetricName) {
+			case name:
+				ss.series = append(ss.series, series{metricName: v.DisplayName, points: points, step: step})
+			case name + histogramBucketSuffix:
+				le, err := strconv.ParseFloat(lb.Get(histogramBoundLabel), 64)
+				if err != nil {
+					// not a bucket of classic histogram
+					continue
+				}
+
+				g := group(lb)
+				g.buckets = append(g.buckets, histogramBucket{le: le, points: points})
+			case name + histogramSumSuffix:
+				group(lb).sum = points
+			}
+		}
+	}
+
+	for _, key := range keys {
+		g := groups[key]
+		if samples := g.samples(); len(samples) != 0 {
+			ss.series = append(ss.series, series{labels: g.labels, histograms: samples})
+		}
+	}
+
+	return ss, nil
+}
+
+// samples returns native histograms with custom buckets for every timestamp of +Inf bucket, where all buckets have
+// values. Counts of buckets are made non-decreasing, since they may be inconsistent after rollup.
+func (g *histogramGroup) samples() []histogramSample {
+	sort.Slice(g.buckets, func(i, j int) bool { return g.buckets[i].le < g.buckets[j].le })
+
+	n := len(g.buckets)
+	if n == 0 || !math.IsInf(g.buckets[n-1].le, 1) {
+		return nil
+	}
+
+	bounds := make([]float64, n-1)
+	values := make([]map[uint32]float64, n)
+
+	for i, b := range g.buckets {
+		if i < n-1 {
+			if i > 0 && b.le == bounds[i-1] {
+				// the same bound is written differently, e.g. 1 and 1.0
+				return nil
+			}
+
+			bounds[i] = b.le
+		}
+
+		values[i] = make(map[uint32]float64, len(b.points))
+		for _, p := range b.points {
+			values[i][p.Time] = p.Value
+		}
+	}
+
+	sums := make(map[uint32]float64, len(g.sum))
+	for _, p := range g.sum {
+		sums[p.Time] = p.Value
+	}
+
+	samples := make([]histogramSample, 0, len(g.buckets[n-1].points))
+
+SAMPLES:
+	for _, p := range g.buckets[n-1].points {
+		buckets := make([]float64, n)
+		cumulative := 0.0
+
+		for i := range values {
+			v, ok := values[i][p.Time]
+			if !ok || math.IsNaN(v) {
+				continue SAMPLES
+			}
+
+			buckets[i] = math.Max(v-cumulative, 0)
+			cumulative = math.Max(v, cumulative)
+		}
+
+		samples = append(samples, histogramSample{
+			t: int64(p.Time) * 1000,
+			h: &histogram.FloatHistogram{
+				Schema:          histogram.CustomBucketsSchema,
+				Count:           cumulative,
+				Sum:             sums[p.Time],
+				PositiveSpans:   []histogram.Span{{Offset: 0, Length: uint32(n)}},
+				PositiveBuckets: buckets,
+				CustomValues:    bounds,
+			},
+		})
+	}
+
+	return samples
+}
+
+// histogramIterator iterates over native histograms of a series
+type histogramIterator struct {
+	samples []histogramSample
+	current int
+}
+
+var _ chunkenc.Iterator = &histogramIterator{}
+
+// Next advances the iterator by one.
+func (it *histogramIterator) Next() chunkenc.ValueType {
+	if it.current+1 >= len(it.samples) {
+		it.current = len(it.samples)
+		return chunkenc.ValNone
+	}
+
+	it.current++
+
+	return chunkenc.ValFloatHistogram
+}
+
+// Seek advances the iterator forward to the value at or after the given timestamp.
+func (it *histogramIterator) Seek(t int64) chunkenc.ValueType {
+	if it.current < 0 {
+		it.current = 0
+	}
+
+	for ; it.current < len(it.samples); it.current++ {
+		if it.samples[it.current].t >= t {
+			return chunkenc.ValFloatHistogram
+		}
+	}
+
+	return chunkenc.ValNone
+}
+
+// At isn't applicable for histograms, it returns the current timestamp and NaN.
+func (it *histogramIterator) At() (int64, float64) {
+	return it.AtT(), math.NaN()
+}
+
+// AtHistogram isn't applicable for histograms with float counts, it returns the current timestamp and nil.
+func (it *histogramIterator) AtHistogram(*histogram.Histogram) (int64, *histogram.Histogram) {
+	return it.AtT(), nil
+}
+
+// AtFloatHistogram returns the current timestamp and histogram. The histogram is copied to fh, if it's passed.
+func (it *histogramIterator) AtFloatHistogram(fh *histogram.FloatHistogram) (int64, *histogram.FloatHistogram) {
+	s := it.samples[it.current]
+	if fh == nil {
+		return s.t, s.h.Copy()
+	}
+
+	s.h.CopyTo(fh)
+
+	return s.t, fh
+}
+
+// AtT returns the current timestamp.
+func (it *histogramIterator) AtT() int64 {
+	if it.current < 0 || it.current >= len(it.samples) {
+		return 0
+	}
+
+	return it.samples[it.current].t
+}
+
+// Err returns the current error.
+func (it *histogramIterator) Err() error { return nil }
@@ -0,0 +1,157 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/util/annotations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+	"github.com/lomik/graphite-clickhouse/render/data"
+)
+
+func TestHistogramMatchers(t *testing.T) {
+	app := labels.MustNewMatcher(labels.MatchEqual, "app", "a")
+	name := labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "req.duration")
+
+	got, histogramName := histogramMatchers([]*labels.Matcher{app, name})
+	assert.Equal(t, "req.duration", histogramName)
+	assert.Equal(t, app, got[0])
+	assert.Equal(t, labels.MatchRegexp, got[1].Type)
+	assert.Equal(t, `^req\.duration(_bucket|_sum)?$`, got[1].Value)
+	// the original matchers are kept
+	assert.Equal(t, labels.MatchEqual, name.Type)
+
+	re := labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "req.*")
+	got, histogramName = histogramMatchers([]*labels.Matcher{re})
+	assert.Equal(t, "", histogramName)
+	assert.Equal(t, []*labels.Matcher{re}, got)
+}
+
+// newHistogramData returns data with classic histogram req for app=a, sum of its observations and a float series req
+// for app=b
+func newHistogramData() *data.Data {
+	values := map[string][]float64{
+		"req_bucket?app=a&le=0.1":    {1, 2},
+		"req_bucket?app=a&le=0.5":    {3, 6},
+		"req_bucket?app=a&le=%2BInf": {4, 8},
+		"req_sum?app=a":              {1.5, 3},
+		"req?app=b":                  {10, 20},
+		// the bucket without le is ignored
+		"req_bucket?app=c": {1, 1},
+	}
+
+	names := make([][]byte, 0, len(values))
+	pp := point.NewPoints()
+
+	for name, vv := range values {
+		names = append(names, []byte(name))
+
+		id := pp.MetricID(name)
+		for i, v := range vv {
+			pp.AppendPoint(id, v, uint32(60+60*i), 0)
+		}
+	}
+
+	am := alias.New()
+	am.MergeTarget(finder.NewMockFinder(names), "", false)
+	pp.Sort()
+
+	return &data.Data{Points: pp, AM: am}
+}
+
+func TestMakeHistogramSeriesSet(t *testing.T) {
+	ss, err := makeHistogramSeriesSet(newHistogramData(), 60000, "req")
+	require.NoError(t, err)
+
+	floats := make([]labels.Labels, 0)
+	histograms := make(map[string][]histogramSample)
+
+	for ss.Next() {
+		s := ss.At().(*series)
+		if s.histograms == nil {
+			floats = append(floats, s.Labels())
+			continue
+		}
+
+		histograms[s.Labels().String()] = s.histograms
+	}
+
+	assert.Equal(t, []labels.Labels{labels.FromStrings("__name__", "req", "app", "b")}, floats)
+	require.Len(t, histograms, 1)
+
+	samples := histograms[`{__name__="req", app="a"}`]
+	require.Len(t, samples, 2)
+	assert.Equal(t, int64(120000), samples[1].t)
+	assert.Equal(t, &histogram.FloatHistogram{
+		Schema:          histogram.CustomBucketsSchema,
+		Count:           8,
+		Sum:             3,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 3}},
+		PositiveBuckets: []float64{2, 4, 2},
+		CustomValues:    []float64{0.1, 0.5},
+	}, samples[1].h)
+	assert.NoError(t, samples[1].h.Validate())
+
+	it := (&series{histograms: samples}).Iterator(nil)
+	assert.Equal(t, chunkenc.ValFloatHistogram, it.Seek(61000))
+	assert.Equal(t, int64(120000), it.AtT())
+	assert.Equal(t, chunkenc.ValNone, it.Next())
+}
+
+type histogramQueryable struct {
+	ss func() storage.SeriesSet
+}
+
+func (q *histogramQueryable) Querier(mint, maxt int64) (storage.Querier, error) {
+	return q, nil
+}
+
+func (q *histogramQueryable) Select(context.Context, bool, *storage.SelectHints, ...*labels.Matcher) storage.SeriesSet {
+	return q.ss()
+}
+
+func (q *histogramQueryable) LabelValues(context.Context, string, *storage.LabelHints, ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	return nil, nil, nil
+}
+
+func (q *histogramQueryable) LabelNames(context.Context, *storage.LabelHints, ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	return nil, nil, nil
+}
+
+func (q *histogramQueryable) Close() error { return nil }
+
+func TestHistogramQuantile(t *testing.T) {
+	q := &histogramQueryable{ss: func() storage.SeriesSet {
+		ss, err := makeHistogramSeriesSet(newHistogramData(), 60000, "req")
+		require.NoError(t, err)
+
+		return ss
+	}}
+
+	engine := promql.NewEngine(promql.EngineOpts{MaxSamples: 1000, Timeout: time.Minute})
+	query, err := engine.NewInstantQuery(context.Background(), q, nil, `histogram_quantile(0.5, req{app="a"})`, time.Unix(120, 0))
+	require.NoError(t, err)
+
+	res := query.Exec(context.Background())
+	require.NoError(t, res.Err)
+
+	vector, err := res.Vector()
+	require.NoError(t, err)
+	require.Len(t, vector, 1)
+	// 4 of 8 observations are in (0.1, 0.5], the median is in the middle of the bucket
+	assert.InDelta(t, 0.3, vector[0].F, 1e-9)
+}
@@ -0,0 +1,246 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+// templateRegexp returns the regexp, which matches values expanded from the template, with a group per reference.
+// References are parsed as in regexp.Expand, the ones to non-numeric names are expanded to the empty string.
+func templateRegexp(template string) (*regexp.Regexp, []int) {
+	var (
+		re   strings.Builder
+		refs []int
+	)
+
+	re.WriteByte('^')
+
+	for {
+		i := strings.IndexByte(template, '$')
+		if i < 0 || i == len(template)-1 {
+			re.WriteString(regexp.QuoteMeta(template))
+			break
+		}
+
+		re.WriteString(regexp.QuoteMeta(template[:i]))
+		template = template[i+1:]
+
+		var name string
+
+		switch {
+		case template[0] == '$':
+			re.WriteString(`\$`)
+			template = template[1:]
+
+			continue
+		case template[0] == '{':
+			end := strings.IndexByte(template, '}')
+			if end < 0 {
+				re.WriteString(regexp.QuoteMeta("$" + template))
+				template = ""
+
+				continue
+			}
+
+			name, template = template[1:end], template[end+1:]
+		default:
+			end := 0
+			for end < len(template) && (template[end] == '_' || unicode.IsLetter(rune(template[end])) || unicode.IsDigit(rune(template[end]))) {
+				end++
+			}
+
+			if end == 0 {
+				re.WriteString(`\$`)
+				continue
+			}
+
+			name, template = template[:end], template[end:]
+		}
+
+		if n, err := strconv.Atoi(name); err == nil {
+			re.WriteString("(.*)")
+			refs = append(refs, n)
+		}
+	}
+
+	re.WriteByte('$')
+
+	return regexp.MustCompile(re.String()), refs
+}
+
+// plainMappingGlob returns the glob for plain metrics, which can be mapped to series matched by matchers. Values of
+// equal matchers are matched with templates of the mapping, and parts of values for "$n" references replace n-th *
+// in the glob. It returns false, if the mapping can't produce matched series at all.
+func plainMappingGlob(m *config.PlainMapping, matchers []*labels.Matcher) (string, bool) {
+	values := make(map[int]string)
+
+	for _, matcher := range matchers {
+		if matcher == nil {
+			continue
+		}
+
+		var (
+			template string
+			ok       bool
+		)
+
+		if matcher.Name == labels.MetricName {
+			template, ok = m.Name, true
+		} else {
+			template, ok = m.Labels[matcher.Name]
+		}
+
+		if !ok {
+			// the label isn't set by the mapping
+			if !matcher.Matches("") {
+				return "", false
+			}
+
+			continue
+		}
+
+		if !strings.Contains(template, "$") {
+			if !matcher.Matches(template) {
+				return "", false
+			}
+
+			continue
+		}
+
+		if matcher.Type != labels.MatchEqual {
+			// checked after the find
+			continue
+		}
+
+		re, refs := templateRegexp(template)
+
+		match := re.FindStringSubmatch(matcher.Value)
+		if match == nil {
+			return "", false
+		}
+
+		for i, n := range refs {
+			v := match[i+1]
+			if v == "" || strings.ContainsAny(v, ".*?[]{}") {
+				// checked after the find
+				continue
+			}
+
+			if prev, exists := values[n]; exists && prev != v {
+				return "", false
+			}
+
+			values[n] = v
+		}
+	}
+
+	parts := strings.Split(m.Match, "*")
+
+	var glob strings.Builder
+
+	for i, part := range parts {
+		if i > 0 {
+			if v, ok := values[i]; ok {
+				glob.WriteString(v)
+			} else {
+				glob.WriteByte('*')
+			}
+		}
+
+		glob.WriteString(part)
+	}
+
+	return glob.String(), true
+}
+
+// plainMappingLabels returns labels of the plain metric or nil, if the mapping doesn't match it
+func plainMappingLabels(m *config.PlainMapping, path string) labels.Labels {
+	match := m.Regexp.FindStringSubmatchIndex(path)
+	if match == nil {
+		return nil
+	}
+
+	lb := make(map[string]string, len(m.Labels)+1)
+
+	for name, template := range m.Labels {
+		if v := string(m.Regexp.ExpandString(nil, template, path, match)); v != "" {
+			lb[name] = v
+		}
+	}
+
+	name := string(m.Regexp.ExpandString(nil, m.Name, path, match))
+	if name == "" {
+		return nil
+	}
+
+	lb[labels.MetricName] = name
+
+	return labels.FromMap(lb)
+}
+
+// firstPlainMapping returns the index of the first mapping, which matches the plain metric, or -1
+func firstPlainMapping(mappings []config.PlainMapping, path string) int {
+	for i := range mappings {
+		if mappings[i].Regexp.MatchString(path) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func matchLabels(lb labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if m != nil && !m.Matches(lb.Get(m.Name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lookupPlainMapping adds plain metrics, mapped to series matched by matchers, to the aliases map. Series names are
+// in the same form as tagged series.
+func (q *Querier) lookupPlainMapping(ctx context.Context, from, until int64, am *alias.Map, matchers []*labels.Matcher) error {
+	mappings := q.config.Prometheus.Mapping
+
+	for i := range mappings {
+		glob, ok := plainMappingGlob(&mappings[i], matchers)
+		if !ok {
+			continue
+		}
+
+		fndResult, err := finder.Find(q.config, ctx, glob, from, until)
+		if err != nil {
+			return err
+		}
+
+		for _, series := range fndResult.Series() {
+			path := string(series)
+			if firstPlainMapping(mappings, path) != i {
+				continue
+			}
+
+			lb := plainMappingLabels(&mappings[i], path)
+			if lb == nil || !matchLabels(lb, matchers) {
+				continue
+			}
+
+			am.Append(path, alias.Value{Target: glob, DisplayName: seriesPath(lb)})
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+func newPlainMappings(t *testing.T) []config.PlainMapping {
+	body := []byte(`
+[[prometheus.mapping]]
+match = "servers.*.cpu.*"
+name = "cpu_usage"
+labels = { host = "$1", mode = "${2}" }
+
+[[prometheus.mapping]]
+match = "servers.*.*"
+name = "${2}_total"
+labels = { host = "$1", job = "servers" }
+`)
+	cfg, _, err := config.Unmarshal(body, false)
+	require.NoError(t, err)
+
+	return cfg.Prometheus.Mapping
+}
+
+func TestPlainMappingGlob(t *testing.T) {
+	mappings := newPlainMappings(t)
+
+	tests := []struct {
+		name     string
+		mapping  int
+		matchers []*labels.Matcher
+		want     string
+		wantOk   bool
+	}{
+		{
+			name:    "name and label",
+			mapping: 0,
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu_usage"),
+				labels.MustNewMatcher(labels.MatchEqual, "host", "web1"),
+			},
+			want:   "servers.web1.cpu.*",
+			wantOk: true,
+		},
+		{
+			name:    "regexp is checked after find",
+			mapping: 0,
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu_usage"),
+				labels.MustNewMatcher(labels.MatchRegexp, "mode", "user|system"),
+			},
+			want:   "servers.*.cpu.*",
+			wantOk: true,
+		},
+		{
+			name:    "value with glob symbols isn't substituted",
+			mapping: 0,
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "host", "web*"),
+			},
+			want:   "servers.*.cpu.*",
+			wantOk: true,
+		},
+		{
+			name:    "other name",
+			mapping: 0,
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "__name__", "memory_usage"),
+			},
+		},
+		{
+			name:    "unknown label",
+			mapping: 0,
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu_usage"),
+				labels.MustNewMatcher(labels.MatchEqual, "dc", "east"),
+			},
+		},
+		{
+			name:    "templated name doesn't match",
+			mapping: 1,
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu_usage"),
+			},
+		},
+		{
+			name:    "constant label",
+			mapping: 1,
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "job", "servers"),
+				labels.MustNewMatcher(labels.MatchEqual, "host", "web2"),
+			},
+			want:   "servers.web2.*",
+			wantOk: true,
+		},
+		{
+			name:    "templated name",
+			mapping: 1,
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "__name__", "requests_total"),
+				labels.MustNewMatcher(labels.MatchNotEqual, "job", "other"),
+			},
+			want:   "servers.*.requests",
+			wantOk: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := plainMappingGlob(&mappings[tt.mapping], tt.matchers)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTemplateRegexp(t *testing.T) {
+	re, refs := templateRegexp("${2}_total")
+	assert.Equal(t, `^(.*)_total$`, re.String())
+	assert.Equal(t, []int{2}, refs)
+
+	// as in regexp.Expand, $1_total is a reference to the group "1_total"
+	re, refs = templateRegexp("a.$1_total$$")
+	assert.Equal(t, `^a\.\$$`, re.String())
+	assert.Empty(t, refs)
+
+	re, refs = templateRegexp("$1-$2")
+	assert.Equal(t, `^(.*)-(.*)$`, re.String())
+	assert.Equal(t, []int{1, 2}, refs)
+}
+
+func TestPlainMappingLabels(t *testing.T) {
+	mappings := newPlainMappings(t)
+
+	assert.Equal(t,
+		labels.FromStrings("__name__", "cpu_usage", "host", "web1", "mode", "user"),
+		plainMappingLabels(&mappings[0], "servers.web1.cpu.user"),
+	)
+	assert.Equal(t,
+		labels.FromStrings("__name__", "requests_total", "host", "web1", "job", "servers"),
+		plainMappingLabels(&mappings[1], "servers.web1.requests"),
+	)
+	assert.Nil(t, plainMappingLabels(&mappings[0], "servers.web1.memory"))
+
+	assert.Equal(t, 0, firstPlainMapping(mappings, "servers.web1.cpu.user"))
+	assert.Equal(t, 1, firstPlainMapping(mappings, "servers.web1.requests"))
+	assert.Equal(t, -1, firstPlainMapping(mappings, "other.web1.requests"))
+}
+
+func TestQuerier_lookupPlainMapping(t *testing.T) {
+	var queries []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		queries = append(queries, string(body))
+
+		_, _ = io.WriteString(w, "servers.web1.cpu.user\nservers.web1.cpu.system\nservers.web1.cpu.idle\n")
+	}))
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.IndexTable = "graphite_index"
+	cfg.ClickHouse.IndexReverse = "direct"
+	cfg.Prometheus.Mapping = newPlainMappings(t)
+
+	q := &Querier{config: cfg}
+	am := alias.New()
+
+	err := q.lookupPlainMapping(context.Background(), 1669453200, 1669626000, am, []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu_usage"),
+		labels.MustNewMatcher(labels.MatchEqual, "host", "web1"),
+		labels.MustNewMatcher(labels.MatchNotEqual, "mode", "idle"),
+	})
+	require.NoError(t, err)
+
+	// only the first mapping produces cpu_usage
+	require.Len(t, queries, 1)
+	assert.True(t, strings.Contains(queries[0], "servers.web1.cpu."), queries[0])
+
+	assert.ElementsMatch(t, []string{"servers.web1.cpu.system", "servers.web1.cpu.user"}, am.Series(false))
+	assert.Equal(t, []alias.Value{{Target: "servers.web1.cpu.*", DisplayName: "cpu_usage?host=web1&mode=user"}}, am.Get("servers.web1.cpu.user"))
+	assert.Equal(t,
+		labels.FromStrings("__name__", "cpu_usage", "host", "web1", "mode", "system"),
+		Labels(am.Get("servers.web1.cpu.system")[0].DisplayName),
+	)
+}
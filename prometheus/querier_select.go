@@ -11,6 +11,7 @@ import (
 	"github.com/lomik/graphite-clickhouse/finder"
 	"github.com/lomik/graphite-clickhouse/limiter"
 	"github.com/lomik/graphite-clickhouse/pkg/alias"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
 	"github.com/lomik/graphite-clickhouse/render/data"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
@@ -57,6 +58,12 @@ func (q *Querier) lookup(ctx context.Context, from, until int64, qlimiter limite
 	am := alias.New()
 	am.Merge(fndResult, false)
 
+	if len(q.config.Prometheus.Mapping) != 0 {
+		if err = q.lookupPlainMapping(ctx, from, until, am, labelsMatcher); err != nil {
+			return nil, err
+		}
+	}
+
 	return am, nil
 }
 
@@ -98,7 +105,13 @@ func (q *Querier) Select(ctx context.Context, sortSeries bool, hints *storage.Se
 	)
 
 	from, until := q.timeRange(hints)
-	qlimiter := data.GetQueryLimiterFrom("", q.config, from, until)
+	qlimiter := data.GetQueryLimiterFrom(scope.User(ctx), q.config, from, until)
+
+	// classic histograms are reassembled into native ones for selectors of the metric name
+	histogramName := ""
+	if q.config.Prometheus.NativeHistograms && (hints == nil || hints.Func != "series") {
+		labelsMatcher, histogramName = histogramMatchers(labelsMatcher)
+	}
 
 	am, err := q.lookup(ctx, from, until, qlimiter, &queueDuration, labelsMatcher...)
 	if err != nil {
@@ -138,7 +151,13 @@ func (q *Querier) Select(ctx context.Context, sortSeries bool, hints *storage.Se
 		return emptySeriesSet() //, nil, nil
 	}
 
-	ss, err := makeSeriesSet(reply[0].Data, step)
+	var ss storage.SeriesSet
+	if histogramName != "" {
+		ss, err = makeHistogramSeriesSet(reply[0].Data, step, histogramName)
+	} else {
+		ss, err = makeSeriesSet(reply[0].Data, step)
+	}
+
 	if err != nil {
 		return nil // , nil, err @TODO
 	}
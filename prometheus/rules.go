@@ -0,0 +1,317 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	promConfig "github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/metadata"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/RowBinary"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// ruleFiles returns files matched by globs of prometheus.rule-files
+func ruleFiles(patterns []string) ([]string, error) {
+	files := make([]string, 0, len(patterns))
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+// alertmanagers returns the alerting config and static target groups for the notifier manager
+func alertmanagers(urls []string) (promConfig.AlertingConfig, map[string][]*targetgroup.Group, error) {
+	alerting := promConfig.AlertingConfig{}
+	groups := make(map[string][]*targetgroup.Group, len(urls))
+
+	for i, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return alerting, nil, err
+		}
+
+		cfg := promConfig.DefaultAlertmanagerConfig
+		cfg.Scheme = u.Scheme
+		cfg.PathPrefix = u.Path
+
+		alerting.AlertmanagerConfigs = append(alerting.AlertmanagerConfigs, &cfg)
+
+		// the same key as in AlertmanagerConfigs.ToMap
+		key := fmt.Sprintf("config-%d", i)
+		groups[key] = []*targetgroup.Group{{
+			Targets: []model.LabelSet{{model.AddressLabel: model.LabelValue(u.Host)}},
+			Source:  key,
+		}}
+	}
+
+	return alerting, groups, nil
+}
+
+// recordingAppendable writes samples of recording rules into prometheus.rules-data-table and their series into
+// prometheus.rules-tagged-table
+type recordingAppendable struct {
+	config *config.Config
+
+	mu sync.Mutex
+	// written contains the series, already written into the tagged table for the day
+	written map[string]uint16
+	// day is the latest day of written series, the series of earlier days are dropped
+	day uint16
+}
+
+var _ storage.Appendable = &recordingAppendable{}
+
+func newRecordingAppendable(config *config.Config) *recordingAppendable {
+	return &recordingAppendable{
+		config:  config,
+		written: make(map[string]uint16),
+	}
+}
+
+func (r *recordingAppendable) Appender(ctx context.Context) storage.Appender {
+	return &recordingAppender{ctx: ctx, appendable: r}
+}
+
+// newSeries returns the points, which series aren't written into the tagged table for the day of the point
+func (r *recordingAppendable) newSeries(points []recordingPoint) []recordingPoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]recordingPoint, 0)
+	seen := make(map[string]bool)
+
+	for _, p := range points {
+		if r.written[p.path] == p.days || seen[p.path] {
+			continue
+		}
+
+		seen[p.path] = true
+
+		result = append(result, p)
+	}
+
+	return result
+}
+
+func (r *recordingAppendable) setWritten(points []recordingPoint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range points {
+		if p.days > r.day {
+			r.day = p.days
+			r.written = make(map[string]uint16)
+		}
+
+		// the late points of the previous day are written again, if any
+		if p.days == r.day {
+			r.written[p.path] = p.days
+		}
+	}
+}
+
+type recordingPoint struct {
+	path   string
+	series labels.Labels
+	value  float64
+	time   uint32
+	days   uint16
+}
+
+type recordingAppender struct {
+	ctx        context.Context
+	appendable *recordingAppendable
+	points     []recordingPoint
+}
+
+var _ storage.Appender = &recordingAppender{}
+
+// Append adds the sample to points for the next Commit. NaN values, including stale markers, are skipped.
+func (a *recordingAppender) Append(ref storage.SeriesRef, l labels.Labels, t int64, v float64) (storage.SeriesRef, error) {
+	if math.IsNaN(v) {
+		return ref, nil
+	}
+
+	a.points = append(a.points, recordingPoint{
+		path:   seriesPath(l),
+		series: l,
+		value:  v,
+		time:   uint32(t / 1000),
+		days:   RowBinary.DateToUint16(time.Unix(t/1000, 0)),
+	})
+
+	return ref, nil
+}
+
+func (a *recordingAppender) AppendExemplar(ref storage.SeriesRef, l labels.Labels, e exemplar.Exemplar) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+func (a *recordingAppender) AppendHistogram(ref storage.SeriesRef, l labels.Labels, t int64, h *histogram.Histogram, fh *histogram.FloatHistogram) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+func (a *recordingAppender) UpdateMetadata(ref storage.SeriesRef, l labels.Labels, m metadata.Metadata) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+func (a *recordingAppender) AppendCTZeroSample(ref storage.SeriesRef, l labels.Labels, t, ct int64) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+// Commit inserts new series into the tagged table and then points into the data table.
+func (a *recordingAppender) Commit() error {
+	points := a.points
+	a.points = nil
+
+	if len(points) == 0 {
+		return nil
+	}
+
+	cfg := a.appendable.config
+	version := uint32(timeNow().Unix())
+
+	series := a.appendable.newSeries(points)
+	if len(series) != 0 {
+		body, err := encodeRecordingSeries(series, version)
+		if err != nil {
+			return err
+		}
+
+		if err = a.insert(cfg.Prometheus.RulesTaggedTable, "(Date, Tag1, Path, Tags, Version)", body); err != nil {
+			return err
+		}
+
+		a.appendable.setWritten(series)
+	}
+
+	body, err := encodeRecordingPoints(points, version)
+	if err != nil {
+		return err
+	}
+
+	return a.insert(cfg.Prometheus.RulesDataTable, "(Path, Value, Time, Date, Timestamp)", body)
+}
+
+// Rollback drops the appended points.
+func (a *recordingAppender) Rollback() error {
+	a.points = nil
+
+	return nil
+}
+
+func (a *recordingAppender) insert(table, columns string, body *bytes.Buffer) error {
+	cfg := a.appendable.config
+
+	_, _, _, err := clickhouse.Post(
+		scope.WithTable(a.ctx, table),
+		cfg.ClickHouse.URL,
+		fmt.Sprintf("INSERT INTO %s %s FORMAT RowBinary", table, columns),
+		body,
+		clickhouse.Options{
+			TLSConfig:      cfg.ClickHouse.TLSConfig,
+			Timeout:        cfg.ClickHouse.DataTimeout,
+			ConnectTimeout: cfg.ClickHouse.ConnectTimeout,
+		},
+		nil,
+	)
+
+	return err
+}
+
+// encodeRecordingPoints returns rows (Path, Value, Time, Date, Timestamp) of the data table
+func encodeRecordingPoints(points []recordingPoint, version uint32) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	encoder := RowBinary.NewEncoder(buf)
+
+	for _, p := range points {
+		if err := encoder.String(p.path); err != nil {
+			return nil, err
+		}
+
+		if err := encoder.Float64(p.value); err != nil {
+			return nil, err
+		}
+
+		if err := encoder.Uint32(p.time); err != nil {
+			return nil, err
+		}
+
+		if err := encoder.Uint16(p.days); err != nil {
+			return nil, err
+		}
+
+		if err := encoder.Uint32(version); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
+
+// encodeRecordingSeries returns rows (Date, Tag1, Path, Tags, Version) of the tagged table, a row per tag of series
+// as carbon-clickhouse writes them
+func encodeRecordingSeries(points []recordingPoint, version uint32) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	encoder := RowBinary.NewEncoder(buf)
+
+	for _, p := range points {
+		tags := make([]string, 0, p.series.Len())
+		tags = append(tags, labels.MetricName+"="+p.series.Get(labels.MetricName))
+
+		p.series.Range(func(l labels.Label) {
+			if l.Name != labels.MetricName {
+				tags = append(tags, l.Name+"="+l.Value)
+			}
+		})
+
+		for _, tag1 := range tags {
+			if err := encoder.Uint16(p.days); err != nil {
+				return nil, err
+			}
+
+			if err := encoder.String(tag1); err != nil {
+				return nil, err
+			}
+
+			if err := encoder.String(p.path); err != nil {
+				return nil, err
+			}
+
+			if err := encoder.StringList(tags); err != nil {
+				return nil, err
+			}
+
+			if err := encoder.Uint32(version); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return buf, nil
+}
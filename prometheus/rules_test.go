@@ -0,0 +1,186 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	promConfig "github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/RowBinary"
+)
+
+func TestRuleFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.yml", "b.yml", "c.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("groups: []\n"), 0o644))
+	}
+
+	files, err := ruleFiles([]string{filepath.Join(dir, "*.yml"), filepath.Join(dir, "missing.yml")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "a.yml"), filepath.Join(dir, "b.yml")}, files)
+}
+
+func TestAlertmanagers(t *testing.T) {
+	alerting, groups, err := alertmanagers([]string{"http://am1:9093", "https://am2/prefix"})
+	require.NoError(t, err)
+
+	require.Len(t, alerting.AlertmanagerConfigs, 2)
+	assert.Equal(t, "http", alerting.AlertmanagerConfigs[0].Scheme)
+	assert.Equal(t, "", alerting.AlertmanagerConfigs[0].PathPrefix)
+	assert.Equal(t, "https", alerting.AlertmanagerConfigs[1].Scheme)
+	assert.Equal(t, "/prefix", alerting.AlertmanagerConfigs[1].PathPrefix)
+	assert.Equal(t, promConfig.AlertmanagerAPIVersionV2, alerting.AlertmanagerConfigs[1].APIVersion)
+
+	assert.Equal(t, map[string][]*targetgroup.Group{
+		"config-0": {{Targets: []model.LabelSet{{model.AddressLabel: "am1:9093"}}, Source: "config-0"}},
+		"config-1": {{Targets: []model.LabelSet{{model.AddressLabel: "am2"}}, Source: "config-1"}},
+	}, groups)
+
+	// keys of groups must match the keys of configs in the notifier manager
+	for key := range alerting.AlertmanagerConfigs.ToMap() {
+		assert.Contains(t, groups, key)
+	}
+}
+
+type insertRequest struct {
+	query string
+	body  []byte
+}
+
+func newInsertServer(t *testing.T) (*httptest.Server, func() []insertRequest) {
+	var (
+		mu       sync.Mutex
+		requests []insertRequest
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		mu.Lock()
+		requests = append(requests, insertRequest{query: r.URL.Query().Get("query"), body: body})
+		mu.Unlock()
+	}))
+
+	return srv, func() []insertRequest {
+		mu.Lock()
+		defer mu.Unlock()
+
+		result := requests
+		requests = nil
+
+		return result
+	}
+}
+
+func rowBinaryString(buf *bytes.Buffer, s string) {
+	buf.WriteByte(byte(len(s)))
+	buf.WriteString(s)
+}
+
+func rowBinaryNumber(buf *bytes.Buffer, v interface{}) {
+	_ = binary.Write(buf, binary.LittleEndian, v)
+}
+
+func TestRecordingAppender(t *testing.T) {
+	defer func(f func() time.Time) { timeNow = f }(timeNow)
+	timeNow = func() time.Time { return time.Unix(1609502500, 0) }
+
+	srv, requests := newInsertServer(t)
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.Prometheus.RulesDataTable = "graphite_data"
+	cfg.Prometheus.RulesTaggedTable = "graphite_tagged"
+
+	series := labels.FromStrings("__name__", "job:requests:rate5m", "job", "api")
+	days := RowBinary.DateToUint16(time.Unix(1609502400, 0))
+
+	appendable := newRecordingAppendable(cfg)
+	app := appendable.Appender(context.Background())
+
+	_, err := app.Append(0, series, 1609502400000, 1.5)
+	require.NoError(t, err)
+	_, err = app.Append(0, series, 1609502460000, math.NaN())
+	require.NoError(t, err)
+	_, err = app.Append(0, series, 1609502460000, math.Float64frombits(value.StaleNaN))
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+
+	got := requests()
+	require.Len(t, got, 2)
+
+	path := "job:requests:rate5m?job=api"
+	tags := []string{"__name__=job:requests:rate5m", "job=api"}
+
+	expected := new(bytes.Buffer)
+	for _, tag1 := range tags {
+		rowBinaryNumber(expected, days)
+		rowBinaryString(expected, tag1)
+		rowBinaryString(expected, path)
+		expected.WriteByte(byte(len(tags)))
+		for _, tag := range tags {
+			rowBinaryString(expected, tag)
+		}
+		rowBinaryNumber(expected, uint32(1609502500))
+	}
+
+	assert.Equal(t, "INSERT INTO graphite_tagged (Date, Tag1, Path, Tags, Version) FORMAT RowBinary", got[0].query)
+	assert.Equal(t, expected.Bytes(), got[0].body)
+
+	expected = new(bytes.Buffer)
+	rowBinaryString(expected, path)
+	rowBinaryNumber(expected, 1.5)
+	rowBinaryNumber(expected, uint32(1609502400))
+	rowBinaryNumber(expected, days)
+	rowBinaryNumber(expected, uint32(1609502500))
+
+	assert.Equal(t, "INSERT INTO graphite_data (Path, Value, Time, Date, Timestamp) FORMAT RowBinary", got[1].query)
+	assert.Equal(t, expected.Bytes(), got[1].body)
+
+	// the series is written once a day
+	app = appendable.Appender(context.Background())
+	_, err = app.Append(0, series, 1609502520000, 2)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+
+	got = requests()
+	require.Len(t, got, 1)
+	assert.Equal(t, "INSERT INTO graphite_data (Path, Value, Time, Date, Timestamp) FORMAT RowBinary", got[0].query)
+
+	// nothing to write
+	_, err = app.Append(0, series, 1609502580000, 3)
+	require.NoError(t, err)
+	require.NoError(t, app.Rollback())
+	require.NoError(t, app.Commit())
+	assert.Empty(t, requests())
+
+	// the series of the previous day are forgotten on the next one
+	other := labels.FromStrings("__name__", "job:errors:rate5m", "job", "api")
+	_, err = app.Append(0, other, 1609588800000, 1)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+	assert.Len(t, requests(), 2)
+	assert.Equal(t, map[string]uint16{"job:errors:rate5m?job=api": days + 1}, appendable.written)
+}
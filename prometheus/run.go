@@ -5,27 +5,33 @@ package prometheus
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
 	"net/http"
-	"time"
 
 	"github.com/grafana/regexp"
+	"github.com/lomik/graphite-clickhouse/auth"
 	"github.com/lomik/graphite-clickhouse/config"
 	"github.com/lomik/zapwriter"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	promConfig "github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/notifier"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/rules"
 	"github.com/prometheus/prometheus/scrape"
+	"github.com/prometheus/prometheus/util/logging"
 	"github.com/prometheus/prometheus/web"
 	"github.com/prometheus/prometheus/web/ui"
+	"go.uber.org/zap"
 
 	uiStatic "github.com/lomik/prometheus-ui-static"
 	"github.com/prometheus/common/assets"
 )
 
-func Run(config *config.Config) error {
+func Run(config *config.Config, authChain *auth.Chain) error {
 	// use precompiled static from github.com/lomik/prometheus-ui-static
 	ui.Assets = http.FS(assets.New(uiStatic.EmbedFS))
 
@@ -40,31 +46,77 @@ func Run(config *config.Config) error {
 		return err
 	}
 
+	var activeQueryTracker promql.QueryTracker
+	if config.Prometheus.ActiveQueryTrackerDir != "" {
+		activeQueryTracker = promql.NewActiveQueryTracker(
+			config.Prometheus.ActiveQueryTrackerDir, config.Prometheus.MaxConcurrentQueries, zapLogger,
+		)
+	}
+
 	queryEngine := promql.NewEngine(promql.EngineOpts{
-		Logger:        zapLogger,
-		Timeout:       time.Minute,
-		MaxSamples:    50000000,
-		LookbackDelta: config.Prometheus.LookbackDelta,
+		Logger:             zapLogger,
+		Timeout:            config.Prometheus.QueryTimeout,
+		MaxSamples:         config.Prometheus.MaxSamples,
+		ActiveQueryTracker: activeQueryTracker,
+		LookbackDelta:      config.Prometheus.LookbackDelta,
 	})
 
+	if config.Prometheus.QueryLogFile != "" {
+		queryLogger, err := logging.NewJSONFileLogger(config.Prometheus.QueryLogFile)
+		if err != nil {
+			return err
+		}
+
+		queryEngine.SetQueryLogger(queryLogger)
+	}
+
 	scrapeManager, err := scrape.NewManager(&scrape.Options{}, zapLogger, storage, prometheus.DefaultRegisterer)
 	if err != nil {
 		return err
 	}
 
+	files, err := ruleFiles(config.Prometheus.RuleFiles)
+	if err != nil {
+		return err
+	}
+
+	alerting, alertmanagerGroups, err := alertmanagers(config.Prometheus.AlertmanagerURLs)
+	if err != nil {
+		return err
+	}
+
+	promCfg := &promConfig.Config{
+		GlobalConfig: promConfig.GlobalConfig{
+			EvaluationInterval: model.Duration(config.Prometheus.EvaluationInterval),
+		},
+		AlertingConfig: alerting,
+		RuleFiles:      files,
+	}
+
+	notifierManager := notifier.NewManager(&notifier.Options{QueueCapacity: 10000}, zapLogger)
+	if err = notifierManager.ApplyConfig(promCfg); err != nil {
+		return err
+	}
+
 	rulesManager := rules.NewManager(&rules.ManagerOptions{
-		Logger:     zapLogger,
-		Appendable: storage,
-		Queryable:  storage,
+		Logger:      zapLogger,
+		Context:     context.Background(),
+		ExternalURL: config.Prometheus.ExternalURL,
+		QueryFunc:   rules.EngineQueryFunc(queryEngine, storage),
+		NotifyFunc:  rules.SendAlerts(notifierManager, config.Prometheus.ExternalURL.String()),
+		Appendable:  newRecordingAppendable(config),
+		Queryable:   storage,
 	})
 
-	notifierManager := notifier.NewManager(&notifier.Options{}, zapLogger)
+	if err = rulesManager.Update(config.Prometheus.EvaluationInterval, files, labels.EmptyLabels(), config.Prometheus.ExternalURL.String(), nil); err != nil {
+		return err
+	}
 
 	promHandler := web.New(zapLogger, &web.Options{
 		ListenAddress:              config.Prometheus.Listen,
-		MaxConnections:             500,
+		MaxConnections:             config.Prometheus.MaxConnections,
 		Storage:                    storage,
-		ExemplarStorage:            &nopExemplarQueryable{},
+		ExemplarStorage:            newExemplarQueryable(config),
 		ExternalURL:                config.Prometheus.ExternalURL,
 		RoutePrefix:                "/",
 		QueryEngine:                queryEngine,
@@ -78,13 +130,45 @@ func Run(config *config.Config) error {
 		PageTitle:                  config.Prometheus.PageTitle,
 		LookbackDelta:              config.Prometheus.LookbackDelta,
 		RemoteReadConcurrencyLimit: config.Prometheus.RemoteReadConcurrencyLimit,
+		// remote write receiver stores exemplars only
+		EnableRemoteWriteReceiver:  config.Prometheus.RemoteWriteExemplars,
+		AcceptRemoteWriteProtoMsgs: []promConfig.RemoteWriteProtoMsg{promConfig.RemoteWriteProtoMsgV1},
 	})
 
-	promHandler.ApplyConfig(&promConfig.Config{})
+	promHandler.ApplyConfig(promCfg)
 	promHandler.SetReady(true)
 
+	// Alertmanagers are static, the notifier manager gets them once instead of discovery updates
+	alertmanagerUpdates := make(chan map[string][]*targetgroup.Group, 1)
+	alertmanagerUpdates <- alertmanagerGroups
+
+	go notifierManager.Run(alertmanagerUpdates)
+	go rulesManager.Run()
+
+	// listener with MaxConnections limit
+	listener, err := promHandler.Listener()
+	if err != nil {
+		return err
+	}
+
+	if config.Prometheus.TLS != nil {
+		listener = tls.NewListener(listener, config.Prometheus.TLS.Config())
+
+		go config.Prometheus.TLS.Watch(context.Background(), config.Common.TLSReloadInterval, zapwriter.Logger("prometheus"))
+	}
+
+	handler, err := newHTTPHandler(promHandler)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:  userHandler(config, authChain, zapwriter.Logger("prometheus"), handler),
+		ErrorLog: zap.NewStdLog(zapwriter.Logger("prometheus")),
+	}
+
 	go func() {
-		log.Fatal(promHandler.Run(context.Background(), nil, ""))
+		log.Fatal(srv.Serve(listener))
 	}()
 
 	return nil
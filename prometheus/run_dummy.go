@@ -4,9 +4,10 @@
 package prometheus
 
 import (
+	"github.com/lomik/graphite-clickhouse/auth"
 	"github.com/lomik/graphite-clickhouse/config"
 )
 
-func Run(config *config.Config) error {
+func Run(config *config.Config, authChain *auth.Chain) error {
 	return nil
 }
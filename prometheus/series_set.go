@@ -31,6 +31,9 @@ type series struct {
 	metricName string
 	points     []point.Point
 	step       int64
+	// labels and histograms are set for native histograms instead of metricName and points
+	labels     labels.Labels
+	histograms []histogramSample
 }
 
 // SeriesSet contains a set of series.
@@ -186,6 +189,10 @@ func (s *seriesSet) Warnings() annotations.Annotations {
 
 // Iterator returns a new iterator of the data of the series.
 func (s *series) Iterator(iterator chunkenc.Iterator) chunkenc.Iterator {
+	if s.histograms != nil {
+		return &histogramIterator{samples: s.histograms, current: -1}
+	}
+
 	return &seriesIterator{metricName: s.metricName, points: s.points, current: -1, step: s.step}
 }
 
@@ -194,5 +201,9 @@ func (s *series) name() string {
 }
 
 func (s *series) Labels() labels.Labels {
+	if s.labels != nil {
+		return s.labels
+	}
+
 	return Labels(s.name())
 }
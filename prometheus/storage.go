@@ -34,9 +34,13 @@ func (s *storageImpl) ChunkQuerier(mint, maxt int64) (storage.ChunkQuerier, erro
 	return nil, nil
 }
 
-// Appender ...
+// Appender returns the appender of exemplars, if prometheus.remote-write-exemplars is set
 func (s *storageImpl) Appender(ctx context.Context) storage.Appender {
-	return nil
+	if !s.config.Prometheus.RemoteWriteExemplars {
+		return nil
+	}
+
+	return &exemplarAppender{ctx: ctx, config: s.config}
 }
 
 // StartTime ...
@@ -91,3 +91,29 @@ func queryCarbonlink(parentCtx context.Context, carbonlink *carbonlinkClient, me
 
 	return fetchResult
 }
+
+// carbonlinkXFilesFactor applies xFilesFactor to the raw points of carbonlink for aggregated requests. ClickHouse
+// applies it to the aggregated points by itself, so after the merge it can't be applied to all points.
+func (c *conditions) carbonlinkXFilesFactor(ctx context.Context, fetcher func() *point.Points) func() *point.Points {
+	if !c.aggregated || len(c.xFilesFactors) == 0 {
+		return fetcher
+	}
+
+	return func() *point.Points {
+		pp := fetcher()
+		if pp == nil || pp.Len() == 0 {
+			return pp
+		}
+
+		pp.SetXFilesFactors(c.xFilesFactors)
+		pp.Sort()
+		pp.Uniq()
+
+		if err := c.rollupRules.RollupPoints(pp, c.From, c.step); err != nil {
+			scope.Logger(ctx).Error("carbonlink rollup failed", zap.Error(err))
+			return nil
+		}
+
+		return pp
+	}
+}
@@ -129,7 +129,7 @@ func (cc *CHResponses) ToMultiFetchResponseV2() (*v2pb.MultiFetchResponse, error
 func (c *CHResponse) ToMultiFetchResponseV3() (*v3pb.MultiFetchResponse, error) {
 	mfr := &v3pb.MultiFetchResponse{Metrics: make([]v3pb.FetchResponse, 0)}
 	data := c.Data
-	addResponse := func(name, function string, step uint32, points []point.Point) error {
+	addResponse := func(name, function string, xFilesFactor float32, step uint32, points []point.Point) error {
 		from, until := uint32(c.From), uint32(c.Until)
 		start, stop, count, getValue := point.FillNulls(points, from, until, step)
 		values := make([]float64, 0, count)
@@ -155,7 +155,7 @@ func (c *CHResponse) ToMultiFetchResponseV3() (*v3pb.MultiFetchResponse, error)
 				StartTime:               int64(start),
 				StopTime:                int64(stop),
 				StepTime:                int64(step),
-				XFilesFactor:            0,
+				XFilesFactor:            xFilesFactor,
 				HighPrecisionTimestamps: false,
 				Values:                  values,
 				AppliedFunctions:        c.AppliedFunctions[a.Target],
@@ -192,7 +192,7 @@ func (c *CHResponse) ToMultiFetchResponseV3() (*v3pb.MultiFetchResponse, error)
 			return nil, err
 		}
 
-		if err := addResponse(name, consolidationFunc, step, points); err != nil {
+		if err := addResponse(name, consolidationFunc, data.GetXFilesFactor(id), step, points); err != nil {
 			return nil, err
 		}
 	}
@@ -200,7 +200,7 @@ func (c *CHResponse) ToMultiFetchResponseV3() (*v3pb.MultiFetchResponse, error)
 	if c.AppendOutEmptySeries && len(writtenMetrics) < data.AM.Len() && data.CommonStep > 0 {
 		for _, metricName := range data.AM.Series(false) {
 			if _, done := writtenMetrics[metricName]; !done {
-				err := addResponse(metricName, "any", uint32(data.CommonStep), []point.Point{})
+				err := addResponse(metricName, "any", 0, uint32(data.CommonStep), []point.Point{})
 				if err != nil {
 					return nil, err
 				}
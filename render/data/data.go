@@ -13,6 +13,7 @@ import (
 
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/helper/rollup"
 	"github.com/lomik/graphite-clickhouse/pkg/alias"
 	"github.com/lomik/graphite-clickhouse/pkg/reverse"
 )
@@ -61,6 +62,9 @@ func (d *Data) GetAggregation(id uint32) (string, error) {
 		return "first", nil
 	case "anyLast":
 		return "last", nil
+	case rollup.RateFunction:
+		// rates are consolidated by average
+		return "avg", nil
 	default:
 		return function, nil
 	}
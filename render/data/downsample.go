@@ -0,0 +1,60 @@
+package data
+
+import (
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/pkg/dry"
+)
+
+// downsampleStep returns the step for the downsampled points, it's a multiplier of the fetched points step
+func (c *conditions) downsampleStep(step int64) int64 {
+	return dry.CeilToMultiplier(dry.Max(step, dry.Ceil(c.Until-c.From, c.downsamplePoints)), step)
+}
+
+// downsample reduces the points of every metric to cond.downsamplePoints and sets the new steps
+func (d *data) downsample(cond *conditions) error {
+	from, until := uint32(cond.From), uint32(cond.Until)
+
+	fn := func(points []point.Point, step uint32) []point.Point {
+		return point.LTTB(points, from, step)
+	}
+
+	if cond.downsample == DownsampleMinMax {
+		fn = func(points []point.Point, step uint32) []point.Point {
+			return point.MinMax(points, from, until, step)
+		}
+	}
+
+	list := make([]point.Point, 0, d.Points.Len())
+	nextMetric := d.Points.GroupByMetric()
+
+	for {
+		points := nextMetric()
+		if len(points) == 0 {
+			break
+		}
+
+		step, err := d.GetStep(points[0].MetricID)
+		if err != nil {
+			return err
+		}
+
+		list = append(list, fn(points, uint32(cond.downsampleStep(int64(step))))...)
+	}
+
+	d.Points.ReplaceList(list)
+
+	if cond.aggregated {
+		d.CommonStep = cond.downsampleStep(d.CommonStep)
+		return nil
+	}
+
+	steps := make(map[uint32][]string, len(cond.steps))
+	for step, metrics := range cond.steps {
+		newStep := uint32(cond.downsampleStep(int64(step)))
+		steps[newStep] = append(steps[newStep], metrics...)
+	}
+
+	d.Points.SetSteps(steps)
+
+	return nil
+}
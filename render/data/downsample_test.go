@@ -0,0 +1,141 @@
+package data
+
+import (
+	"testing"
+
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+func TestGetDownsampling(t *testing.T) {
+	lttb := []*v3pb.FilteringFunction{{Name: "downsample", Arguments: []string{"lttb"}}}
+	minmax := []*v3pb.FilteringFunction{{Name: "consolidateBy", Arguments: []string{"max"}}, {Name: "downsample", Arguments: []string{"minmax"}}}
+
+	tests := []struct {
+		name    string
+		ff      [][]*v3pb.FilteringFunction
+		request string
+		want    string
+		wantErr bool
+	}{
+		{name: "none", ff: [][]*v3pb.FilteringFunction{nil, nil}},
+		{name: "request", ff: [][]*v3pb.FilteringFunction{nil, lttb}, request: "minmax", want: "minmax"},
+		{name: "all targets", ff: [][]*v3pb.FilteringFunction{minmax, minmax}, want: "minmax"},
+		{name: "different targets", ff: [][]*v3pb.FilteringFunction{minmax, lttb}},
+		{name: "not all targets", ff: [][]*v3pb.FilteringFunction{lttb, nil}},
+		{
+			name:    "unknown mode",
+			ff:      [][]*v3pb.FilteringFunction{{{Name: "downsample", Arguments: []string{"avg"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "no arguments",
+			ff:      [][]*v3pb.FilteringFunction{{{Name: "downsample"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := NewTargets(nil, alias.New())
+
+			for i, ff := range tt.ff {
+				target := string(rune('a' + i))
+				targets.Append(target)
+
+				if ff != nil {
+					targets.SetFilteringFunctions(target, ff)
+				}
+			}
+
+			if tt.request != "" {
+				targets.SetDownsampling(tt.request)
+			}
+
+			got, err := targets.getDownsampling()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	assert.NoError(t, CheckDownsampling("lttb"))
+	assert.Error(t, CheckDownsampling("max"))
+}
+
+func TestDataDownsample(t *testing.T) {
+	newData := func() *data {
+		d := &data{Data: &Data{Points: point.NewPoints()}}
+		for _, name := range []string{"a", "b"} {
+			id := d.Points.MetricID(name)
+			for i, v := range []float64{1, 5, 2, 3, 0, 1, 1, 1} {
+				d.Points.AppendPoint(id, v, uint32(600+60*i), 0)
+			}
+		}
+
+		return d
+	}
+
+	// 8 points of 60s are reduced to 4
+	tf := &TimeFrame{From: 600, Until: 1079, MaxDataPoints: 100}
+
+	t.Run("aggregated lttb", func(t *testing.T) {
+		cond := &conditions{TimeFrame: tf, aggregated: true, downsample: DownsampleLTTB, downsamplePoints: 4}
+		d := newData()
+		d.CommonStep = 60
+
+		require.NoError(t, d.downsample(cond))
+		assert.Equal(t, int64(120), d.CommonStep)
+		assert.Equal(t, []point.Point{
+			{MetricID: 1, Time: 600, Value: 5},
+			{MetricID: 1, Time: 720, Value: 2},
+			{MetricID: 1, Time: 840, Value: 0},
+			{MetricID: 1, Time: 960, Value: 1},
+			{MetricID: 2, Time: 600, Value: 5},
+			{MetricID: 2, Time: 720, Value: 2},
+			{MetricID: 2, Time: 840, Value: 0},
+			{MetricID: 2, Time: 960, Value: 1},
+		}, d.Points.List())
+	})
+
+	t.Run("non-aggregated minmax", func(t *testing.T) {
+		cond := &conditions{
+			TimeFrame:        tf,
+			downsample:       DownsampleMinMax,
+			downsamplePoints: 4,
+			steps:            map[uint32][]string{60: {"a"}, 120: {"b"}},
+		}
+		d := newData()
+		d.setSteps(cond)
+
+		require.NoError(t, d.downsample(cond))
+
+		step, err := d.GetStep(1)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(120), step)
+
+		// the step of "b" is already 120s
+		step, err = d.GetStep(2)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(120), step)
+
+		assert.Equal(t, []point.Point{
+			{MetricID: 1, Time: 600, Value: 1},
+			{MetricID: 1, Time: 720, Value: 5},
+			{MetricID: 1, Time: 840, Value: 0},
+			{MetricID: 1, Time: 960, Value: 1},
+			{MetricID: 2, Time: 600, Value: 1},
+			{MetricID: 2, Time: 720, Value: 5},
+			{MetricID: 2, Time: 840, Value: 0},
+			{MetricID: 2, Time: 960, Value: 1},
+		}, d.Points.List())
+	})
+}
@@ -68,6 +68,22 @@ func (m *MultiTarget) checkMetricsLimitExceeded(num int) error {
 	return nil
 }
 
+// TruncateMetrics keeps the first num metrics for every time frame and returns count of the removed ones. It's used
+// for the partial responses instead of the metrics limit error.
+func (m *MultiTarget) TruncateMetrics(num int) int {
+	if num <= 0 {
+		// zero or negative means unlimited
+		return 0
+	}
+
+	truncated := 0
+	for _, t := range *m {
+		truncated += t.AM.Truncate(num)
+	}
+
+	return truncated
+}
+
 func getDataTimeout(cfg *config.Config, m *MultiTarget) time.Duration {
 	dataTimeout := cfg.ClickHouse.DataTimeout
 
@@ -181,6 +197,9 @@ func (m *MultiTarget) Fetch(ctx context.Context, cfg *config.Config, chContext s
 	errors := make([]error, 0, len(*m))
 	query := newQuery(cfg, len(*m))
 
+	var splits []*splitGroup
+
+TimeFramesLoop:
 	for tf, targets := range *m {
 		tf, targets := tf, targets
 
@@ -203,39 +222,76 @@ func (m *MultiTarget) Fetch(ctx context.Context, cfg *config.Config, chContext s
 			return EmptyResponse(), err
 		}
 
-		if qlimiter.Enabled() {
-			start := time.Now()
-			err = qlimiter.Enter(ctxTimeout, "render")
-			*queueDuration += time.Since(start)
+		conds := []*conditions{cond}
+
+		if cfg.ClickHouse.SplitDataTables {
+			conds, err = cond.splitDataTables(cfg, chContext)
+			if err != nil {
+				logger.Error("split data tables", zap.Error(err))
+				return EmptyResponse(), err
+			}
+
+			if len(conds) > 1 {
+				// every part is counted in the common step
+				if query.cStep != nil {
+					query.cStep.addTargets(len(conds) - 1)
+				}
+
+				splits = append(splits, conds[0].split)
+			}
+		}
 
+		if tf.MaxDataPoints > 0 && len(conds) == 1 {
+			cond.downsample, err = targets.getDownsampling()
 			if err != nil {
-				// status = http.StatusServiceUnavailable
-				// queueFail = true
-				// http.Error(w, err.Error(), status)
-				lock.Lock()
-				errors = append(errors, err)
-				lock.Unlock()
-
-				break
+				logger.Error("downsampling", zap.Error(err))
+				return EmptyResponse(), errs.NewErrorWithCode(err.Error(), http.StatusBadRequest)
 			}
+		}
 
-			entered++
+		if cond.downsample != "" && cond.MaxDataPoints < int64(cfg.ClickHouse.MaxDataPoints) {
+			// fetch the points with the finest step, limited only by ClickHouse settings
+			cond.downsamplePoints = cond.MaxDataPoints
+			cond.MaxDataPoints = int64(cfg.ClickHouse.MaxDataPoints)
+		} else {
+			cond.downsample = ""
 		}
 
-		wg.Add(1)
+		for _, cond := range conds {
+			if qlimiter.Enabled() {
+				start := time.Now()
+				err = qlimiter.Enter(ctxTimeout, "render")
+				*queueDuration += time.Since(start)
 
-		go func(cond *conditions) {
-			defer wg.Done()
+				if err != nil {
+					// status = http.StatusServiceUnavailable
+					// queueFail = true
+					// http.Error(w, err.Error(), status)
+					lock.Lock()
+					errors = append(errors, err)
+					lock.Unlock()
 
-			err := query.getDataPoints(ctxTimeout, cond)
-			if err != nil {
-				lock.Lock()
-				errors = append(errors, err)
-				lock.Unlock()
+					break TimeFramesLoop
+				}
 
-				return
+				entered++
 			}
-		}(cond)
+
+			wg.Add(1)
+
+			go func(cond *conditions) {
+				defer wg.Done()
+
+				err := query.getDataPoints(ctxTimeout, cond)
+				if err != nil {
+					lock.Lock()
+					errors = append(errors, err)
+					lock.Unlock()
+
+					return
+				}
+			}(cond)
+		}
 	}
 
 	wg.Wait()
@@ -244,5 +300,17 @@ func (m *MultiTarget) Fetch(ctx context.Context, cfg *config.Config, chContext s
 		return EmptyResponse(), errors[0]
 	}
 
+	for _, split := range splits {
+		reply, err := split.merge()
+		if err != nil {
+			logger.Error("merge data tables", zap.Error(err))
+			return EmptyResponse(), err
+		}
+
+		if reply != nil {
+			query.appendReply(*reply)
+		}
+	}
+
 	return query.CHResponses, nil
 }
@@ -0,0 +1,208 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/helper/rollup"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+// key expression, aggregate function, aggregated query
+// The per-path points of the inner query are joined by time and aggregated with the function into the series with name Key
+const queryPushDown = `SELECT Key AS Path,
+ arrayMap(p->p.1, points) AS times,
+ arrayMap(p->p.2, points) AS values
+FROM (
+ SELECT Key, arraySort(p->p.1, groupArray((Time, Value))) AS points
+ FROM (
+  SELECT %[1]s AS Key, Time, toFloat64(%[2]s(Value)) AS Value
+  FROM (%[3]s)
+  ARRAY JOIN times AS Time, values AS Value
+  GROUP BY Key, Time
+ )
+ GROUP BY Key
+)
+FORMAT RowBinary`
+
+// pushDown is the target with the aggregating function, which is applied by ClickHouse
+type pushDown struct {
+	*seriesAggregation
+	target string
+	// key prefixes the names of the result series, it's unique for the request
+	key string
+	// agg is the rollup aggregation, it must be the same for all metrics of the target
+	agg     string
+	invalid bool
+	body    strings.Builder
+}
+
+// keyExpr returns ClickHouse expression for the result series names
+func (p *pushDown) keyExpr(isReverse bool) string {
+	key := "'" + strings.ReplaceAll(p.key, "\x00", `\0`) + "'"
+	if !p.byNode {
+		return key
+	}
+
+	// arrays in ClickHouse are 1-based, negative index is counted from the end
+	idx := p.node + 1
+	if p.node < 0 {
+		idx = p.node
+	}
+
+	if isReverse {
+		idx = -idx
+	}
+
+	return fmt.Sprintf("concat(%s, splitByChar('.', Path)[%d])", key, idx)
+}
+
+// displayName returns the graphite name of the result series
+func (p *pushDown) displayName(name string) string {
+	if p.byNode {
+		return name[len(p.key):]
+	}
+
+	return p.name + "(" + p.target + ")"
+}
+
+// preparePushDown groups the metrics of the targets with aggregating FilteringFunctions.
+// aggs contains the rollup aggregation for every requested metric.
+// It returns true for metrics, which are requested only by pushed down targets.
+// The target is fetched as is, if its metrics have different rollup aggregations.
+func (c *conditions) preparePushDown(aggs []string) ([]bool, error) {
+	c.pushDowns = nil
+	pushed := make([]bool, len(c.metricsRequested))
+
+	// carbonlink points and the parts of split requests are merged by the metric names
+	if !c.aggregated || carbonlink != nil || c.split != nil {
+		return pushed, nil
+	}
+
+	groups := make(map[string]*pushDown)
+
+	for i := range c.metricsRequested {
+		for _, a := range c.AM.Get(c.metricsUnreverse[i]) {
+			p, ok := groups[a.Target]
+			if !ok {
+				sa, err := c.getSeriesAggregation(a.Target)
+				if err != nil {
+					return nil, fmt.Errorf("failed to push down functions for '%s': %w", a.Target, err)
+				}
+
+				if sa != nil {
+					p = &pushDown{seriesAggregation: sa, target: a.Target, agg: aggs[i]}
+				}
+
+				// nil is kept for targets without push down
+				groups[a.Target] = p
+			}
+
+			// ClickHouse can't check xFilesFactor or calculate rate of the source metrics in the aggregating query
+			if p != nil && (p.agg != aggs[i] || aggs[i] == rollup.RateFunction || c.xFilesFactors[c.metricsUnreverse[i]] > 0) {
+				p.invalid = true
+			}
+		}
+	}
+
+	for target, p := range groups {
+		if p == nil || p.invalid {
+			continue
+		}
+
+		c.pushDowns = append(c.pushDowns, p)
+		c.appliedFunctions[target] = append(c.appliedFunctions[target], p.name)
+	}
+
+	if len(c.pushDowns) == 0 {
+		return pushed, nil
+	}
+
+	sort.Slice(c.pushDowns, func(i, j int) bool { return c.pushDowns[i].target < c.pushDowns[j].target })
+
+	for n, p := range c.pushDowns {
+		p.key = "\x00" + strconv.Itoa(n) + "\x00"
+	}
+
+	for i := range c.metricsRequested {
+		aliases := c.AM.Get(c.metricsUnreverse[i])
+		pushed[i] = len(aliases) != 0
+
+		for _, a := range aliases {
+			p := groups[a.Target]
+			if p == nil || p.invalid {
+				pushed[i] = false
+				continue
+			}
+
+			p.body.WriteString(c.metricsRequested[i] + "\n")
+		}
+	}
+
+	return pushed, nil
+}
+
+func (c *conditions) generateQueryPushDown(p *pushDown) string {
+	aggregated := fmt.Sprintf(
+		queryAggregatedBody,
+		c.from, c.until, c.step, c.resample(p.agg),
+		c.pointsTable, c.prewhere, c.where,
+	)
+
+	return fmt.Sprintf(queryPushDown, p.keyExpr(c.isReverse), p.function, aggregated)
+}
+
+// pushDownAliases returns the aliases map for the response, where the metrics of pushed down targets are replaced by
+// the aggregated series. The aggregated series are added to c.aggregations too.
+func (c *conditions) pushDownAliases(pp *point.Points) *alias.Map {
+	if len(c.pushDowns) == 0 {
+		return c.AM
+	}
+
+	byTarget := make(map[string]*pushDown, len(c.pushDowns))
+	byKey := make(map[string]*pushDown, len(c.pushDowns))
+
+	for _, p := range c.pushDowns {
+		byTarget[p.target] = p
+		byKey[p.key] = p
+	}
+
+	am := alias.New()
+
+	for _, m := range c.AM.Series(false) {
+		for _, a := range c.AM.Get(m) {
+			if byTarget[a.Target] == nil {
+				am.Append(m, a)
+			}
+		}
+	}
+
+	for id := uint32(1); ; id++ {
+		name := pp.MetricName(id)
+		if name == "" {
+			break
+		}
+
+		if name[0] != 0 {
+			continue
+		}
+
+		end := strings.IndexByte(name[1:], 0)
+		if end < 0 {
+			continue
+		}
+
+		p := byKey[name[:end+2]]
+		if p == nil {
+			continue
+		}
+
+		am.Append(name, alias.Value{Target: p.target, DisplayName: p.displayName(name)})
+		c.aggregations[p.agg] = append(c.aggregations[p.agg], name)
+	}
+
+	return am
+}
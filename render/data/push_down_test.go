@@ -0,0 +1,266 @@
+package data
+
+import (
+	"sort"
+	"testing"
+
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/date"
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/helper/rollup"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+func TestGetSeriesAggregation(t *testing.T) {
+	tests := []struct {
+		name    string
+		ff      []*v3pb.FilteringFunction
+		want    *seriesAggregation
+		wantErr bool
+	}{
+		{name: "none"},
+		{
+			name: "consolidateBy",
+			ff:   []*v3pb.FilteringFunction{{Name: "consolidateBy", Arguments: []string{"sum"}}},
+		},
+		{
+			name: "sumSeries with consolidateBy",
+			ff: []*v3pb.FilteringFunction{
+				{Name: "consolidateBy", Arguments: []string{"sum"}},
+				{Name: "sumSeries"},
+			},
+			want: &seriesAggregation{name: "sumSeries", function: "sum"},
+		},
+		{
+			name: "maxSeries",
+			ff:   []*v3pb.FilteringFunction{{Name: "maxSeries"}},
+			want: &seriesAggregation{name: "maxSeries", function: "max"},
+		},
+		{
+			name: "groupByNode default callback",
+			ff:   []*v3pb.FilteringFunction{{Name: "groupByNode", Arguments: []string{"1"}}},
+			want: &seriesAggregation{name: "groupByNode", function: "avg", byNode: true, node: 1},
+		},
+		{
+			name: "groupByNode",
+			ff:   []*v3pb.FilteringFunction{{Name: "groupByNode", Arguments: []string{"-2", "total"}}},
+			want: &seriesAggregation{name: "groupByNode", function: "sum", byNode: true, node: -2},
+		},
+		{
+			name: "groupByNode by tag",
+			ff:   []*v3pb.FilteringFunction{{Name: "groupByNode", Arguments: []string{"dc", "sum"}}},
+		},
+		{
+			name: "groupByNode unsupported callback",
+			ff:   []*v3pb.FilteringFunction{{Name: "groupByNode", Arguments: []string{"1", "median"}}},
+		},
+		{
+			name:    "groupByNode without arguments",
+			ff:      []*v3pb.FilteringFunction{{Name: "groupByNode"}},
+			wantErr: true,
+		},
+		{
+			name: "several functions",
+			ff:   []*v3pb.FilteringFunction{{Name: "sumSeries"}, {Name: "scale", Arguments: []string{"2"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := NewTargets([]string{"a.*.b"}, alias.New())
+			if tt.ff != nil {
+				targets.SetFilteringFunctions("a.*.b", tt.ff)
+			}
+
+			got, err := targets.getSeriesAggregation("a.*.b")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func newPushDownCondition(aggregated bool, ff ...*v3pb.FilteringFunction) *conditions {
+	cond := newCondition(5400, 1800, 5)
+	cond.aggregated = aggregated
+	cond.SetFilteringFunctions("*.name.*", ff)
+	cond.prepareMetricsLists()
+	sort.Strings(cond.metricsLookup)
+	sort.Strings(cond.metricsRequested)
+	sort.Strings(cond.metricsUnreverse)
+
+	return cond
+}
+
+func TestPreparePushDown(t *testing.T) {
+	metrics := "10_min.name.any\n1_min.name.avg\n5_min.name.min\n5_sec.name.max\n"
+
+	t.Run("same rollup aggregation", func(t *testing.T) {
+		cond := newPushDownCondition(true,
+			&v3pb.FilteringFunction{Name: "consolidateBy", Arguments: []string{"sum"}},
+			&v3pb.FilteringFunction{Name: "sumSeries"},
+		)
+		require.NoError(t, cond.prepareLookup())
+
+		assert.Empty(t, cond.extDataBodies)
+		require.Len(t, cond.pushDowns, 1)
+		assert.Equal(t, "*.name.*", cond.pushDowns[0].target)
+		assert.Equal(t, "sum", cond.pushDowns[0].agg)
+		assert.Equal(t, "\x000\x00", cond.pushDowns[0].key)
+		assert.Equal(t, metrics, cond.pushDowns[0].body.String())
+		assert.Equal(t, map[string][]string{"*.name.*": {"consolidateBy", "sumSeries"}}, cond.appliedFunctions)
+	})
+
+	t.Run("different rollup aggregations", func(t *testing.T) {
+		cond := newPushDownCondition(true, &v3pb.FilteringFunction{Name: "sumSeries"})
+		require.NoError(t, cond.prepareLookup())
+
+		assert.Empty(t, cond.pushDowns)
+		assert.Empty(t, cond.appliedFunctions)
+		assert.Equal(t, map[string]string{
+			"avg": "10_min.name.any\n1_min.name.avg\n",
+			"max": "5_sec.name.max\n",
+			"min": "5_min.name.min\n",
+		}, extTableString(cond.extDataBodies))
+	})
+
+	t.Run("non-aggregated", func(t *testing.T) {
+		cond := newPushDownCondition(false,
+			&v3pb.FilteringFunction{Name: "consolidateBy", Arguments: []string{"sum"}},
+			&v3pb.FilteringFunction{Name: "sumSeries"},
+		)
+		require.NoError(t, cond.prepareLookup())
+
+		assert.Empty(t, cond.pushDowns)
+		assert.Equal(t, map[string]string{"": metrics}, extTableString(cond.extDataBodies))
+	})
+
+	t.Run("xFilesFactor", func(t *testing.T) {
+		cond := newPushDownCondition(true,
+			&v3pb.FilteringFunction{Name: "consolidateBy", Arguments: []string{"sum"}},
+			&v3pb.FilteringFunction{Name: "sumSeries"},
+		)
+		xff := float32(0.5)
+		rules, err := rollup.NewMockRules([]rollup.Pattern{{Regexp: "^5_sec[.]", XFilesFactor: &xff}}, 30, "avg")
+		require.NoError(t, err)
+
+		cond.rollupRules = rules
+		require.NoError(t, cond.prepareLookup())
+
+		assert.Empty(t, cond.pushDowns)
+		assert.Equal(t, map[string][]string{"*.name.*": {"consolidateBy"}}, cond.appliedFunctions)
+	})
+
+	t.Run("metrics of several targets", func(t *testing.T) {
+		cond := newPushDownCondition(true,
+			&v3pb.FilteringFunction{Name: "consolidateBy", Arguments: []string{"sum"}},
+			&v3pb.FilteringFunction{Name: "groupByNode", Arguments: []string{"0", "sum"}},
+		)
+		cond.AM.MergeTarget(finderResult, "5_sec.name.max", false)
+		require.NoError(t, cond.prepareLookup())
+
+		require.Len(t, cond.pushDowns, 1)
+		assert.Equal(t, metrics, cond.pushDowns[0].body.String())
+		// all metrics are fetched as is for the second target, consolidateBy is taken from the first one
+		assert.Equal(t, map[string]string{"sum": metrics}, extTableString(cond.extDataBodies))
+	})
+}
+
+func TestGenerateQueryPushDown(t *testing.T) {
+	cond := &conditions{
+		Targets: &Targets{},
+		from:    11111,
+		until:   33333,
+		step:    11111,
+	}
+	cond.pointsTable = "graphite.table"
+	cond.setPrewhere()
+	cond.setWhere()
+
+	p := &pushDown{seriesAggregation: &seriesAggregation{name: "sumSeries", function: "sum"}, key: "\x001\x00", agg: "max"}
+
+	assert.Equal(t,
+		"SELECT Key AS Path,\n"+
+			" arrayMap(p->p.1, points) AS times,\n"+
+			" arrayMap(p->p.2, points) AS values\n"+
+			"FROM (\n"+
+			" SELECT Key, arraySort(p->p.1, groupArray((Time, Value))) AS points\n"+
+			" FROM (\n"+
+			"  SELECT '\\01\\0' AS Key, Time, toFloat64(sum(Value)) AS Value\n"+
+			"  FROM (WITH anyResample(11111, 33333, 11111)(toUInt32(intDiv(Time, 11111)*11111), Time) AS mask\n"+
+			"SELECT Path,\n arrayFilter(m->m!=0, mask) AS times,\n"+
+			" arrayFilter((v,m)->m!=0, maxResample(11111, 33333, 11111)(Value, Time), mask) AS values\n"+
+			"FROM graphite.table\n"+
+			"PREWHERE Date >= '"+date.FromTimestampToDaysFormat(11111)+"' AND Date <= '"+date.UntilTimestampToDaysFormat(33333)+"'\n"+
+			"WHERE (Path in metrics_list) AND (Time >= 11111 AND Time <= 33333)\n"+
+			"GROUP BY Path)\n"+
+			"  ARRAY JOIN times AS Time, values AS Value\n"+
+			"  GROUP BY Key, Time\n"+
+			" )\n"+
+			" GROUP BY Key\n"+
+			")\n"+
+			"FORMAT RowBinary",
+		cond.generateQueryPushDown(p),
+	)
+
+	tests := []struct {
+		node      int
+		isReverse bool
+		want      string
+	}{
+		{1, false, `concat('\01\0', splitByChar('.', Path)[2])`},
+		{-1, false, `concat('\01\0', splitByChar('.', Path)[-1])`},
+		{0, true, `concat('\01\0', splitByChar('.', Path)[-1])`},
+		{-2, true, `concat('\01\0', splitByChar('.', Path)[2])`},
+	}
+
+	for _, tt := range tests {
+		p := &pushDown{seriesAggregation: &seriesAggregation{name: "groupByNode", byNode: true, node: tt.node}, key: "\x001\x00"}
+		assert.Equal(t, tt.want, p.keyExpr(tt.isReverse), "node %d, reverse %v", tt.node, tt.isReverse)
+	}
+}
+
+func TestPushDownAliases(t *testing.T) {
+	am := alias.New()
+	am.Append("a.b.c", alias.Value{Target: "a.*.c", DisplayName: "a.b.c"})
+	am.Append("a.b.c", alias.Value{Target: "a.b.*", DisplayName: "a.b.c"})
+	am.Append("a.b.d", alias.Value{Target: "a.b.*", DisplayName: "a.b.d"})
+
+	cond := &conditions{
+		Targets:      NewTargets([]string{"a.*.c", "a.b.*"}, am),
+		aggregations: map[string][]string{"avg": {"a.b.c", "a.b.d"}},
+		pushDowns: []*pushDown{
+			{seriesAggregation: &seriesAggregation{name: "sumSeries", function: "sum"}, target: "a.*.c", key: "\x000\x00", agg: "avg"},
+		},
+	}
+
+	pp := point.NewPoints()
+	pp.MetricID("a.b.c")
+	pp.MetricID("\x000\x00")
+
+	got := cond.pushDownAliases(pp)
+	assert.Equal(t, []alias.Value{{Target: "a.b.*", DisplayName: "a.b.c"}}, got.Get("a.b.c"))
+	assert.Equal(t, []alias.Value{{Target: "a.b.*", DisplayName: "a.b.d"}}, got.Get("a.b.d"))
+	assert.Equal(t, []alias.Value{{Target: "a.*.c", DisplayName: "sumSeries(a.*.c)"}}, got.Get("\x000\x00"))
+	assert.Equal(t, map[string][]string{"avg": {"a.b.c", "a.b.d", "\x000\x00"}}, cond.aggregations)
+
+	cond.pushDowns = []*pushDown{
+		{seriesAggregation: &seriesAggregation{name: "groupByNode", function: "sum", byNode: true, node: 1}, target: "a.b.*", key: "\x000\x00", agg: "avg"},
+	}
+	cond.aggregations = map[string][]string{}
+
+	pp = point.NewPoints()
+	pp.MetricID("\x000\x00b")
+
+	got = cond.pushDownAliases(pp)
+	assert.Equal(t, []alias.Value{{Target: "a.*.c", DisplayName: "a.b.c"}}, got.Get("a.b.c"))
+	assert.Nil(t, got.Get("a.b.d"))
+	assert.Equal(t, []alias.Value{{Target: "a.b.*", DisplayName: "b"}}, got.Get("\x000\x00b"))
+}
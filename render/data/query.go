@@ -25,22 +25,83 @@ import (
 	"github.com/lomik/graphite-clickhouse/pkg/where"
 )
 
-// from, until, step, function, table, prewhere, where
+// from, until, step, values, table, prewhere, where
 // arrayFilter(x->isNotNull(x)) - do not pass nulls to client
 // -Resample - group time and values by time intervals and apply aggregation function
 // -OrNull - if there aren't points in an interval, null will be returned
 // intDiv(Time, x)*x - round Time down to step multiplier
 // TODO: support custom aggregating functions
-const queryAggregated = `WITH anyResample(%[1]d, %[2]d, %[3]d)(toUInt32(intDiv(Time, %[3]d)*%[3]d), Time) AS mask
+const queryAggregatedBody = `WITH anyResample(%[1]d, %[2]d, %[3]d)(toUInt32(intDiv(Time, %[3]d)*%[3]d), Time) AS mask
 SELECT Path,
  arrayFilter(m->m!=0, mask) AS times,
- arrayFilter((v,m)->m!=0, %[4]sResample(%[1]d, %[2]d, %[3]d)(Value, Time), mask) AS values
+ arrayFilter((v,m)->m!=0, %[4]s, mask) AS values
+FROM %[5]s
+%[6]s
+%[7]s
+GROUP BY Path`
+
+const queryAggregated = queryAggregatedBody + `
+FORMAT RowBinary`
+
+// from, until, step, values, table, prewhere, where, precision, minimal number of points
+// counts - the number of rollup intervals of precision with points in every interval of step
+const queryAggregatedXFilesFactor = `WITH anyResample(%[1]d, %[2]d, %[3]d)(toUInt32(intDiv(Time, %[3]d)*%[3]d), Time) AS mask,
+ uniqExactResample(%[1]d, %[2]d, %[3]d)(intDiv(Time, %[8]d), Time) AS counts
+SELECT Path,
+ arrayFilter((m,c)->m!=0 AND c>=%[9]d, mask, counts) AS times,
+ arrayFilter((v,m,c)->m!=0 AND c>=%[9]d, %[4]s, mask, counts) AS values
 FROM %[5]s
 %[6]s
 %[7]s
 GROUP BY Path
 FORMAT RowBinary`
 
+// step, table, prewhere, where, filter of increases, filter of intervals
+// Points are deduplicated by the latest Timestamp first. For every point the counter increase and the time since
+// the previous point are calculated, the decreased value means the counter reset, and the value is the increase then.
+// The rate in an interval is the sum of increases divided by the sum of times.
+const queryAggregatedRateBody = `SELECT Path,
+ arrayMap(p->p.1, points) AS times,
+ arrayMap(p->p.2, points) AS values
+FROM (
+ SELECT Path, arraySort(p->p.1, groupArray((Time, Value))) AS points
+ FROM (
+  SELECT Path, toUInt32(intDiv(p.1, %[1]d)*%[1]d) AS Time, sum(p.2)/sum(p.3) AS Value
+  FROM (
+   SELECT Path, arraySort(p->p.1, groupArray((Time, Value))) AS raw,
+    arrayMap(i->(
+     raw[i].1,
+     if(i=1, 0, if(raw[i].2>=raw[i-1].2, raw[i].2-raw[i-1].2, raw[i].2)),
+     if(i=1, 0, raw[i].1-raw[i-1].1)
+    ), arrayEnumerate(raw)) AS increases
+   FROM (
+    SELECT Path, Time, argMax(Value, Timestamp) AS Value
+    FROM %[2]s
+    %[3]s
+    %[4]s
+    GROUP BY Path, Time
+   )
+   GROUP BY Path
+  )
+  ARRAY JOIN increases AS p
+  %[5]s
+ )
+%[6]s GROUP BY Path
+)
+FORMAT RowBinary`
+
+// the points before the first interval are read only for the increase of the first point
+const queryAggregatedRateIntervals = ` WHERE Time >= %d
+`
+
+const queryAggregatedRateFilter = `WHERE p.3 > 0
+  GROUP BY Path, Time`
+
+// precision, minimal number of points
+// The first point has no increase, but it's counted for xFilesFactor, so intervals are filtered after GROUP BY
+const queryAggregatedRateXFilesFactorFilter = `GROUP BY Path, Time
+  HAVING sum(p.3) > 0 AND uniqExact(intDiv(p.1, %d)) >= %d`
+
 // table, prewhere, where
 const queryUnaggregated = `SELECT Path, groupArray(Time), groupArray(Value), groupArray(Timestamp)
 FROM %s
@@ -94,6 +155,25 @@ type conditions struct {
 	metricsUnreverse []string
 	metricsLookup    []string
 	appliedFunctions map[string][]string
+	// targets with aggregating functions, which are applied by ClickHouse
+	pushDowns []*pushDown
+	// metricUnreversed with xFilesFactor from rollup rules
+	xFilesFactors map[string]float32
+	// External-data bodies of aggregated requests for metrics with xFilesFactor
+	xFilesFactorBodies map[xFilesFactorKey]*strings.Builder
+	// downsample is the mode of visual-fidelity downsampling to downsamplePoints, the points are fetched with
+	// the finest step then
+	downsample       string
+	downsamplePoints int64
+	// split is set for the parts of the time frame, which are read from different data tables
+	split *splitGroup
+}
+
+// xFilesFactorKey groups metrics with xFilesFactor by the query parameters
+type xFilesFactorKey struct {
+	agg          string
+	precision    uint32
+	xFilesFactor float32
 }
 
 func newQuery(cfg *config.Config, targets int) *query {
@@ -151,7 +231,13 @@ func (q *query) getDataPoints(ctx context.Context, cond *conditions) error {
 	}
 
 	// carbonlink request
-	carbonlinkResponseRead := queryCarbonlink(ctx, carbonlink, cond.metricsUnreverse)
+	carbonlinkClient := carbonlink
+	if cond.split != nil && !cond.split.isLast(cond.TimeFrame) {
+		// carbonlink has only the newest points
+		carbonlinkClient = nil
+	}
+
+	carbonlinkResponseRead := queryCarbonlink(ctx, carbonlinkClient, cond.metricsUnreverse)
 
 	err = cond.prepareLookup()
 	if err != nil {
@@ -172,13 +258,31 @@ func (q *query) getDataPoints(ctx context.Context, cond *conditions) error {
 	queryContext, queryCancel := context.WithCancel(ctx)
 	defer queryCancel()
 
-	data := prepareData(queryContext, len(cond.extDataBodies), carbonlinkResponseRead)
+	queriesCount := len(cond.extDataBodies) + len(cond.xFilesFactorBodies) + len(cond.pushDowns)
+	data := prepareData(queryContext, queriesCount, cond.carbonlinkXFilesFactor(ctx, carbonlinkResponseRead))
 
 	var ch_read_bytes, ch_read_rows int64
 
+	queries := make([]string, 0, queriesCount)
+	extTableBodies := make([]*strings.Builder, 0, cap(queries))
+
 	for agg, extTableBody := range cond.extDataBodies {
-		extData := q.metricsListExtData(extTableBody)
-		query := cond.generateQuery(agg)
+		queries = append(queries, cond.generateQuery(agg))
+		extTableBodies = append(extTableBodies, extTableBody)
+	}
+
+	for key, extTableBody := range cond.xFilesFactorBodies {
+		queries = append(queries, cond.generateQueryXFilesFactor(key))
+		extTableBodies = append(extTableBodies, extTableBody)
+	}
+
+	for _, p := range cond.pushDowns {
+		queries = append(queries, cond.generateQueryPushDown(p))
+		extTableBodies = append(extTableBodies, &p.body)
+	}
+
+	for i, query := range queries {
+		extData := q.metricsListExtData(extTableBodies[i])
 
 		data.wg.Add(1)
 
@@ -238,8 +342,15 @@ func (q *query) getDataPoints(ctx context.Context, cond *conditions) error {
 	)
 
 	data.setSteps(cond)
+	am := cond.pushDownAliases(data.Points)
 	data.Points.SetAggregations(cond.aggregations)
 
+	// ClickHouse and carbonlinkXFilesFactor have already applied xFilesFactor to aggregated points, so for them it's
+	// set after the rollup
+	if !cond.aggregated {
+		data.Points.SetXFilesFactors(cond.xFilesFactors)
+	}
+
 	// ClickHouse returns sorted and uniq values, when internal aggregation is used
 	// But if carbonlink is used, we still need to sort, filter and rollup points
 	if !cond.aggregated || carbonlink != nil {
@@ -254,10 +365,13 @@ func (q *query) getDataPoints(ctx context.Context, cond *conditions) error {
 
 		rollupStart := time.Now()
 
-		err = cond.rollupRules.RollupPoints(data.Points, cond.From, data.CommonStep)
-		if err != nil {
-			logger.Error("rollup failed", zap.Error(err))
-			return err
+		// the raw points of the split parts are rolled up together after the merge
+		if cond.split == nil || cond.aggregated {
+			err = cond.rollupRules.RollupPoints(data.Points, cond.From, data.CommonStep)
+			if err != nil {
+				logger.Error("rollup failed", zap.Error(err))
+				return err
+			}
 		}
 
 		rollupTime := time.Since(rollupStart)
@@ -268,15 +382,33 @@ func (q *query) getDataPoints(ctx context.Context, cond *conditions) error {
 		)
 	}
 
-	data.AM = cond.AM
+	if cond.aggregated {
+		data.Points.SetXFilesFactors(cond.xFilesFactors)
+	}
 
-	q.appendReply(CHResponse{
+	if cond.downsample != "" {
+		err = data.downsample(cond)
+		if err != nil {
+			logger.Error("downsample failed", zap.Error(err))
+			return err
+		}
+	}
+
+	data.AM = am
+
+	reply := CHResponse{
 		Data:                 data.Data,
 		From:                 cond.From,
 		Until:                cond.Until,
 		AppendOutEmptySeries: cond.appendEmptySeries,
 		AppliedFunctions:     cond.appliedFunctions,
-	})
+	}
+
+	if cond.split != nil {
+		cond.split.add(reply)
+	} else {
+		q.appendReply(reply)
+	}
 
 	return nil
 }
@@ -321,10 +453,24 @@ func (c *conditions) prepareLookup() error {
 	c.appliedFunctions = make(map[string][]string)
 	c.extDataBodies = make(map[string]*strings.Builder)
 	c.steps = make(map[uint32][]string)
+	c.xFilesFactors = make(map[string]float32)
+	c.xFilesFactorBodies = make(map[xFilesFactorKey]*strings.Builder)
 	aggName := ""
+	aggs := make([]string, len(c.metricsRequested))
+	precisions := make([]uint32, len(c.metricsRequested))
 
 	for i := range c.metricsRequested {
 		step, agg, _, _ := c.rollupRules.Lookup(c.metricsLookup[i], age, false)
+		if c.precision != 0 {
+			// the intervals of the pre-aggregated table must not be split
+			step = uint32(dry.CeilToMultiplier(int64(step), int64(c.precision)))
+		}
+
+		precisions[i] = step
+
+		if xff := c.rollupRules.LookupXFilesFactor(c.metricsLookup[i]); xff > 0 {
+			c.xFilesFactors[c.metricsUnreverse[i]] = xff
+		}
 
 		// Override agregation with an argument of consolidateBy function.
 		// consolidateBy with its argument is passed through FilteringFunctions field of carbonapi_v3_pb protocol.
@@ -360,9 +506,41 @@ func (c *conditions) prepareLookup() error {
 			c.aggregations[agg.Name()] = []string{c.metricsUnreverse[i]}
 		}
 
+		aggs[i] = agg.Name()
+	}
+
+	pushed, err := c.preparePushDown(aggs)
+	if err != nil {
+		return err
+	}
+
+	if c.downsample != "" {
+		for _, target := range c.List {
+			if mode, _ := c.requestedDownsampling(target); mode != "" {
+				c.appliedFunctions[target] = append(c.appliedFunctions[target], graphiteDownsampleFunction)
+			}
+		}
+	}
+
+	for i := range c.metricsRequested {
+		if pushed[i] {
+			continue
+		}
+
 		// Build external-data bodies. For non-aggregated requests there is only one request
 		if c.aggregated {
-			aggName = agg.Name()
+			aggName = aggs[i]
+
+			if xff := c.xFilesFactors[c.metricsUnreverse[i]]; xff > 0 {
+				key := xFilesFactorKey{agg: aggName, precision: precisions[i], xFilesFactor: xff}
+				if _, ok := c.xFilesFactorBodies[key]; !ok {
+					c.xFilesFactorBodies[key] = &strings.Builder{}
+				}
+
+				c.xFilesFactorBodies[key].WriteString(c.metricsRequested[i] + "\n")
+
+				continue
+			}
 		}
 
 		if mm, ok := c.extDataBodies[aggName]; ok {
@@ -408,7 +586,13 @@ func (c *conditions) setStep(cStep *commonStep) {
 		return
 	}
 
-	step = dry.Max(rStep, dry.Ceil(c.Until-c.From, c.MaxDataPoints))
+	interval := c.Until - c.From
+	if c.split != nil {
+		// the parts must have the same step as the whole time frame
+		interval = c.split.frame.Until - c.split.frame.From
+	}
+
+	step = dry.Max(rStep, dry.Ceil(interval, c.MaxDataPoints))
 	c.step = dry.CeilToMultiplier(step, rStep)
 
 	return
@@ -417,6 +601,18 @@ func (c *conditions) setStep(cStep *commonStep) {
 func (c *conditions) setFromUntil() {
 	c.from = dry.CeilToMultiplier(c.From, c.step)
 	c.until = dry.FloorToMultiplier(c.Until, c.step) + c.step - 1
+
+	// The parts of aggregated requests have the same step, so every interval is read from one table. The raw points
+	// of not aggregated requests are rolled up with the steps of the oldest part, the border is aligned to all of them.
+	if c.split != nil && !c.aggregated {
+		if !c.split.isFirst(c.TimeFrame) {
+			c.from = dry.CeilToMultiplier(c.From, c.split.step)
+		}
+
+		if !c.split.isLast(c.TimeFrame) {
+			c.until = dry.CeilToMultiplier(c.Until+1, c.split.step) - 1
+		}
+	}
 }
 
 func (c *conditions) setPrewhere() {
@@ -432,6 +628,25 @@ func (c *conditions) setWhere() {
 	c.where = wr.SQL()
 }
 
+// rateConditions returns prewhere, where and the filter of intervals for the rate query. The split parts, except the
+// oldest one, read the points of the previous interval too, so the increase on the border of parts isn't lost.
+func (c *conditions) rateConditions() (string, string, string) {
+	if c.split == nil || c.split.isFirst(c.TimeFrame) {
+		return c.prewhere, c.where, ""
+	}
+
+	from := c.from - c.step
+
+	pw := where.New()
+	pw.And(where.DateBetween("Date", from, c.until))
+
+	wr := where.New()
+	wr.And(where.InTable("Path", extTableName))
+	wr.And(where.TimestampBetween("Time", from, c.until))
+
+	return pw.PreWhereSQL(), wr.SQL(), fmt.Sprintf(queryAggregatedRateIntervals, c.from)
+}
+
 func (c *conditions) generateQuery(agg string) string {
 	if c.aggregated {
 		return c.generateQueryaAggregated(agg)
@@ -441,10 +656,61 @@ func (c *conditions) generateQuery(agg string) string {
 }
 
 func (c *conditions) generateQueryaAggregated(agg string) string {
+	if agg == rollup.RateFunction {
+		pw, wr, intervals := c.rateConditions()
+		return fmt.Sprintf(queryAggregatedRateBody, c.step, c.pointsTable, pw, wr, queryAggregatedRateFilter, intervals)
+	}
+
 	return fmt.Sprintf(
 		queryAggregated,
-		c.from, c.until, c.step, agg,
+		c.from, c.until, c.step, c.resample(agg),
+		c.pointsTable, c.prewhere, c.where,
+	)
+}
+
+// resample returns the expression with the array of values aggregated by the function in the intervals of step.
+// The aggregates of the pre-aggregated table are aggregated again, avg is calculated from sum and count.
+func (c *conditions) resample(agg string) string {
+	resample := fmt.Sprintf("Resample(%d, %d, %d)", c.from, c.until, c.step)
+
+	if c.aggregates == nil {
+		return agg + resample + "(Value, Time)"
+	}
+
+	switch agg {
+	case "avg":
+		return fmt.Sprintf(
+			"arrayMap((s,n)->s/n, sum%[1]s(%[2]s, Time), sum%[1]s(%[3]s, Time))",
+			resample, c.aggregates["sum"], c.aggregates["count"],
+		)
+	default:
+		return agg + resample + "(" + c.aggregates[agg] + ", Time)"
+	}
+}
+
+// generateQueryXFilesFactor returns the aggregated query, which drops the points of intervals with not enough points
+func (c *conditions) generateQueryXFilesFactor(key xFilesFactorKey) string {
+	minPoints := rollup.MinXFilesFactorPoints(uint32(c.step), key.precision, key.xFilesFactor)
+	if minPoints <= 1 {
+		return c.generateQueryaAggregated(key.agg)
+	}
+
+	if key.agg == rollup.RateFunction {
+		pw, wr, intervals := c.rateConditions()
+
+		return fmt.Sprintf(
+			queryAggregatedRateBody,
+			c.step, c.pointsTable, pw, wr,
+			fmt.Sprintf(queryAggregatedRateXFilesFactorFilter, key.precision, minPoints),
+			intervals,
+		)
+	}
+
+	return fmt.Sprintf(
+		queryAggregatedXFilesFactor,
+		c.from, c.until, c.step, c.resample(key.agg),
 		c.pointsTable, c.prewhere, c.where,
+		key.precision, minPoints,
 	)
 }
 
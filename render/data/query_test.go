@@ -1,7 +1,10 @@
 package data
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -9,12 +12,19 @@ import (
 	"time"
 
 	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/lomik/graphite-clickhouse/config"
 	"github.com/lomik/graphite-clickhouse/finder"
 	"github.com/lomik/graphite-clickhouse/helper/date"
+	"github.com/lomik/graphite-clickhouse/helper/point"
 	"github.com/lomik/graphite-clickhouse/helper/rollup"
+	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+	"github.com/lomik/graphite-clickhouse/limiter"
 	"github.com/lomik/graphite-clickhouse/pkg/alias"
 	"github.com/lomik/graphite-clickhouse/pkg/reverse"
+	graphitePickle "github.com/lomik/graphite-pickle"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func genPattern(regexp, function string, retention []rollup.Retention) rollup.Pattern {
@@ -574,3 +584,243 @@ func TestGenerateQuery(t *testing.T) {
 		})
 	}
 }
+
+func TestXFilesFactor(t *testing.T) {
+	xff := float32(0.5)
+	pattern := []rollup.Pattern{
+		{Regexp: "^5_sec[.]", Retention: []rollup.Retention{{Age: 0, Precision: 5}}, XFilesFactor: &xff},
+		{Regexp: "^1_min[.]", Function: "sum", Retention: []rollup.Retention{{Age: 0, Precision: 60}}},
+	}
+	rules, err := rollup.NewMockRules(pattern, 30, "avg")
+	assert.NoError(t, err)
+
+	cond := newCondition(1800, 0, 5)
+	cond.rollupRules = rules
+	cond.aggregated = true
+	cond.prepareMetricsLists()
+	sort.Strings(cond.metricsLookup)
+	sort.Strings(cond.metricsRequested)
+	sort.Strings(cond.metricsUnreverse)
+	assert.NoError(t, cond.prepareLookup())
+
+	assert.Equal(t, map[string]float32{"5_sec.name.max": 0.5}, cond.xFilesFactors)
+	assert.Equal(t, map[string]string{"sum": "1_min.name.avg\n", "avg": "10_min.name.any\n5_min.name.min\n"}, extTableString(cond.extDataBodies))
+
+	key := xFilesFactorKey{agg: "avg", precision: 5, xFilesFactor: 0.5}
+	assert.Len(t, cond.xFilesFactorBodies, 1)
+	assert.Equal(t, "5_sec.name.max\n", cond.xFilesFactorBodies[key].String())
+
+	cond.from, cond.until, cond.step = 600, 1799, 600
+	cond.pointsTable = "graphite.table"
+	cond.setPrewhere()
+	cond.setWhere()
+	assert.Equal(t,
+		"WITH anyResample(600, 1799, 600)(toUInt32(intDiv(Time, 600)*600), Time) AS mask,\n"+
+			" uniqExactResample(600, 1799, 600)(intDiv(Time, 5), Time) AS counts\n"+
+			"SELECT Path,\n arrayFilter((m,c)->m!=0 AND c>=60, mask, counts) AS times,\n"+
+			" arrayFilter((v,m,c)->m!=0 AND c>=60, avgResample(600, 1799, 600)(Value, Time), mask, counts) AS values\n"+
+			"FROM graphite.table\n"+
+			"PREWHERE Date >= '"+date.FromTimestampToDaysFormat(600)+"' AND Date <= '"+date.UntilTimestampToDaysFormat(1799)+"'\n"+
+			"WHERE (Path in metrics_list) AND (Time >= 600 AND Time <= 1799)\n"+
+			"GROUP BY Path\n"+
+			"FORMAT RowBinary",
+		cond.generateQueryXFilesFactor(key),
+	)
+
+	// every point is enough for the interval of precision
+	cond.step = 5
+	assert.Equal(t, cond.generateQueryaAggregated("avg"), cond.generateQueryXFilesFactor(key))
+}
+
+func TestGenerateQueryRate(t *testing.T) {
+	cond := &conditions{
+		Targets:    &Targets{},
+		aggregated: true,
+		from:       600,
+		until:      1799,
+		step:       600,
+	}
+	cond.pointsTable = "graphite.table"
+	cond.setPrewhere()
+	cond.setWhere()
+
+	assert.Equal(t,
+		"SELECT Path,\n"+
+			" arrayMap(p->p.1, points) AS times,\n"+
+			" arrayMap(p->p.2, points) AS values\n"+
+			"FROM (\n"+
+			" SELECT Path, arraySort(p->p.1, groupArray((Time, Value))) AS points\n"+
+			" FROM (\n"+
+			"  SELECT Path, toUInt32(intDiv(p.1, 600)*600) AS Time, sum(p.2)/sum(p.3) AS Value\n"+
+			"  FROM (\n"+
+			"   SELECT Path, arraySort(p->p.1, groupArray((Time, Value))) AS raw,\n"+
+			"    arrayMap(i->(\n"+
+			"     raw[i].1,\n"+
+			"     if(i=1, 0, if(raw[i].2>=raw[i-1].2, raw[i].2-raw[i-1].2, raw[i].2)),\n"+
+			"     if(i=1, 0, raw[i].1-raw[i-1].1)\n"+
+			"    ), arrayEnumerate(raw)) AS increases\n"+
+			"   FROM (\n"+
+			"    SELECT Path, Time, argMax(Value, Timestamp) AS Value\n"+
+			"    FROM graphite.table\n"+
+			"    PREWHERE Date >= '"+date.FromTimestampToDaysFormat(600)+"' AND Date <= '"+date.UntilTimestampToDaysFormat(1799)+"'\n"+
+			"    WHERE (Path in metrics_list) AND (Time >= 600 AND Time <= 1799)\n"+
+			"    GROUP BY Path, Time\n"+
+			"   )\n"+
+			"   GROUP BY Path\n"+
+			"  )\n"+
+			"  ARRAY JOIN increases AS p\n"+
+			"  WHERE p.3 > 0\n"+
+			"  GROUP BY Path, Time\n"+
+			" )\n"+
+			" GROUP BY Path\n"+
+			")\n"+
+			"FORMAT RowBinary",
+		cond.generateQuery(rollup.RateFunction),
+	)
+
+	// xFilesFactor counts the rollup intervals with points, including the first point without increase
+	xffQuery := cond.generateQueryXFilesFactor(xFilesFactorKey{agg: rollup.RateFunction, precision: 60, xFilesFactor: 0.5})
+	assert.Contains(t, xffQuery,
+		"  ARRAY JOIN increases AS p\n"+
+			"  GROUP BY Path, Time\n"+
+			"  HAVING sum(p.3) > 0 AND uniqExact(intDiv(p.1, 60)) >= 5\n"+
+			" )\n",
+	)
+
+	d := &Data{Points: point.NewPoints()}
+	id := d.Points.MetricID("counter")
+	d.Points.SetAggregations(map[string][]string{rollup.RateFunction: {"counter"}})
+
+	function, err := d.GetAggregation(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "avg", function)
+}
+
+func TestGetDataPointsXFilesFactor(t *testing.T) {
+	srv := chtest.NewFakeServer()
+	defer srv.Close()
+
+	rollupConf := filepath.Join(t.TempDir(), "rollup.xml")
+	require.NoError(t, os.WriteFile(rollupConf, []byte(`<graphite_rollup>
+	<default>
+		<function>sum</function>
+		<xFilesFactor>0.5</xFilesFactor>
+		<retention><age>0</age><precision>10</precision></retention>
+	</default>
+</graphite_rollup>`), 0o644))
+
+	cfg, _, err := config.Unmarshal([]byte(fmt.Sprintf(`
+[clickhouse]
+url = "%s"
+internal-aggregation = true
+
+[[data-table]]
+table = "graphite"
+rollup-conf = "%s"
+`, srv.URL, rollupConf)), false)
+	require.NoError(t, err)
+
+	from := time.Now().Truncate(time.Minute).Add(-10 * time.Minute).Unix()
+	// 3 of 6 intervals of the precision have points in ClickHouse
+	require.NoError(t, srv.AddPoints("graphite", "a.b",
+		point.Point{Time: uint32(from), Value: 1, Timestamp: uint32(from)},
+		point.Point{Time: uint32(from + 10), Value: 2, Timestamp: uint32(from + 10)},
+		point.Point{Time: uint32(from + 20), Value: 3, Timestamp: uint32(from + 20)},
+	))
+
+	cache := new(carbonlinkMocked)
+	cache.On("CacheQueryMulti", mock.Anything, []string{"a.b"}).Return(map[string][]graphitePickle.DataPoint{
+		"a.b": {
+			// 3 of 6 intervals of the precision have points in carbonlink
+			{Timestamp: from + 120, Value: 4},
+			{Timestamp: from + 130, Value: 5},
+			{Timestamp: from + 140, Value: 6},
+			// only one interval has points
+			{Timestamp: from + 180, Value: 7},
+		},
+	}, nil)
+
+	carbonlink = &carbonlinkClient{cache, time.Second}
+	defer func() { carbonlink = nil }()
+
+	am := alias.New()
+	am.Append("a.b", alias.Value{Target: "a.b", DisplayName: "a.b"})
+
+	m := MultiTarget{
+		TimeFrame{From: from, Until: from + 599, MaxDataPoints: 10}: NewTargets([]string{"a.b"}, am),
+	}
+
+	var queueDuration time.Duration
+
+	reply, err := m.Fetch(context.Background(), cfg, config.ContextGraphite, limiter.NoopLimiter{}, &queueDuration)
+	require.NoError(t, err)
+	require.Len(t, reply, 1)
+	assert.Equal(t, int64(60), reply[0].Data.CommonStep)
+	assert.Equal(t, float32(0.5), reply[0].Data.Points.GetXFilesFactor(1))
+
+	values := make(map[uint32]float64)
+	for _, p := range reply[0].Data.Points.List() {
+		values[p.Time] = p.Value
+	}
+
+	assert.Equal(t, map[uint32]float64{uint32(from): 6, uint32(from + 120): 15}, values)
+}
+
+func TestGetDataPointsRateXFilesFactor(t *testing.T) {
+	srv := chtest.NewFakeServer()
+	defer srv.Close()
+
+	rollupConf := filepath.Join(t.TempDir(), "rollup.xml")
+	require.NoError(t, os.WriteFile(rollupConf, []byte(`<graphite_rollup>
+	<default>
+		<function>rate</function>
+		<xFilesFactor>0.5</xFilesFactor>
+		<retention><age>0</age><precision>10</precision></retention>
+	</default>
+</graphite_rollup>`), 0o644))
+
+	cfg, _, err := config.Unmarshal([]byte(fmt.Sprintf(`
+[clickhouse]
+url = "%s"
+internal-aggregation = true
+
+[[data-table]]
+table = "graphite"
+rollup-conf = "%s"
+`, srv.URL, rollupConf)), false)
+	require.NoError(t, err)
+
+	from := time.Now().Truncate(time.Minute).Add(-10 * time.Minute).Unix()
+	points := make([]point.Point, 0)
+
+	// the interval from+60 has points in 1 of 6 intervals of the precision, its rate is dropped, but the point is used
+	// for the rate of the next interval, as graphite-clickhouse does for carbonlink points
+	for _, p := range []struct {
+		t int64
+		v float64
+	}{{0, 10}, {10, 20}, {20, 30}, {60, 40}, {120, 50}, {130, 60}, {140, 70}} {
+		points = append(points, point.Point{Time: uint32(from + p.t), Value: p.v, Timestamp: uint32(from + p.t)})
+	}
+
+	require.NoError(t, srv.AddPoints("graphite", "a.b", points...))
+
+	am := alias.New()
+	am.Append("a.b", alias.Value{Target: "a.b", DisplayName: "a.b"})
+
+	m := MultiTarget{
+		TimeFrame{From: from, Until: from + 599, MaxDataPoints: 10}: NewTargets([]string{"a.b"}, am),
+	}
+
+	var queueDuration time.Duration
+
+	reply, err := m.Fetch(context.Background(), cfg, config.ContextGraphite, limiter.NoopLimiter{}, &queueDuration)
+	require.NoError(t, err)
+	require.Len(t, reply, 1)
+
+	values := make(map[uint32]float64)
+	for _, p := range reply[0].Data.Points.List() {
+		values[p.Time] = p.Value
+	}
+
+	assert.Equal(t, map[uint32]float64{uint32(from): 1, uint32(from + 120): 0.375}, values)
+}
@@ -0,0 +1,189 @@
+package data
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/helper/rollup"
+	"github.com/lomik/graphite-clickhouse/pkg/dry"
+	"github.com/lomik/graphite-clickhouse/pkg/reverse"
+)
+
+// splitGroup collects the responses for the parts of the time frame, which are read from different data tables
+type splitGroup struct {
+	// frame is the whole time frame of the request
+	frame TimeFrame
+	// step aligns the border of parts for not aggregated requests, it's the LCM of the rollup steps of the oldest part
+	step int64
+	// rollupRules of the oldest part roll up the raw points of not aggregated requests after the merge
+	rollupRules *rollup.Rules
+	mu          sync.Mutex
+	responses   []CHResponse
+}
+
+func (s *splitGroup) add(r CHResponse) {
+	s.mu.Lock()
+	s.responses = append(s.responses, r)
+	s.mu.Unlock()
+}
+
+// isFirst returns true for the part, which starts the time frame of the request
+func (s *splitGroup) isFirst(tf *TimeFrame) bool {
+	return tf.From == s.frame.From
+}
+
+// isLast returns true for the part, which ends the time frame of the request
+func (s *splitGroup) isLast(tf *TimeFrame) bool {
+	return tf.Until == s.frame.Until
+}
+
+// splitDataTables returns the conditions for the parts of the time frame, which should be read from different data
+// tables, see Targets.dataTableParts. The conditions are returned as is, if the data table is the same for the whole
+// time frame.
+func (c *conditions) splitDataTables(cfg *config.Config, context string) ([]*conditions, error) {
+	now := time.Now().Unix()
+
+	tables, parts := c.dataTableParts(cfg, c.TimeFrame, context, now)
+	if len(parts) < 2 {
+		return []*conditions{c}, nil
+	}
+
+	group := &splitGroup{frame: *c.TimeFrame}
+	conds := make([]*conditions, 0, len(parts))
+
+	for i := range parts {
+		targets := *c.Targets
+
+		err := targets.setDataTable(cfg, tables[i], &parts[i], context, now)
+		if err != nil {
+			return nil, err
+		}
+
+		cond := *c
+		cond.TimeFrame = &parts[i]
+		cond.Targets = &targets
+		cond.split = group
+
+		conds = append(conds, &cond)
+	}
+
+	oldest := conds[len(conds)-1].Targets
+	group.rollupRules = oldest.rollupRules
+
+	if !c.aggregated {
+		group.step = oldest.rollupLCM(uint32(dry.Max(0, now-c.From)))
+	}
+
+	return conds, nil
+}
+
+// rollupLCM returns the least common multiple of the rollup steps of the metrics for the age
+func (tt *Targets) rollupLCM(age uint32) int64 {
+	step := int64(1)
+
+	for _, metric := range tt.AM.Series(false) {
+		lookup := metric
+		if tt.isReverse && !tt.rollupUseReverted {
+			lookup = reverse.String(metric)
+		}
+
+		precision, _, _, _ := tt.rollupRules.Lookup(lookup, age, false)
+		if precision > 0 {
+			step = dry.LCM(step, int64(precision))
+		}
+	}
+
+	return step
+}
+
+// merge joins the points of the parts into the response for the whole time frame. Every interval is read from one
+// table, so the aggregated points are only concatenated. The raw points of not aggregated requests are rolled up
+// together by the rules of the oldest part, as the points of one table.
+func (s *splitGroup) merge() (*CHResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.responses) == 0 {
+		return nil, nil
+	}
+
+	pp := point.NewPoints()
+	steps := make(map[string]uint32)
+	aggs := make(map[string]string)
+	xFilesFactors := make(map[string]float32)
+	appliedFunctions := make(map[string][]string)
+	commonStep := s.responses[0].Data.CommonStep
+
+	for _, r := range s.responses {
+		for target, functions := range r.AppliedFunctions {
+			appliedFunctions[target] = functions
+		}
+
+		for _, p := range r.Data.Points.List() {
+			name := r.Data.Points.MetricName(p.MetricID)
+			pp.AppendPoint(pp.MetricID(name), p.Value, p.Time, p.Timestamp)
+
+			if agg, err := r.Data.Points.GetAggregation(p.MetricID); err == nil {
+				aggs[name] = agg
+			}
+
+			if xff := r.Data.Points.GetXFilesFactor(p.MetricID); xff > 0 {
+				xFilesFactors[name] = xff
+			}
+		}
+	}
+
+	pp.Sort()
+
+	if commonStep == 0 {
+		list := make([]point.Point, 0, pp.Len())
+		nextMetric := pp.GroupByMetric()
+
+		for points := nextMetric(); len(points) != 0; points = nextMetric() {
+			id := points[0].MetricID
+			name := pp.MetricName(id)
+
+			points, step, err := s.rollupRules.RollupMetric(name, uint32(s.frame.From), points)
+			if err != nil {
+				return nil, err
+			}
+
+			for i := range points {
+				points[i].MetricID = id
+			}
+
+			steps[name] = step
+			list = append(list, points...)
+		}
+
+		pp.ReplaceList(list)
+	}
+
+	stepMetrics := make(map[uint32][]string)
+	for name, step := range steps {
+		stepMetrics[step] = append(stepMetrics[step], name)
+	}
+
+	aggMetrics := make(map[string][]string)
+	for name, agg := range aggs {
+		aggMetrics[agg] = append(aggMetrics[agg], name)
+	}
+
+	pp.SetSteps(stepMetrics)
+	pp.SetAggregations(aggMetrics)
+	pp.SetXFilesFactors(xFilesFactors)
+
+	return &CHResponse{
+		Data: &Data{
+			Points:     pp,
+			AM:         s.responses[0].Data.AM,
+			CommonStep: commonStep,
+		},
+		From:                 s.frame.From,
+		Until:                s.frame.Until,
+		AppendOutEmptySeries: s.responses[0].AppendOutEmptySeries,
+		AppliedFunctions:     appliedFunctions,
+	}, nil
+}
@@ -0,0 +1,203 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/helper/rollup"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+func TestDataTableParts(t *testing.T) {
+	cfg := config.New()
+	cfg.DataTable = []config.DataTable{
+		{
+			Table:  "first_day",
+			MaxAge: 24 * time.Hour,
+		},
+		{
+			Table:  "second_day",
+			MinAge: 24 * time.Hour,
+			MaxAge: 48 * time.Hour,
+		},
+		{
+			Table:       "short_intervals",
+			MaxInterval: time.Hour,
+		},
+		{
+			Table: "unlimited",
+		},
+	}
+	require.NoError(t, cfg.ProcessDataTables())
+
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	tg := NewTargets([]string{"metric"}, nil)
+
+	tests := []struct {
+		name   string
+		tf     TimeFrame
+		tables []string
+		parts  []TimeFrame
+	}{
+		{
+			name:   "one table",
+			tf:     TimeFrame{From: now - 3600, Until: now, MaxDataPoints: 100},
+			tables: []string{"first_day"},
+			parts:  []TimeFrame{{From: now - 3600, Until: now, MaxDataPoints: 100}},
+		},
+		{
+			name:   "two days",
+			tf:     TimeFrame{From: now - 2*day + 3600, Until: now},
+			tables: []string{"first_day", "second_day"},
+			parts: []TimeFrame{
+				{From: now - day, Until: now},
+				{From: now - 2*day + 3600, Until: now - day - 1},
+			},
+		},
+		{
+			name:   "three days",
+			tf:     TimeFrame{From: now - 3*day, Until: now},
+			tables: []string{"first_day", "second_day", "unlimited"},
+			parts: []TimeFrame{
+				{From: now - day, Until: now},
+				{From: now - 2*day, Until: now - day - 1},
+				{From: now - 3*day, Until: now - 2*day - 1},
+			},
+		},
+		{
+			name:   "old data",
+			tf:     TimeFrame{From: now - 5*day, Until: now - 3*day},
+			tables: []string{"unlimited"},
+			parts:  []TimeFrame{{From: now - 5*day, Until: now - 3*day}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tables, parts := tg.dataTableParts(cfg, &tt.tf, config.ContextGraphite, now)
+
+			names := make([]string, 0, len(tables))
+			for _, table := range tables {
+				names = append(names, table.Table)
+			}
+
+			assert.Equal(t, tt.tables, names)
+			assert.Equal(t, tt.parts, parts)
+		})
+	}
+}
+
+func TestSplitGroupMerge(t *testing.T) {
+	am := alias.New()
+	am.Append("a.b", alias.Value{Target: "a.*", DisplayName: "a.b"})
+
+	response := func(from, until, commonStep int64, step uint32, points ...point.Point) CHResponse {
+		pp := point.NewPoints()
+		for _, p := range points {
+			pp.AppendPoint(pp.MetricID("a.b"), p.Value, p.Time, p.Time)
+		}
+
+		pp.SetSteps(map[uint32][]string{step: {"a.b"}})
+		pp.SetAggregations(map[string][]string{"avg": {"a.b"}})
+
+		return CHResponse{Data: &Data{Points: pp, AM: am, CommonStep: commonStep}, From: from, Until: until}
+	}
+
+	values := func(reply *CHResponse) map[uint32]float64 {
+		result := make(map[uint32]float64)
+		for _, p := range reply.Data.Points.List() {
+			result[p.Time] = p.Value
+		}
+
+		return result
+	}
+
+	t.Run("aggregated", func(t *testing.T) {
+		group := &splitGroup{frame: TimeFrame{From: 0, Until: 1199}}
+		// the border is at 650, the interval 600 is read from the oldest part only
+		group.add(response(650, 1199, 300, 300,
+			point.Point{Time: 900, Value: 3},
+		))
+		group.add(response(0, 649, 300, 300,
+			point.Point{Time: 0, Value: 10},
+			point.Point{Time: 300, Value: 20},
+			point.Point{Time: 600, Value: 30},
+		))
+
+		reply, err := group.merge()
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(0), reply.From)
+		assert.Equal(t, int64(1199), reply.Until)
+		assert.Equal(t, int64(300), reply.Data.CommonStep)
+
+		agg, err := reply.Data.GetAggregation(1)
+		require.NoError(t, err)
+		assert.Equal(t, "avg", agg)
+
+		assert.Equal(t, map[uint32]float64{0: 10, 300: 20, 600: 30, 900: 3}, values(reply))
+	})
+
+	t.Run("not aggregated", func(t *testing.T) {
+		rules, err := rollup.NewMockRules(nil, 300, "avg")
+		require.NoError(t, err)
+
+		group := &splitGroup{frame: TimeFrame{From: 0, Until: 1199}, step: 300, rollupRules: rules}
+		// the raw points of the newest part are rolled up with the step of the oldest one
+		group.add(response(650, 1199, 0, 60,
+			point.Point{Time: 900, Value: 1},
+			point.Point{Time: 960, Value: 2},
+			point.Point{Time: 1020, Value: 6},
+		))
+		group.add(response(0, 649, 0, 300,
+			point.Point{Time: 0, Value: 10},
+			point.Point{Time: 600, Value: 30},
+		))
+
+		reply, err := group.merge()
+		require.NoError(t, err)
+
+		step, err := reply.Data.GetStep(1)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(300), step)
+
+		assert.Equal(t, map[uint32]float64{0: 10, 600: 30, 900: 3}, values(reply))
+	})
+}
+
+func TestSplitBorder(t *testing.T) {
+	group := &splitGroup{frame: TimeFrame{From: 0, Until: 1199}, step: 300}
+	oldest := &TimeFrame{From: 0, Until: 649}
+	newest := &TimeFrame{From: 650, Until: 1199}
+
+	bounds := func(tf *TimeFrame, aggregated bool, step int64) [2]int64 {
+		cond := &conditions{TimeFrame: tf, Targets: &Targets{}, aggregated: aggregated, step: step, split: group}
+		cond.setFromUntil()
+
+		return [2]int64{cond.from, cond.until}
+	}
+
+	// aggregated parts have the same step
+	assert.Equal(t, [2]int64{0, 899}, bounds(oldest, true, 300))
+	assert.Equal(t, [2]int64{900, 1199}, bounds(newest, true, 300))
+
+	// not aggregated parts are aligned to the step of the oldest one
+	assert.Equal(t, [2]int64{0, 899}, bounds(oldest, false, 300))
+	assert.Equal(t, [2]int64{900, 1199}, bounds(newest, false, 60))
+
+	// the rate of the newest part reads the previous interval for the increase of the first point
+	cond := &conditions{TimeFrame: newest, Targets: &Targets{}, aggregated: true, step: 300, split: group}
+	cond.setFromUntil()
+	cond.setPrewhere()
+	cond.setWhere()
+
+	query := cond.generateQuery(rollup.RateFunction)
+	assert.Contains(t, query, "WHERE (Path in metrics_list) AND (Time >= 600 AND Time <= 1199)")
+	assert.Contains(t, query, " )\n WHERE Time >= 900\n GROUP BY Path\n")
+}
@@ -2,6 +2,7 @@ package data
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
 	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
@@ -9,10 +10,22 @@ import (
 	"github.com/lomik/graphite-clickhouse/helper/rollup"
 	"github.com/lomik/graphite-clickhouse/metrics"
 	"github.com/lomik/graphite-clickhouse/pkg/alias"
+	"github.com/lomik/graphite-clickhouse/pkg/dry"
+	"github.com/lomik/graphite-clickhouse/pkg/reverse"
 )
 
 const graphiteConsolidationFunction = "consolidateBy"
 
+// downsample is the filtering function for the visual-fidelity downsampling of maxDataPoints
+const graphiteDownsampleFunction = "downsample"
+
+const (
+	// DownsampleLTTB selects one point per interval with Largest-Triangle-Three-Buckets algorithm
+	DownsampleLTTB = "lttb"
+	// DownsampleMinMax returns min and max points for every two intervals
+	DownsampleMinMax = "minmax"
+)
+
 type FilteringFunctionsByTarget map[string][]*v3pb.FilteringFunction
 type Cache struct {
 	Cached     bool
@@ -37,6 +50,11 @@ type Targets struct {
 	rollupRules                *rollup.Rules
 	rollupUseReverted          bool
 	queryMetrics               *metrics.QueryMetrics
+	// downsample is set for all targets of the request
+	downsample string
+	// precision and aggregates are set for the pre-aggregated table
+	precision  uint32
+	aggregates map[string]string
 }
 
 func NewTargets(list []string, am *alias.Map) *Targets {
@@ -72,63 +90,293 @@ func (tt *Targets) SetFilteringFunctions(target string, filteringFunctions []*v3
 	tt.filteringFunctionsByTarget[target] = filteringFunctions
 }
 
+// SetDownsampling sets the downsampling mode for all targets. The mode should be checked with CheckDownsampling
+func (tt *Targets) SetDownsampling(mode string) {
+	tt.downsample = mode
+}
+
+// CheckDownsampling returns error for unknown downsampling mode
+func CheckDownsampling(mode string) error {
+	switch mode {
+	case DownsampleLTTB, DownsampleMinMax:
+		return nil
+	default:
+		return fmt.Errorf("unknown downsampling mode (allowed modes are: '%s', '%s'): received %s", DownsampleLTTB, DownsampleMinMax, mode)
+	}
+}
+
+// requestedDownsampling returns the mode from the downsample filtering function of the target
+func (tt *Targets) requestedDownsampling(target string) (string, error) {
+	for _, filteringFunc := range tt.filteringFunctionsByTarget[target] {
+		if filteringFunc.GetName() != graphiteDownsampleFunction {
+			continue
+		}
+
+		ffArgs := filteringFunc.GetArguments()
+		if len(ffArgs) < 1 {
+			return "", fmt.Errorf("no arguments were provided to %s function", graphiteDownsampleFunction)
+		}
+
+		if err := CheckDownsampling(ffArgs[0]); err != nil {
+			return "", err
+		}
+
+		return ffArgs[0], nil
+	}
+
+	return "", nil
+}
+
+// getDownsampling returns the downsampling mode for the targets. The points are shared by targets, so the mode from
+// the filtering functions is used only if all targets request the same one.
+func (tt *Targets) getDownsampling() (string, error) {
+	if tt.downsample != "" {
+		return tt.downsample, nil
+	}
+
+	mode := ""
+
+	for i, target := range tt.List {
+		m, err := tt.requestedDownsampling(target)
+		if err != nil {
+			return "", err
+		}
+
+		if i == 0 {
+			mode = m
+		} else if m != mode {
+			mode = ""
+		}
+	}
+
+	return mode, nil
+}
+
+// tableAllowed checks the time frame and targets restrictions of the table. The interval restrictions are checked for
+// the time frame of the request, and the age restrictions for the part of it, which is read from the table.
+func (tt *Targets) tableAllowed(t *config.DataTable, tf, part *TimeFrame, context string, now int64) bool {
+	if !t.ContextMap[context] {
+		return false
+	}
+
+	if t.MaxInterval != 0 && (tf.Until-tf.From) > int64(t.MaxInterval.Seconds()) {
+		return false
+	}
+
+	if t.MinInterval != 0 && (tf.Until-tf.From) < int64(t.MinInterval.Seconds()) {
+		return false
+	}
+
+	if t.MaxAge != 0 && part.From < now-int64(t.MaxAge.Seconds()) {
+		return false
+	}
+
+	if t.MinAge != 0 && part.Until > now-int64(t.MinAge.Seconds()) {
+		return false
+	}
+
+	if t.TargetMatchAllRegexp != nil {
+		for j := 0; j < len(tt.List); j++ {
+			if !t.TargetMatchAllRegexp.MatchString(tt.List[j]) {
+				return false
+			}
+		}
+	}
+
+	if t.TargetMatchAnyRegexp != nil {
+		for j := 0; j < len(tt.List); j++ {
+			if t.TargetMatchAnyRegexp.MatchString(tt.List[j]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
 func (tt *Targets) selectDataTable(cfg *config.Config, tf *TimeFrame, context string) error {
 	now := time.Now().Unix()
 
-TableLoop:
 	for i := 0; i < len(cfg.DataTable); i++ {
 		t := &cfg.DataTable[i]
 
-		if !t.ContextMap[context] {
-			continue TableLoop
+		if t.IsPreAggregated() || !tt.tableAllowed(t, tf, tf, context, now) {
+			continue
+		}
+
+		return tt.setDataTable(cfg, t, tf, context, now)
+	}
+
+	return fmt.Errorf("data tables is not specified for %v", tt.List[0])
+}
+
+// setDataTable sets the raw table for the time frame and replaces it by the pre-aggregated one, if possible
+func (tt *Targets) setDataTable(cfg *config.Config, t *config.DataTable, tf *TimeFrame, context string, now int64) error {
+	tt.pointsTable = t.Table
+	tt.isReverse = t.Reverse
+	tt.rollupUseReverted = t.RollupUseReverted
+	tt.rollupRules = t.Rollup.Rules()
+	tt.queryMetrics = t.QueryMetrics
+	tt.precision = 0
+	tt.aggregates = nil
+
+	if cfg.ClickHouse.InternalAggregation {
+		return tt.selectPreAggregated(cfg, tf, context, now)
+	}
+
+	return nil
+}
+
+// dataTableParts splits the time frame by max-age of the data tables. The newest part is read from the first allowed
+// table, which stores the end of the time frame, and the rest of the time frame is split again. The parts are returned
+// from the newest to the oldest, the oldest part may not start at tf.From, if no table stores it.
+func (tt *Targets) dataTableParts(cfg *config.Config, tf *TimeFrame, context string, now int64) ([]*config.DataTable, []TimeFrame) {
+	var (
+		tables []*config.DataTable
+		parts  []TimeFrame
+	)
+
+	until := tf.Until
+
+TimeFrameLoop:
+	for until >= tf.From {
+		for i := 0; i < len(cfg.DataTable); i++ {
+			t := &cfg.DataTable[i]
+			if t.IsPreAggregated() {
+				continue
+			}
+
+			part := TimeFrame{From: tf.From, Until: until, MaxDataPoints: tf.MaxDataPoints}
+			if t.MaxAge != 0 {
+				part.From = dry.Max(part.From, now-int64(t.MaxAge.Seconds()))
+			}
+
+			if part.From > part.Until || !tt.tableAllowed(t, tf, &part, context, now) {
+				continue
+			}
+
+			tables = append(tables, t)
+			parts = append(parts, part)
+			until = part.From - 1
+
+			continue TimeFrameLoop
 		}
 
-		if t.MaxInterval != 0 && (tf.Until-tf.From) > int64(t.MaxInterval.Seconds()) {
-			continue TableLoop
+		break
+	}
+
+	return tables, parts
+}
+
+// preAggregatedColumns returns the aggregates of the pre-aggregated table, which are necessary for the rollup function
+func preAggregatedColumns(agg string) []string {
+	switch agg {
+	case "avg":
+		return []string{"sum", "count"}
+	case "min", "max", "sum", "any", "anyLast":
+		return []string{agg}
+	default:
+		return nil
+	}
+}
+
+// rollupStep returns the step of the request to the selected raw table and the rollup functions of the metrics
+func (tt *Targets) rollupStep(tf *TimeFrame, now int64) (int64, map[string]bool, error) {
+	step := int64(0)
+	if tf.MaxDataPoints > 0 {
+		step = dry.Ceil(tf.Until-tf.From, tf.MaxDataPoints)
+	}
+
+	aggs := make(map[string]bool)
+	age := uint32(dry.Max(0, now-tf.From))
+
+	for _, metric := range tt.AM.Series(false) {
+		lookup := metric
+		if tt.isReverse && !tt.rollupUseReverted {
+			lookup = reverse.String(metric)
 		}
 
-		if t.MinInterval != 0 && (tf.Until-tf.From) < int64(t.MinInterval.Seconds()) {
-			continue TableLoop
+		precision, agg, _, _ := tt.rollupRules.Lookup(lookup, age, false)
+		step = dry.Max(step, int64(precision))
+		aggName := agg.Name()
+
+		for _, a := range tt.AM.Get(metric) {
+			requestedAgg, err := tt.GetRequestedAggregation(a.Target)
+			if err != nil {
+				return 0, nil, err
+			}
+
+			if requestedAgg != "" {
+				aggName = requestedAgg
+				break
+			}
 		}
 
-		if t.MaxAge != 0 && tf.From < now-int64(t.MaxAge.Seconds()) {
-			continue TableLoop
+		aggs[aggName] = true
+	}
+
+	return step, aggs, nil
+}
+
+// selectPreAggregated replaces the selected raw table by the pre-aggregated one with the biggest precision, which is
+// not greater than the step of the request, and has the aggregates for all rollup functions of the metrics.
+func (tt *Targets) selectPreAggregated(cfg *config.Config, tf *TimeFrame, context string, now int64) error {
+	var candidates []*config.DataTable
+
+	for i := 0; i < len(cfg.DataTable); i++ {
+		t := &cfg.DataTable[i]
+		// the rollup rules of the raw table are looked up by the names in its direction
+		if t.IsPreAggregated() && t.Reverse == tt.isReverse && tt.tableAllowed(t, tf, tf, context, now) {
+			candidates = append(candidates, t)
 		}
+	}
+
+	if len(candidates) == 0 || tt.AM == nil || tt.AM.Len() == 0 {
+		return nil
+	}
+
+	step, aggs, err := tt.rollupStep(tf, now)
+	if err != nil {
+		// the error is returned by the lookup later
+		return nil
+	}
 
-		if t.MinAge != 0 && tf.Until > now-int64(t.MinAge.Seconds()) {
-			continue TableLoop
+	var selected *config.DataTable
+
+CandidatesLoop:
+	for _, t := range candidates {
+		precision := int64(t.Precision.Seconds())
+		if precision > step || (selected != nil && t.Precision <= selected.Precision) {
+			continue
 		}
 
-		if t.TargetMatchAllRegexp != nil {
-			for j := 0; j < len(tt.List); j++ {
-				if !t.TargetMatchAllRegexp.MatchString(tt.List[j]) {
-					continue TableLoop
-				}
+		for agg := range aggs {
+			columns := preAggregatedColumns(agg)
+			if len(columns) == 0 {
+				continue CandidatesLoop
 			}
-		}
 
-		if t.TargetMatchAnyRegexp != nil {
-			matched := false
-		TargetsLoop:
-			for j := 0; j < len(tt.List); j++ {
-				if t.TargetMatchAnyRegexp.MatchString(tt.List[j]) {
-					matched = true
-					break TargetsLoop
+			for _, c := range columns {
+				if t.Aggregates[c] == "" {
+					continue CandidatesLoop
 				}
 			}
-			if !matched {
-				continue TableLoop
-			}
 		}
-		tt.pointsTable = t.Table
-		tt.isReverse = t.Reverse
-		tt.rollupUseReverted = t.RollupUseReverted
-		tt.rollupRules = t.Rollup.Rules()
-		tt.queryMetrics = t.QueryMetrics
-		return nil
+
+		selected = t
 	}
 
-	return fmt.Errorf("data tables is not specified for %v", tt.List[0])
+	if selected != nil {
+		// rollup rules of the raw table are used for the aggregation functions
+		tt.pointsTable = selected.Table
+		tt.queryMetrics = selected.QueryMetrics
+		tt.precision = uint32(selected.Precision.Seconds())
+		tt.aggregates = selected.Aggregates
+	}
+
+	return nil
 }
 
 func (tt *Targets) GetRequestedAggregation(target string) (string, error) {
@@ -175,3 +423,88 @@ func (tt *Targets) GetRequestedAggregation(target string) (string, error) {
 
 	return "", nil
 }
+
+// graphite functions, which aggregate all series of the target, and the according ClickHouse aggregate functions
+var seriesAggregationFunctions = map[string]string{
+	"sumSeries":     "sum",
+	"averageSeries": "avg",
+	"maxSeries":     "max",
+	"minSeries":     "min",
+}
+
+// groupByNode callbacks, which could be calculated by ClickHouse
+var groupByNodeCallbacks = map[string]string{
+	"average": "avg",
+	"avg":     "avg",
+	"sum":     "sum",
+	"total":   "sum",
+	"max":     "max",
+	"min":     "min",
+	"count":   "count",
+}
+
+// seriesAggregation is the aggregating graphite function, requested for the target through FilteringFunctions
+type seriesAggregation struct {
+	// name of the graphite function
+	name string
+	// function is the ClickHouse aggregate function
+	function string
+	// byNode is set for groupByNode, the series are grouped by the node value
+	byNode bool
+	node   int
+}
+
+// getSeriesAggregation returns the aggregating function, which could be applied by ClickHouse to the series of the target.
+// It returns nil, when nothing is requested or there are other functions besides consolidateBy, which must be applied by carbonapi in order.
+func (tt *Targets) getSeriesAggregation(target string) (*seriesAggregation, error) {
+	var ff *v3pb.FilteringFunction
+
+	for _, filteringFunc := range tt.filteringFunctionsByTarget[target] {
+		if filteringFunc.GetName() == graphiteConsolidationFunction {
+			continue
+		}
+
+		if ff != nil {
+			return nil, nil
+		}
+
+		ff = filteringFunc
+	}
+
+	if ff == nil {
+		return nil, nil
+	}
+
+	ffName := ff.GetName()
+	ffArgs := ff.GetArguments()
+
+	if function, ok := seriesAggregationFunctions[ffName]; ok {
+		return &seriesAggregation{name: ffName, function: function}, nil
+	}
+
+	if ffName != "groupByNode" {
+		return nil, nil
+	}
+
+	if len(ffArgs) < 1 {
+		return nil, fmt.Errorf("no arguments were provided to groupByNode function")
+	}
+
+	node, err := strconv.Atoi(ffArgs[0])
+	if err != nil {
+		// tags are grouped by carbonapi
+		return nil, nil
+	}
+
+	callback := "average"
+	if len(ffArgs) > 1 && ffArgs[1] != "" {
+		callback = ffArgs[1]
+	}
+
+	function, ok := groupByNodeCallbacks[callback]
+	if !ok {
+		return nil, nil
+	}
+
+	return &seriesAggregation{name: ffName, function: function, byNode: true, node: node}, nil
+}
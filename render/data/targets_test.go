@@ -5,8 +5,11 @@ import (
 	"testing"
 	"time"
 
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
 	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSelectDataTableTime(t *testing.T) {
@@ -151,3 +154,118 @@ func TestSelectDataTableMatch(t *testing.T) {
 		})
 	}
 }
+
+func TestSelectDataTablePreAggregated(t *testing.T) {
+	cfg := config.New()
+	cfg.DataTable = []config.DataTable{
+		{
+			Table:                  "graphite_1h",
+			Precision:              time.Hour,
+			Aggregates:             map[string]string{"sum": "Sum", "count": "Count", "max": "Max"},
+			RollupConf:             "none",
+			RollupDefaultPrecision: 3600,
+			RollupDefaultFunction:  "avg",
+		},
+		{
+			Table:                  "graphite",
+			RollupConf:             "none",
+			RollupDefaultPrecision: 60,
+			RollupDefaultFunction:  "avg",
+		},
+		{
+			Table:                  "graphite_1d",
+			Precision:              24 * time.Hour,
+			Aggregates:             map[string]string{"max": "Max"},
+			RollupConf:             "none",
+			RollupDefaultPrecision: 86400,
+			RollupDefaultFunction:  "avg",
+		},
+		{
+			Table:                  "graphite_reverse_1d",
+			Reverse:                true,
+			Precision:              24 * time.Hour,
+			Aggregates:             map[string]string{"sum": "Sum", "count": "Count"},
+			RollupConf:             "none",
+			RollupDefaultPrecision: 86400,
+			RollupDefaultFunction:  "avg",
+		},
+	}
+	require.NoError(t, cfg.ProcessDataTables())
+
+	day := int64(24 * 3600)
+
+	tests := []struct {
+		name          string
+		tf            *TimeFrame
+		consolidateBy string
+		want          string
+		precision     uint32
+	}{
+		{
+			name: "step is less than precision",
+			tf:   &TimeFrame{From: ageToTimestamp(day), Until: ageToTimestamp(0), MaxDataPoints: 100},
+			want: "graphite",
+		},
+		{
+			name: "no max data points",
+			tf:   &TimeFrame{From: ageToTimestamp(30 * day), Until: ageToTimestamp(0)},
+			want: "graphite",
+		},
+		{
+			name:      "hourly",
+			tf:        &TimeFrame{From: ageToTimestamp(30 * day), Until: ageToTimestamp(0), MaxDataPoints: 100},
+			want:      "graphite_1h",
+			precision: 3600,
+		},
+		{
+			name:      "avg is not stored in daily",
+			tf:        &TimeFrame{From: ageToTimestamp(365 * day), Until: ageToTimestamp(0), MaxDataPoints: 100},
+			want:      "graphite_1h",
+			precision: 3600,
+		},
+		{
+			name:          "daily max",
+			tf:            &TimeFrame{From: ageToTimestamp(365 * day), Until: ageToTimestamp(0), MaxDataPoints: 100},
+			consolidateBy: "max",
+			want:          "graphite_1d",
+			precision:     86400,
+		},
+		{
+			name:          "min is not stored",
+			tf:            &TimeFrame{From: ageToTimestamp(365 * day), Until: ageToTimestamp(0), MaxDataPoints: 100},
+			consolidateBy: "min",
+			want:          "graphite",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			am := alias.New()
+			am.Append("a.b", alias.Value{Target: "a.*", DisplayName: "a.b"})
+
+			tg := NewTargets([]string{"a.*"}, am)
+			if tt.consolidateBy != "" {
+				tg.SetFilteringFunctions("a.*", []*v3pb.FilteringFunction{{Name: "consolidateBy", Arguments: []string{tt.consolidateBy}}})
+			}
+
+			require.NoError(t, tg.selectDataTable(cfg, tt.tf, config.ContextGraphite))
+			assert.Equal(t, tt.want, tg.pointsTable)
+			assert.Equal(t, tt.precision, tg.precision)
+			// rollup rules of the raw table are used
+			assert.Equal(t, cfg.DataTable[1].Rollup.Rules(), tg.rollupRules)
+		})
+	}
+
+	t.Run("internal aggregation is disabled", func(t *testing.T) {
+		cfg.ClickHouse.InternalAggregation = false
+		defer func() { cfg.ClickHouse.InternalAggregation = true }()
+
+		am := alias.New()
+		am.Append("a.b", alias.Value{Target: "a.*", DisplayName: "a.b"})
+
+		tg := NewTargets([]string{"a.*"}, am)
+		tf := &TimeFrame{From: ageToTimestamp(30 * day), Until: ageToTimestamp(0), MaxDataPoints: 100}
+		require.NoError(t, tg.selectDataTable(cfg, tf, config.ContextGraphite))
+		assert.Equal(t, "graphite", tg.pointsTable)
+	})
+}
@@ -0,0 +1,319 @@
+// Package eval evaluates the common graphite functions in /render targets, for running graphite-clickhouse without carbonapi
+package eval
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/go-graphite/carbonapi/pkg/parser"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+	"github.com/lomik/graphite-clickhouse/render/data"
+)
+
+// ErrUnsupportedFunction is returned for targets with the functions, which are not implemented
+var ErrUnsupportedFunction = errors.New("unsupported function")
+
+type target struct {
+	target string
+	expr   parser.Expr
+}
+
+type frame struct {
+	tf      data.TimeFrame
+	targets []target
+}
+
+// Request contains the parsed render targets
+type Request struct {
+	frames []frame
+}
+
+// checkFunctions returns error, if any of nested functions is not supported
+func checkFunctions(e parser.Expr) error {
+	if !e.IsFunc() {
+		return nil
+	}
+
+	if !Supported(e.Target()) {
+		return fmt.Errorf("%w: %s", ErrUnsupportedFunction, e.Target())
+	}
+
+	for _, arg := range e.Args() {
+		if err := checkFunctions(arg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Parse parses the targets. It returns nil, if no target contains functions, so the request can be served as is
+func Parse(m data.MultiTarget) (*Request, error) {
+	r := &Request{frames: make([]frame, 0, len(m))}
+	hasFunctions := false
+
+	for tf, targets := range m {
+		f := frame{tf: tf, targets: make([]target, 0, len(targets.List))}
+
+		for _, t := range targets.List {
+			e, rest, err := parser.ParseExpr(t)
+			if err != nil || rest != "" || !e.IsFunc() {
+				// plain metric or glob, the finder will check it
+				f.targets = append(f.targets, target{target: t, expr: parser.NewTargetExpr(t)})
+				continue
+			}
+
+			if err = checkFunctions(e); err != nil {
+				return nil, err
+			}
+
+			hasFunctions = true
+
+			f.targets = append(f.targets, target{target: t, expr: e})
+		}
+
+		r.frames = append(r.frames, f)
+	}
+
+	if !hasFunctions {
+		return nil, nil
+	}
+
+	// stable response order
+	sort.Slice(r.frames, func(i, j int) bool {
+		a, b := r.frames[i].tf, r.frames[j].tf
+		if a.From != b.From {
+			return a.From < b.From
+		}
+
+		if a.Until != b.Until {
+			return a.Until < b.Until
+		}
+
+		return a.MaxDataPoints < b.MaxDataPoints
+	})
+
+	return r, nil
+}
+
+// MultiTarget returns the metrics, which should be fetched for evaluation
+func (r *Request) MultiTarget() data.MultiTarget {
+	m := make(data.MultiTarget)
+	seen := make(map[data.TimeFrame]map[string]bool)
+
+	for _, f := range r.frames {
+		for _, t := range f.targets {
+			var requests []parser.MetricRequest
+			if t.expr.IsName() {
+				requests = []parser.MetricRequest{{Metric: t.expr.Target(), From: f.tf.From, Until: f.tf.Until}}
+			} else {
+				requests = t.expr.Metrics(f.tf.From, f.tf.Until)
+			}
+
+			for _, req := range requests {
+				tf := data.TimeFrame{From: req.From, Until: req.Until, MaxDataPoints: f.tf.MaxDataPoints}
+
+				if seen[tf] == nil {
+					seen[tf] = make(map[string]bool)
+				}
+
+				if seen[tf][req.Metric] {
+					continue
+				}
+
+				seen[tf][req.Metric] = true
+
+				if targets, ok := m[tf]; ok {
+					targets.Append(req.Metric)
+				} else {
+					m[tf] = data.NewTargetsOne(req.Metric, 1, alias.New())
+				}
+			}
+		}
+	}
+
+	return m
+}
+
+type evaluator struct {
+	fetched map[parser.MetricRequest][]*Series
+}
+
+func (ev *evaluator) eval(e parser.Expr, from, until int64) ([]*Series, error) {
+	switch {
+	case e.IsName():
+		fetched := ev.fetched[parser.MetricRequest{Metric: e.Target(), From: from, Until: until}]
+
+		series := make([]*Series, len(fetched))
+		for i := range fetched {
+			series[i] = fetched[i].copy()
+		}
+
+		return series, nil
+	case e.IsFunc():
+		f, ok := functions[e.Target()]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedFunction, e.Target())
+		}
+
+		series, err := f(ev, e, from, until)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Target(), err)
+		}
+
+		return series, nil
+	default:
+		return nil, parser.ErrMissingTimeseries
+	}
+}
+
+// evalArg evaluates n-th argument as series list
+func (ev *evaluator) evalArg(e parser.Expr, n int, from, until int64) ([]*Series, error) {
+	if e.ArgsLen() <= n {
+		return nil, parser.ErrMissingTimeseries
+	}
+
+	return ev.eval(e.Arg(n), from, until)
+}
+
+// fetchedSeries converts ClickHouse responses to the series by requested metric
+func fetchedSeries(responses data.CHResponses) (map[parser.MetricRequest][]*Series, error) {
+	fetched := make(map[parser.MetricRequest][]*Series)
+	filled := make(map[parser.MetricRequest]int)
+
+	for n := range responses {
+		c := &responses[n]
+		d := c.Data
+		nextMetric := d.GroupByMetric()
+
+		for {
+			points := nextMetric()
+			if len(points) == 0 {
+				break
+			}
+
+			id := points[0].MetricID
+
+			step, err := d.GetStep(id)
+			if err != nil {
+				return nil, err
+			}
+
+			function, err := d.GetAggregation(id)
+			if err != nil {
+				return nil, err
+			}
+
+			start, _, count, getValue := point.FillNulls(points, uint32(c.From), uint32(c.Until), step)
+			values := make([]float64, 0, count)
+
+			for {
+				value, err := getValue()
+				if err != nil {
+					if errors.Is(err, point.ErrTimeGreaterStop) {
+						break
+					}
+
+					return nil, err
+				}
+
+				values = append(values, value)
+			}
+
+			for _, a := range d.AM.Get(d.MetricName(id)) {
+				req := parser.MetricRequest{Metric: a.Target, From: c.From, Until: c.Until}
+				if i, ok := filled[req]; ok && i != n {
+					// the same metrics with another maxDataPoints
+					continue
+				}
+
+				filled[req] = n
+				fetched[req] = append(fetched[req], &Series{
+					Name:              a.DisplayName,
+					ConsolidationFunc: function,
+					Start:             int64(start),
+					Step:              int64(step),
+					Values:            values,
+				})
+			}
+		}
+	}
+
+	for _, series := range fetched {
+		sort.SliceStable(series, func(i, j int) bool { return series[i].Name < series[j].Name })
+	}
+
+	return fetched, nil
+}
+
+// toResponse returns the series in the ClickHouse response form, so they can be written with any of formatters
+func toResponse(tf data.TimeFrame, targets []string, results [][]*Series) data.CHResponse {
+	d := &data.Data{Points: point.NewPoints(), AM: alias.New()}
+	steps := make(map[uint32][]string)
+	functions := make(map[string][]string)
+
+	n := 0
+
+	for i := range results {
+		for _, s := range results[i] {
+			n++
+			// unique internal name, the display name can be the same for the different series
+			key := strconv.Itoa(n)
+			id := d.Points.MetricID(key)
+
+			for j, v := range s.Values {
+				// NaN points are kept, so the series without values are returned too
+				if ts := s.Start + int64(j)*s.Step; ts >= 0 && ts <= math.MaxUint32 {
+					d.Points.AppendPoint(id, v, uint32(ts), 0)
+				}
+			}
+
+			steps[uint32(s.Step)] = append(steps[uint32(s.Step)], key)
+			functions[s.ConsolidationFunc] = append(functions[s.ConsolidationFunc], key)
+			d.AM.Append(key, alias.Value{Target: targets[i], DisplayName: s.Name})
+		}
+	}
+
+	d.Points.SetSteps(steps)
+	d.Points.SetAggregations(functions)
+
+	return data.CHResponse{
+		Data:  d,
+		From:  tf.From,
+		Until: tf.Until,
+	}
+}
+
+// Eval evaluates the targets with the fetched data and returns responses for the requested time frames
+func (r *Request) Eval(responses data.CHResponses) (data.CHResponses, error) {
+	fetched, err := fetchedSeries(responses)
+	if err != nil {
+		return nil, err
+	}
+
+	ev := &evaluator{fetched: fetched}
+	result := make(data.CHResponses, 0, len(r.frames))
+
+	for _, f := range r.frames {
+		targets := make([]string, len(f.targets))
+		results := make([][]*Series, len(f.targets))
+
+		for i, t := range f.targets {
+			targets[i] = t.target
+
+			results[i], err = ev.eval(t.expr, f.tf.From, f.tf.Until)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", t.target, err)
+			}
+		}
+
+		result = append(result, toResponse(f.tf, targets, results))
+	}
+
+	return result, nil
+}
@@ -0,0 +1,231 @@
+package eval
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+	"github.com/lomik/graphite-clickhouse/render/data"
+)
+
+var nan = math.NaN()
+
+type testMetric struct {
+	name   string
+	target string
+	values []float64 // from the response start, with step 60
+}
+
+// testResponse returns ClickHouse response, like it's fetched for the metrics
+func testResponse(from, until int64, metrics ...testMetric) data.CHResponse {
+	d := &data.Data{Points: point.NewPoints(), AM: alias.New()}
+	steps := make(map[uint32][]string)
+	aggs := make(map[string][]string)
+
+	for _, m := range metrics {
+		// the metric, found by the several targets, is fetched once
+		if d.AM.Get(m.name) == nil {
+			id := d.Points.MetricID(m.name)
+
+			for i, v := range m.values {
+				if !math.IsNaN(v) {
+					d.Points.AppendPoint(id, v, uint32(from)+uint32(i)*60, 0)
+				}
+			}
+
+			steps[60] = append(steps[60], m.name)
+			aggs["avg"] = append(aggs["avg"], m.name)
+		}
+
+		d.AM.Append(m.name, alias.Value{Target: m.target, DisplayName: m.name})
+	}
+
+	d.Points.SetSteps(steps)
+	d.Points.SetAggregations(aggs)
+
+	return data.CHResponse{Data: d, From: from, Until: until}
+}
+
+type result struct {
+	name   string
+	start  int64
+	step   int64
+	values []float64
+}
+
+func evalTargets(t *testing.T, from, until int64, targets []string, responses data.CHResponses) []result {
+	m := data.MultiTarget{
+		data.TimeFrame{From: from, Until: until, MaxDataPoints: 100}: data.NewTargets(targets, alias.New()),
+	}
+
+	r, err := Parse(m)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+
+	reply, err := r.Eval(responses)
+	require.NoError(t, err)
+
+	mfr, err := reply.ToMultiFetchResponseV3()
+	require.NoError(t, err)
+
+	results := make([]result, 0, len(mfr.Metrics))
+	for _, m := range mfr.Metrics {
+		results = append(results, result{name: m.Name, start: m.StartTime, step: m.StepTime, values: m.Values})
+	}
+
+	return results
+}
+
+func assertResults(t *testing.T, expected, got []result) {
+	t.Helper()
+
+	require.Len(t, got, len(expected))
+
+	for i := range expected {
+		assert.Equal(t, expected[i].name, got[i].name)
+		assert.Equal(t, expected[i].start, got[i].start, got[i].name)
+		assert.Equal(t, expected[i].step, got[i].step, got[i].name)
+
+		require.Len(t, got[i].values, len(expected[i].values), got[i].name)
+
+		for j := range expected[i].values {
+			if math.IsNaN(expected[i].values[j]) {
+				assert.True(t, math.IsNaN(got[i].values[j]), "%s[%d]: %v", got[i].name, j, got[i].values[j])
+			} else {
+				assert.InDelta(t, expected[i].values[j], got[i].values[j], 1e-9, "%s[%d]", got[i].name, j)
+			}
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tf := data.TimeFrame{From: 600, Until: 1199, MaxDataPoints: 100}
+
+	r, err := Parse(data.MultiTarget{tf: data.NewTargets([]string{"a.b.*", "seriesByTag('name=a')"}, alias.New())})
+	require.NoError(t, err)
+	assert.Nil(t, r, "plain targets are fetched as is")
+
+	_, err = Parse(data.MultiTarget{tf: data.NewTargets([]string{"sumSeries(highestMax(a.*, 1))"}, alias.New())})
+	assert.ErrorIs(t, err, ErrUnsupportedFunction)
+
+	r, err = Parse(data.MultiTarget{tf: data.NewTargets([]string{
+		"a.b.c",
+		"sumSeries(a.b.*, a.c.*)",
+		"movingAverage(a.b.c, '5min')",
+		"aliasByNode(seriesByTag('name=a'), 'dc')",
+	}, alias.New())})
+	require.NoError(t, err)
+	require.NotNil(t, r)
+
+	m := r.MultiTarget()
+	require.Len(t, m, 2)
+	assert.Equal(t, []string{"a.b.c", "a.b.*", "a.c.*", "seriesByTag('name=a')"}, m[tf].List)
+	assert.Equal(t, []string{"a.b.c"}, m[data.TimeFrame{From: 300, Until: 1199, MaxDataPoints: 100}].List)
+}
+
+func TestEval(t *testing.T) {
+	from, until := int64(600), int64(899) // 5 points
+
+	responses := data.CHResponses{testResponse(from, until,
+		testMetric{name: "a.b.c", target: "a.b.*", values: []float64{1, 2, nan, 4, 5}},
+		testMetric{name: "a.b.d", target: "a.b.*", values: []float64{10, 20, 30, nan, 50}},
+		testMetric{name: "a.c.d", target: "a.*.d", values: []float64{100, 200, 300, 400, 500}},
+		testMetric{name: "a.b.d", target: "a.*.d", values: []float64{10, 20, 30, nan, 50}},
+		testMetric{name: "a.b.c", target: "a.b.c", values: []float64{1, 2, nan, 4, 5}},
+		testMetric{name: "a.b.d", target: "a.b.d", values: []float64{10, 20, 30, nan, 50}},
+		testMetric{name: "cnt", target: "cnt", values: []float64{10, 70, 130, 10, 40}},
+	)}
+
+	tests := []struct {
+		target string
+		want   []result
+	}{
+		{
+			target: "sumSeries(a.b.*)",
+			want:   []result{{"sumSeries(a.b.*)", 600, 60, []float64{11, 22, 30, 4, 55}}},
+		},
+		{
+			target: "averageSeries(a.b.*, a.*.d)",
+			want:   []result{{"averageSeries(a.b.*, a.*.d)", 600, 60, []float64{30.25, 60.5, 120, 202, 151.25}}},
+		},
+		{
+			target: "groupByNode(a.*.d, 1, 'sum')",
+			want: []result{
+				{"b", 600, 60, []float64{10, 20, 30, nan, 50}},
+				{"c", 600, 60, []float64{100, 200, 300, 400, 500}},
+			},
+		},
+		{
+			target: "aliasByNode(scale(a.b.*, 0.5), 1, 2)",
+			want: []result{
+				{"b.c", 600, 60, []float64{0.5, 1, nan, 2, 2.5}},
+				{"b.d", 600, 60, []float64{5, 10, 15, nan, 25}},
+			},
+		},
+		{
+			target: "scale(a.b.c, 2)",
+			want:   []result{{"scale(a.b.c,2)", 600, 60, []float64{2, 4, nan, 8, 10}}},
+		},
+		{
+			target: "nonNegativeDerivative(cnt)",
+			want:   []result{{"nonNegativeDerivative(cnt)", 600, 60, []float64{nan, 60, 60, nan, 30}}},
+		},
+		{
+			target: "perSecond(cnt, 139)",
+			want:   []result{{"perSecond(cnt)", 600, 60, []float64{nan, 1, 1, 0.333333, 0.5}}},
+		},
+		{
+			target: "movingAverage(a.b.c, 2)",
+			want:   []result{{"movingAverage(a.b.c,2)", 600, 60, []float64{nan, 1, 1.5, 2, 4}}},
+		},
+		{
+			target: "summarize(a.b.d, '2min')",
+			want:   []result{{`summarize(a.b.d, "2min", "sum")`, 600, 120, []float64{30, 30, 50}}},
+		},
+		{
+			target: "summarize(a.b.d, '2min', 'max', true)",
+			want:   []result{{`summarize(a.b.d, "2min", "max", true)`, 600, 120, []float64{20, 30, 50}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			assertResults(t, tt.want, evalTargets(t, from, until, []string{tt.target}, responses))
+		})
+	}
+}
+
+func TestEvalMixed(t *testing.T) {
+	responses := data.CHResponses{testResponse(600, 719,
+		testMetric{name: "a.b.c", target: "a.b.*", values: []float64{1, nan}},
+		testMetric{name: "a.b.d", target: "a.b.*", values: []float64{nan, nan}},
+	)}
+
+	// metrics without points are skipped, like in the plain render
+	got := evalTargets(t, 600, 719, []string{"a.b.*", "sumSeries(a.b.*)", "sumSeries(a.b.*)"}, responses)
+	assertResults(t, []result{
+		{"a.b.c", 600, 60, []float64{1, nan}},
+		{"sumSeries(a.b.*)", 600, 60, []float64{1, nan}},
+		{"sumSeries(a.b.*)", 600, 60, []float64{1, nan}},
+	}, got)
+}
+
+func TestEvalMovingAverageInterval(t *testing.T) {
+	responses := data.CHResponses{
+		testResponse(480, 899, testMetric{name: "a.b.c", target: "a.b.c", values: []float64{1, 3, 5, 7, 9, 11, 13}}),
+	}
+
+	got := evalTargets(t, 600, 899, []string{"movingAverage(a.b.c, '2min')"}, responses)
+	assertResults(t, []result{
+		{`movingAverage(a.b.c,"2min")`, 600, 60, []float64{2, 4, 6, 8, 10}},
+	}, got)
+}
+
+func TestEvalEmpty(t *testing.T) {
+	got := evalTargets(t, 600, 899, []string{"sumSeries(a.b.*)", "scale(a.b.c, 2)"}, data.CHResponses{testResponse(600, 899)})
+	assert.Empty(t, got)
+}
@@ -0,0 +1,404 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/go-graphite/carbonapi/pkg/parser"
+)
+
+type function func(ev *evaluator, e parser.Expr, from, until int64) ([]*Series, error)
+
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		"sumSeries":             sumSeries,
+		"sum":                   sumSeries,
+		"averageSeries":         averageSeries,
+		"avg":                   averageSeries,
+		"groupByNode":           groupByNode,
+		"aliasByNode":           aliasByNode,
+		"scale":                 scale,
+		"perSecond":             perSecond,
+		"nonNegativeDerivative": nonNegativeDerivative,
+		"movingAverage":         movingAverage,
+		"summarize":             summarize,
+	}
+}
+
+// Supported returns true, if the function can be evaluated
+func Supported(name string) bool {
+	_, ok := functions[name]
+	return ok
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sumSeries(*seriesLists)
+func sumSeries(ev *evaluator, e parser.Expr, from, until int64) ([]*Series, error) {
+	return aggregateArgs(ev, e, from, until, "sumSeries", aggSum)
+}
+
+// averageSeries(*seriesLists)
+func averageSeries(ev *evaluator, e parser.Expr, from, until int64) ([]*Series, error) {
+	return aggregateArgs(ev, e, from, until, "averageSeries", aggAverage)
+}
+
+func aggregateArgs(ev *evaluator, e parser.Expr, from, until int64, name string, agg aggregate) ([]*Series, error) {
+	if e.ArgsLen() == 0 {
+		return nil, parser.ErrMissingTimeseries
+	}
+
+	var series []*Series
+
+	for _, arg := range e.Args() {
+		s, err := ev.eval(arg, from, until)
+		if err != nil {
+			return nil, err
+		}
+
+		series = append(series, s...)
+	}
+
+	if len(series) == 0 {
+		return nil, nil
+	}
+
+	return []*Series{aggregateSeries(name+"("+e.RawArgs()+")", series, agg)}, nil
+}
+
+// groupByNode(seriesList, nodeNum, callback="average")
+func groupByNode(ev *evaluator, e parser.Expr, from, until int64) ([]*Series, error) {
+	series, err := ev.evalArg(e, 0, from, until)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := e.GetNodeOrTagArgs(1, true)
+	if err != nil {
+		return nil, err
+	}
+
+	callback, err := e.GetStringArgDefault(2, "average")
+	if err != nil {
+		return nil, err
+	}
+
+	agg, ok := aggregates[callback]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported callback %q", parser.ErrInvalidArg, callback)
+	}
+
+	var keys []string
+
+	groups := make(map[string][]*Series)
+
+	for _, s := range series {
+		key := aggKey(s.Name, nodes)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		groups[key] = append(groups[key], s)
+	}
+
+	result := make([]*Series, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, aggregateSeries(key, groups[key], agg))
+	}
+
+	return result, nil
+}
+
+// aliasByNode(seriesList, *nodes)
+func aliasByNode(ev *evaluator, e parser.Expr, from, until int64) ([]*Series, error) {
+	series, err := ev.evalArg(e, 0, from, until)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := e.GetNodeOrTagArgs(1, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range series {
+		s.Name = aggKey(s.Name, nodes)
+	}
+
+	return series, nil
+}
+
+// scale(seriesList, factor)
+func scale(ev *evaluator, e parser.Expr, from, until int64) ([]*Series, error) {
+	series, err := ev.evalArg(e, 0, from, until)
+	if err != nil {
+		return nil, err
+	}
+
+	factor, err := e.GetFloatArg(1)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Series, len(series))
+
+	for i, s := range series {
+		values := make([]float64, len(s.Values))
+		for j, v := range s.Values {
+			values[j] = v * factor
+		}
+
+		result[i] = s.withValues("scale("+s.Name+","+formatFloat(factor)+")", values)
+	}
+
+	return result, nil
+}
+
+// nonNegativeDelta returns the counter increase, NaN for the first value, resets and values out of [minValue, maxValue]
+func nonNegativeDelta(v, prev, maxValue, minValue float64) (delta, next float64) {
+	if v > maxValue || v < minValue {
+		return math.NaN(), math.NaN()
+	}
+
+	if math.IsNaN(prev) || math.IsNaN(v) {
+		return math.NaN(), v
+	}
+
+	if v >= prev {
+		return v - prev, v
+	}
+
+	// counter wrapped
+	if !math.IsInf(maxValue, 1) {
+		return maxValue + 1 + v - prev, v
+	}
+
+	if !math.IsInf(minValue, -1) {
+		return v - minValue, v
+	}
+
+	return math.NaN(), v
+}
+
+func derivative(ev *evaluator, e parser.Expr, from, until int64, name string, perSecond bool) ([]*Series, error) {
+	series, err := ev.evalArg(e, 0, from, until)
+	if err != nil {
+		return nil, err
+	}
+
+	maxValue, err := e.GetFloatNamedOrPosArgDefault("maxValue", 1, math.Inf(1))
+	if err != nil {
+		return nil, err
+	}
+
+	minValue, err := e.GetFloatNamedOrPosArgDefault("minValue", 2, math.Inf(-1))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Series, len(series))
+
+	for i, s := range series {
+		values := make([]float64, len(s.Values))
+		prev := math.NaN()
+
+		for j, v := range s.Values {
+			values[j], prev = nonNegativeDelta(v, prev, maxValue, minValue)
+			if perSecond && !math.IsNaN(values[j]) {
+				values[j] = math.Round(values[j]/float64(s.Step)*1e6) / 1e6
+			}
+		}
+
+		result[i] = s.withValues(name+"("+s.Name+")", values)
+	}
+
+	return result, nil
+}
+
+// perSecond(seriesList, maxValue=None, minValue=None)
+func perSecond(ev *evaluator, e parser.Expr, from, until int64) ([]*Series, error) {
+	return derivative(ev, e, from, until, "perSecond", true)
+}
+
+// nonNegativeDerivative(seriesList, maxValue=None, minValue=None)
+func nonNegativeDerivative(ev *evaluator, e parser.Expr, from, until int64) ([]*Series, error) {
+	return derivative(ev, e, from, until, "nonNegativeDerivative", false)
+}
+
+// movingAverage(seriesList, windowSize, xFilesFactor=0)
+// Only interval windows (like "5min") fetch the additional data before from.
+func movingAverage(ev *evaluator, e parser.Expr, from, until int64) ([]*Series, error) {
+	if e.ArgsLen() < 2 {
+		return nil, parser.ErrMissingArgument
+	}
+
+	var (
+		preview    int64
+		windowSize int
+		windowName string
+	)
+
+	if e.Arg(1).IsString() {
+		offs, err := e.GetIntervalArg(1, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if offs <= 0 {
+			return nil, parser.ErrInvalidInterval
+		}
+
+		preview = int64(offs)
+		windowName = strconv.Quote(e.Arg(1).StringValue())
+	} else {
+		n, err := e.GetIntArg(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if n <= 0 {
+			return nil, parser.ErrInvalidArg
+		}
+
+		windowSize = n
+		windowName = strconv.Itoa(n)
+	}
+
+	xFilesFactor, err := e.GetFloatNamedOrPosArgDefault("xFilesFactor", 2, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	series, err := ev.evalArg(e, 0, from-preview, until)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Series, len(series))
+
+	for i, s := range series {
+		points := windowSize
+		if preview > 0 {
+			points = int(preview / s.Step)
+			if points == 0 {
+				points = 1
+			}
+		}
+
+		// the first value of the result, the previous values are the preview for the window
+		first := 0
+		if preview > 0 && s.Start < from {
+			first = int((from - s.Start + s.Step - 1) / s.Step)
+			if first > len(s.Values) {
+				first = len(s.Values)
+			}
+		}
+
+		values := make([]float64, 0, len(s.Values)-first)
+		window := make([]float64, 0, points)
+
+		for j := first; j < len(s.Values); j++ {
+			window = window[:0]
+
+			for k := j - points; k < j; k++ {
+				if k >= 0 && !math.IsNaN(s.Values[k]) {
+					window = append(window, s.Values[k])
+				}
+			}
+
+			if len(window) > 0 && float64(len(window))/float64(points) >= xFilesFactor {
+				values = append(values, aggAverage(window))
+			} else {
+				values = append(values, math.NaN())
+			}
+		}
+
+		r := s.withValues("movingAverage("+s.Name+","+windowName+")", values)
+		r.Start = s.Start + int64(first)*s.Step
+		result[i] = r
+	}
+
+	return result, nil
+}
+
+// summarize(seriesList, intervalString, func="sum", alignToFrom=False)
+func summarize(ev *evaluator, e parser.Expr, from, until int64) ([]*Series, error) {
+	series, err := ev.evalArg(e, 0, from, until)
+	if err != nil {
+		return nil, err
+	}
+
+	offs, err := e.GetIntervalArg(1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if offs <= 0 {
+		return nil, parser.ErrInvalidInterval
+	}
+
+	interval := int64(offs)
+
+	fn, err := e.GetStringNamedOrPosArgDefault("func", 2, "sum")
+	if err != nil {
+		return nil, err
+	}
+
+	agg, ok := aggregates[fn]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported func %q", parser.ErrInvalidArg, fn)
+	}
+
+	alignToFrom, err := e.GetBoolNamedOrPosArgDefault("alignToFrom", 3, false)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Series, len(series))
+
+	for i, s := range series {
+		start, stop := s.Start, s.Stop()
+		if !alignToFrom {
+			start -= start % interval
+			if stop%interval != 0 {
+				stop += interval - stop%interval
+			}
+		}
+
+		buckets := make([][]float64, (stop-start+interval-1)/interval)
+
+		for j, v := range s.Values {
+			if math.IsNaN(v) {
+				continue
+			}
+
+			b := (s.Start + int64(j)*s.Step - start) / interval
+			if b < int64(len(buckets)) {
+				buckets[b] = append(buckets[b], v)
+			}
+		}
+
+		values := make([]float64, len(buckets))
+		for b := range buckets {
+			values[b] = agg(buckets[b])
+		}
+
+		name := "summarize(" + s.Name + ", \"" + e.Arg(1).StringValue() + "\", \"" + fn + "\""
+		if alignToFrom {
+			name += ", true"
+		}
+
+		r := s.withValues(name+")", values)
+		r.Start = start
+		r.Step = interval
+		r.ConsolidationFunc = fn
+		result[i] = r
+	}
+
+	return result, nil
+}
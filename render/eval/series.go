@@ -0,0 +1,343 @@
+package eval
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/go-graphite/carbonapi/pkg/parser"
+)
+
+// Series is the time series with the fixed step. NaN values are absent points
+type Series struct {
+	Name              string
+	ConsolidationFunc string
+	Start             int64 // timestamp of the first value
+	Step              int64
+	Values            []float64
+}
+
+// Stop returns the timestamp after the last value
+func (s *Series) Stop() int64 {
+	return s.Start + int64(len(s.Values))*s.Step
+}
+
+// copy returns the series with the same values slice. Functions must not modify the values in place
+func (s *Series) copy() *Series {
+	c := *s
+	return &c
+}
+
+// withValues returns the series with new values and the name
+func (s *Series) withValues(name string, values []float64) *Series {
+	c := *s
+	c.Name = name
+	c.Values = values
+
+	return &c
+}
+
+// value returns the value at the timestamp t or NaN
+func (s *Series) value(t int64) float64 {
+	if t < s.Start || (t-s.Start)%s.Step != 0 {
+		return math.NaN()
+	}
+
+	i := (t - s.Start) / s.Step
+	if i >= int64(len(s.Values)) {
+		return math.NaN()
+	}
+
+	return s.Values[i]
+}
+
+// consolidate returns series with step, values are averaged into the step buckets
+func (s *Series) consolidate(step int64) *Series {
+	if step == s.Step || len(s.Values) == 0 {
+		c := s.copy()
+		c.Step = step
+
+		return c
+	}
+
+	start := s.Start - s.Start%step
+	stop := s.Stop()
+
+	values := make([]float64, 0, (stop-start)/step+1)
+	bucket := make([]float64, 0, step/s.Step)
+
+	for t := start; t < stop; t += step {
+		bucket = bucket[:0]
+
+		for i := t; i < t+step; i += s.Step {
+			if v := s.value(i); !math.IsNaN(v) {
+				bucket = append(bucket, v)
+			}
+		}
+
+		values = append(values, aggAverage(bucket))
+	}
+
+	c := s.copy()
+	c.Start = start
+	c.Step = step
+	c.Values = values
+
+	return c
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
+
+// normalize consolidates series to the common step (least common multiple) and returns the common time range
+func normalize(series []*Series) (result []*Series, start, stop, step int64) {
+	if len(series) == 0 {
+		return series, 0, 0, 0
+	}
+
+	step = series[0].Step
+	for _, s := range series[1:] {
+		step = step / gcd(step, s.Step) * s.Step
+	}
+
+	result = make([]*Series, len(series))
+	for i, s := range series {
+		result[i] = s.consolidate(step)
+	}
+
+	start, stop = result[0].Start, result[0].Stop()
+	for _, s := range result[1:] {
+		if s.Start < start {
+			start = s.Start
+		}
+
+		if s.Stop() > stop {
+			stop = s.Stop()
+		}
+	}
+
+	return
+}
+
+// aggregateSeries combines series point by point with the aggregate function
+func aggregateSeries(name string, series []*Series, agg aggregate) *Series {
+	series, start, stop, step := normalize(series)
+
+	values := make([]float64, 0, (stop-start)/step)
+	row := make([]float64, 0, len(series))
+
+	for t := start; t < stop; t += step {
+		row = row[:0]
+
+		for _, s := range series {
+			if v := s.value(t); !math.IsNaN(v) {
+				row = append(row, v)
+			}
+		}
+
+		values = append(values, agg(row))
+	}
+
+	return &Series{
+		Name:              name,
+		ConsolidationFunc: "avg",
+		Start:             start,
+		Step:              step,
+		Values:            values,
+	}
+}
+
+// aggregate returns the aggregated value for not NaN values, or NaN if values is empty
+type aggregate func(values []float64) float64
+
+func aggAverage(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	return aggSum(values) / float64(len(values))
+}
+
+func aggSum(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+
+	return sum
+}
+
+func aggMin(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	min := values[0]
+	for _, v := range values[1:] {
+		if v < min {
+			min = v
+		}
+	}
+
+	return min
+}
+
+func aggMax(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	max := values[0]
+	for _, v := range values[1:] {
+		if v > max {
+			max = v
+		}
+	}
+
+	return max
+}
+
+func aggMedian(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+func aggCount(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	return float64(len(values))
+}
+
+func aggFirst(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	return values[0]
+}
+
+func aggLast(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	return values[len(values)-1]
+}
+
+func aggRange(values []float64) float64 {
+	return aggMax(values) - aggMin(values)
+}
+
+func aggMultiply(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	result := values[0]
+	for _, v := range values[1:] {
+		result *= v
+	}
+
+	return result
+}
+
+var aggregates = map[string]aggregate{
+	"average":  aggAverage,
+	"avg":      aggAverage,
+	"sum":      aggSum,
+	"total":    aggSum,
+	"min":      aggMin,
+	"max":      aggMax,
+	"median":   aggMedian,
+	"count":    aggCount,
+	"first":    aggFirst,
+	"last":     aggLast,
+	"current":  aggLast,
+	"range":    aggRange,
+	"rangeOf":  aggRange,
+	"multiply": aggMultiply,
+}
+
+// pathName returns the first metric name from the series name, e.g. a.b.c for scale(sumSeries(a.b.c),2)
+func pathName(name string) string {
+	if !strings.HasSuffix(name, ")") {
+		return name
+	}
+
+	if i := strings.LastIndexByte(name, '('); i >= 0 {
+		name = name[i+1:]
+	}
+
+	if i := strings.IndexAny(name, ",)"); i >= 0 {
+		name = name[:i]
+	}
+
+	return name
+}
+
+// nodeOrTag returns the node of the metric path, or the tag value for tagged series
+func nodeOrTag(name string, n parser.NodeOrTag) string {
+	path, tags, _ := strings.Cut(pathName(name), ";")
+
+	if n.IsTag {
+		tag, _ := n.Value.(string)
+		if tag == "name" {
+			return path
+		}
+
+		for tags != "" {
+			var kv string
+
+			kv, tags, _ = strings.Cut(tags, ";")
+			if k, v, ok := strings.Cut(kv, "="); ok && k == tag {
+				return v
+			}
+		}
+
+		return ""
+	}
+
+	node, _ := n.Value.(int)
+	nodes := strings.Split(path, ".")
+
+	if node < 0 {
+		node += len(nodes)
+	}
+
+	if node < 0 || node >= len(nodes) {
+		return ""
+	}
+
+	return nodes[node]
+}
+
+func aggKey(name string, nodes []parser.NodeOrTag) string {
+	parts := make([]string, len(nodes))
+	for i := range nodes {
+		parts[i] = nodeOrTag(name, nodes[i])
+	}
+
+	return strings.Join(parts, ".")
+}
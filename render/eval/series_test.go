@@ -0,0 +1,42 @@
+package eval
+
+import (
+	"testing"
+
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeOrTag(t *testing.T) {
+	tests := []struct {
+		name string
+		node parser.NodeOrTag
+		want string
+	}{
+		{"a.b.c", parser.NodeOrTag{Value: 1}, "b"},
+		{"a.b.c", parser.NodeOrTag{Value: -1}, "c"},
+		{"a.b.c", parser.NodeOrTag{Value: 3}, ""},
+		{"scale(sumSeries(a.b.c),2)", parser.NodeOrTag{Value: 0}, "a"},
+		{"cpu.load;dc=east;host=h1", parser.NodeOrTag{Value: 1}, "load"},
+		{"cpu.load;dc=east;host=h1", parser.NodeOrTag{IsTag: true, Value: "host"}, "h1"},
+		{"cpu.load;dc=east;host=h1", parser.NodeOrTag{IsTag: true, Value: "name"}, "cpu.load"},
+		{"cpu.load;dc=east;host=h1", parser.NodeOrTag{IsTag: true, Value: "rack"}, ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, nodeOrTag(tt.name, tt.node), "%s %v", tt.name, tt.node.Value)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	series, start, stop, step := normalize([]*Series{
+		{Name: "a", Start: 60, Step: 60, Values: []float64{1, 2, 3, 4}},
+		{Name: "b", Start: 120, Step: 120, Values: []float64{10, 20}},
+	})
+
+	assert.Equal(t, int64(0), start)
+	assert.Equal(t, int64(360), stop)
+	assert.Equal(t, int64(120), step)
+	assert.Equal(t, []float64{1, 2.5, 4}, series[0].Values)
+	assert.Equal(t, []float64{10, 20}, series[1].Values)
+}
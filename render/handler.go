@@ -15,12 +15,14 @@ import (
 	"github.com/lomik/graphite-clickhouse/config"
 	"github.com/lomik/graphite-clickhouse/finder"
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/headers"
 	"github.com/lomik/graphite-clickhouse/helper/utils"
 	"github.com/lomik/graphite-clickhouse/limiter"
 	"github.com/lomik/graphite-clickhouse/logs"
 	"github.com/lomik/graphite-clickhouse/metrics"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
 	"github.com/lomik/graphite-clickhouse/render/data"
+	"github.com/lomik/graphite-clickhouse/render/eval"
 	"github.com/lomik/graphite-clickhouse/render/reply"
 )
 
@@ -56,9 +58,11 @@ func getCacheTimeout(now time.Time, from, until int64, cacheConfig *config.Cache
 }
 
 // try to fetch cached finder queries
-func (h *Handler) finderCached(ts time.Time, fetchRequests data.MultiTarget, logger *zap.Logger, metricsLen *int) (cachedFind int, maxCacheTimeoutStr string, err error) {
+func (h *Handler) finderCached(ctx context.Context, ts time.Time, fetchRequests data.MultiTarget, logger *zap.Logger, metricsLen *int) (cachedFind int, maxCacheTimeoutStr string, err error) {
 	var lock sync.RWMutex
 
+	tenant := finder.Tenant(ctx, h.config)
+
 	var maxCacheTimeout int32
 
 	errors := make([]error, 0, len(fetchRequests))
@@ -80,7 +84,7 @@ func (h *Handler) finderCached(ts time.Time, fetchRequests data.MultiTarget, log
 					}
 
 					targets.Cache[n].TS = utils.TimestampTruncate(ts.Unix(), time.Duration(targets.Cache[n].Timeout)*time.Second)
-					targets.Cache[n].Key = targetKey(tf.From, tf.Until, target, targets.Cache[n].TimeoutStr)
+					targets.Cache[n].Key = targetKey(tf.From, tf.Until, target, targets.Cache[n].TimeoutStr) + scope.CacheKey(ctx)
 
 					body, err := h.config.Common.FindCache.Get(targets.Cache[n].Key)
 					if err == nil {
@@ -92,6 +96,9 @@ func (h *Handler) finderCached(ts time.Time, fetchRequests data.MultiTarget, log
 								f = finder.NewCachedTags(body)
 							} else {
 								f = finder.NewCachedIndex(body)
+								if tenant != nil {
+									f = finder.WrapTenant(f, tenant.Prefix)
+								}
 							}
 
 							targets.AM.MergeTarget(f.(finder.Result), target, false)
@@ -314,6 +321,36 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var evalRequest *eval.Request
+
+	if h.config.Common.EvaluateFunctions {
+		evalRequest, err = eval.Parse(fetchRequests)
+		if err != nil {
+			status = http.StatusBadRequest
+			http.Error(w, fmt.Sprintf("Failed to parse request: %v", err.Error()), status)
+
+			return
+		}
+
+		if evalRequest != nil {
+			// fetch the metrics from functions arguments
+			fetchRequests = evalRequest.MultiTarget()
+		}
+	}
+
+	if downsample := r.FormValue("downsample"); downsample != "" {
+		if err = data.CheckDownsampling(downsample); err != nil {
+			status = http.StatusBadRequest
+			http.Error(w, fmt.Sprintf("Failed to parse request: %v", err.Error()), status)
+
+			return
+		}
+
+		for _, targets := range fetchRequests {
+			targets.SetDownsampling(downsample)
+		}
+	}
+
 	for tf, targets := range fetchRequests {
 		if tf.From >= tf.Until {
 			// wrong duration
@@ -336,7 +373,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if useCache {
 		var cached int
 
-		cached, maxCacheTimeoutStr, err = h.finderCached(start, fetchRequests, logger, &metricsLen)
+		cached, maxCacheTimeoutStr, err = h.finderCached(r.Context(), start, fetchRequests, logger, &metricsLen)
 		if err != nil {
 			status, _ = clickhouse.HandleError(w, err)
 			return
@@ -362,6 +399,19 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.config.Common.PartialResponse {
+		if truncated := fetchRequests.TruncateMetrics(h.config.Common.MaxMetricsPerTarget); truncated > 0 {
+			warning := fmt.Sprintf("metrics limit exceeded: %d metrics are skipped, limit is %d", truncated, h.config.Common.MaxMetricsPerTarget)
+			logger.Warn("partial response", zap.Int("truncated", truncated), zap.Int("limit", h.config.Common.MaxMetricsPerTarget))
+
+			metricsLen -= truncated
+			metrics.RenderRequestMetric.Truncated.Add(1)
+
+			// carbonapi_v3_pb has no field for warnings, the header is the only flag for all formats
+			w.Header().Set(headers.PartialResponse, warning)
+		}
+	}
+
 	logger.Info("finder", zap.Int("metrics", metricsLen), zap.Bool("find_cached", cachedFind))
 
 	if cachedFind {
@@ -384,6 +434,18 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if evalRequest != nil && len(reply) > 0 {
+		reply, err = evalRequest.Eval(reply)
+		if err != nil {
+			status = http.StatusBadRequest
+
+			logger.Error("eval", zap.Error(err))
+			http.Error(w, fmt.Sprintf("Failed to evaluate request: %v", err.Error()), status)
+
+			return
+		}
+	}
+
 	if len(reply) == 0 {
 		status = http.StatusNotFound
 
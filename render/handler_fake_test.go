@@ -0,0 +1,254 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/headers"
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+// fakeDataTable is the raw data table with one minute precision
+const fakeDataTable = `
+[[data-table]]
+table = "graphite"
+rollup-conf = "none"
+rollup-default-precision = 60
+rollup-default-function = "avg"
+`
+
+// newFakeHandler starts the fake ClickHouse with the index of paths and the rows added by fill, and returns the render
+// handler for it. The settings are appended to the [clickhouse] section with the fake server and the index table.
+func newFakeHandler(t *testing.T, now time.Time, paths []string, fill func(t *testing.T, srv *clickhouse.FakeServer), settings string) (*Handler, *clickhouse.FakeServer) {
+	t.Helper()
+	metrics.DisableMetrics()
+
+	srv := clickhouse.NewFakeServer()
+	t.Cleanup(srv.Close)
+
+	require.NoError(t, srv.AddIndex("graphite_index", now, paths...))
+
+	if fill != nil {
+		fill(t, srv)
+	}
+
+	cfg, _, err := config.Unmarshal([]byte(fmt.Sprintf(`
+[clickhouse]
+url = "%s"
+index-table = "graphite_index"
+index-use-daily = true
+%s`, srv.URL, settings)), false)
+	require.NoError(t, err)
+
+	return NewHandler(cfg), srv
+}
+
+// renderJSON requests the target in json format
+func renderJSON(h *Handler, target string, from, until int64, params string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", fmt.Sprintf("/render/?format=json&target=%s&from=%d&until=%d%s", target, from, until, params), nil)
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestHandler_FakeServer(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	from := now.Add(-10 * time.Minute).Unix()
+	paths := []string{"DB.postgres.host1.cpu", "DB.postgres.host2.cpu"}
+
+	h, _ := newFakeHandler(t, now, paths, func(t *testing.T, srv *clickhouse.FakeServer) {
+		for i, path := range paths {
+			require.NoError(t, srv.AddPoints("graphite", path,
+				point.Point{Time: uint32(from + 60), Value: float64(i + 1), Timestamp: uint32(from + 60)},
+				point.Point{Time: uint32(from + 120), Value: float64(i + 2), Timestamp: uint32(from + 120)},
+			))
+		}
+	}, fakeDataTable)
+
+	w := renderJSON(h, "DB.postgres.*.cpu", from, now.Unix(), "")
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	body := w.Body.String()
+
+	assert.Contains(t, body, `"name":"DB.postgres.host1.cpu"`)
+	assert.Contains(t, body, `"name":"DB.postgres.host2.cpu"`)
+	assert.Contains(t, body, `"values":[null,1.000000,2.000000,null,`)
+	assert.Contains(t, body, `"values":[null,2.000000,3.000000,null,`)
+}
+
+func TestHandler_FakeServerPreAggregated(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	from := now.Add(-30 * 24 * time.Hour).Unix()
+	// the step is max(3600, 30d/100) aligned to 3600
+	step := int64(28800)
+	ts := (now.Add(-10*24*time.Hour).Unix() / step) * step
+
+	h, srv := newFakeHandler(t, now, []string{"DB.postgres.host1.cpu"}, func(t *testing.T, srv *clickhouse.FakeServer) {
+		require.NoError(t, srv.AddPoints("graphite", "DB.postgres.host1.cpu", point.Point{Time: uint32(ts), Value: 100, Timestamp: uint32(ts)}))
+		require.NoError(t, srv.CreateTable("graphite_1h", "Path String, Sum Float64, Count UInt64, Time UInt32, Date Date, Timestamp UInt32"))
+
+		for i, row := range [][]interface{}{{10.0, 2}, {20.0, 3}} {
+			rowTime := ts + int64(i)*3600
+			day := time.Unix(rowTime, 0).UTC().Format("2006-01-02")
+			require.NoError(t, srv.Insert("graphite_1h", "DB.postgres.host1.cpu", row[0], row[1], rowTime, day, rowTime))
+		}
+	}, fakeDataTable+`
+[[data-table]]
+table = "graphite_1h"
+precision = "1h"
+aggregates = { sum = "Sum", count = "Count" }
+rollup-conf = "none"
+rollup-default-precision = 3600
+rollup-default-function = "avg"
+`)
+
+	w := renderJSON(h, "DB.postgres.*.cpu", from, now.Unix(), "&maxDataPoints=100")
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `6.000000`)
+	assert.NotContains(t, w.Body.String(), `100.000000`)
+	assert.Contains(t, w.Body.String(), fmt.Sprintf(`"stepTime":%d`, step))
+
+	queries := srv.Queries()
+	require.NotEmpty(t, queries)
+	assert.Contains(t, queries[len(queries)-1], "FROM graphite_1h")
+}
+
+func TestHandler_FakeServerSplitDataTables(t *testing.T) {
+	now := time.Now().Truncate(time.Hour)
+	recent := uint32(now.Add(-time.Hour).Unix())
+	old := uint32(now.Add(-30 * time.Hour).Unix())
+
+	fill := func(t *testing.T, srv *clickhouse.FakeServer) {
+		require.NoError(t, srv.AddPoints("graphite_raw", "DB.postgres.host1.cpu",
+			point.Point{Time: recent, Value: 10, Timestamp: recent},
+			point.Point{Time: recent + 60, Value: 20, Timestamp: recent + 60},
+		))
+		require.NoError(t, srv.AddPoints("graphite_long", "DB.postgres.host1.cpu",
+			point.Point{Time: old, Value: 5, Timestamp: old},
+			point.Point{Time: recent, Value: 99, Timestamp: recent},
+		))
+	}
+
+	for _, tt := range []struct{ split, aggregation bool }{{true, true}, {true, false}, {false, true}} {
+		split := tt.split
+
+		t.Run(fmt.Sprintf("split=%v,internal-aggregation=%v", tt.split, tt.aggregation), func(t *testing.T) {
+			h, _ := newFakeHandler(t, now, []string{"DB.postgres.host1.cpu"}, fill, fmt.Sprintf(`split-data-tables = %v
+internal-aggregation = %v
+
+[[data-table]]
+table = "graphite_raw"
+max-age = "24h"
+rollup-conf = "none"
+rollup-default-precision = 60
+rollup-default-function = "avg"
+
+[[data-table]]
+table = "graphite_long"
+rollup-conf = "none"
+rollup-default-precision = 300
+rollup-default-function = "avg"
+`, tt.split, tt.aggregation))
+
+			w := renderJSON(h, "DB.postgres.*.cpu", now.Add(-48*time.Hour).Unix(), now.Unix(), "")
+
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			body := w.Body.String()
+
+			assert.Contains(t, body, `"stepTime":300`)
+			assert.Contains(t, body, `5.000000`)
+
+			if split {
+				// points of the raw table are aggregated to the step of the long-term one
+				assert.Contains(t, body, `15.000000`)
+				assert.NotContains(t, body, `99.000000`)
+			} else {
+				assert.Contains(t, body, `99.000000`)
+				assert.NotContains(t, body, `15.000000`)
+			}
+		})
+	}
+}
+
+func TestHandler_FakeServerPartialResponse(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	from := now.Add(-10 * time.Minute).Unix()
+	paths := []string{"DB.postgres.host1.cpu", "DB.postgres.host2.cpu", "DB.postgres.host3.cpu"}
+
+	newHandler := func(t *testing.T, partial bool) *Handler {
+		h, _ := newFakeHandler(t, now, paths, func(t *testing.T, srv *clickhouse.FakeServer) {
+			for i, path := range paths {
+				require.NoError(t, srv.AddPoints("graphite", path,
+					point.Point{Time: uint32(from + 60), Value: float64(i + 1), Timestamp: uint32(from + 60)},
+				))
+			}
+		}, fakeDataTable+fmt.Sprintf(`
+[common]
+max-metrics-per-target = 2
+partial-response = %t
+`, partial))
+
+		return h
+	}
+
+	warning := "metrics limit exceeded: 1 metrics are skipped, limit is 2"
+
+	t.Run("rejected", func(t *testing.T) {
+		w := renderJSON(newHandler(t, false), "DB.postgres.*.cpu", from, now.Unix(), "")
+
+		assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+		assert.Empty(t, w.Header().Get(headers.PartialResponse))
+	})
+
+	t.Run("json", func(t *testing.T) {
+		w := renderJSON(newHandler(t, true), "DB.postgres.*.cpu", from, now.Unix(), "")
+
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, warning, w.Header().Get(headers.PartialResponse))
+
+		body := w.Body.String()
+		assert.Contains(t, body, `"name":"DB.postgres.host1.cpu"`)
+		assert.Contains(t, body, `"name":"DB.postgres.host2.cpu"`)
+		assert.NotContains(t, body, `"name":"DB.postgres.host3.cpu"`)
+	})
+
+	t.Run("carbonapi_v3_pb", func(t *testing.T) {
+		request := v3pb.MultiFetchRequest{
+			Metrics: []v3pb.FetchRequest{{Name: "DB.postgres.*.cpu", PathExpression: "DB.postgres.*.cpu", StartTime: from, StopTime: now.Unix()}},
+		}
+		body, err := request.Marshal()
+		require.NoError(t, err)
+
+		r := httptest.NewRequest("POST", "/render/?format=carbonapi_v3_pb", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+
+		newHandler(t, true).ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, warning, w.Header().Get(headers.PartialResponse))
+
+		var response v3pb.MultiFetchResponse
+		require.NoError(t, response.Unmarshal(w.Body.Bytes()))
+
+		names := make([]string, 0, len(response.Metrics))
+		for _, m := range response.Metrics {
+			names = append(names, m.Name)
+		}
+
+		assert.ElementsMatch(t, []string{"DB.postgres.host1.cpu", "DB.postgres.host2.cpu"}, names)
+	})
+}
@@ -168,6 +168,67 @@ func TestFormatterReply(t *testing.T) {
 	}
 }
 
+func TestFormatterReplyMetadata(t *testing.T) {
+	formatters := []struct {
+		impl             Formatter
+		format           client.FormatType
+		appliedFunctions []string
+	}{
+		{&V3PB{}, client.FormatPb_v3, []string{"consolidateBy"}},
+		{&JSON{}, client.FormatJSON, []string{"consolidateBy"}},
+		// pickle has no applied functions
+		{&Pickle{}, client.FormatPickle, nil},
+	}
+
+	input := prepareCHResponses(1688990000, 1688990460,
+		[][]byte{[]byte("test.metric1")},
+		map[string][]point.Point{
+			"test.metric1": {{Value: 3, Time: 1688990160, Timestamp: 1688990204}},
+		},
+	)
+	input[0].AppliedFunctions = map[string][]string{"test.*": {"consolidateBy"}}
+	input[0].Data.SetXFilesFactors(map[string]float32{"test.metric1": 0.5})
+
+	for _, formatter := range formatters {
+		t.Run(formatter.format.String(), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/render/", nil)
+
+			formatter.impl.Reply(w, r, input)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			got, err := client.Decode(w.Body.Bytes(), formatter.format)
+			require.NoError(t, err)
+			require.Len(t, got, 1)
+
+			require.Equal(t, "test.metric1", got[0].Name)
+			require.Equal(t, "test.*", got[0].PathExpression)
+			require.Equal(t, "avg", got[0].ConsolidationFunc)
+			require.Equal(t, int64(60), got[0].StepTime)
+			require.Equal(t, float32(0.5), got[0].XFilesFactor)
+			require.Equal(t, formatter.appliedFunctions, got[0].AppliedFunctions)
+		})
+	}
+}
+
+func TestGetFormatter(t *testing.T) {
+	for format, expected := range map[string]Formatter{
+		"carbonapi_v3_pb": &V3PB{},
+		"pickle":          &Pickle{},
+		"protobuf":        &V2PB{},
+		"carbonapi_v2_pb": &V2PB{},
+		// json is a public format, it doesn't require X-Gch-Debug-Output header
+		"json": &JSON{},
+	} {
+		f, err := GetFormatter(httptest.NewRequest(http.MethodGet, "/render/?format="+format, nil))
+		require.NoError(t, err, format)
+		require.IsType(t, expected, f, format)
+	}
+
+	_, err := GetFormatter(httptest.NewRequest(http.MethodGet, "/render/?format=raw", nil))
+	require.Error(t, err)
+}
+
 // prepareCHResponses prepares CHResponses for tests.
 func prepareCHResponses(from, until int64, indices [][]byte, points map[string][]point.Point) data.CHResponses {
 	// alias
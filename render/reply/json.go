@@ -3,7 +3,6 @@ package reply
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"math"
 	"net/http"
@@ -17,6 +16,7 @@ import (
 
 // JSON is an implementation of carbonapi_v3_pb MultiGlobRequest and MultiFetchResponse interconnection. It accepts the
 // normal forms parser of `Content-Type: application/json` POST requests with JSON representation of MultiGlobRequest.
+// The reply contains the same series metadata as carbonapi_v3_pb.
 type JSON struct{}
 
 func marshalJSON(mfr *v3pb.MultiFetchResponse) []byte {
@@ -63,6 +63,17 @@ func marshalJSON(mfr *v3pb.MultiFetchResponse) []byte {
 			buf.WriteString("],")
 		}
 
+		if len(m.AppliedFunctions) != 0 {
+			buf.WriteString(`"appliedFunctions":[`)
+
+			for _, f := range m.AppliedFunctions {
+				buf.WriteString(fmt.Sprintf("%q,", f))
+			}
+
+			buf.Truncate(buf.Len() - 1)
+			buf.WriteString("],")
+		}
+
 		buf.WriteString(fmt.Sprintf(`"requestStartTime":%d,`, m.RequestStartTime))
 		buf.WriteString(fmt.Sprintf(`"requestStopTime":%d,`, m.RequestStopTime))
 		buf.Truncate(buf.Len() - 1)
@@ -108,10 +119,6 @@ func parseJSONBody(r *http.Request) (data.MultiTarget, error) {
 // ParseRequest first tries to get body for application/json and convert it to carbonapi_v3_pb.MultiFetchRequest. As a fail-over it
 // parses request forms.
 func (*JSON) ParseRequest(r *http.Request) (data.MultiTarget, error) {
-	if !scope.Debug(r.Context(), "Output") {
-		return nil, errors.New("json format is only enabled for debugging purposes, pass 'X-Gch-Debug-Output: true' header")
-	}
-
 	fetchRequests, err := parseJSONBody(r)
 	if err == nil {
 		return fetchRequests, err
@@ -2,8 +2,10 @@ package reply
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"time"
@@ -52,7 +54,7 @@ func (*Pickle) Reply(w http.ResponseWriter, r *http.Request, multiData data.CHRe
 
 	p.List()
 
-	writeAlias := func(name string, pathExpression string, points []point.Point, step uint32) {
+	writeAlias := func(name, pathExpression, function string, xFilesFactor float32, points []point.Point, step uint32) {
 		pickleStart := time.Now()
 
 		p.Dict()
@@ -65,6 +67,15 @@ func (*Pickle) Reply(w http.ResponseWriter, r *http.Request, multiData data.CHRe
 		p.String(pathExpression)
 		p.SetItem()
 
+		// graphite-web uses them for the consolidation of series with many points
+		p.String("consolidationFunc")
+		p.String(function)
+		p.SetItem()
+
+		p.String("xFilesFactor")
+		pickleFloat64(writer, float64(xFilesFactor))
+		p.SetItem()
+
 		p.String("step")
 		p.Uint32(step)
 		p.SetItem()
@@ -120,8 +131,16 @@ func (*Pickle) Reply(w http.ResponseWriter, r *http.Request, multiData data.CHRe
 			return err
 		}
 
+		function, err := data.GetAggregation(points[0].MetricID)
+		if err != nil {
+			logger.Error("fail to get aggregation", zap.Error(err))
+			http.Error(w, fmt.Sprintf("failed to get aggregation for metric: %v", data.MetricName(points[0].MetricID)), http.StatusInternalServerError)
+
+			return err
+		}
+
 		for _, a := range data.AM.Get(metricName) {
-			writeAlias(a.DisplayName, a.Target, points, step)
+			writeAlias(a.DisplayName, a.Target, function, data.GetXFilesFactor(points[0].MetricID), points, step)
 		}
 
 		return nil
@@ -145,7 +164,7 @@ func (*Pickle) Reply(w http.ResponseWriter, r *http.Request, multiData data.CHRe
 		for _, metricName := range data.AM.Series(false) {
 			if _, done := writtenMetrics[metricName]; !done {
 				for _, a := range data.AM.Get(metricName) {
-					writeAlias(a.DisplayName, a.Target, []point.Point{}, uint32(data.CommonStep))
+					writeAlias(a.DisplayName, a.Target, "first", 0, []point.Point{}, uint32(data.CommonStep))
 				}
 			}
 		}
@@ -153,3 +172,12 @@ func (*Pickle) Reply(w http.ResponseWriter, r *http.Request, multiData data.CHRe
 
 	p.Stop()
 }
+
+// pickleFloat64 writes the float value, graphitePickle.Writer has only the method to append it to the list
+func pickleFloat64(w io.Writer, v float64) {
+	var b [9]byte
+	b[0] = 'G'
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(v))
+
+	w.Write(b[:])
+}
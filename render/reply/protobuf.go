@@ -25,7 +25,7 @@ const (
 
 type pb interface {
 	initBuffer()
-	writeBody(writer *bufio.Writer, target, name, function string, from, until, step uint32, points []point.Point)
+	writeBody(writer *bufio.Writer, target, name, function string, xFilesFactor float32, appliedFunctions []string, from, until, step uint32, points []point.Point)
 }
 
 func replyProtobuf(p pb, w http.ResponseWriter, r *http.Request, multiData data.CHResponses) {
@@ -76,7 +76,7 @@ func replyProtobuf(p pb, w http.ResponseWriter, r *http.Request, multiData data.
 			}
 
 			for _, a := range data.AM.Get(metricName) {
-				p.writeBody(writer, a.Target, a.DisplayName, function, from, until, step, points)
+				p.writeBody(writer, a.Target, a.DisplayName, function, data.GetXFilesFactor(points[0].MetricID), d.AppliedFunctions[a.Target], from, until, step, points)
 			}
 		}
 
@@ -85,7 +85,7 @@ func replyProtobuf(p pb, w http.ResponseWriter, r *http.Request, multiData data.
 			for _, metricName := range data.AM.Series(false) {
 				if _, done := writtenMetrics[metricName]; !done {
 					for _, a := range data.AM.Get(metricName) {
-						p.writeBody(writer, a.Target, a.DisplayName, "any", from, until, uint32(data.CommonStep), []point.Point{})
+						p.writeBody(writer, a.Target, a.DisplayName, "any", 0, d.AppliedFunctions[a.Target], from, until, uint32(data.CommonStep), []point.Point{})
 					}
 				}
 			}
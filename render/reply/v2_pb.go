@@ -52,7 +52,7 @@ func (v *V2PB) replyDebug(w http.ResponseWriter, r *http.Request, multiData data
 	w.Write(response)
 }
 
-func (v *V2PB) writeBody(writer *bufio.Writer, target, name, function string, from, until, step uint32, points []point.Point) {
+func (v *V2PB) writeBody(writer *bufio.Writer, target, name, function string, xFilesFactor float32, appliedFunctions []string, from, until, step uint32, points []point.Point) {
 	start, stop, count, getValue := point.FillNulls(points, from, until, step)
 
 	v.b1.Reset()
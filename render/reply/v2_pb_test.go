@@ -105,7 +105,7 @@ func TestV2PBWriteBody(t *testing.T) {
 
 			v := &V2PB{}
 			v.initBuffer()
-			v.writeBody(w, tt.target, tt.name, tt.function, tt.from, tt.until, tt.step, tt.points)
+			v.writeBody(w, tt.target, tt.name, tt.function, 0, nil, tt.from, tt.until, tt.step, tt.points)
 
 			w.Flush()
 
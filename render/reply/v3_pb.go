@@ -88,7 +88,7 @@ func (v *V3PB) replyDebug(w http.ResponseWriter, r *http.Request, multiData data
 	w.Write(response)
 }
 
-func (v *V3PB) writeBody(writer *bufio.Writer, target, name, function string, from, until, step uint32, points []point.Point) {
+func (v *V3PB) writeBody(writer *bufio.Writer, target, name, function string, xFilesFactor float32, appliedFunctions []string, from, until, step uint32, points []point.Point) {
 	start, stop, count, getValue := point.FillNulls(points, from, until, step)
 
 	v.b.Reset()
@@ -124,7 +124,7 @@ func (v *V3PB) writeBody(writer *bufio.Writer, target, name, function string, fr
 
 	// xFilesFactor
 	VarintWrite(v.b, (7<<3)+flt32) // tag
-	ProtobufWriteSingle(v.b, 0.0)
+	ProtobufWriteSingle(v.b, xFilesFactor)
 
 	// highPrecisionTimestamps
 	VarintWrite(v.b, 8<<3) // tag
@@ -149,11 +149,12 @@ func (v *V3PB) writeBody(writer *bufio.Writer, target, name, function string, fr
 
 	// rest fields, that goes after values
 
-	// Fields with default values are skipped, so this should be uncommented if support for appliedFunctions will be
-	// implemented
 	// appliedFunctions
-	//VarintWrite(mb2, (10<<3)+Repeated)  // tag
-	//VarintWrite(mb2, VarintLen(0)) // currently not supported
+	for _, f := range appliedFunctions {
+		VarintWrite(v.b, (10<<3)+repeated) // tag
+		VarintWrite(v.b, uint64(len(f)))
+		v.b.WriteString(f)
+	}
 
 	// requestStartTime
 	VarintWrite(v.b, 11<<3)
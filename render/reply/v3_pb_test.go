@@ -16,11 +16,14 @@ type testV3PB struct {
 	name     string
 	target   string
 	function string
-	response v3pb.MultiFetchResponse
-	from     uint32
-	until    uint32
-	step     uint32
-	points   []point.Point
+	// appliedFunctions for the target
+	appliedFunctions []string
+	xFilesFactor     float32
+	response         v3pb.MultiFetchResponse
+	from             uint32
+	until            uint32
+	step             uint32
+	points           []point.Point
 }
 
 func TestV3PBWriteBody(t *testing.T) {
@@ -58,6 +61,40 @@ func TestV3PBWriteBody(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:             "appliedFunctions",
+			function:         "sum",
+			appliedFunctions: []string{"consolidateBy", "sumSeries"},
+			from:             4,
+			until:            13,
+			step:             5,
+			target:           "a.*",
+			points: []point.Point{
+				{
+					MetricID:  0,
+					Value:     1.0,
+					Time:      5,
+					Timestamp: 5,
+				},
+			},
+			response: v3pb.MultiFetchResponse{
+				Metrics: []v3pb.FetchResponse{
+					{
+						Name:                    "appliedFunctions",
+						PathExpression:          "a.*",
+						ConsolidationFunc:       "sum",
+						XFilesFactor:            0,
+						HighPrecisionTimestamps: false,
+						StartTime:               5,
+						StopTime:                10,
+						Values:                  []float64{1.0},
+						AppliedFunctions:        []string{"consolidateBy", "sumSeries"},
+						RequestStartTime:        4,
+						RequestStopTime:         13,
+					},
+				},
+			},
+		},
 		{
 			name:     "multiPoint",
 			function: "max",
@@ -103,6 +140,40 @@ func TestV3PBWriteBody(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:         "xFilesFactor",
+			function:     "sum",
+			from:         5,
+			until:        14,
+			step:         5,
+			target:       "xFilesFactor",
+			xFilesFactor: 0.5,
+			points: []point.Point{
+				{
+					MetricID:  0,
+					Value:     2.0,
+					Time:      10,
+					Timestamp: 10,
+				},
+			},
+			response: v3pb.MultiFetchResponse{
+				Metrics: []v3pb.FetchResponse{
+					{
+						Name:                    "xFilesFactor",
+						PathExpression:          "xFilesFactor",
+						ConsolidationFunc:       "sum",
+						XFilesFactor:            0.5,
+						HighPrecisionTimestamps: false,
+						StartTime:               5,
+						StopTime:                15,
+						Values:                  []float64{math.NaN(), 2.0},
+						AppliedFunctions:        []string{},
+						RequestStartTime:        5,
+						RequestStopTime:         14,
+					},
+				},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -116,7 +187,7 @@ func TestV3PBWriteBody(t *testing.T) {
 
 			v := &V3PB{}
 			v.initBuffer()
-			v.writeBody(w, tt.target, tt.name, tt.function, tt.from, tt.until, tt.step, tt.points)
+			v.writeBody(w, tt.target, tt.name, tt.function, tt.xFilesFactor, tt.appliedFunctions, tt.from, tt.until, tt.step, tt.points)
 
 			w.Flush()
 